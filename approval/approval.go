@@ -0,0 +1,111 @@
+/*
+Package approval reads and writes approvals for activating prefetched
+systems, for environments requiring change-control sign-off before
+production switches. Approvals may be required to carry an ssh signature.
+*/
+package approval
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// ssh-keygen -Y namespace approvals are signed in.
+const Namespace = "nixos-hydra-upgrade"
+
+// The approval isn't signed by File.AllowedSigners.
+var ErrBadSignature = errors.New("approval signature not valid")
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+// Sign-off for activating a build.
+type Approval struct {
+	// hydra build id of the approved system
+	BuildID int `json:"buildId"`
+	// store path of the approved system, empty approves any system of the build
+	Toplevel string `json:"toplevel,omitempty"`
+	// who approved, informational
+	By   string    `json:"by,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// Whether the approval covers activating `toplevel` of build `buildID`.
+func (approval Approval) Approves(buildID int, toplevel string) bool {
+	return approval.BuildID == buildID && (approval.Toplevel == "" || approval.Toplevel == toplevel)
+}
+
+// An approval file, signed in <Path>.sig when AllowedSigners is set.
+type File struct {
+	Path string
+	// ssh allowed_signers file, empty accepts unsigned approvals
+	AllowedSigners string
+}
+
+/*
+Loads the approval, verifying its signature when required. A missing
+approval file is an error wrapping fs.ErrNotExist.
+*/
+func (file File) Load(ctx context.Context) (Approval, error) {
+	var approval Approval
+	contents, err := os.ReadFile(file.Path)
+	if err != nil {
+		return approval, err
+	}
+	if file.AllowedSigners != "" {
+		err = file.verify(ctx, contents)
+		if err != nil {
+			return approval, err
+		}
+	}
+	err = json.Unmarshal(contents, &approval)
+	if err != nil {
+		return approval, fmt.Errorf("invalid approval %s: %w", file.Path, err)
+	}
+	return approval, nil
+}
+
+// Verifies the approval's <Path>.sig against AllowedSigners with ssh-keygen.
+func (file File) verify(ctx context.Context, contents []byte) error {
+	signature := file.Path + ".sig"
+	_, err := os.Stat(signature)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadSignature, err)
+	}
+	output, err := Runner.Output(ctx, runner.Command("ssh-keygen", "-Y", "find-principals", "-s", signature, "-f", file.AllowedSigners))
+	if err != nil {
+		return fmt.Errorf("%w: no allowed signer signed %s", ErrBadSignature, signature)
+	}
+	principals := strings.Fields(string(output))
+	if len(principals) == 0 {
+		return fmt.Errorf("%w: no allowed signer signed %s", ErrBadSignature, signature)
+	}
+	cmd := runner.Command("ssh-keygen", "-Y", "verify", "-f", file.AllowedSigners, "-I", principals[0], "-n", Namespace, "-s", signature)
+	cmd.Stdin = contents
+	_, err = Runner.CombinedOutput(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrBadSignature, signature, err)
+	}
+	return nil
+}
+
+// Writes `approval`, replacing any earlier one. Signatures must be added separately.
+func (file File) Save(approval Approval) error {
+	contents, err := json.MarshalIndent(approval, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file.Path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file.Path, append(contents, '\n'), 0644)
+}
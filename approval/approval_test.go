@@ -0,0 +1,71 @@
+package approval_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/approval"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestFile(t *testing.T) {
+	original := approval.Runner
+	t.Cleanup(func() { approval.Runner = original })
+
+	t.Run("round trips approvals", func(t *testing.T) {
+		file := approval.File{Path: filepath.Join(t.TempDir(), "nested", "approval")}
+		err := file.Save(approval.Approval{BuildID: 1234, By: "alice", Time: time.Unix(1700000000, 0).UTC()})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		loaded, err := file.Load(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, loaded.By, "alice")
+		assert.Equal(t, loaded.Approves(1234, "/nix/store/abc-nixos-system"), true)
+		assert.Equal(t, loaded.Approves(1235, "/nix/store/abc-nixos-system"), false)
+	})
+
+	t.Run("missing approvals don't exist", func(t *testing.T) {
+		_, err := approval.File{Path: filepath.Join(t.TempDir(), "approval")}.Load(context.Background())
+		assert.Equal(t, errors.Is(err, os.ErrNotExist), true)
+	})
+
+	t.Run("verifies signatures", func(t *testing.T) {
+		dir := t.TempDir()
+		file := approval.File{Path: filepath.Join(dir, "approval"), AllowedSigners: "/etc/allowed_signers"}
+		err := file.Save(approval.Approval{BuildID: 1234, Toplevel: "/nix/store/abc-nixos-system"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err = file.Load(context.Background())
+		assert.Equal(t, errors.Is(err, approval.ErrBadSignature), true)
+
+		err = os.WriteFile(file.Path+".sig", []byte("signature"), 0644)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		signature := file.Path + ".sig"
+		fake := &runner.Fake{Outputs: map[string]string{
+			"ssh-keygen -Y find-principals -s " + signature + " -f /etc/allowed_signers": "change-control@example.org\n",
+		}}
+		approval.Runner = fake
+		loaded, err := file.Load(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, loaded.Approves(1234, "/nix/store/def-nixos-system"), false)
+		assert.Equal(t, fake.Ran[1], "ssh-keygen -Y verify -f /etc/allowed_signers -I change-control@example.org -n nixos-hydra-upgrade -s "+signature)
+
+		fake.Errors = map[string]error{fake.Ran[1]: errors.New("exit status 255")}
+		_, err = file.Load(context.Background())
+		assert.Equal(t, errors.Is(err, approval.ErrBadSignature), true)
+	})
+}
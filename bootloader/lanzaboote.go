@@ -0,0 +1,54 @@
+package bootloader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+/*
+Lists EFI binaries on the ESP and in sbctl's file database that aren't
+signed with sbctl's keys, as reported by `sbctl verify`. lanzaboote signs
+its generations with the same keys, so an unsigned binary won't boot with
+Secure Boot enforcing.
+*/
+func UnsignedBinaries(ctx context.Context) ([]string, error) {
+	output, err := Runner.Output(ctx, runner.Command("sbctl", "verify"))
+	if err != nil {
+		return nil, fmt.Errorf("sbctl verify: %w", err)
+	}
+	return ParseVerify(string(output)), nil
+}
+
+/*
+Parses `sbctl verify` output, e.g.
+
+	✓ /boot/EFI/BOOT/BOOTX64.EFI is signed
+	✗ /boot/EFI/Linux/nixos-generation-42.efi is not signed
+*/
+func ParseVerify(output string) []string {
+	unsigned := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		file, found := strings.CutSuffix(strings.TrimSpace(line), " is not signed")
+		if !found {
+			continue
+		}
+		_, file, _ = strings.Cut(file, " ")
+		unsigned = append(unsigned, file)
+	}
+	return unsigned
+}
+
+// Fails when any EFI binary isn't signed, see UnsignedBinaries.
+func VerifySecureBoot(ctx context.Context) error {
+	unsigned, err := UnsignedBinaries(ctx)
+	if err != nil {
+		return err
+	}
+	if len(unsigned) > 0 {
+		return fmt.Errorf("EFI binaries not signed for Secure Boot: %s", strings.Join(unsigned, ", "))
+	}
+	return nil
+}
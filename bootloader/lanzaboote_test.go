@@ -0,0 +1,32 @@
+package bootloader_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/bootloader"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+const verifyOutput = `Verifying file database and EFI images in /boot...
+✓ /boot/EFI/BOOT/BOOTX64.EFI is signed
+✓ /boot/EFI/Linux/nixos-generation-41-abc.efi is signed
+✗ /boot/EFI/Linux/nixos-generation-42-def.efi is not signed
+‼ /boot/EFI/nixos/kernel.efi is not a valid EFI binary
+`
+
+func TestVerifySecureBoot(t *testing.T) {
+	assert.ArrayEqual(t, bootloader.ParseVerify(verifyOutput), []string{"/boot/EFI/Linux/nixos-generation-42-def.efi"})
+
+	original := bootloader.Runner
+	t.Cleanup(func() { bootloader.Runner = original })
+
+	bootloader.Runner = &runner.Fake{Outputs: map[string]string{"sbctl verify": verifyOutput}}
+	err := bootloader.VerifySecureBoot(context.Background())
+	assert.Equal(t, err.Error(), "EFI binaries not signed for Secure Boot: /boot/EFI/Linux/nixos-generation-42-def.efi")
+
+	bootloader.Runner = &runner.Fake{Outputs: map[string]string{"sbctl verify": "✓ /boot/EFI/BOOT/BOOTX64.EFI is signed\n"}}
+	err = bootloader.VerifySecureBoot(context.Background())
+	assert.Equal(t, err, nil)
+}
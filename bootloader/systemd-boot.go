@@ -0,0 +1,100 @@
+package bootloader
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+/*
+systemd-boot automatic boot assessment, see
+https://systemd.io/AUTOMATIC_BOOT_ASSESSMENT/
+
+Entries named `<name>+<tries left>[-<tries done>].conf` are attempted that
+many times before systemd-boot falls back to another entry. A successful
+boot strips the counter with `systemd-bless-boot good`.
+*/
+type SystemdBoot struct {
+	// EFI system partition mount point
+	ESP string
+	// path to the systemd-bless-boot executable
+	BlessBoot string
+}
+
+// nixos-generation-123.conf, nixos-generation-123-specialisation-foo.conf
+// and their counted variants
+var entryPattern = regexp.MustCompile(`^nixos-generation-(\d+)((?:-specialisation-[^+]+)?)(?:\+(\d+)(?:-(\d+))?)?\.conf$`)
+
+func (sdboot SystemdBoot) entriesDir() string {
+	return filepath.Join(sdboot.ESP, "loader", "entries")
+}
+
+// Lists entry file names for a generation, including specialisations.
+func (sdboot SystemdBoot) entries(generation int) ([]string, error) {
+	dirEntries, err := os.ReadDir(sdboot.entriesDir())
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, dirEntry := range dirEntries {
+		match := entryPattern.FindStringSubmatch(dirEntry.Name())
+		if match != nil && match[1] == fmt.Sprint(generation) {
+			entries = append(entries, dirEntry.Name())
+		}
+	}
+	return entries, nil
+}
+
+// Enables boot counting with `tries` attempts for a generation's entries.
+func (sdboot SystemdBoot) EnableBootCounting(generation int, tries int) error {
+	entries, err := sdboot.entries(generation)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no systemd-boot entries for generation %d in %s", generation, sdboot.entriesDir())
+	}
+	for _, entry := range entries {
+		match := entryPattern.FindStringSubmatch(entry)
+		counted := fmt.Sprintf("nixos-generation-%s%s+%d.conf", match[1], match[2], tries)
+		slog.Debug("Enabling boot counting.", slog.String("entry", entry), slog.String("counted", counted))
+		err = os.Rename(filepath.Join(sdboot.entriesDir(), entry), filepath.Join(sdboot.entriesDir(), counted))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports whether every entry of a generation used up its boot attempts.
+func (sdboot SystemdBoot) Exhausted(generation int) (bool, error) {
+	entries, err := sdboot.entries(generation)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		match := entryPattern.FindStringSubmatch(entry)
+		if match[3] != "0" {
+			return false, nil
+		}
+	}
+	return len(entries) > 0, nil
+}
+
+// Marks the currently booted entry as good.
+func (sdboot SystemdBoot) MarkGood() error {
+	output, err := Runner.CombinedOutput(context.Background(), runner.Command(sdboot.BlessBoot, "good"))
+	if err != nil {
+		return fmt.Errorf("%s good: %w: %s", sdboot.BlessBoot, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package bootloader_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/bootloader"
+)
+
+func setupESP(t *testing.T, entries []string) bootloader.SystemdBoot {
+	esp := t.TempDir()
+	entriesDir := filepath.Join(esp, "loader", "entries")
+	err := os.MkdirAll(entriesDir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		err = os.WriteFile(filepath.Join(entriesDir, entry), []byte{}, 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return bootloader.SystemdBoot{ESP: esp}
+}
+
+func listEntries(sdboot bootloader.SystemdBoot) []string {
+	dirEntries, err := os.ReadDir(filepath.Join(sdboot.ESP, "loader", "entries"))
+	if err != nil {
+		panic(err)
+	}
+	names := []string{}
+	for _, dirEntry := range dirEntries {
+		names = append(names, dirEntry.Name())
+	}
+	return names
+}
+
+func TestEnableBootCounting(t *testing.T) {
+	t.Run("counts generation and specialisation entries", func(t *testing.T) {
+		sdboot := setupESP(t, []string{
+			"nixos-generation-11.conf",
+			"nixos-generation-12.conf",
+			"nixos-generation-12-specialisation-gaming.conf",
+		})
+
+		err := sdboot.EnableBootCounting(12, 3)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		assert.ArrayEqual(t, listEntries(sdboot), []string{
+			"nixos-generation-11.conf",
+			"nixos-generation-12+3.conf",
+			"nixos-generation-12-specialisation-gaming+3.conf",
+		})
+	})
+
+	t.Run("missing generation is an error", func(t *testing.T) {
+		sdboot := setupESP(t, []string{"nixos-generation-11.conf"})
+
+		err := sdboot.EnableBootCounting(12, 3)
+		if err == nil {
+			t.Error("unexpected success")
+		}
+	})
+}
+
+func TestExhausted(t *testing.T) {
+	var exhaustedTests = []struct {
+		description string
+		entries     []string
+		expected    bool
+	}{
+		{"uncounted entry", []string{"nixos-generation-12.conf"}, false},
+		{"tries remaining", []string{"nixos-generation-12+1-2.conf"}, false},
+		{"tries exhausted", []string{"nixos-generation-12+0-3.conf"}, true},
+		{"specialisation tries remaining", []string{"nixos-generation-12+0-3.conf", "nixos-generation-12-specialisation-gaming+2-1.conf"}, false},
+		{"other generation exhausted", []string{"nixos-generation-11+0-3.conf", "nixos-generation-12+3.conf"}, false},
+		{"no entries", []string{}, false},
+	}
+
+	for _, test := range exhaustedTests {
+		t.Run(test.description, func(t *testing.T) {
+			sdboot := setupESP(t, test.entries)
+
+			exhausted, err := sdboot.Exhausted(12)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			assert.Equal(t, exhausted, test.expected)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/approval"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+	"github.com/spf13/cobra"
+)
+
+// approveCmd represents the approve command
+func NewApproveCommand() *cobra.Command {
+	approveCommand := &cobra.Command{
+		Use:   "approve [build-id]",
+		Short: "Approves activating a prefetched upgrade",
+		Long: `With approval.required, upgrades stop once the new system is prefetched until it's approved. Approves the prefetched build recorded in the state file, or the given hydra build id, by writing approval.file. The next run, e.g. the next scheduled daemon run or the systemd timer, activates it. POST /approve on the daemon's control API approves and activates at once.
+
+With approval.allowed-signers, approvals must be signed in <approval.file>.sig, e.g. by change-control automation with ssh-keygen -Y sign -n nixos-hydra-upgrade, and approvals written by this command are only accepted once signed.`,
+		Args: cobra.MaximumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return initConfig(cmd, nil)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			buildID := 0
+			if len(args) > 0 {
+				var err error
+				buildID, err = strconv.Atoi(args[0])
+				if err != nil {
+					return err
+				}
+			}
+			err := approveBuild(buildID, approver())
+			if err != nil {
+				return err
+			}
+			if conf.Approval.AllowedSigners != "" {
+				slog.Warn("Approvals must be signed, sign the approval file before the next run.", slog.String("file", conf.Approval.File))
+			}
+			return nil
+		},
+	}
+
+	return approveCommand
+}
+
+// The user approving on the command line.
+func approver() string {
+	sudoUser := os.Getenv("SUDO_USER")
+	if sudoUser != "" {
+		return sudoUser
+	}
+	current, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return current.Username
+}
+
+/*
+Writes an approval for the hydra build `buildID`, or for the prefetched build
+recorded in the state file when 0.
+*/
+func approveBuild(buildID int, by string) error {
+	approved := approval.Approval{BuildID: buildID, By: by, Time: time.Now()}
+	if buildID == 0 {
+		upgradeState, err := state.Load(conf.StateFile)
+		if err != nil {
+			slog.Error("Unable to load upgrade state.", slog.String("error", err.Error()))
+			return err
+		}
+		run := upgradeState.Run
+		if run == nil || run.Toplevel == "" {
+			return errors.New("no prefetched upgrade to approve, pass a build id to approve it in advance")
+		}
+		approved.BuildID = run.BuildID
+		approved.Toplevel = run.Toplevel
+	}
+
+	file := approval.File{Path: conf.Approval.File}
+	err := file.Save(approved)
+	if err != nil {
+		slog.Error("Writing approval failed.", slog.String("error", err.Error()))
+		return permissionHint("approve", err)
+	}
+	slog.Info("Upgrade approved.",
+		slog.Int("buildid", approved.BuildID),
+		slog.String("toplevel", approved.Toplevel),
+		slog.String("file", file.Path))
+	return nil
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+	"github.com/spf13/cobra"
+)
+
+// checkCmd represents the check command
+func NewCheckCommand() *cobra.Command {
+	checkCommand := &cobra.Command{
+		Use:   "check",
+		Short: "Checks whether a newer build is available",
+		Long: `Resolves the latest hydra build and compares it to the running system, printing the outcome, e.g. available or up-to-date. Nothing is fetched or activated, and no state, motd, or notifications are written and no hooks run, so it runs as any user.
+
+Start gates and upgrade gates are still checked, a held or deferred upgrade is reported as such.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return initConfig(cmd, nil)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			opts := upgradeOptions()
+			opts.Check = true
+			// nothing this user may not be allowed to write
+			opts.Sinks = nil
+			opts.Hooks = upgrade.Hooks{}
+			opts.StateFile = ""
+			outcome, err := upgrade.Run(cmd.Context(), opts)
+			fmt.Fprintln(cmd.OutOrStdout(), outcome)
+			if outcome.Failed() {
+				return &OutcomeError{Outcome: outcome, Err: err}
+			}
+			return nil
+		},
+	}
+
+	return checkCommand
+}
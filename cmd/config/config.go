@@ -2,49 +2,453 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/logging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+type ApprovalConfig struct {
+	Required       bool
+	File           string `validate:"required"`
+	AllowedSigners string `mapstructure:"allowed-signers"`
+}
+
+type BootCountingConfig struct {
+	Enable    bool
+	Tries     int    `validate:"min=1"`
+	ESP       string `validate:"min=1"`
+	BlessBoot string `mapstructure:"bless-boot" validate:"min=1"`
+}
+
+type CacheConfig struct {
+	Dir         string        `validate:"required"`
+	MetadataTTL time.Duration `mapstructure:"metadata-ttl" validate:"min=0"`
+}
+
+type DaemonConfig struct {
+	Interval         time.Duration `validate:"gt=0"`
+	Socket           string        `validate:"required"`
+	Schedule         string
+	ActivateSchedule string `mapstructure:"activate-schedule"`
+	Timezone         string
+	ReadOnlySocket   string        `mapstructure:"read-only-socket"`
+	MaxBackoff       time.Duration `mapstructure:"max-backoff" validate:"min=0"`
+	Jitter           time.Duration `validate:"min=0"`
+}
+
+type FetchConfig struct {
+	Retries    int           `validate:"min=0"`
+	RetryDelay time.Duration `mapstructure:"retry-delay" validate:"min=0"`
+}
+
+type FlakeCheckConfig struct {
+	Enable bool
+	Checks []string
+}
+
+type GatesConfig struct {
+	Inhibitors          []string      `validate:"required,dive,oneof=shutdown sleep idle handle-power-key handle-suspend-key handle-hibernate-key handle-lid-switch"`
+	MinUptime           time.Duration `mapstructure:"min-uptime" validate:"min=0"`
+	BackupUnits         []string      `mapstructure:"backup-units" validate:"required,dive,min=1"`
+	LibvirtDomains      bool          `mapstructure:"libvirt-domains"`
+	Containers          []string      `validate:"required,dive,min=1"`
+	Tailscale           bool
+	WireGuardInterfaces []string `mapstructure:"wireguard-interfaces" validate:"required,dive,min=1"`
+	OverlayPeers        []string `mapstructure:"overlay-peers" validate:"required,dive,min=1"`
+	TimeSync            bool     `mapstructure:"time-sync"`
+}
+
 type HealthCheckConfig struct {
-	CanaryHosts []string `validate:"required,dive,min=1"`
+	CanaryHosts   []string `validate:"required,dive,min=1"`
+	SSHHosts      []string `mapstructure:"ssh-hosts" validate:"required,dive,min=1"`
+	SSHCommand    string   `mapstructure:"ssh-command"`
+	SSHIdentity   string   `mapstructure:"ssh-identity"`
+	SSHKnownHosts string   `mapstructure:"ssh-known-hosts"`
+	// local units required to be active before upgrading and after switching
+	Units []string `validate:"required,dive,min=1"`
+	// commands run with sh -c, required to exit 0 within ScriptTimeout
+	Scripts       []string      `validate:"required,dive,min=1"`
+	ScriptTimeout time.Duration `mapstructure:"script-timeout" validate:"gt=0"`
+	// yaml only
+	Canaries []CanaryConfig `validate:"dive"`
+}
+
+// A canary checked with a health check of `Type`, see healthcheck.Check.
+type CanaryConfig struct {
+	Type string `validate:"oneof=http tcp"`
+	// http only
+	URL string `validate:"required_if=Type http,omitempty,url"`
+	// tcp only
+	Host string `validate:"required_if=Type tcp"`
+	Port int    `validate:"required_if=Type tcp,min=0,max=65535"`
+	// expected http status, 0 expects 200
+	Status int `validate:"min=0"`
+	// regular expression the http response body must match
+	Body string `validate:"omitempty,regexp"`
+	// 0 uses the check's default
+	Timeout time.Duration `validate:"min=0"`
+}
+
+type HooksConfig struct {
+	PreSwitch  []string `mapstructure:"pre-switch" validate:"required,dive,min=1"`
+	PostSwitch []string `mapstructure:"post-switch" validate:"required,dive,min=1"`
+	PreReboot  []string `mapstructure:"pre-reboot" validate:"required,dive,min=1"`
+	OnFailure  []string `mapstructure:"on-failure" validate:"required,dive,min=1"`
+	OnRollback []string `mapstructure:"on-rollback" validate:"required,dive,min=1"`
+	Evacuate   []string `validate:"required,dive,min=1"`
+	Phase      []string `validate:"required,dive,min=1"`
 }
 
 type HydraConfig struct {
-	Instance string `validate:"url"`
-	JobSet   string `validate:"min=1"`
-	Job      string `validate:"min=1"`
-	Project  string `validate:"min=1"`
+	// may be discovered instead, see DiscoveryDomain
+	Instance    string   `validate:"required_without=DiscoveryDomain,omitempty,url"`
+	JobSet      string   `validate:"min=1"`
+	Job         string   `validate:"min=1"`
+	Project     string   `validate:"min=1"`
+	AllowedRefs []string `mapstructure:"allowed-refs" validate:"required,dive,min=1"`
+	// project/jobset/job, in order of preference after the primary job
+	Fallbacks       []string      `validate:"required,dive,min=1"`
+	MaxBuildAge     time.Duration `mapstructure:"max-build-age" validate:"min=0"`
+	Freshness       time.Duration `validate:"min=0"`
+	ExpectedOrigin  string        `mapstructure:"expected-origin"`
+	DiscoveryDomain string        `mapstructure:"discovery-domain"`
+	// [input=]project/jobset/job of jobs that must be built before upgrading
+	Dependencies []string `validate:"required,dive,min=1"`
+	Products     []string `validate:"required,dive,min=1"`
+	ProductsDir  string   `mapstructure:"products-dir" validate:"required"`
+	// hostname or glob -> job, so one config file can be shared across a fleet. yaml only
+	Hosts map[string]HydraHostConfig `validate:"dive,keys,glob,endkeys"`
+	// colmena or deploy-rs inventory selecting jobs for hosts missing from Hosts
+	Inventory      string `validate:"omitempty,oneof=colmena deploy-rs"`
+	InventoryFlake string `mapstructure:"inventory-flake" validate:"required_with=Inventory"`
+	// job of inventory nodes, {node} is replaced with the node name
+	InventoryJob string `mapstructure:"inventory-job" validate:"required_with=Inventory"`
+}
+
+type HydraHostConfig struct {
+	JobSet string
+	Job    string `validate:"min=1"`
+	// flake nixosConfigurations.<name>, replacing nixos-rebuild.host
+	Host string
+}
+
+/*
+Selects the hydra.hosts entry for a hostname. An entry for the exact hostname
+wins over globs, and longer globs win over shorter ones, so specific hosts can
+be carved out of a pattern.
+*/
+func (hydra HydraConfig) HostConfig(hostname string) (HydraHostConfig, bool) {
+	// viper lowercases map keys, hostnames are case insensitive anyway
+	hostname = strings.ToLower(hostname)
+	if host, ok := hydra.Hosts[hostname]; ok {
+		return host, true
+	}
+	patterns := []string{}
+	for pattern := range hydra.Hosts {
+		if matched, _ := path.Match(pattern, hostname); matched {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return HydraHostConfig{}, false
+	}
+	slices.SortFunc(patterns, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+	return hydra.Hosts[patterns[0]], true
+}
+
+type KubernetesConfig struct {
+	Drain      bool
+	Node       string `validate:"required_if=Drain true"`
+	Kubeconfig string
+	DrainArgs  []string `mapstructure:"drain-args" validate:"required,dive,min=1"`
+}
+
+type LimitsConfig struct {
+	// resolve and preflight phases
+	Eval ResourceLimitsConfig `validate:"required"`
+	// prefetch phase
+	Download ResourceLimitsConfig `validate:"required"`
+}
+
+// zero values leave a limit unset, see runner.Limits
+type ResourceLimitsConfig struct {
+	Nice      int    `validate:"min=0,max=19"`
+	CPUWeight int    `mapstructure:"cpu-weight" validate:"min=0,max=10000"`
+	IOWeight  int    `mapstructure:"io-weight" validate:"min=0,max=10000"`
+	MemoryMax string `mapstructure:"memory-max" validate:"omitempty,memorymax"`
+}
+
+type NixConfig struct {
+	Substituters      []string `validate:"required,dive,min=1"`
+	TrustedPublicKeys []string `mapstructure:"trusted-public-keys" validate:"required,dive,min=1"`
+	MaxJobs           string   `mapstructure:"max-jobs" validate:"omitempty,number|eq=auto"`
+	Cores             int      `validate:"min=0"`
+	NetrcFile         string   `mapstructure:"netrc-file"`
+	PreferChunked     bool     `mapstructure:"prefer-chunked"`
+	PinnedKeys        []string `mapstructure:"pinned-keys" validate:"required,dive,min=1"`
 }
 
 type NixOSRebuildConfig struct {
-	Operation string   `validate:"oneof=boot switch"`
+	Operation string   `validate:"oneof=boot switch test-then-boot"`
 	Host      string   `validate:"min=1"`
 	Args      []string `validate:"required,dive,min=1"`
 }
 
+type PhasesConfig struct {
+	Retries    int           `validate:"min=0"`
+	RetryDelay time.Duration `mapstructure:"retry-delay" validate:"min=0"`
+}
+
+type RestartsConfig struct {
+	CriticalUnits []string `mapstructure:"critical-units" validate:"required,dive,min=1"`
+	Policy        string   `validate:"oneof=warn boot prompt abort"`
+}
+
+type RollbackConfig struct {
+	MagicTimeout      time.Duration `mapstructure:"magic-timeout" validate:"min=0"`
+	ConfirmTimeout    time.Duration `mapstructure:"confirm-timeout" validate:"min=0"`
+	RecoverActivation bool          `mapstructure:"recover-activation"`
+	VerifyFailure     bool          `mapstructure:"verify-failure"`
+}
+
+type RolloutConfig struct {
+	Percentage   int `validate:"min=0,max=100"`
+	WidenPerHour int `mapstructure:"widen-per-hour" validate:"min=0"`
+}
+
+type SBOMConfig struct {
+	Enable bool
+	Format string `validate:"oneof=spdx cyclonedx"`
+	Dir    string `validate:"required"`
+}
+
+type SecretsConfig struct {
+	Paths []string `validate:"required,dive,min=1"`
+}
+
+type SecureBootConfig struct {
+	Verify bool
+}
+
+type SnapshotsConfig struct {
+	ZFSDatasets     []string `mapstructure:"zfs-datasets" validate:"required,dive,min=1"`
+	Keep            int      `validate:"min=0"`
+	BtrfsSubvolumes []string `mapstructure:"btrfs-subvolumes" validate:"required,dive,min=1"`
+}
+
+type SwitchConfig struct {
+	Retries    int           `validate:"min=0"`
+	RetryDelay time.Duration `mapstructure:"retry-delay" validate:"min=0"`
+}
+
+type VerifyConfig struct {
+	SystemRunning    bool          `mapstructure:"system-running"`
+	RunningTimeout   time.Duration `mapstructure:"running-timeout" validate:"gt=0"`
+	JournalWindow    time.Duration `mapstructure:"journal-window" validate:"min=0"`
+	HealthChecks     bool          `mapstructure:"health-checks"`
+	MaxJournalErrors int           `mapstructure:"max-journal-errors" validate:"min=0"`
+}
+
+type WaitConfig struct {
+	Enable   bool
+	Interval time.Duration `validate:"gt=0"`
+	Timeout  time.Duration `validate:"gt=0"`
+}
+
 // command config
 type Config struct {
+	AdvisoryChecks     []string `mapstructure:"advisory-checks" validate:"dive,glob"`
+	AllowReleaseChange bool     `mapstructure:"allow-release-change"`
+	// operator note on why single runs were triggered, see upgrade.Options.Annotation
+	Annotation   string
+	Approval     ApprovalConfig     `validate:"required"`
+	BootCounting BootCountingConfig `validate:"required"`
+	Cache        CacheConfig        `validate:"required"`
+	Daemon       DaemonConfig       `validate:"required"`
 	Debug        bool
-	HealthCheck  HealthCheckConfig  `validate:"required"`
-	Hydra        HydraConfig        `validate:"required"`
-	NixOSRebuild NixOSRebuildConfig `mapstructure:"nixos-rebuild" validate:"required"`
-	Reboot       bool
+	Degraded     string `validate:"oneof=ignore warn refuse"`
+	EvalFree     bool   `mapstructure:"eval-free"`
+	// name=/absolute/path, see runner.Paths
+	Executables []string `validate:"dive,executable"`
+	// option=rule between the running and target systems, see gates.Constraint
+	Constraints []string          `validate:"dive,constraint"`
+	Fetch       FetchConfig       `validate:"required"`
+	FlakeCheck  FlakeCheckConfig  `mapstructure:"flake-check"`
+	GCRoot      string            `mapstructure:"gc-root"`
+	Gates       GatesConfig       `validate:"required"`
+	HealthCheck HealthCheckConfig `validate:"required"`
+	HoldFile    string            `mapstructure:"hold-file" validate:"required"`
+	// identifies this machine in place of its hostname, defaults to the hostname
+	Hostname        string
+	Hooks           HooksConfig      `validate:"required"`
+	Hydra           HydraConfig      `validate:"required"`
+	InhibitSleep    bool             `mapstructure:"inhibit-sleep"`
+	IPFamily        string           `mapstructure:"ip-family" validate:"oneof=any ipv4 ipv6"`
+	Kubernetes      KubernetesConfig `validate:"required"`
+	Limits          LimitsConfig     `validate:"required"`
+	LogLevels       []string         `mapstructure:"log-levels" validate:"dive,loglevel"`
+	MaxDownloadMiB  int              `mapstructure:"max-download-mib" validate:"min=0"`
+	MetricsTextfile string           `mapstructure:"metrics-textfile"`
+	Motd            string
+	Nix             NixConfig          `validate:"required"`
+	NixOSRebuild    NixOSRebuildConfig `mapstructure:"nixos-rebuild" validate:"required"`
+	OfflineCheck    bool               `mapstructure:"offline-check"`
+	PendingBoot     string             `mapstructure:"pending-boot" validate:"oneof=skip warn restage reboot"`
+	Phases          PhasesConfig       `validate:"required"`
+	PluginDir       string             `mapstructure:"plugin-dir"`
+	PolicyFromFlake bool               `mapstructure:"policy-from-flake"`
+	RandomDelay     time.Duration      `mapstructure:"random-delay" validate:"min=0"`
+	Reboot          bool
+	Reexec          bool
+	Reproducibility string         `validate:"oneof=off eval rebuild"`
+	Restarts        RestartsConfig `validate:"required"`
+	Rollback        RollbackConfig
+	Rollout         RolloutConfig    `validate:"required"`
+	SBOM            SBOMConfig       `validate:"required"`
+	Secrets         SecretsConfig    `validate:"required"`
+	SecureBoot      SecureBootConfig `mapstructure:"secure-boot"`
+	Snapshots       SnapshotsConfig  `validate:"required"`
+	StallTimeout    time.Duration    `mapstructure:"stall-timeout" validate:"min=0"`
+	StateFile       string           `mapstructure:"state-file" validate:"required"`
+	Switch          SwitchConfig     `validate:"required"`
+	Verify          VerifyConfig     `validate:"required"`
+	Wait            WaitConfig       `validate:"required"`
 }
 
 // cobra and viper key constants, matching the command structure
+type ApprovalConfigKeys struct {
+	Required       string
+	File           string
+	AllowedSigners string
+}
+
+type BootCountingConfigKeys struct {
+	Enable    string
+	Tries     string
+	ESP       string
+	BlessBoot string
+}
+
+type CacheConfigKeys struct {
+	Dir         string
+	MetadataTTL string
+}
+
+type DaemonConfigKeys struct {
+	Interval         string
+	Socket           string
+	Schedule         string
+	ActivateSchedule string
+	Timezone         string
+	ReadOnlySocket   string
+	MaxBackoff       string
+	Jitter           string
+}
+
+type FetchConfigKeys struct {
+	Retries    string
+	RetryDelay string
+}
+
+type FlakeCheckConfigKeys struct {
+	Enable string
+	Checks string
+}
+
+type GatesConfigKeys struct {
+	Inhibitors          string
+	MinUptime           string
+	BackupUnits         string
+	LibvirtDomains      string
+	Containers          string
+	Tailscale           string
+	WireGuardInterfaces string
+	OverlayPeers        string
+	TimeSync            string
+}
+
 type HealthCheckConfigKeys struct {
-	CanaryHosts string
+	CanaryHosts   string
+	SSHHosts      string
+	SSHCommand    string
+	SSHIdentity   string
+	SSHKnownHosts string
+	Units         string
+	Scripts       string
+	ScriptTimeout string
+	Canaries      string
+}
+
+type HooksConfigKeys struct {
+	PreSwitch  string
+	PostSwitch string
+	PreReboot  string
+	OnFailure  string
+	OnRollback string
+	Evacuate   string
+	Phase      string
 }
 
 type HydraConfigKeys struct {
-	Instance string
-	JobSet   string
-	Job      string
-	Project  string
+	Instance        string
+	JobSet          string
+	Job             string
+	Project         string
+	AllowedRefs     string
+	Hosts           string
+	Inventory       string
+	InventoryFlake  string
+	InventoryJob    string
+	Fallbacks       string
+	MaxBuildAge     string
+	Freshness       string
+	ExpectedOrigin  string
+	DiscoveryDomain string
+	Dependencies    string
+	Products        string
+	ProductsDir     string
+}
+
+type KubernetesConfigKeys struct {
+	Drain      string
+	Node       string
+	Kubeconfig string
+	DrainArgs  string
+}
+
+type LimitsConfigKeys struct {
+	Eval     ResourceLimitsConfigKeys
+	Download ResourceLimitsConfigKeys
+}
+
+type ResourceLimitsConfigKeys struct {
+	Nice      string
+	CPUWeight string
+	IOWeight  string
+	MemoryMax string
+}
+
+type NixConfigKeys struct {
+	Substituters      string
+	TrustedPublicKeys string
+	MaxJobs           string
+	Cores             string
+	NetrcFile         string
+	PreferChunked     string
+	PinnedKeys        string
 }
 
 type NixOSRebuildConfigKeys struct {
@@ -53,89 +457,867 @@ type NixOSRebuildConfigKeys struct {
 	Args      string
 }
 
+type PhasesConfigKeys struct {
+	Retries    string
+	RetryDelay string
+}
+
+type RestartsConfigKeys struct {
+	CriticalUnits string
+	Policy        string
+}
+
+type RollbackConfigKeys struct {
+	MagicTimeout      string
+	ConfirmTimeout    string
+	RecoverActivation string
+	VerifyFailure     string
+}
+
+type RolloutConfigKeys struct {
+	Percentage   string
+	WidenPerHour string
+}
+
+type SBOMConfigKeys struct {
+	Enable string
+	Format string
+	Dir    string
+}
+
+type SecretsConfigKeys struct {
+	Paths string
+}
+
+type SecureBootConfigKeys struct {
+	Verify string
+}
+
+type SnapshotsConfigKeys struct {
+	ZFSDatasets     string
+	Keep            string
+	BtrfsSubvolumes string
+}
+
+type SwitchConfigKeys struct {
+	Retries    string
+	RetryDelay string
+}
+
+type VerifyConfigKeys struct {
+	SystemRunning    string
+	RunningTimeout   string
+	JournalWindow    string
+	HealthChecks     string
+	MaxJournalErrors string
+}
+
+type WaitConfigKeys struct {
+	Enable   string
+	Interval string
+	Timeout  string
+}
+
 type ConfigKeys struct {
-	Debug        string
-	HealthCheck  HealthCheckConfigKeys
-	Hydra        HydraConfigKeys
-	NixOSRebuild NixOSRebuildConfigKeys
-	Reboot       string
+	AdvisoryChecks     string
+	AllowReleaseChange string
+	Annotation         string
+	Approval           ApprovalConfigKeys
+	BootCounting       BootCountingConfigKeys
+	Cache              CacheConfigKeys
+	Daemon             DaemonConfigKeys
+	Debug              string
+	Degraded           string
+	EvalFree           string
+	Executables        string
+	Constraints        string
+	Fetch              FetchConfigKeys
+	FlakeCheck         FlakeCheckConfigKeys
+	GCRoot             string
+	Gates              GatesConfigKeys
+	HealthCheck        HealthCheckConfigKeys
+	HoldFile           string
+	Hostname           string
+	Hooks              HooksConfigKeys
+	Hydra              HydraConfigKeys
+	InhibitSleep       string
+	IPFamily           string
+	Kubernetes         KubernetesConfigKeys
+	Limits             LimitsConfigKeys
+	LogLevels          string
+	MaxDownloadMiB     string
+	MetricsTextfile    string
+	Motd               string
+	Nix                NixConfigKeys
+	NixOSRebuild       NixOSRebuildConfigKeys
+	OfflineCheck       string
+	PendingBoot        string
+	Phases             PhasesConfigKeys
+	PluginDir          string
+	PolicyFromFlake    string
+	RandomDelay        string
+	Reboot             string
+	Reexec             string
+	Reproducibility    string
+	Restarts           RestartsConfigKeys
+	Rollback           RollbackConfigKeys
+	Rollout            RolloutConfigKeys
+	SBOM               SBOMConfigKeys
+	Secrets            SecretsConfigKeys
+	SecureBoot         SecureBootConfigKeys
+	Snapshots          SnapshotsConfigKeys
+	StallTimeout       string
+	StateFile          string
+	Switch             SwitchConfigKeys
+	Verify             VerifyConfigKeys
+	Wait               WaitConfigKeys
 }
 
 var (
 	envPrefix      = "NHU"
 	envKeyReplacer = strings.NewReplacer(".", "_", "-", "_")
 	CobraKeys      = ConfigKeys{
-		Debug: "debug",
+		AdvisoryChecks:     "advisory-checks",
+		AllowReleaseChange: "allow-release-change",
+		Annotation:         "annotation",
+		Approval: ApprovalConfigKeys{
+			Required:       "approval-required",
+			File:           "approval-file",
+			AllowedSigners: "approval-allowed-signers",
+		},
+		BootCounting: BootCountingConfigKeys{
+			Enable:    "boot-counting",
+			Tries:     "boot-tries",
+			ESP:       "esp",
+			BlessBoot: "bless-boot",
+		},
+		Cache: CacheConfigKeys{
+			Dir:         "cache-dir",
+			MetadataTTL: "metadata-cache-ttl",
+		},
+		Daemon: DaemonConfigKeys{
+			Interval:         "daemon-interval",
+			Socket:           "control-socket",
+			Schedule:         "daemon-schedule",
+			ActivateSchedule: "daemon-activate-schedule",
+			Timezone:         "daemon-timezone",
+			ReadOnlySocket:   "daemon-read-only-socket",
+			MaxBackoff:       "daemon-max-backoff",
+			Jitter:           "daemon-jitter",
+		},
+		Debug:       "debug",
+		Degraded:    "degraded",
+		EvalFree:    "eval-free",
+		Executables: "executables",
+		Constraints: "constraints",
+		Fetch: FetchConfigKeys{
+			Retries:    "fetch-retries",
+			RetryDelay: "fetch-retry-delay",
+		},
+		FlakeCheck: FlakeCheckConfigKeys{
+			Enable: "flake-check",
+			Checks: "flake-check-checks",
+		},
+		GCRoot: "gc-root",
+		Gates: GatesConfigKeys{
+			Inhibitors:          "inhibitors",
+			MinUptime:           "min-uptime",
+			BackupUnits:         "backup-units",
+			LibvirtDomains:      "libvirt-domains",
+			Containers:          "containers",
+			Tailscale:           "tailscale-gate",
+			WireGuardInterfaces: "wireguard-interfaces",
+			OverlayPeers:        "overlay-peers",
+			TimeSync:            "time-sync",
+		},
 		HealthCheck: HealthCheckConfigKeys{
-			CanaryHosts: "canary",
+			CanaryHosts:   "canary",
+			SSHHosts:      "canary-ssh",
+			SSHCommand:    "canary-ssh-command",
+			SSHIdentity:   "canary-ssh-identity",
+			SSHKnownHosts: "canary-ssh-known-hosts",
+			Units:         "healthcheck-units",
+			Scripts:       "healthcheck-scripts",
+			ScriptTimeout: "healthcheck-script-timeout",
+			Canaries:      "N/A",
+		},
+		HoldFile: "hold-file",
+		Hostname: "hostname",
+		Hooks: HooksConfigKeys{
+			PreSwitch:  "hook-pre-switch",
+			PostSwitch: "hook-post-switch",
+			PreReboot:  "hook-pre-reboot",
+			OnFailure:  "hook-on-failure",
+			OnRollback: "hook-on-rollback",
+			Evacuate:   "hook-evacuate",
+			Phase:      "hook-phase",
 		},
 		Hydra: HydraConfigKeys{
-			Instance: "instance",
-			JobSet:   "jobset",
-			Job:      "job",
-			Project:  "project",
+			Instance:        "instance",
+			JobSet:          "jobset",
+			Job:             "job",
+			Project:         "project",
+			AllowedRefs:     "allowed-refs",
+			Hosts:           "N/A",
+			Inventory:       "hydra-inventory",
+			InventoryFlake:  "hydra-inventory-flake",
+			InventoryJob:    "hydra-inventory-job",
+			Fallbacks:       "hydra-fallbacks",
+			MaxBuildAge:     "hydra-max-build-age",
+			Freshness:       "hydra-freshness",
+			ExpectedOrigin:  "hydra-expected-origin",
+			DiscoveryDomain: "hydra-discovery-domain",
+			Dependencies:    "hydra-dependencies",
+			Products:        "hydra-products",
+			ProductsDir:     "hydra-products-dir",
+		},
+		InhibitSleep: "inhibit-sleep",
+		IPFamily:     "ip-family",
+		Kubernetes: KubernetesConfigKeys{
+			Drain:      "k8s-drain",
+			Node:       "k8s-node",
+			Kubeconfig: "kubeconfig",
+			DrainArgs:  "k8s-drain-args",
+		},
+		Limits: LimitsConfigKeys{
+			Eval: ResourceLimitsConfigKeys{
+				Nice:      "limits-eval-nice",
+				CPUWeight: "limits-eval-cpu-weight",
+				IOWeight:  "limits-eval-io-weight",
+				MemoryMax: "limits-eval-memory-max",
+			},
+			Download: ResourceLimitsConfigKeys{
+				Nice:      "limits-download-nice",
+				CPUWeight: "limits-download-cpu-weight",
+				IOWeight:  "limits-download-io-weight",
+				MemoryMax: "limits-download-memory-max",
+			},
+		},
+		LogLevels:       "log-levels",
+		MaxDownloadMiB:  "max-download-mib",
+		MetricsTextfile: "metrics-textfile",
+		Motd:            "motd",
+		Nix: NixConfigKeys{
+			Substituters:      "nix-substituters",
+			TrustedPublicKeys: "nix-trusted-public-keys",
+			MaxJobs:           "nix-max-jobs",
+			Cores:             "nix-cores",
+			NetrcFile:         "nix-netrc-file",
+			PreferChunked:     "nix-prefer-chunked",
+			PinnedKeys:        "nix-pinned-keys",
 		},
 		NixOSRebuild: NixOSRebuildConfigKeys{
 			Operation: "N/A",
 			Host:      "host",
 			Args:      "passthru-args",
 		},
-		Reboot: "reboot",
+		OfflineCheck: "offline-check",
+		PendingBoot:  "pending-boot",
+		Phases: PhasesConfigKeys{
+			Retries:    "phase-retries",
+			RetryDelay: "phase-retry-delay",
+		},
+		PluginDir:       "plugin-dir",
+		PolicyFromFlake: "policy-from-flake",
+		RandomDelay:     "random-delay",
+		Reboot:          "reboot",
+		Reexec:          "reexec",
+		Reproducibility: "reproducibility",
+		Restarts: RestartsConfigKeys{
+			CriticalUnits: "critical-units",
+			Policy:        "critical-restart-policy",
+		},
+		Rollback: RollbackConfigKeys{
+			MagicTimeout:      "magic-rollback-timeout",
+			ConfirmTimeout:    "confirm-timeout",
+			RecoverActivation: "recover-activation",
+			VerifyFailure:     "rollback-verify-failure",
+		},
+		Rollout: RolloutConfigKeys{
+			Percentage:   "rollout-percentage",
+			WidenPerHour: "rollout-widen-per-hour",
+		},
+		SBOM: SBOMConfigKeys{
+			Enable: "sbom",
+			Format: "sbom-format",
+			Dir:    "sbom-dir",
+		},
+		Secrets: SecretsConfigKeys{
+			Paths: "secrets",
+		},
+		SecureBoot: SecureBootConfigKeys{
+			Verify: "secure-boot-verify",
+		},
+		Snapshots: SnapshotsConfigKeys{
+			ZFSDatasets:     "zfs-datasets",
+			Keep:            "snapshot-keep",
+			BtrfsSubvolumes: "btrfs-subvolumes",
+		},
+		StallTimeout: "stall-timeout",
+		StateFile:    "state-file",
+		Switch: SwitchConfigKeys{
+			Retries:    "switch-retries",
+			RetryDelay: "switch-retry-delay",
+		},
+		Verify: VerifyConfigKeys{
+			SystemRunning:    "verify-system-running",
+			RunningTimeout:   "verify-running-timeout",
+			JournalWindow:    "verify-journal-window",
+			HealthChecks:     "verify-health-checks",
+			MaxJournalErrors: "verify-max-journal-errors",
+		},
+		Wait: WaitConfigKeys{
+			Enable:   "wait",
+			Interval: "wait-interval",
+			Timeout:  "wait-timeout",
+		},
 	}
 	ViperKeys = ConfigKeys{
-		Debug: "debug",
+		AdvisoryChecks:     "advisory-checks",
+		AllowReleaseChange: "allow-release-change",
+		Annotation:         "annotation",
+		Approval: ApprovalConfigKeys{
+			Required:       "approval.required",
+			File:           "approval.file",
+			AllowedSigners: "approval.allowed-signers",
+		},
+		BootCounting: BootCountingConfigKeys{
+			Enable:    "bootcounting.enable",
+			Tries:     "bootcounting.tries",
+			ESP:       "bootcounting.esp",
+			BlessBoot: "bootcounting.bless-boot",
+		},
+		Cache: CacheConfigKeys{
+			Dir:         "cache.dir",
+			MetadataTTL: "cache.metadata-ttl",
+		},
+		Daemon: DaemonConfigKeys{
+			Interval:         "daemon.interval",
+			Socket:           "daemon.socket",
+			Schedule:         "daemon.schedule",
+			ActivateSchedule: "daemon.activate-schedule",
+			Timezone:         "daemon.timezone",
+			ReadOnlySocket:   "daemon.read-only-socket",
+			MaxBackoff:       "daemon.max-backoff",
+			Jitter:           "daemon.jitter",
+		},
+		Debug:       "debug",
+		Degraded:    "degraded",
+		EvalFree:    "eval-free",
+		Executables: "executables",
+		Constraints: "constraints",
+		Fetch: FetchConfigKeys{
+			Retries:    "fetch.retries",
+			RetryDelay: "fetch.retry-delay",
+		},
+		FlakeCheck: FlakeCheckConfigKeys{
+			Enable: "flake-check.enable",
+			Checks: "flake-check.checks",
+		},
+		GCRoot: "gc-root",
+		Gates: GatesConfigKeys{
+			Inhibitors:          "gates.inhibitors",
+			MinUptime:           "gates.min-uptime",
+			BackupUnits:         "gates.backup-units",
+			LibvirtDomains:      "gates.libvirt-domains",
+			Containers:          "gates.containers",
+			Tailscale:           "gates.tailscale",
+			WireGuardInterfaces: "gates.wireguard-interfaces",
+			OverlayPeers:        "gates.overlay-peers",
+			TimeSync:            "gates.time-sync",
+		},
 		HealthCheck: HealthCheckConfigKeys{
-			CanaryHosts: "healthcheck.canaryhosts",
+			CanaryHosts:   "healthcheck.canaryhosts",
+			SSHHosts:      "healthcheck.ssh-hosts",
+			SSHCommand:    "healthcheck.ssh-command",
+			SSHIdentity:   "healthcheck.ssh-identity",
+			SSHKnownHosts: "healthcheck.ssh-known-hosts",
+			Units:         "healthcheck.units",
+			Scripts:       "healthcheck.scripts",
+			ScriptTimeout: "healthcheck.script-timeout",
+			Canaries:      "healthcheck.canaries",
+		},
+		HoldFile: "hold-file",
+		Hostname: "hostname",
+		Hooks: HooksConfigKeys{
+			PreSwitch:  "hooks.pre-switch",
+			PostSwitch: "hooks.post-switch",
+			PreReboot:  "hooks.pre-reboot",
+			OnFailure:  "hooks.on-failure",
+			OnRollback: "hooks.on-rollback",
+			Evacuate:   "hooks.evacuate",
+			Phase:      "hooks.phase",
 		},
 		Hydra: HydraConfigKeys{
-			Instance: "hydra.instance",
-			JobSet:   "hydra.jobset",
-			Job:      "hydra.job",
-			Project:  "hydra.project",
+			Instance:        "hydra.instance",
+			JobSet:          "hydra.jobset",
+			Job:             "hydra.job",
+			Project:         "hydra.project",
+			AllowedRefs:     "hydra.allowed-refs",
+			Hosts:           "hydra.hosts",
+			Inventory:       "hydra.inventory",
+			InventoryFlake:  "hydra.inventory-flake",
+			InventoryJob:    "hydra.inventory-job",
+			Fallbacks:       "hydra.fallbacks",
+			MaxBuildAge:     "hydra.max-build-age",
+			Freshness:       "hydra.freshness",
+			ExpectedOrigin:  "hydra.expected-origin",
+			DiscoveryDomain: "hydra.discovery-domain",
+			Dependencies:    "hydra.dependencies",
+			Products:        "hydra.products",
+			ProductsDir:     "hydra.products-dir",
+		},
+		InhibitSleep: "inhibit-sleep",
+		IPFamily:     "ip-family",
+		Kubernetes: KubernetesConfigKeys{
+			Drain:      "kubernetes.drain",
+			Node:       "kubernetes.node",
+			Kubeconfig: "kubernetes.kubeconfig",
+			DrainArgs:  "kubernetes.drain-args",
+		},
+		Limits: LimitsConfigKeys{
+			Eval: ResourceLimitsConfigKeys{
+				Nice:      "limits.eval.nice",
+				CPUWeight: "limits.eval.cpu-weight",
+				IOWeight:  "limits.eval.io-weight",
+				MemoryMax: "limits.eval.memory-max",
+			},
+			Download: ResourceLimitsConfigKeys{
+				Nice:      "limits.download.nice",
+				CPUWeight: "limits.download.cpu-weight",
+				IOWeight:  "limits.download.io-weight",
+				MemoryMax: "limits.download.memory-max",
+			},
+		},
+		LogLevels:       "log-levels",
+		MaxDownloadMiB:  "max-download-mib",
+		MetricsTextfile: "metrics-textfile",
+		Motd:            "motd",
+		Nix: NixConfigKeys{
+			Substituters:      "nix.substituters",
+			TrustedPublicKeys: "nix.trusted-public-keys",
+			MaxJobs:           "nix.max-jobs",
+			Cores:             "nix.cores",
+			NetrcFile:         "nix.netrc-file",
+			PreferChunked:     "nix.prefer-chunked",
+			PinnedKeys:        "nix.pinned-keys",
 		},
 		NixOSRebuild: NixOSRebuildConfigKeys{
 			Operation: "nixos-rebuild.operation",
 			Host:      "nixos-rebuild.host",
 			Args:      "nixos-rebuild.args",
 		},
-		Reboot: "reboot",
+		OfflineCheck: "offline-check",
+		PendingBoot:  "pending-boot",
+		Phases: PhasesConfigKeys{
+			Retries:    "phases.retries",
+			RetryDelay: "phases.retry-delay",
+		},
+		PluginDir:       "plugin-dir",
+		PolicyFromFlake: "policy-from-flake",
+		RandomDelay:     "random-delay",
+		Reboot:          "reboot",
+		Reexec:          "reexec",
+		Reproducibility: "reproducibility",
+		Restarts: RestartsConfigKeys{
+			CriticalUnits: "restarts.critical-units",
+			Policy:        "restarts.policy",
+		},
+		Rollback: RollbackConfigKeys{
+			MagicTimeout:      "rollback.magic-timeout",
+			ConfirmTimeout:    "rollback.confirm-timeout",
+			RecoverActivation: "rollback.recover-activation",
+			VerifyFailure:     "rollback.verify-failure",
+		},
+		Rollout: RolloutConfigKeys{
+			Percentage:   "rollout.percentage",
+			WidenPerHour: "rollout.widen-per-hour",
+		},
+		SBOM: SBOMConfigKeys{
+			Enable: "sbom.enable",
+			Format: "sbom.format",
+			Dir:    "sbom.dir",
+		},
+		Secrets: SecretsConfigKeys{
+			Paths: "secrets.paths",
+		},
+		SecureBoot: SecureBootConfigKeys{
+			Verify: "secure-boot.verify",
+		},
+		Snapshots: SnapshotsConfigKeys{
+			ZFSDatasets:     "snapshots.zfs-datasets",
+			Keep:            "snapshots.keep",
+			BtrfsSubvolumes: "snapshots.btrfs-subvolumes",
+		},
+		StallTimeout: "stall-timeout",
+		StateFile:    "state-file",
+		Switch: SwitchConfigKeys{
+			Retries:    "switch.retries",
+			RetryDelay: "switch.retry-delay",
+		},
+		Verify: VerifyConfigKeys{
+			SystemRunning:    "verify.system-running",
+			RunningTimeout:   "verify.running-timeout",
+			JournalWindow:    "verify.journal-window",
+			HealthChecks:     "verify.health-checks",
+			MaxJournalErrors: "verify.max-journal-errors",
+		},
+		Wait: WaitConfigKeys{
+			Enable:   "wait.enable",
+			Interval: "wait.interval",
+			Timeout:  "wait.timeout",
+		},
 	}
 )
 
 // Builds a config.Config from a config file, environment variables
 // and CLI flags. flags > env > config.
 func InitializeConfig(rootCmd *cobra.Command, args []string) (Config, error) {
+	return InitializeConfigWithPolicy(rootCmd, args, nil)
+}
+
+// Values of ResourceLimitsConfig.MemoryMax.
+var memoryMax = regexp.MustCompile(`^([0-9]+[KMGT]?|[0-9]+(\.[0-9]+)?%|infinity)$`)
+
+// Top-level settings the target flake may set, see policy-from-flake.
+var PolicyKeys = []string{"degraded", "gates", "healthcheck", "max-download-mib", "reboot", "restarts", "rollback", "rollout", "verify"}
+
+/*
+Splits module settings evaluated from the target flake into upgrade policy,
+see PolicyKeys, and the sorted keys of everything else, which is ignored.
+*/
+func FilterPolicy(settings map[string]any) (map[string]any, []string) {
+	policy := map[string]any{}
+	ignored := []string{}
+	for key, value := range settings {
+		if slices.Contains(PolicyKeys, key) {
+			policy[key] = value
+		} else {
+			ignored = append(ignored, key)
+		}
+	}
+	slices.Sort(ignored)
+	return policy, ignored
+}
+
+/*
+Searched for config.yaml when --config isn't set, after the directories in
+systemd's $CONFIGURATION_DIRECTORY. Set at link time with -X for images
+keeping their config elsewhere.
+*/
+var DefaultConfigDir = "/etc/nixos-hydra-upgrade"
+
+/*
+Directories searched for config.yaml when --config isn't set, in order. The
+ConfigurationDirectory= of the service, e.g. of a portable service, is found
+without passing --config.
+*/
+func ConfigDirs() []string {
+	dirs := []string{}
+	if env := os.Getenv("CONFIGURATION_DIRECTORY"); env != "" {
+		dirs = append(dirs, strings.Split(env, ":")...)
+	}
+	return append(dirs, DefaultConfigDir)
+}
+
+/*
+InitializeConfig, with upgrade policy from the target flake (see FilterPolicy)
+layered over the config file. flags > env > policy > config.
+*/
+func InitializeConfigWithPolicy(rootCmd *cobra.Command, args []string, policy map[string]any) (Config, error) {
 	v := viper.New()
 	v.SetConfigName("config")
 	v.SetConfigType("yaml")
 
-	v.SetConfigFile(rootCmd.PersistentFlags().Lookup("config").Value.String())
+	configFile := rootCmd.PersistentFlags().Lookup("config").Value.String()
+	v.SetConfigFile(configFile)
+	if configFile == "" {
+		for _, dir := range ConfigDirs() {
+			v.AddConfigPath(dir)
+		}
+	}
 
 	v.SetEnvPrefix(envPrefix)
 	v.SetEnvKeyReplacer(envKeyReplacer)
 
 	// manually bind so environment variables function without config file unmarshalling
+	v.BindEnv(ViperKeys.AdvisoryChecks)
+	v.BindEnv(ViperKeys.AllowReleaseChange)
+	v.BindEnv(ViperKeys.Annotation)
+	v.BindEnv(ViperKeys.Approval.Required)
+	v.BindEnv(ViperKeys.Approval.File)
+	v.BindEnv(ViperKeys.Approval.AllowedSigners)
+	v.BindEnv(ViperKeys.BootCounting.Enable)
+	v.BindEnv(ViperKeys.BootCounting.Tries)
+	v.BindEnv(ViperKeys.BootCounting.ESP)
+	v.BindEnv(ViperKeys.BootCounting.BlessBoot)
+	v.BindEnv(ViperKeys.Cache.Dir)
+	v.BindEnv(ViperKeys.Cache.MetadataTTL)
+	v.BindEnv(ViperKeys.Daemon.Interval)
+	v.BindEnv(ViperKeys.Daemon.Socket)
+	v.BindEnv(ViperKeys.Daemon.Schedule)
+	v.BindEnv(ViperKeys.Daemon.ActivateSchedule)
+	v.BindEnv(ViperKeys.Daemon.Timezone)
+	v.BindEnv(ViperKeys.Daemon.ReadOnlySocket)
+	v.BindEnv(ViperKeys.Daemon.MaxBackoff)
+	v.BindEnv(ViperKeys.Daemon.Jitter)
 	v.BindEnv(ViperKeys.Debug)
+	v.BindEnv(ViperKeys.Degraded)
+	v.BindEnv(ViperKeys.EvalFree)
+	v.BindEnv(ViperKeys.Executables)
+	v.BindEnv(ViperKeys.Constraints)
+	v.BindEnv(ViperKeys.Fetch.Retries)
+	v.BindEnv(ViperKeys.Fetch.RetryDelay)
+	v.BindEnv(ViperKeys.FlakeCheck.Enable)
+	v.BindEnv(ViperKeys.FlakeCheck.Checks)
+	v.BindEnv(ViperKeys.GCRoot)
+	v.BindEnv(ViperKeys.Gates.Inhibitors)
+	v.BindEnv(ViperKeys.Gates.MinUptime)
+	v.BindEnv(ViperKeys.Gates.BackupUnits)
+	v.BindEnv(ViperKeys.Gates.LibvirtDomains)
+	v.BindEnv(ViperKeys.Gates.Containers)
+	v.BindEnv(ViperKeys.Gates.Tailscale)
+	v.BindEnv(ViperKeys.Gates.WireGuardInterfaces)
+	v.BindEnv(ViperKeys.Gates.OverlayPeers)
+	v.BindEnv(ViperKeys.Gates.TimeSync)
 	v.BindEnv(ViperKeys.HealthCheck.CanaryHosts)
+	v.BindEnv(ViperKeys.HealthCheck.SSHHosts)
+	v.BindEnv(ViperKeys.HealthCheck.SSHCommand)
+	v.BindEnv(ViperKeys.HealthCheck.SSHIdentity)
+	v.BindEnv(ViperKeys.HealthCheck.SSHKnownHosts)
+	v.BindEnv(ViperKeys.HealthCheck.Units)
+	v.BindEnv(ViperKeys.HealthCheck.Scripts)
+	v.BindEnv(ViperKeys.HealthCheck.ScriptTimeout)
+	v.BindEnv(ViperKeys.HoldFile)
+	v.BindEnv(ViperKeys.Hostname)
+	v.BindEnv(ViperKeys.Hooks.PreSwitch)
+	v.BindEnv(ViperKeys.Hooks.PostSwitch)
+	v.BindEnv(ViperKeys.Hooks.PreReboot)
+	v.BindEnv(ViperKeys.Hooks.OnFailure)
+	v.BindEnv(ViperKeys.Hooks.OnRollback)
+	v.BindEnv(ViperKeys.Hooks.Evacuate)
+	v.BindEnv(ViperKeys.Hooks.Phase)
 	v.BindEnv(ViperKeys.Hydra.Instance)
 	v.BindEnv(ViperKeys.Hydra.JobSet)
 	v.BindEnv(ViperKeys.Hydra.Job)
 	v.BindEnv(ViperKeys.Hydra.Project)
+	v.BindEnv(ViperKeys.Hydra.AllowedRefs)
+	v.BindEnv(ViperKeys.Hydra.Inventory)
+	v.BindEnv(ViperKeys.Hydra.InventoryFlake)
+	v.BindEnv(ViperKeys.Hydra.InventoryJob)
+	v.BindEnv(ViperKeys.Hydra.Fallbacks)
+	v.BindEnv(ViperKeys.Hydra.MaxBuildAge)
+	v.BindEnv(ViperKeys.Hydra.Freshness)
+	v.BindEnv(ViperKeys.Hydra.ExpectedOrigin)
+	v.BindEnv(ViperKeys.Hydra.DiscoveryDomain)
+	v.BindEnv(ViperKeys.Hydra.Dependencies)
+	v.BindEnv(ViperKeys.Hydra.Products)
+	v.BindEnv(ViperKeys.Hydra.ProductsDir)
+	v.BindEnv(ViperKeys.InhibitSleep)
+	v.BindEnv(ViperKeys.IPFamily)
+	v.BindEnv(ViperKeys.Kubernetes.Drain)
+	v.BindEnv(ViperKeys.Kubernetes.Node)
+	v.BindEnv(ViperKeys.Kubernetes.Kubeconfig)
+	v.BindEnv(ViperKeys.Kubernetes.DrainArgs)
+	v.BindEnv(ViperKeys.Limits.Eval.Nice)
+	v.BindEnv(ViperKeys.Limits.Eval.CPUWeight)
+	v.BindEnv(ViperKeys.Limits.Eval.IOWeight)
+	v.BindEnv(ViperKeys.Limits.Eval.MemoryMax)
+	v.BindEnv(ViperKeys.Limits.Download.Nice)
+	v.BindEnv(ViperKeys.Limits.Download.CPUWeight)
+	v.BindEnv(ViperKeys.Limits.Download.IOWeight)
+	v.BindEnv(ViperKeys.Limits.Download.MemoryMax)
+	v.BindEnv(ViperKeys.LogLevels)
+	v.BindEnv(ViperKeys.MaxDownloadMiB)
+	v.BindEnv(ViperKeys.MetricsTextfile)
+	v.BindEnv(ViperKeys.Motd)
+	v.BindEnv(ViperKeys.Nix.Substituters)
+	v.BindEnv(ViperKeys.Nix.TrustedPublicKeys)
+	v.BindEnv(ViperKeys.Nix.MaxJobs)
+	v.BindEnv(ViperKeys.Nix.Cores)
+	v.BindEnv(ViperKeys.Nix.NetrcFile)
+	v.BindEnv(ViperKeys.Nix.PreferChunked)
+	v.BindEnv(ViperKeys.Nix.PinnedKeys)
 	v.BindEnv(ViperKeys.NixOSRebuild.Operation)
 	v.BindEnv(ViperKeys.NixOSRebuild.Host)
 	v.BindEnv(ViperKeys.NixOSRebuild.Args)
+	v.BindEnv(ViperKeys.OfflineCheck)
+	v.BindEnv(ViperKeys.PendingBoot)
+	v.BindEnv(ViperKeys.Phases.Retries)
+	v.BindEnv(ViperKeys.Phases.RetryDelay)
+	v.BindEnv(ViperKeys.PluginDir)
+	v.BindEnv(ViperKeys.PolicyFromFlake)
+	v.BindEnv(ViperKeys.RandomDelay)
 	v.BindEnv(ViperKeys.Reboot)
+	v.BindEnv(ViperKeys.Reexec)
+	v.BindEnv(ViperKeys.Reproducibility)
+	v.BindEnv(ViperKeys.Restarts.CriticalUnits)
+	v.BindEnv(ViperKeys.Restarts.Policy)
+	v.BindEnv(ViperKeys.Rollback.MagicTimeout)
+	v.BindEnv(ViperKeys.Rollback.ConfirmTimeout)
+	v.BindEnv(ViperKeys.Rollback.RecoverActivation)
+	v.BindEnv(ViperKeys.Rollback.VerifyFailure)
+	v.BindEnv(ViperKeys.Rollout.Percentage)
+	v.BindEnv(ViperKeys.Rollout.WidenPerHour)
+	v.BindEnv(ViperKeys.SBOM.Enable)
+	v.BindEnv(ViperKeys.SBOM.Format)
+	v.BindEnv(ViperKeys.SBOM.Dir)
+	v.BindEnv(ViperKeys.Secrets.Paths)
+	v.BindEnv(ViperKeys.SecureBoot.Verify)
+	v.BindEnv(ViperKeys.Snapshots.ZFSDatasets)
+	v.BindEnv(ViperKeys.Snapshots.Keep)
+	v.BindEnv(ViperKeys.Snapshots.BtrfsSubvolumes)
+	v.BindEnv(ViperKeys.StallTimeout)
+	v.BindEnv(ViperKeys.StateFile)
+	v.BindEnv(ViperKeys.Switch.Retries)
+	v.BindEnv(ViperKeys.Switch.RetryDelay)
+	v.BindEnv(ViperKeys.Verify.SystemRunning)
+	v.BindEnv(ViperKeys.Verify.RunningTimeout)
+	v.BindEnv(ViperKeys.Verify.JournalWindow)
+	v.BindEnv(ViperKeys.Verify.HealthChecks)
+	v.BindEnv(ViperKeys.Verify.MaxJournalErrors)
+	v.BindEnv(ViperKeys.Wait.Enable)
+	v.BindEnv(ViperKeys.Wait.Interval)
+	v.BindEnv(ViperKeys.Wait.Timeout)
 
+	v.BindPFlag(ViperKeys.AdvisoryChecks, rootCmd.PersistentFlags().Lookup(CobraKeys.AdvisoryChecks))
+	v.BindPFlag(ViperKeys.AllowReleaseChange, rootCmd.PersistentFlags().Lookup(CobraKeys.AllowReleaseChange))
+	v.BindPFlag(ViperKeys.Annotation, rootCmd.PersistentFlags().Lookup(CobraKeys.Annotation))
+	v.BindPFlag(ViperKeys.Approval.Required, rootCmd.PersistentFlags().Lookup(CobraKeys.Approval.Required))
+	v.BindPFlag(ViperKeys.Approval.File, rootCmd.PersistentFlags().Lookup(CobraKeys.Approval.File))
+	v.BindPFlag(ViperKeys.Approval.AllowedSigners, rootCmd.PersistentFlags().Lookup(CobraKeys.Approval.AllowedSigners))
+	v.BindPFlag(ViperKeys.BootCounting.Enable, rootCmd.PersistentFlags().Lookup(CobraKeys.BootCounting.Enable))
+	v.BindPFlag(ViperKeys.BootCounting.Tries, rootCmd.PersistentFlags().Lookup(CobraKeys.BootCounting.Tries))
+	v.BindPFlag(ViperKeys.BootCounting.ESP, rootCmd.PersistentFlags().Lookup(CobraKeys.BootCounting.ESP))
+	v.BindPFlag(ViperKeys.BootCounting.BlessBoot, rootCmd.PersistentFlags().Lookup(CobraKeys.BootCounting.BlessBoot))
+	v.BindPFlag(ViperKeys.Cache.Dir, rootCmd.PersistentFlags().Lookup(CobraKeys.Cache.Dir))
+	v.BindPFlag(ViperKeys.Cache.MetadataTTL, rootCmd.PersistentFlags().Lookup(CobraKeys.Cache.MetadataTTL))
+	v.BindPFlag(ViperKeys.Daemon.Interval, rootCmd.PersistentFlags().Lookup(CobraKeys.Daemon.Interval))
+	v.BindPFlag(ViperKeys.Daemon.Socket, rootCmd.PersistentFlags().Lookup(CobraKeys.Daemon.Socket))
+	v.BindPFlag(ViperKeys.Daemon.Schedule, rootCmd.PersistentFlags().Lookup(CobraKeys.Daemon.Schedule))
+	v.BindPFlag(ViperKeys.Daemon.ActivateSchedule, rootCmd.PersistentFlags().Lookup(CobraKeys.Daemon.ActivateSchedule))
+	v.BindPFlag(ViperKeys.Daemon.Timezone, rootCmd.PersistentFlags().Lookup(CobraKeys.Daemon.Timezone))
+	v.BindPFlag(ViperKeys.Daemon.ReadOnlySocket, rootCmd.PersistentFlags().Lookup(CobraKeys.Daemon.ReadOnlySocket))
+	v.BindPFlag(ViperKeys.Daemon.MaxBackoff, rootCmd.PersistentFlags().Lookup(CobraKeys.Daemon.MaxBackoff))
+	v.BindPFlag(ViperKeys.Daemon.Jitter, rootCmd.PersistentFlags().Lookup(CobraKeys.Daemon.Jitter))
 	v.BindPFlag(ViperKeys.Debug, rootCmd.PersistentFlags().Lookup(CobraKeys.Debug))
+	v.BindPFlag(ViperKeys.Degraded, rootCmd.PersistentFlags().Lookup(CobraKeys.Degraded))
+	v.BindPFlag(ViperKeys.EvalFree, rootCmd.PersistentFlags().Lookup(CobraKeys.EvalFree))
+	v.BindPFlag(ViperKeys.Executables, rootCmd.PersistentFlags().Lookup(CobraKeys.Executables))
+	v.BindPFlag(ViperKeys.Constraints, rootCmd.PersistentFlags().Lookup(CobraKeys.Constraints))
+	v.BindPFlag(ViperKeys.Fetch.Retries, rootCmd.PersistentFlags().Lookup(CobraKeys.Fetch.Retries))
+	v.BindPFlag(ViperKeys.Fetch.RetryDelay, rootCmd.PersistentFlags().Lookup(CobraKeys.Fetch.RetryDelay))
+	v.BindPFlag(ViperKeys.FlakeCheck.Enable, rootCmd.PersistentFlags().Lookup(CobraKeys.FlakeCheck.Enable))
+	v.BindPFlag(ViperKeys.FlakeCheck.Checks, rootCmd.PersistentFlags().Lookup(CobraKeys.FlakeCheck.Checks))
+	v.BindPFlag(ViperKeys.GCRoot, rootCmd.PersistentFlags().Lookup(CobraKeys.GCRoot))
+	v.BindPFlag(ViperKeys.Gates.Inhibitors, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.Inhibitors))
+	v.BindPFlag(ViperKeys.Gates.MinUptime, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.MinUptime))
+	v.BindPFlag(ViperKeys.Gates.BackupUnits, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.BackupUnits))
+	v.BindPFlag(ViperKeys.Gates.LibvirtDomains, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.LibvirtDomains))
+	v.BindPFlag(ViperKeys.Gates.Containers, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.Containers))
+	v.BindPFlag(ViperKeys.Gates.Tailscale, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.Tailscale))
+	v.BindPFlag(ViperKeys.Gates.WireGuardInterfaces, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.WireGuardInterfaces))
+	v.BindPFlag(ViperKeys.Gates.OverlayPeers, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.OverlayPeers))
+	v.BindPFlag(ViperKeys.Gates.TimeSync, rootCmd.PersistentFlags().Lookup(CobraKeys.Gates.TimeSync))
 	v.BindPFlag(ViperKeys.HealthCheck.CanaryHosts, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.CanaryHosts))
+	v.BindPFlag(ViperKeys.HealthCheck.SSHHosts, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.SSHHosts))
+	v.BindPFlag(ViperKeys.HealthCheck.SSHCommand, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.SSHCommand))
+	v.BindPFlag(ViperKeys.HealthCheck.SSHIdentity, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.SSHIdentity))
+	v.BindPFlag(ViperKeys.HealthCheck.SSHKnownHosts, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.SSHKnownHosts))
+	v.BindPFlag(ViperKeys.HealthCheck.Units, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Units))
+	v.BindPFlag(ViperKeys.HealthCheck.Scripts, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Scripts))
+	v.BindPFlag(ViperKeys.HealthCheck.ScriptTimeout, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.ScriptTimeout))
+	v.BindPFlag(ViperKeys.HoldFile, rootCmd.PersistentFlags().Lookup(CobraKeys.HoldFile))
+	v.BindPFlag(ViperKeys.Hostname, rootCmd.PersistentFlags().Lookup(CobraKeys.Hostname))
+	v.BindPFlag(ViperKeys.Hooks.PreSwitch, rootCmd.PersistentFlags().Lookup(CobraKeys.Hooks.PreSwitch))
+	v.BindPFlag(ViperKeys.Hooks.PostSwitch, rootCmd.PersistentFlags().Lookup(CobraKeys.Hooks.PostSwitch))
+	v.BindPFlag(ViperKeys.Hooks.PreReboot, rootCmd.PersistentFlags().Lookup(CobraKeys.Hooks.PreReboot))
+	v.BindPFlag(ViperKeys.Hooks.OnFailure, rootCmd.PersistentFlags().Lookup(CobraKeys.Hooks.OnFailure))
+	v.BindPFlag(ViperKeys.Hooks.OnRollback, rootCmd.PersistentFlags().Lookup(CobraKeys.Hooks.OnRollback))
+	v.BindPFlag(ViperKeys.Hooks.Evacuate, rootCmd.PersistentFlags().Lookup(CobraKeys.Hooks.Evacuate))
+	v.BindPFlag(ViperKeys.Hooks.Phase, rootCmd.PersistentFlags().Lookup(CobraKeys.Hooks.Phase))
 	v.BindPFlag(ViperKeys.Hydra.Instance, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Instance))
 	v.BindPFlag(ViperKeys.Hydra.JobSet, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.JobSet))
 	v.BindPFlag(ViperKeys.Hydra.Job, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Job))
 	v.BindPFlag(ViperKeys.Hydra.Project, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Project))
+	v.BindPFlag(ViperKeys.Hydra.AllowedRefs, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.AllowedRefs))
+	v.BindPFlag(ViperKeys.Hydra.Inventory, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Inventory))
+	v.BindPFlag(ViperKeys.Hydra.InventoryFlake, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.InventoryFlake))
+	v.BindPFlag(ViperKeys.Hydra.InventoryJob, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.InventoryJob))
+	v.BindPFlag(ViperKeys.Hydra.Fallbacks, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Fallbacks))
+	v.BindPFlag(ViperKeys.Hydra.MaxBuildAge, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.MaxBuildAge))
+	v.BindPFlag(ViperKeys.Hydra.Freshness, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Freshness))
+	v.BindPFlag(ViperKeys.Hydra.ExpectedOrigin, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.ExpectedOrigin))
+	v.BindPFlag(ViperKeys.Hydra.DiscoveryDomain, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.DiscoveryDomain))
+	v.BindPFlag(ViperKeys.Hydra.Dependencies, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Dependencies))
+	v.BindPFlag(ViperKeys.Hydra.Products, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Products))
+	v.BindPFlag(ViperKeys.Hydra.ProductsDir, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.ProductsDir))
+	v.BindPFlag(ViperKeys.InhibitSleep, rootCmd.PersistentFlags().Lookup(CobraKeys.InhibitSleep))
+	v.BindPFlag(ViperKeys.IPFamily, rootCmd.PersistentFlags().Lookup(CobraKeys.IPFamily))
+	v.BindPFlag(ViperKeys.Kubernetes.Drain, rootCmd.PersistentFlags().Lookup(CobraKeys.Kubernetes.Drain))
+	v.BindPFlag(ViperKeys.Kubernetes.Node, rootCmd.PersistentFlags().Lookup(CobraKeys.Kubernetes.Node))
+	v.BindPFlag(ViperKeys.Kubernetes.Kubeconfig, rootCmd.PersistentFlags().Lookup(CobraKeys.Kubernetes.Kubeconfig))
+	v.BindPFlag(ViperKeys.Kubernetes.DrainArgs, rootCmd.PersistentFlags().Lookup(CobraKeys.Kubernetes.DrainArgs))
+	v.BindPFlag(ViperKeys.Limits.Eval.Nice, rootCmd.PersistentFlags().Lookup(CobraKeys.Limits.Eval.Nice))
+	v.BindPFlag(ViperKeys.Limits.Eval.CPUWeight, rootCmd.PersistentFlags().Lookup(CobraKeys.Limits.Eval.CPUWeight))
+	v.BindPFlag(ViperKeys.Limits.Eval.IOWeight, rootCmd.PersistentFlags().Lookup(CobraKeys.Limits.Eval.IOWeight))
+	v.BindPFlag(ViperKeys.Limits.Eval.MemoryMax, rootCmd.PersistentFlags().Lookup(CobraKeys.Limits.Eval.MemoryMax))
+	v.BindPFlag(ViperKeys.Limits.Download.Nice, rootCmd.PersistentFlags().Lookup(CobraKeys.Limits.Download.Nice))
+	v.BindPFlag(ViperKeys.Limits.Download.CPUWeight, rootCmd.PersistentFlags().Lookup(CobraKeys.Limits.Download.CPUWeight))
+	v.BindPFlag(ViperKeys.Limits.Download.IOWeight, rootCmd.PersistentFlags().Lookup(CobraKeys.Limits.Download.IOWeight))
+	v.BindPFlag(ViperKeys.Limits.Download.MemoryMax, rootCmd.PersistentFlags().Lookup(CobraKeys.Limits.Download.MemoryMax))
+	v.BindPFlag(ViperKeys.LogLevels, rootCmd.PersistentFlags().Lookup(CobraKeys.LogLevels))
+	v.BindPFlag(ViperKeys.MaxDownloadMiB, rootCmd.PersistentFlags().Lookup(CobraKeys.MaxDownloadMiB))
+	v.BindPFlag(ViperKeys.MetricsTextfile, rootCmd.PersistentFlags().Lookup(CobraKeys.MetricsTextfile))
+	v.BindPFlag(ViperKeys.Motd, rootCmd.PersistentFlags().Lookup(CobraKeys.Motd))
+	v.BindPFlag(ViperKeys.Nix.Substituters, rootCmd.PersistentFlags().Lookup(CobraKeys.Nix.Substituters))
+	v.BindPFlag(ViperKeys.Nix.TrustedPublicKeys, rootCmd.PersistentFlags().Lookup(CobraKeys.Nix.TrustedPublicKeys))
+	v.BindPFlag(ViperKeys.Nix.MaxJobs, rootCmd.PersistentFlags().Lookup(CobraKeys.Nix.MaxJobs))
+	v.BindPFlag(ViperKeys.Nix.Cores, rootCmd.PersistentFlags().Lookup(CobraKeys.Nix.Cores))
+	v.BindPFlag(ViperKeys.Nix.NetrcFile, rootCmd.PersistentFlags().Lookup(CobraKeys.Nix.NetrcFile))
+	v.BindPFlag(ViperKeys.Nix.PreferChunked, rootCmd.PersistentFlags().Lookup(CobraKeys.Nix.PreferChunked))
+	v.BindPFlag(ViperKeys.Nix.PinnedKeys, rootCmd.PersistentFlags().Lookup(CobraKeys.Nix.PinnedKeys))
 	v.BindPFlag(ViperKeys.NixOSRebuild.Operation, rootCmd.PersistentFlags().Lookup(CobraKeys.NixOSRebuild.Operation))
 	v.BindPFlag(ViperKeys.NixOSRebuild.Host, rootCmd.PersistentFlags().Lookup(CobraKeys.NixOSRebuild.Host))
 	v.BindPFlag(ViperKeys.NixOSRebuild.Args, rootCmd.PersistentFlags().Lookup(CobraKeys.NixOSRebuild.Args))
+	v.BindPFlag(ViperKeys.OfflineCheck, rootCmd.PersistentFlags().Lookup(CobraKeys.OfflineCheck))
+	v.BindPFlag(ViperKeys.PendingBoot, rootCmd.PersistentFlags().Lookup(CobraKeys.PendingBoot))
+	v.BindPFlag(ViperKeys.Phases.Retries, rootCmd.PersistentFlags().Lookup(CobraKeys.Phases.Retries))
+	v.BindPFlag(ViperKeys.Phases.RetryDelay, rootCmd.PersistentFlags().Lookup(CobraKeys.Phases.RetryDelay))
+	v.BindPFlag(ViperKeys.PluginDir, rootCmd.PersistentFlags().Lookup(CobraKeys.PluginDir))
+	v.BindPFlag(ViperKeys.PolicyFromFlake, rootCmd.PersistentFlags().Lookup(CobraKeys.PolicyFromFlake))
+	v.BindPFlag(ViperKeys.RandomDelay, rootCmd.PersistentFlags().Lookup(CobraKeys.RandomDelay))
 	v.BindPFlag(ViperKeys.Reboot, rootCmd.PersistentFlags().Lookup(CobraKeys.Reboot))
+	v.BindPFlag(ViperKeys.Reexec, rootCmd.PersistentFlags().Lookup(CobraKeys.Reexec))
+	v.BindPFlag(ViperKeys.Reproducibility, rootCmd.PersistentFlags().Lookup(CobraKeys.Reproducibility))
+	v.BindPFlag(ViperKeys.Restarts.CriticalUnits, rootCmd.PersistentFlags().Lookup(CobraKeys.Restarts.CriticalUnits))
+	v.BindPFlag(ViperKeys.Restarts.Policy, rootCmd.PersistentFlags().Lookup(CobraKeys.Restarts.Policy))
+	v.BindPFlag(ViperKeys.Rollback.MagicTimeout, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollback.MagicTimeout))
+	v.BindPFlag(ViperKeys.Rollback.ConfirmTimeout, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollback.ConfirmTimeout))
+	v.BindPFlag(ViperKeys.Rollback.RecoverActivation, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollback.RecoverActivation))
+	v.BindPFlag(ViperKeys.Rollback.VerifyFailure, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollback.VerifyFailure))
+	v.BindPFlag(ViperKeys.Rollout.Percentage, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollout.Percentage))
+	v.BindPFlag(ViperKeys.Rollout.WidenPerHour, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollout.WidenPerHour))
+	v.BindPFlag(ViperKeys.SBOM.Enable, rootCmd.PersistentFlags().Lookup(CobraKeys.SBOM.Enable))
+	v.BindPFlag(ViperKeys.SBOM.Format, rootCmd.PersistentFlags().Lookup(CobraKeys.SBOM.Format))
+	v.BindPFlag(ViperKeys.SBOM.Dir, rootCmd.PersistentFlags().Lookup(CobraKeys.SBOM.Dir))
+	v.BindPFlag(ViperKeys.Secrets.Paths, rootCmd.PersistentFlags().Lookup(CobraKeys.Secrets.Paths))
+	v.BindPFlag(ViperKeys.SecureBoot.Verify, rootCmd.PersistentFlags().Lookup(CobraKeys.SecureBoot.Verify))
+	v.BindPFlag(ViperKeys.Snapshots.ZFSDatasets, rootCmd.PersistentFlags().Lookup(CobraKeys.Snapshots.ZFSDatasets))
+	v.BindPFlag(ViperKeys.Snapshots.Keep, rootCmd.PersistentFlags().Lookup(CobraKeys.Snapshots.Keep))
+	v.BindPFlag(ViperKeys.Snapshots.BtrfsSubvolumes, rootCmd.PersistentFlags().Lookup(CobraKeys.Snapshots.BtrfsSubvolumes))
+	v.BindPFlag(ViperKeys.StallTimeout, rootCmd.PersistentFlags().Lookup(CobraKeys.StallTimeout))
+	v.BindPFlag(ViperKeys.StateFile, rootCmd.PersistentFlags().Lookup(CobraKeys.StateFile))
+	v.BindPFlag(ViperKeys.Switch.Retries, rootCmd.PersistentFlags().Lookup(CobraKeys.Switch.Retries))
+	v.BindPFlag(ViperKeys.Switch.RetryDelay, rootCmd.PersistentFlags().Lookup(CobraKeys.Switch.RetryDelay))
+	v.BindPFlag(ViperKeys.Verify.SystemRunning, rootCmd.PersistentFlags().Lookup(CobraKeys.Verify.SystemRunning))
+	v.BindPFlag(ViperKeys.Verify.RunningTimeout, rootCmd.PersistentFlags().Lookup(CobraKeys.Verify.RunningTimeout))
+	v.BindPFlag(ViperKeys.Verify.JournalWindow, rootCmd.PersistentFlags().Lookup(CobraKeys.Verify.JournalWindow))
+	v.BindPFlag(ViperKeys.Verify.HealthChecks, rootCmd.PersistentFlags().Lookup(CobraKeys.Verify.HealthChecks))
+	v.BindPFlag(ViperKeys.Verify.MaxJournalErrors, rootCmd.PersistentFlags().Lookup(CobraKeys.Verify.MaxJournalErrors))
+	v.BindPFlag(ViperKeys.Wait.Enable, rootCmd.PersistentFlags().Lookup(CobraKeys.Wait.Enable))
+	v.BindPFlag(ViperKeys.Wait.Interval, rootCmd.PersistentFlags().Lookup(CobraKeys.Wait.Interval))
+	v.BindPFlag(ViperKeys.Wait.Timeout, rootCmd.PersistentFlags().Lookup(CobraKeys.Wait.Timeout))
 
 	config := Config{}
 	// defaults
@@ -149,6 +1331,12 @@ func InitializeConfig(rootCmd *cobra.Command, args []string) (Config, error) {
 			return config, err
 		}
 	}
+	if len(policy) > 0 {
+		err = v.MergeConfigMap(policy)
+		if err != nil {
+			return config, err
+		}
+	}
 	err = v.Unmarshal(&config)
 	if err != nil {
 		return config, err
@@ -156,14 +1344,74 @@ func InitializeConfig(rootCmd *cobra.Command, args []string) (Config, error) {
 	if len(args) > 0 {
 		config.NixOSRebuild.Operation = args[0]
 	}
+	if config.Hostname == "" {
+		config.Hostname, err = os.Hostname()
+		if err != nil {
+			return config, err
+		}
+	}
+	if config.Kubernetes.Node == "" {
+		// kubernetes node names default to the hostname
+		config.Kubernetes.Node = config.Hostname
+	}
+	if host, ok := config.Hydra.HostConfig(config.Hostname); ok {
+		config.ApplyHost(rootCmd, host)
+	}
 
 	return config, nil
 }
 
+/*
+Selects the job of a hydra.hosts entry, or of an inventory node, for this
+host. Per-host jobs override yaml, but not flags or environment variables.
+*/
+func (config *Config) ApplyHost(rootCmd *cobra.Command, host HydraHostConfig) {
+	explicit := func(cobraKey string, viperKey string) bool {
+		_, env := os.LookupEnv(GetEnv(viperKey))
+		return env || rootCmd.PersistentFlags().Changed(cobraKey)
+	}
+	if !explicit(CobraKeys.Hydra.Job, ViperKeys.Hydra.Job) {
+		config.Hydra.Job = host.Job
+	}
+	if host.JobSet != "" && !explicit(CobraKeys.Hydra.JobSet, ViperKeys.Hydra.JobSet) {
+		config.Hydra.JobSet = host.JobSet
+	}
+	if host.Host != "" && !explicit(CobraKeys.NixOSRebuild.Host, ViperKeys.NixOSRebuild.Host) {
+		config.NixOSRebuild.Host = host.Host
+	}
+}
+
 // Validates a config struct. `err` should only be a `validator.ValidationErrors`
 // as long as all validators are valid.
 func (config Config) Validate() error {
 	validate := validator.New(validator.WithRequiredStructEnabled())
+	// module=level, see logging.ParseLevels
+	validate.RegisterValidation("loglevel", func(fl validator.FieldLevel) bool {
+		_, err := logging.ParseLevels([]string{fl.Field().String()})
+		return err == nil
+	})
+	// name=/absolute/path
+	validate.RegisterValidation("executable", func(fl validator.FieldLevel) bool {
+		name, executable, ok := strings.Cut(fl.Field().String(), "=")
+		return ok && name != "" && path.IsAbs(executable)
+	})
+	// option=unchanged or option=same-major
+	validate.RegisterValidation("constraint", func(fl validator.FieldLevel) bool {
+		option, rule, ok := strings.Cut(fl.Field().String(), "=")
+		return ok && option != "" && (rule == "unchanged" || rule == "same-major")
+	})
+	// bytes with an optional K, M, G, or T suffix, a percentage, or infinity, see systemd.resource-control
+	validate.RegisterValidation("memorymax", func(fl validator.FieldLevel) bool {
+		return memoryMax.MatchString(fl.Field().String())
+	})
+	validate.RegisterValidation("regexp", func(fl validator.FieldLevel) bool {
+		_, err := regexp.Compile(fl.Field().String())
+		return err == nil
+	})
+	validate.RegisterValidation("glob", func(fl validator.FieldLevel) bool {
+		_, err := path.Match(fl.Field().String(), "")
+		return err == nil
+	})
 	err := validate.Struct(config)
 	if err != nil {
 		return err
@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
@@ -13,56 +14,585 @@ import (
 )
 
 var (
-	cyaml = []byte(`debug: true
+	cyaml = []byte(`advisory-checks:
+  - ssh:*
+allow-release-change: true
+annotation: yaml annotation
+approval:
+  required: true
+  file: /yaml/approval
+  allowed-signers: /yaml/allowed_signers
+bootcounting:
+  enable: true
+  tries: 5
+  esp: /yaml/boot
+  bless-boot: /yaml/systemd-bless-boot
+cache:
+  dir: /yaml/cache
+  metadata-ttl: 1m
+daemon:
+  interval: 30m
+  socket: /run/nhu.sock
+  schedule: 0 * * * *
+  activate-schedule: 0 3 * * sat
+  timezone: Europe/Helsinki
+  read-only-socket: /run/nhu-ro.sock
+  max-backoff: 12h
+  jitter: 10m
+debug: true
+degraded: refuse
+eval-free: true
+executables:
+  - nix=/nix/var/nix/profiles/default/bin/nix
+constraints:
+  - system.stateVersion=unchanged
+fetch:
+  retries: 4
+  retry-delay: 1s
+flake-check:
+  enable: true
+  checks:
+    - yaml
+gc-root: /etc/yaml/gcroot
+gates:
+  inhibitors:
+    - shutdown
+    - sleep
+  min-uptime: 30m
+  backup-units:
+    - restic-backups-*.service
+  libvirt-domains: true
+  containers:
+    - yaml-*
+  tailscale: true
+  wireguard-interfaces:
+    - wg0
+  overlay-peers:
+    - yaml-peer
+  time-sync: true
 healthcheck:
   canaryHosts:
     - www.example.com
+  ssh-hosts:
+    - root@yaml-canary.example.com
+  ssh-command: systemctl is-active yaml.service
+  ssh-identity: /etc/yaml/id_ed25519
+  ssh-known-hosts: /etc/yaml/known_hosts
+  units:
+    - yaml.service
+  scripts:
+    - curl -sf http://localhost:8080/healthz
+  script-timeout: 30s
+  canaries:
+    - type: http
+      url: https://yaml-canary.example.com/healthz
+      status: 204
+      body: ok
+      timeout: 5s
+    - type: tcp
+      host: yaml-canary.example.com
+      port: 22
+hold-file: /var/lib/nhu/hold
+hostname: yaml-host
+hooks:
+  pre-switch:
+    - echo yaml pre-switch
+  post-switch:
+    - echo yaml post-switch
+  pre-reboot:
+    - echo yaml pre-reboot
+  on-failure:
+    - echo yaml on-failure
+  on-rollback:
+    - echo yaml on-rollback
+  evacuate:
+    - echo yaml evacuate
+  phase:
+    - echo yaml phase
 hydra:
   instance: https://hydra.example.com
   project: yaml-config
   jobset: yaml-branch
   job: hosts.yaml
+  allowed-refs:
+    - refs/heads/main
+  fallbacks:
+    - yaml-config/stable/hosts.yaml
+  max-build-age: 48h
+  freshness: 168h
+  expected-origin: github:example/yaml
+  discovery-domain: yaml.example.com
+  inventory: colmena
+  inventory-flake: github:example/yaml
+  inventory-job: yaml.{node}
+  dependencies: [overlay=yaml-overlay/main/checks]
+  products: ["*.iso"]
+  products-dir: /yaml/products
+inhibit-sleep: false
+ip-family: ipv6
+kubernetes:
+  drain: true
+  node: yaml-node
+  kubeconfig: /etc/yaml/kubeconfig
+  drain-args:
+    - --timeout=5m
+limits:
+  eval:
+    nice: 10
+    cpu-weight: 50
+    io-weight: 40
+    memory-max: 4G
+  download:
+    nice: 19
+    cpu-weight: 20
+    io-weight: 10
+    memory-max: 25%
+log-levels:
+  - hydra=debug
+max-download-mib: 2048
+metrics-textfile: /yaml/metrics.prom
+motd: /yaml/motd
+nix:
+  substituters:
+    - https://cache.yaml.org
+  trusted-public-keys:
+    - cache.yaml.org-1:yaml
+  max-jobs: auto
+  cores: 4
+  netrc-file: /etc/yaml/netrc
+  prefer-chunked: true
+  pinned-keys:
+    - hydra.yaml.org-1:yaml
 nixos-rebuild:
   host: yaml
   operation: switch
   args:
     - --yaml
-reboot: true`)
+offline-check: false
+pending-boot: skip
+phases:
+  retries: 2
+  retry-delay: 1m
+plugin-dir: /etc/yaml/plugins
+policy-from-flake: true
+random-delay: 15m
+reboot: true
+reexec: false
+reproducibility: eval
+restarts:
+  critical-units:
+    - sshd.service
+  policy: boot
+rollback:
+  magic-timeout: 90s
+  confirm-timeout: 15m
+  recover-activation: false
+  verify-failure: true
+rollout:
+  percentage: 25
+  widen-per-hour: 5
+sbom:
+  enable: true
+  format: cyclonedx
+  dir: /yaml/sbom
+secrets:
+  paths:
+    - /run/secrets/db:postgres:postgres:0400
+    - /run/agenix/*
+secure-boot:
+  verify: true
+snapshots:
+  zfs-datasets:
+    - rpool/safe/persist
+  keep: 3
+  btrfs-subvolumes:
+    - /persist
+stall-timeout: 10m
+state-file: /var/lib/nhu/state.json
+switch:
+  retries: 2
+  retry-delay: 30s
+verify:
+  system-running: true
+  running-timeout: 2m
+  journal-window: 1m
+  health-checks: true
+  max-journal-errors: 3
+wait:
+  enable: true
+  interval: 30s
+  timeout: 2h`)
 	cenv = config.Config{
-		Debug: true,
+		AdvisoryChecks:     []string{"ping:*", "journal"},
+		AllowReleaseChange: true,
+		Annotation:         "CHG-1: env annotation",
+		Approval: config.ApprovalConfig{
+			Required:       true,
+			File:           "/env/approval",
+			AllowedSigners: "/env/allowed_signers",
+		},
+		BootCounting: config.BootCountingConfig{
+			Enable:    true,
+			Tries:     2,
+			ESP:       "/env/boot",
+			BlessBoot: "/env/systemd-bless-boot",
+		},
+		Cache: config.CacheConfig{
+			Dir:         "/env/cache",
+			MetadataTTL: 2 * time.Minute,
+		},
+		Daemon: config.DaemonConfig{
+			Interval:         2 * time.Hour,
+			Socket:           "/run/env.sock",
+			Schedule:         "*/30 * * * *",
+			ActivateSchedule: "0 4 * * *",
+			Timezone:         "UTC",
+			ReadOnlySocket:   "/run/env-ro.sock",
+			MaxBackoff:       6 * time.Hour,
+			Jitter:           5 * time.Minute,
+		},
+		Debug:       true,
+		Degraded:    "ignore",
+		EvalFree:    true,
+		Executables: []string{"nix=/env/bin/nix", "nixos-rebuild=/env/bin/nixos-rebuild"},
+		Constraints: []string{"system.stateVersion=unchanged", "services.postgresql.package.version=same-major"},
+		Fetch: config.FetchConfig{
+			Retries:    5,
+			RetryDelay: 2 * time.Second,
+		},
+		FlakeCheck: config.FlakeCheckConfig{
+			Enable: true,
+			Checks: []string{"env"},
+		},
+		GCRoot: "/etc/env/gcroot",
+		Gates: config.GatesConfig{
+			Inhibitors:          []string{"shutdown", "idle"},
+			BackupUnits:         []string{"restic-backups-*.service", "borgmatic.service"},
+			LibvirtDomains:      true,
+			Containers:          []string{"env-*", "database"},
+			MinUptime:           time.Hour,
+			Tailscale:           true,
+			WireGuardInterfaces: []string{"wg-env"},
+			OverlayPeers:        []string{"env-peer1", "env-peer2"},
+			TimeSync:            true,
+		},
 		HealthCheck: config.HealthCheckConfig{
-			CanaryHosts: []string{"env-canary1.example.com", "env-canary2.example.com"},
+			CanaryHosts:   []string{"env-canary1.example.com", "env-canary2.example.com"},
+			SSHHosts:      []string{"root@env-canary1.example.com"},
+			SSHCommand:    "systemctl is-active env.service",
+			SSHIdentity:   "/etc/env/id_ed25519",
+			SSHKnownHosts: "/etc/env/known_hosts",
+			Units:         []string{"env1.service", "env2.service"},
+			Scripts:       []string{"echo env health"},
+			ScriptTimeout: 2 * time.Minute,
+			Canaries: []config.CanaryConfig{
+				{Type: "http", URL: "https://env-canary1.example.com/healthz"},
+				{Type: "tcp", Host: "env-canary2.example.com", Port: 443},
+			},
+		},
+		HoldFile: "/run/nhu/env.hold",
+		Hostname: "env-host",
+		Hooks: config.HooksConfig{
+			PreSwitch:  []string{"echo env pre-switch"},
+			PostSwitch: []string{"echo env post-switch"},
+			PreReboot:  []string{"echo env pre-reboot"},
+			OnFailure:  []string{"echo env on-failure"},
+			OnRollback: []string{"echo env on-rollback"},
+			Evacuate:   []string{"echo env evacuate"},
+			Phase:      []string{"echo env phase"},
 		},
 		Hydra: config.HydraConfig{
-			Instance: "https://env-hydra.example.com",
-			JobSet:   "env-branch",
-			Job:      "hosts.env",
-			Project:  "env-config",
+			Instance:        "https://env-hydra.example.com",
+			JobSet:          "env-branch",
+			Job:             "hosts.env",
+			Project:         "env-config",
+			AllowedRefs:     []string{"refs/heads/main", "refs/heads/env"},
+			Fallbacks:       []string{"env-config/stable/hosts.env"},
+			MaxBuildAge:     24 * time.Hour,
+			Freshness:       72 * time.Hour,
+			ExpectedOrigin:  "github:example/env",
+			DiscoveryDomain: "env.example.com",
+			Inventory:       "deploy-rs",
+			InventoryFlake:  "github:example/env",
+			InventoryJob:    "env.{node}",
+			Dependencies:    []string{"env-overlay/main/checks"},
+			Products:        []string{"*.tar.zst"},
+			ProductsDir:     "/env/products",
+		},
+		InhibitSleep: false,
+		IPFamily:     "ipv4",
+		Kubernetes: config.KubernetesConfig{
+			Drain:      true,
+			Node:       "env-node",
+			Kubeconfig: "/etc/env/kubeconfig",
+			DrainArgs:  []string{"--timeout=1m", "--force"},
+		},
+		Limits: config.LimitsConfig{
+			Eval:     config.ResourceLimitsConfig{Nice: 5, CPUWeight: 80, IOWeight: 70, MemoryMax: "2G"},
+			Download: config.ResourceLimitsConfig{Nice: 15, CPUWeight: 30, IOWeight: 20, MemoryMax: "1024M"},
+		},
+		LogLevels:       []string{"nix=warn", "hydra=debug"},
+		MaxDownloadMiB:  512,
+		MetricsTextfile: "/run/env/metrics.prom",
+		Motd:            "/run/env/motd",
+		Nix: config.NixConfig{
+			Substituters:      []string{"https://cache.env.org", "https://cache.nixos.org"},
+			TrustedPublicKeys: []string{"cache.env.org-1:env"},
+			MaxJobs:           "2",
+			Cores:             8,
+			NetrcFile:         "/etc/env/netrc",
+			PreferChunked:     true,
+			PinnedKeys:        []string{"hydra.env.org-1:env"},
 		},
 		NixOSRebuild: config.NixOSRebuildConfig{
 			Args:      []string{"--env1", "--env2"},
 			Host:      "env",
 			Operation: "switch",
 		},
-		Reboot: true,
+		OfflineCheck: false,
+		PendingBoot:  "restage",
+		Phases: config.PhasesConfig{
+			Retries:    3,
+			RetryDelay: 2 * time.Minute,
+		},
+		PluginDir:       "/etc/env/plugins",
+		PolicyFromFlake: true,
+		RandomDelay:     20 * time.Minute,
+		Reboot:          true,
+		Reexec:          false,
+		Reproducibility: "rebuild",
+		Restarts: config.RestartsConfig{
+			CriticalUnits: []string{"sshd.service", "env-*.service"},
+			Policy:        "abort",
+		},
+		Rollback: config.RollbackConfig{
+			MagicTimeout:      time.Minute,
+			ConfirmTimeout:    5 * time.Minute,
+			RecoverActivation: false,
+			VerifyFailure:     true,
+		},
+		Rollout: config.RolloutConfig{
+			Percentage:   50,
+			WidenPerHour: 10,
+		},
+		SBOM: config.SBOMConfig{
+			Enable: true,
+			Format: "cyclonedx",
+			Dir:    "/env/sbom",
+		},
+		Secrets: config.SecretsConfig{
+			Paths: []string{"/run/secrets/env"},
+		},
+		SecureBoot: config.SecureBootConfig{
+			Verify: true,
+		},
+		Snapshots: config.SnapshotsConfig{
+			ZFSDatasets:     []string{"rpool/env/persist", "rpool/env/home"},
+			BtrfsSubvolumes: []string{"/env/persist", "/env/home"},
+			Keep:            7,
+		},
+		StallTimeout: 45 * time.Minute,
+		StateFile:    "/run/nhu/state.json",
+		Switch: config.SwitchConfig{
+			Retries:    3,
+			RetryDelay: 2 * time.Minute,
+		},
+		Verify: config.VerifyConfig{
+			SystemRunning:    true,
+			RunningTimeout:   3 * time.Minute,
+			JournalWindow:    2 * time.Minute,
+			HealthChecks:     true,
+			MaxJournalErrors: 4,
+		},
+		Wait: config.WaitConfig{
+			Enable:   true,
+			Interval: 2 * time.Minute,
+			Timeout:  3 * time.Hour,
+		},
 	}
 	cflag = config.Config{
-		Debug: true,
+		AdvisoryChecks:     []string{"flake-check", "dependency:*"},
+		AllowReleaseChange: true,
+		Annotation:         "CHG-2: flag annotation",
+		Approval: config.ApprovalConfig{
+			Required:       true,
+			File:           "/flag/approval",
+			AllowedSigners: "/flag/allowed_signers",
+		},
+		BootCounting: config.BootCountingConfig{
+			Enable:    true,
+			Tries:     4,
+			ESP:       "/flag/boot",
+			BlessBoot: "/flag/systemd-bless-boot",
+		},
+		Cache: config.CacheConfig{
+			Dir:         "/flag/cache",
+			MetadataTTL: 3 * time.Minute,
+		},
+		Daemon: config.DaemonConfig{
+			Interval:         3 * time.Hour,
+			Socket:           "/run/flag.sock",
+			Schedule:         "@hourly",
+			ActivateSchedule: "0 2 * * mon-fri",
+			Timezone:         "America/New_York",
+			ReadOnlySocket:   "/run/flag-ro.sock",
+			MaxBackoff:       3 * time.Hour,
+			Jitter:           2 * time.Minute,
+		},
+		Debug:       true,
+		Degraded:    "refuse",
+		EvalFree:    true,
+		Executables: []string{"nix=/flag/bin/nix", "systemctl=/flag/bin/systemctl"},
+		Constraints: []string{"system.stateVersion=unchanged", "services.mysql.package.version=same-major"},
+		Fetch: config.FetchConfig{
+			Retries:    6,
+			RetryDelay: 3 * time.Second,
+		},
+		FlakeCheck: config.FlakeCheckConfig{
+			Enable: true,
+			Checks: []string{"flag1", "flag2"},
+		},
+		GCRoot: "/etc/flag/gcroot",
+		Gates: config.GatesConfig{
+			Inhibitors:          []string{"sleep", "idle"},
+			BackupUnits:         []string{"syncoid-*.service", "borgmatic.service"},
+			LibvirtDomains:      true,
+			Containers:          []string{"flag-*", "database"},
+			MinUptime:           2 * time.Hour,
+			Tailscale:           true,
+			WireGuardInterfaces: []string{"wg-flag"},
+			OverlayPeers:        []string{"flag-peer1", "flag-peer2"},
+			TimeSync:            true,
+		},
 		HealthCheck: config.HealthCheckConfig{
-			CanaryHosts: []string{"flag-canary1.example.com", "flag-canary2.example.com"},
+			CanaryHosts:   []string{"flag-canary1.example.com", "flag-canary2.example.com"},
+			SSHHosts:      []string{"root@flag-canary1.example.com"},
+			SSHCommand:    "systemctl is-active flag.service",
+			SSHIdentity:   "/etc/flag/id_ed25519",
+			SSHKnownHosts: "/etc/flag/known_hosts",
+			Units:         []string{"flag1.service", "flag2.service"},
+			Scripts:       []string{"echo flag health"},
+			ScriptTimeout: 3 * time.Minute,
+		},
+		HoldFile: "/run/nhu/flag.hold",
+		Hostname: "flag-host",
+		Hooks: config.HooksConfig{
+			PreSwitch:  []string{"echo flag pre-switch", "echo flag, with comma"},
+			PostSwitch: []string{"echo flag post-switch"},
+			PreReboot:  []string{"echo flag pre-reboot"},
+			OnFailure:  []string{"echo flag on-failure"},
+			OnRollback: []string{"echo flag on-rollback"},
+			Evacuate:   []string{"echo flag evacuate"},
+			Phase:      []string{"echo flag phase"},
 		},
 		Hydra: config.HydraConfig{
-			Instance: "https://flag-hydra.example.com",
-			JobSet:   "flag-branch",
-			Job:      "hosts.flag",
-			Project:  "flag-config",
+			Instance:        "https://flag-hydra.example.com",
+			JobSet:          "flag-branch",
+			Job:             "hosts.flag",
+			Project:         "flag-config",
+			AllowedRefs:     []string{"refs/heads/main", "refs/heads/flag"},
+			Fallbacks:       []string{"flag-config/stable/hosts.flag", "flag-config/backup/hosts.flag"},
+			MaxBuildAge:     72 * time.Hour,
+			Freshness:       96 * time.Hour,
+			ExpectedOrigin:  "github:example/flag",
+			DiscoveryDomain: "flag.example.com",
+			Inventory:       "colmena",
+			InventoryFlake:  "github:example/flag",
+			InventoryJob:    "flag.{node}",
+			Dependencies:    []string{"overlay=flag-overlay/main/checks", "flag-secrets/main/checks"},
+			Products:        []string{"*.img", "sbom.json"},
+			ProductsDir:     "/flag/products",
+		},
+		InhibitSleep: false,
+		IPFamily:     "ipv6",
+		Kubernetes: config.KubernetesConfig{
+			Drain:      true,
+			Node:       "flag-node",
+			Kubeconfig: "/etc/flag/kubeconfig",
+			DrainArgs:  []string{"--timeout=2m", "--force"},
+		},
+		Limits: config.LimitsConfig{
+			Eval:     config.ResourceLimitsConfig{Nice: 7, CPUWeight: 90, IOWeight: 60, MemoryMax: "3G"},
+			Download: config.ResourceLimitsConfig{Nice: 18, CPUWeight: 25, IOWeight: 15, MemoryMax: "50%"},
+		},
+		LogLevels:       []string{"healthcheck=warn", "upgrade=debug"},
+		MaxDownloadMiB:  1024,
+		MetricsTextfile: "/run/flag/metrics.prom",
+		Motd:            "/run/flag/motd",
+		Nix: config.NixConfig{
+			Substituters:      []string{"https://cache.flag.org"},
+			TrustedPublicKeys: []string{"cache.flag.org-1:flag", "cache.nixos.org-1:nixos"},
+			MaxJobs:           "6",
+			Cores:             1,
+			NetrcFile:         "/etc/flag/netrc",
+			PreferChunked:     true,
+			PinnedKeys:        []string{"hydra.flag.org-1:flag", "cache.nixos.org-1:nixos"},
 		},
 		NixOSRebuild: config.NixOSRebuildConfig{
 			Args:      []string{"--flag1", "--flag2"},
 			Host:      "flag",
-			Operation: "switch",
+			Operation: "test-then-boot",
+		},
+		OfflineCheck: false,
+		PendingBoot:  "reboot",
+		Phases: config.PhasesConfig{
+			Retries:    4,
+			RetryDelay: 3 * time.Minute,
+		},
+		PluginDir:       "/etc/flag/plugins",
+		PolicyFromFlake: true,
+		RandomDelay:     25 * time.Minute,
+		Reboot:          true,
+		Reexec:          false,
+		Reproducibility: "eval",
+		Restarts: config.RestartsConfig{
+			CriticalUnits: []string{"sshd.service", "flag-*.service"},
+			Policy:        "prompt",
+		},
+		Rollback: config.RollbackConfig{
+			MagicTimeout:      2 * time.Minute,
+			ConfirmTimeout:    10 * time.Minute,
+			RecoverActivation: false,
+			VerifyFailure:     true,
+		},
+		Rollout: config.RolloutConfig{
+			Percentage:   75,
+			WidenPerHour: 20,
+		},
+		SBOM: config.SBOMConfig{
+			Enable: true,
+			Format: "cyclonedx",
+			Dir:    "/flag/sbom",
+		},
+		Secrets: config.SecretsConfig{
+			Paths: []string{"/run/agenix/*:root", "/run/agenix/wg:systemd-network"},
+		},
+		SecureBoot: config.SecureBootConfig{
+			Verify: true,
+		},
+		Snapshots: config.SnapshotsConfig{
+			ZFSDatasets:     []string{"rpool/flag/persist", "rpool/flag/home"},
+			BtrfsSubvolumes: []string{"/flag/persist", "/flag/home"},
+			Keep:            9,
+		},
+		StallTimeout: time.Hour,
+		StateFile:    "/tmp/nhu/state.json",
+		Switch: config.SwitchConfig{
+			Retries:    4,
+			RetryDelay: 3 * time.Minute,
+		},
+		Verify: config.VerifyConfig{
+			SystemRunning:    true,
+			RunningTimeout:   4 * time.Minute,
+			JournalWindow:    3 * time.Minute,
+			HealthChecks:     true,
+			MaxJournalErrors: 5,
+		},
+		Wait: config.WaitConfig{
+			Enable:   true,
+			Interval: 20 * time.Second,
+			Timeout:  30 * time.Minute,
 		},
-		Reboot: true,
 	}
 )
 
@@ -74,9 +604,133 @@ func TestInitializeConfig(t *testing.T) {
 			panic(err)
 		}
 
+		hostname, err := os.Hostname()
+		if err != nil {
+			panic(err)
+		}
+
+		assert.Equal(t, c.BootCounting.Enable, false)
+		assert.Equal(t, c.BootCounting.Tries, 3)
+		assert.Equal(t, c.BootCounting.ESP, "/boot")
 		assert.Equal(t, c.Debug, false)
+		assert.Equal(t, c.Degraded, "warn")
+		assert.Equal(t, c.InhibitSleep, true)
+		assert.Equal(t, c.IPFamily, "any")
+		assert.Equal(t, c.Kubernetes.Drain, false)
+		assert.Equal(t, c.Kubernetes.Node, hostname)
+		assert.Equal(t, c.Limits.Eval.Nice, 0)
+		assert.Equal(t, c.Limits.Eval.CPUWeight, 0)
+		assert.Equal(t, c.Limits.Eval.IOWeight, 0)
+		assert.Equal(t, c.Limits.Eval.MemoryMax, "")
+		assert.Equal(t, c.Limits.Download.Nice, 0)
+		assert.Equal(t, c.Limits.Download.CPUWeight, 0)
+		assert.Equal(t, c.Limits.Download.IOWeight, 0)
+		assert.Equal(t, c.Limits.Download.MemoryMax, "")
 		assert.Equal(t, c.NixOSRebuild.Operation, "boot")
+		assert.Equal(t, c.RandomDelay, 0)
 		assert.Equal(t, c.Reboot, false)
+		assert.Equal(t, c.Reexec, true)
+		assert.Equal(t, c.EvalFree, false)
+		assert.ArrayEqual(t, c.Executables, []string{})
+		assert.ArrayEqual(t, c.Constraints, []string{})
+		assert.Equal(t, c.Reproducibility, "off")
+		assert.ArrayEqual(t, c.Gates.Inhibitors, []string{})
+		assert.Equal(t, c.Rollout.Percentage, 100)
+		assert.Equal(t, c.Rollout.WidenPerHour, 0)
+		assert.Equal(t, c.SBOM.Enable, false)
+		assert.Equal(t, c.SBOM.Format, "spdx")
+		assert.Equal(t, c.SBOM.Dir, "/var/lib/nixos-hydra-upgrade/sbom")
+		assert.Equal(t, c.Gates.MinUptime, 0*time.Second)
+		assert.Equal(t, c.PendingBoot, "warn")
+		assert.Equal(t, c.StateFile, "/var/lib/nixos-hydra-upgrade/state.json")
+		assert.Equal(t, c.StallTimeout, 30*time.Minute)
+		assert.ArrayEqual(t, c.Gates.BackupUnits, []string{})
+		assert.Equal(t, c.Gates.LibvirtDomains, false)
+		assert.ArrayEqual(t, c.Gates.Containers, []string{})
+		assert.Equal(t, c.Gates.Tailscale, false)
+		assert.ArrayEqual(t, c.Gates.WireGuardInterfaces, []string{})
+		assert.ArrayEqual(t, c.Gates.OverlayPeers, []string{})
+		assert.Equal(t, c.Gates.TimeSync, false)
+		assert.ArrayEqual(t, c.Hooks.Evacuate, []string{})
+		assert.Equal(t, c.HoldFile, "/run/nixos-hydra-upgrade.hold")
+		assert.Equal(t, c.Hostname, hostname)
+		assert.ArrayEqual(t, c.Snapshots.ZFSDatasets, []string{})
+		assert.Equal(t, c.Snapshots.Keep, 5)
+		assert.ArrayEqual(t, c.Snapshots.BtrfsSubvolumes, []string{})
+		assert.Equal(t, c.Rollback.MagicTimeout, 0*time.Second)
+		assert.Equal(t, c.Rollback.ConfirmTimeout, 0*time.Second)
+		assert.Equal(t, c.Rollback.RecoverActivation, true)
+		assert.Equal(t, c.Rollback.VerifyFailure, false)
+		assert.ArrayEqual(t, c.Hydra.AllowedRefs, []string{})
+		assert.ArrayEqual(t, c.Hydra.Fallbacks, []string{})
+		assert.Equal(t, c.Hydra.MaxBuildAge, 0*time.Second)
+		assert.Equal(t, c.Hydra.Freshness, 0*time.Second)
+		assert.Equal(t, c.Hydra.ExpectedOrigin, "")
+		assert.Equal(t, c.Hydra.DiscoveryDomain, "")
+		assert.Equal(t, c.Hydra.Inventory, "")
+		assert.Equal(t, c.Hydra.InventoryFlake, "")
+		assert.Equal(t, c.Hydra.InventoryJob, "hosts.{node}")
+		assert.ArrayEqual(t, c.Hydra.Dependencies, []string{})
+		assert.ArrayEqual(t, c.Hydra.Products, []string{})
+		assert.Equal(t, c.Hydra.ProductsDir, "/var/lib/nixos-hydra-upgrade/products")
+		assert.ArrayEqual(t, c.LogLevels, []string{})
+		assert.Equal(t, c.MaxDownloadMiB, 0)
+		assert.Equal(t, c.MetricsTextfile, "")
+		assert.Equal(t, c.Motd, "")
+		assert.ArrayEqual(t, c.AdvisoryChecks, []string{})
+		assert.Equal(t, c.AllowReleaseChange, false)
+		assert.Equal(t, c.Annotation, "")
+		assert.ArrayEqual(t, c.Restarts.CriticalUnits, []string{"sshd.service", "display-manager.service", "NetworkManager.service", "systemd-networkd.service", "systemd-resolved.service", "wpa_supplicant*.service", "iwd.service"})
+		assert.Equal(t, c.Restarts.Policy, "warn")
+		assert.Equal(t, c.Daemon.Interval, time.Hour)
+		assert.Equal(t, c.Daemon.Socket, "/run/nixos-hydra-upgrade.sock")
+		assert.Equal(t, c.Daemon.Schedule, "")
+		assert.Equal(t, c.Daemon.ActivateSchedule, "")
+		assert.Equal(t, c.Daemon.Timezone, "")
+		assert.Equal(t, c.Daemon.ReadOnlySocket, "")
+		assert.Equal(t, c.Daemon.MaxBackoff, 24*time.Hour)
+		assert.Equal(t, c.Daemon.Jitter, 0)
+		assert.Equal(t, c.Phases.Retries, 0)
+		assert.Equal(t, c.Phases.RetryDelay, 30*time.Second)
+		assert.ArrayEqual(t, c.Hooks.Phase, []string{})
+		assert.Equal(t, c.PluginDir, "")
+		assert.Equal(t, c.PolicyFromFlake, false)
+		assert.ArrayEqual(t, c.HealthCheck.SSHHosts, []string{})
+		assert.ArrayEqual(t, c.HealthCheck.Units, []string{})
+		assert.ArrayEqual(t, c.HealthCheck.Scripts, []string{})
+		assert.Equal(t, c.HealthCheck.ScriptTimeout, time.Minute)
+		assert.Equal(t, len(c.HealthCheck.Canaries), 0)
+		assert.Equal(t, c.HealthCheck.SSHCommand, "")
+		assert.Equal(t, c.Cache.Dir, "/var/cache/nixos-hydra-upgrade")
+		assert.Equal(t, c.Cache.MetadataTTL, 5*time.Minute)
+		assert.Equal(t, c.OfflineCheck, true)
+		assert.Equal(t, c.Fetch.Retries, 2)
+		assert.Equal(t, c.Fetch.RetryDelay, 5*time.Second)
+		assert.Equal(t, c.GCRoot, "/nix/var/nix/gcroots/nixos-hydra-upgrade")
+		assert.ArrayEqual(t, c.Nix.Substituters, []string{})
+		assert.ArrayEqual(t, c.Nix.TrustedPublicKeys, []string{})
+		assert.Equal(t, c.Nix.MaxJobs, "")
+		assert.Equal(t, c.Nix.Cores, 0)
+		assert.Equal(t, c.Nix.NetrcFile, "")
+		assert.Equal(t, c.Nix.PreferChunked, false)
+		assert.ArrayEqual(t, c.Nix.PinnedKeys, []string{})
+		assert.Equal(t, c.Switch.Retries, 0)
+		assert.Equal(t, c.Switch.RetryDelay, time.Minute)
+		assert.ArrayEqual(t, c.Secrets.Paths, []string{})
+		assert.Equal(t, c.SecureBoot.Verify, false)
+		assert.Equal(t, c.Verify.SystemRunning, false)
+		assert.Equal(t, c.Verify.RunningTimeout, 5*time.Minute)
+		assert.Equal(t, c.Verify.JournalWindow, 0*time.Second)
+		assert.Equal(t, c.Verify.HealthChecks, false)
+		assert.Equal(t, c.Verify.MaxJournalErrors, 0)
+		assert.Equal(t, c.Wait.Enable, false)
+		assert.Equal(t, c.Wait.Interval, time.Minute)
+		assert.Equal(t, c.Wait.Timeout, time.Hour)
+		assert.Equal(t, c.FlakeCheck.Enable, false)
+		assert.ArrayEqual(t, c.FlakeCheck.Checks, []string{})
+		assert.Equal(t, c.Approval.Required, false)
+		assert.Equal(t, c.Approval.File, "/var/lib/nixos-hydra-upgrade/approval")
+		assert.Equal(t, c.Approval.AllowedSigners, "")
 	})
 
 	t.Run("initialize config from yaml file", func(t *testing.T) {
@@ -97,29 +751,296 @@ func TestInitializeConfig(t *testing.T) {
 			panic(err)
 		}
 
+		assert.Equal(t, c.BootCounting.Enable, true)
+		assert.Equal(t, c.BootCounting.Tries, 5)
+		assert.Equal(t, c.BootCounting.ESP, "/yaml/boot")
+		assert.Equal(t, c.BootCounting.BlessBoot, "/yaml/systemd-bless-boot")
 		assert.Equal(t, c.Debug, true)
+		assert.Equal(t, c.Degraded, "refuse")
 		assert.ArrayEqual(t, c.HealthCheck.CanaryHosts, []string{"www.example.com"})
+		assert.ArrayEqual(t, c.HealthCheck.SSHHosts, []string{"root@yaml-canary.example.com"})
+		assert.Equal(t, c.HealthCheck.SSHCommand, "systemctl is-active yaml.service")
+		assert.Equal(t, c.HealthCheck.SSHIdentity, "/etc/yaml/id_ed25519")
+		assert.Equal(t, c.HealthCheck.SSHKnownHosts, "/etc/yaml/known_hosts")
+		assert.ArrayEqual(t, c.HealthCheck.Units, []string{"yaml.service"})
+		assert.ArrayEqual(t, c.HealthCheck.Scripts, []string{"curl -sf http://localhost:8080/healthz"})
+		assert.Equal(t, c.HealthCheck.ScriptTimeout, 30*time.Second)
+		assert.ArrayEqual(t, c.HealthCheck.Canaries, []config.CanaryConfig{{
+			Type:    "http",
+			URL:     "https://yaml-canary.example.com/healthz",
+			Status:  204,
+			Body:    "ok",
+			Timeout: 5 * time.Second,
+		}, {
+			Type: "tcp",
+			Host: "yaml-canary.example.com",
+			Port: 22,
+		}})
+		assert.ArrayEqual(t, c.Hooks.PreSwitch, []string{"echo yaml pre-switch"})
+		assert.ArrayEqual(t, c.Hooks.PostSwitch, []string{"echo yaml post-switch"})
+		assert.ArrayEqual(t, c.Hooks.PreReboot, []string{"echo yaml pre-reboot"})
+		assert.ArrayEqual(t, c.Hooks.OnFailure, []string{"echo yaml on-failure"})
+		assert.ArrayEqual(t, c.Hooks.OnRollback, []string{"echo yaml on-rollback"})
 		assert.Equal(t, c.Hydra.Instance, "https://hydra.example.com")
 		assert.Equal(t, c.Hydra.Job, "hosts.yaml")
 		assert.Equal(t, c.Hydra.JobSet, "yaml-branch")
 		assert.Equal(t, c.Hydra.Project, "yaml-config")
+		assert.Equal(t, c.InhibitSleep, false)
+		assert.Equal(t, c.IPFamily, "ipv6")
+		assert.Equal(t, c.Kubernetes.Drain, true)
+		assert.Equal(t, c.Kubernetes.Node, "yaml-node")
+		assert.Equal(t, c.Kubernetes.Kubeconfig, "/etc/yaml/kubeconfig")
+		assert.ArrayEqual(t, c.Kubernetes.DrainArgs, []string{"--timeout=5m"})
+		assert.Equal(t, c.Limits.Eval.Nice, 10)
+		assert.Equal(t, c.Limits.Eval.CPUWeight, 50)
+		assert.Equal(t, c.Limits.Eval.IOWeight, 40)
+		assert.Equal(t, c.Limits.Eval.MemoryMax, "4G")
+		assert.Equal(t, c.Limits.Download.Nice, 19)
+		assert.Equal(t, c.Limits.Download.CPUWeight, 20)
+		assert.Equal(t, c.Limits.Download.IOWeight, 10)
+		assert.Equal(t, c.Limits.Download.MemoryMax, "25%")
 		assert.ArrayEqual(t, c.NixOSRebuild.Args, []string{"--yaml"})
 		assert.Equal(t, c.NixOSRebuild.Host, "yaml")
 		assert.Equal(t, c.NixOSRebuild.Operation, "switch")
+		assert.Equal(t, c.RandomDelay, 15*time.Minute)
 		assert.Equal(t, c.Reboot, true)
+		assert.Equal(t, c.Reexec, false)
+		assert.Equal(t, c.EvalFree, true)
+		assert.ArrayEqual(t, c.Executables, []string{"nix=/nix/var/nix/profiles/default/bin/nix"})
+		assert.ArrayEqual(t, c.Constraints, []string{"system.stateVersion=unchanged"})
+		assert.Equal(t, c.Reproducibility, "eval")
+		assert.ArrayEqual(t, c.Gates.Inhibitors, []string{"shutdown", "sleep"})
+		assert.Equal(t, c.Rollout.Percentage, 25)
+		assert.Equal(t, c.Rollout.WidenPerHour, 5)
+		assert.Equal(t, c.SBOM.Enable, true)
+		assert.Equal(t, c.SBOM.Format, "cyclonedx")
+		assert.Equal(t, c.SBOM.Dir, "/yaml/sbom")
+		assert.Equal(t, c.Gates.MinUptime, 30*time.Minute)
+		assert.Equal(t, c.PendingBoot, "skip")
+		assert.Equal(t, c.StateFile, "/var/lib/nhu/state.json")
+		assert.Equal(t, c.StallTimeout, 10*time.Minute)
+		assert.ArrayEqual(t, c.Gates.BackupUnits, []string{"restic-backups-*.service"})
+		assert.Equal(t, c.Gates.LibvirtDomains, true)
+		assert.ArrayEqual(t, c.Gates.Containers, []string{"yaml-*"})
+		assert.Equal(t, c.Gates.Tailscale, true)
+		assert.ArrayEqual(t, c.Gates.WireGuardInterfaces, []string{"wg0"})
+		assert.ArrayEqual(t, c.Gates.OverlayPeers, []string{"yaml-peer"})
+		assert.Equal(t, c.Gates.TimeSync, true)
+		assert.ArrayEqual(t, c.Hooks.Evacuate, []string{"echo yaml evacuate"})
+		assert.Equal(t, c.HoldFile, "/var/lib/nhu/hold")
+		assert.Equal(t, c.Hostname, "yaml-host")
+		assert.ArrayEqual(t, c.Snapshots.ZFSDatasets, []string{"rpool/safe/persist"})
+		assert.Equal(t, c.Snapshots.Keep, 3)
+		assert.ArrayEqual(t, c.Snapshots.BtrfsSubvolumes, []string{"/persist"})
+		assert.Equal(t, c.Rollback.MagicTimeout, 90*time.Second)
+		assert.Equal(t, c.Rollback.ConfirmTimeout, 15*time.Minute)
+		assert.Equal(t, c.Rollback.RecoverActivation, false)
+		assert.Equal(t, c.Rollback.VerifyFailure, true)
+		assert.ArrayEqual(t, c.Hydra.AllowedRefs, []string{"refs/heads/main"})
+		assert.ArrayEqual(t, c.Hydra.Fallbacks, []string{"yaml-config/stable/hosts.yaml"})
+		assert.Equal(t, c.Hydra.MaxBuildAge, 48*time.Hour)
+		assert.Equal(t, c.Hydra.Freshness, 168*time.Hour)
+		assert.Equal(t, c.Hydra.ExpectedOrigin, "github:example/yaml")
+		assert.Equal(t, c.Hydra.DiscoveryDomain, "yaml.example.com")
+		assert.Equal(t, c.Hydra.Inventory, "colmena")
+		assert.Equal(t, c.Hydra.InventoryFlake, "github:example/yaml")
+		assert.Equal(t, c.Hydra.InventoryJob, "yaml.{node}")
+		assert.ArrayEqual(t, c.Hydra.Dependencies, []string{"overlay=yaml-overlay/main/checks"})
+		assert.ArrayEqual(t, c.Hydra.Products, []string{"*.iso"})
+		assert.Equal(t, c.Hydra.ProductsDir, "/yaml/products")
+		assert.ArrayEqual(t, c.LogLevels, []string{"hydra=debug"})
+		assert.Equal(t, c.MaxDownloadMiB, 2048)
+		assert.Equal(t, c.MetricsTextfile, "/yaml/metrics.prom")
+		assert.Equal(t, c.Motd, "/yaml/motd")
+		assert.ArrayEqual(t, c.AdvisoryChecks, []string{"ssh:*"})
+		assert.Equal(t, c.AllowReleaseChange, true)
+		assert.Equal(t, c.Annotation, "yaml annotation")
+		assert.ArrayEqual(t, c.Restarts.CriticalUnits, []string{"sshd.service"})
+		assert.Equal(t, c.Restarts.Policy, "boot")
+		assert.Equal(t, c.Daemon.Interval, 30*time.Minute)
+		assert.Equal(t, c.Daemon.Socket, "/run/nhu.sock")
+		assert.Equal(t, c.Daemon.Schedule, "0 * * * *")
+		assert.Equal(t, c.Daemon.ActivateSchedule, "0 3 * * sat")
+		assert.Equal(t, c.Daemon.Timezone, "Europe/Helsinki")
+		assert.Equal(t, c.Daemon.ReadOnlySocket, "/run/nhu-ro.sock")
+		assert.Equal(t, c.Daemon.MaxBackoff, 12*time.Hour)
+		assert.Equal(t, c.Daemon.Jitter, 10*time.Minute)
+		assert.Equal(t, c.Phases.Retries, 2)
+		assert.Equal(t, c.Phases.RetryDelay, time.Minute)
+		assert.ArrayEqual(t, c.Hooks.Phase, []string{"echo yaml phase"})
+		assert.Equal(t, c.PluginDir, "/etc/yaml/plugins")
+		assert.Equal(t, c.PolicyFromFlake, true)
+		assert.Equal(t, c.Cache.Dir, "/yaml/cache")
+		assert.Equal(t, c.Cache.MetadataTTL, time.Minute)
+		assert.Equal(t, c.OfflineCheck, false)
+		assert.Equal(t, c.Fetch.Retries, 4)
+		assert.Equal(t, c.Fetch.RetryDelay, time.Second)
+		assert.Equal(t, c.GCRoot, "/etc/yaml/gcroot")
+		assert.ArrayEqual(t, c.Nix.Substituters, []string{"https://cache.yaml.org"})
+		assert.ArrayEqual(t, c.Nix.TrustedPublicKeys, []string{"cache.yaml.org-1:yaml"})
+		assert.Equal(t, c.Nix.MaxJobs, "auto")
+		assert.Equal(t, c.Nix.Cores, 4)
+		assert.Equal(t, c.Nix.NetrcFile, "/etc/yaml/netrc")
+		assert.Equal(t, c.Nix.PreferChunked, true)
+		assert.ArrayEqual(t, c.Nix.PinnedKeys, []string{"hydra.yaml.org-1:yaml"})
+		assert.Equal(t, c.Switch.Retries, 2)
+		assert.Equal(t, c.Switch.RetryDelay, 30*time.Second)
+		assert.ArrayEqual(t, c.Secrets.Paths, []string{"/run/secrets/db:postgres:postgres:0400", "/run/agenix/*"})
+		assert.Equal(t, c.SecureBoot.Verify, true)
+		assert.Equal(t, c.Verify.SystemRunning, true)
+		assert.Equal(t, c.Verify.RunningTimeout, 2*time.Minute)
+		assert.Equal(t, c.Verify.JournalWindow, time.Minute)
+		assert.Equal(t, c.Verify.HealthChecks, true)
+		assert.Equal(t, c.Verify.MaxJournalErrors, 3)
+		assert.Equal(t, c.Wait.Enable, true)
+		assert.Equal(t, c.Wait.Interval, 30*time.Second)
+		assert.Equal(t, c.Wait.Timeout, 2*time.Hour)
+		assert.Equal(t, c.FlakeCheck.Enable, true)
+		assert.ArrayEqual(t, c.FlakeCheck.Checks, []string{"yaml"})
+		assert.Equal(t, c.Approval.Required, true)
+		assert.Equal(t, c.Approval.File, "/yaml/approval")
+		assert.Equal(t, c.Approval.AllowedSigners, "/yaml/allowed_signers")
 	})
 
 	t.Run("initialize config from env", func(t *testing.T) {
+		t.Setenv("NHU_BOOTCOUNTING_ENABLE", strconv.FormatBool(cenv.BootCounting.Enable))
+		t.Setenv("NHU_BOOTCOUNTING_TRIES", strconv.Itoa(cenv.BootCounting.Tries))
+		t.Setenv("NHU_BOOTCOUNTING_ESP", cenv.BootCounting.ESP)
+		t.Setenv("NHU_BOOTCOUNTING_BLESS_BOOT", cenv.BootCounting.BlessBoot)
 		t.Setenv("NHU_DEBUG", strconv.FormatBool(cenv.Debug))
+		t.Setenv("NHU_DEGRADED", cenv.Degraded)
 		t.Setenv("NHU_HEALTHCHECK_CANARYHOSTS", fmt.Sprintf("%v,%v", cenv.HealthCheck.CanaryHosts[0], cenv.HealthCheck.CanaryHosts[1]))
+		t.Setenv("NHU_HEALTHCHECK_SSH_HOSTS", cenv.HealthCheck.SSHHosts[0])
+		t.Setenv("NHU_HEALTHCHECK_SSH_COMMAND", cenv.HealthCheck.SSHCommand)
+		t.Setenv("NHU_HEALTHCHECK_SSH_IDENTITY", cenv.HealthCheck.SSHIdentity)
+		t.Setenv("NHU_HEALTHCHECK_SSH_KNOWN_HOSTS", cenv.HealthCheck.SSHKnownHosts)
+		t.Setenv("NHU_HEALTHCHECK_UNITS", fmt.Sprintf("%v,%v", cenv.HealthCheck.Units[0], cenv.HealthCheck.Units[1]))
+		t.Setenv("NHU_HEALTHCHECK_SCRIPTS", cenv.HealthCheck.Scripts[0])
+		t.Setenv("NHU_HEALTHCHECK_SCRIPT_TIMEOUT", cenv.HealthCheck.ScriptTimeout.String())
+		t.Setenv("NHU_HOOKS_PRE_SWITCH", cenv.Hooks.PreSwitch[0])
+		t.Setenv("NHU_HOOKS_POST_SWITCH", cenv.Hooks.PostSwitch[0])
+		t.Setenv("NHU_HOOKS_PRE_REBOOT", cenv.Hooks.PreReboot[0])
+		t.Setenv("NHU_HOOKS_ON_FAILURE", cenv.Hooks.OnFailure[0])
+		t.Setenv("NHU_HOOKS_ON_ROLLBACK", cenv.Hooks.OnRollback[0])
 		t.Setenv("NHU_HYDRA_INSTANCE", cenv.Hydra.Instance)
 		t.Setenv("NHU_HYDRA_JOBSET", cenv.Hydra.JobSet)
 		t.Setenv("NHU_HYDRA_JOB", cenv.Hydra.Job)
 		t.Setenv("NHU_HYDRA_PROJECT", cenv.Hydra.Project)
+		t.Setenv("NHU_INHIBIT_SLEEP", strconv.FormatBool(cenv.InhibitSleep))
+		t.Setenv("NHU_IP_FAMILY", cenv.IPFamily)
+		t.Setenv("NHU_KUBERNETES_DRAIN", strconv.FormatBool(cenv.Kubernetes.Drain))
+		t.Setenv("NHU_KUBERNETES_NODE", cenv.Kubernetes.Node)
+		t.Setenv("NHU_KUBERNETES_KUBECONFIG", cenv.Kubernetes.Kubeconfig)
+		t.Setenv("NHU_KUBERNETES_DRAIN_ARGS", fmt.Sprintf("%v,%v", cenv.Kubernetes.DrainArgs[0], cenv.Kubernetes.DrainArgs[1]))
+		t.Setenv("NHU_LIMITS_EVAL_NICE", strconv.Itoa(cenv.Limits.Eval.Nice))
+		t.Setenv("NHU_LIMITS_EVAL_CPU_WEIGHT", strconv.Itoa(cenv.Limits.Eval.CPUWeight))
+		t.Setenv("NHU_LIMITS_EVAL_IO_WEIGHT", strconv.Itoa(cenv.Limits.Eval.IOWeight))
+		t.Setenv("NHU_LIMITS_EVAL_MEMORY_MAX", cenv.Limits.Eval.MemoryMax)
+		t.Setenv("NHU_LIMITS_DOWNLOAD_NICE", strconv.Itoa(cenv.Limits.Download.Nice))
+		t.Setenv("NHU_LIMITS_DOWNLOAD_CPU_WEIGHT", strconv.Itoa(cenv.Limits.Download.CPUWeight))
+		t.Setenv("NHU_LIMITS_DOWNLOAD_IO_WEIGHT", strconv.Itoa(cenv.Limits.Download.IOWeight))
+		t.Setenv("NHU_LIMITS_DOWNLOAD_MEMORY_MAX", cenv.Limits.Download.MemoryMax)
 		t.Setenv("NHU_NIXOS_REBUILD_ARGS", fmt.Sprintf("%v,%v", cenv.NixOSRebuild.Args[0], cenv.NixOSRebuild.Args[1]))
 		t.Setenv("NHU_NIXOS_REBUILD_HOST", cenv.NixOSRebuild.Host)
 		t.Setenv("NHU_NIXOS_REBUILD_OPERATION", cenv.NixOSRebuild.Operation)
+		t.Setenv("NHU_RANDOM_DELAY", cenv.RandomDelay.String())
 		t.Setenv("NHU_REBOOT", strconv.FormatBool(cenv.Reboot))
+		t.Setenv("NHU_GATES_INHIBITORS", fmt.Sprintf("%v,%v", cenv.Gates.Inhibitors[0], cenv.Gates.Inhibitors[1]))
+		t.Setenv("NHU_ROLLOUT_PERCENTAGE", strconv.Itoa(cenv.Rollout.Percentage))
+		t.Setenv("NHU_ROLLOUT_WIDEN_PER_HOUR", strconv.Itoa(cenv.Rollout.WidenPerHour))
+		t.Setenv("NHU_SBOM_ENABLE", strconv.FormatBool(cenv.SBOM.Enable))
+		t.Setenv("NHU_SBOM_FORMAT", cenv.SBOM.Format)
+		t.Setenv("NHU_SBOM_DIR", cenv.SBOM.Dir)
+		t.Setenv("NHU_GATES_MIN_UPTIME", cenv.Gates.MinUptime.String())
+		t.Setenv("NHU_PENDING_BOOT", cenv.PendingBoot)
+		t.Setenv("NHU_STATE_FILE", cenv.StateFile)
+		t.Setenv("NHU_STALL_TIMEOUT", cenv.StallTimeout.String())
+		t.Setenv("NHU_GATES_BACKUP_UNITS", fmt.Sprintf("%v,%v", cenv.Gates.BackupUnits[0], cenv.Gates.BackupUnits[1]))
+		t.Setenv("NHU_GATES_LIBVIRT_DOMAINS", strconv.FormatBool(cenv.Gates.LibvirtDomains))
+		t.Setenv("NHU_GATES_CONTAINERS", fmt.Sprintf("%v,%v", cenv.Gates.Containers[0], cenv.Gates.Containers[1]))
+		t.Setenv("NHU_GATES_TAILSCALE", strconv.FormatBool(cenv.Gates.Tailscale))
+		t.Setenv("NHU_GATES_WIREGUARD_INTERFACES", cenv.Gates.WireGuardInterfaces[0])
+		t.Setenv("NHU_GATES_OVERLAY_PEERS", fmt.Sprintf("%v,%v", cenv.Gates.OverlayPeers[0], cenv.Gates.OverlayPeers[1]))
+		t.Setenv("NHU_GATES_TIME_SYNC", strconv.FormatBool(cenv.Gates.TimeSync))
+		t.Setenv("NHU_HOOKS_EVACUATE", cenv.Hooks.Evacuate[0])
+		t.Setenv("NHU_HOOKS_PHASE", cenv.Hooks.Phase[0])
+		t.Setenv("NHU_HOLD_FILE", cenv.HoldFile)
+		t.Setenv("NHU_HOSTNAME", cenv.Hostname)
+		t.Setenv("NHU_SNAPSHOTS_ZFS_DATASETS", fmt.Sprintf("%v,%v", cenv.Snapshots.ZFSDatasets[0], cenv.Snapshots.ZFSDatasets[1]))
+		t.Setenv("NHU_SNAPSHOTS_KEEP", strconv.Itoa(cenv.Snapshots.Keep))
+		t.Setenv("NHU_SNAPSHOTS_BTRFS_SUBVOLUMES", fmt.Sprintf("%v,%v", cenv.Snapshots.BtrfsSubvolumes[0], cenv.Snapshots.BtrfsSubvolumes[1]))
+		t.Setenv("NHU_ROLLBACK_MAGIC_TIMEOUT", cenv.Rollback.MagicTimeout.String())
+		t.Setenv("NHU_ROLLBACK_CONFIRM_TIMEOUT", cenv.Rollback.ConfirmTimeout.String())
+		t.Setenv("NHU_ROLLBACK_RECOVER_ACTIVATION", strconv.FormatBool(cenv.Rollback.RecoverActivation))
+		t.Setenv("NHU_ROLLBACK_VERIFY_FAILURE", strconv.FormatBool(cenv.Rollback.VerifyFailure))
+		t.Setenv("NHU_HYDRA_ALLOWED_REFS", fmt.Sprintf("%v,%v", cenv.Hydra.AllowedRefs[0], cenv.Hydra.AllowedRefs[1]))
+		t.Setenv("NHU_HYDRA_FALLBACKS", cenv.Hydra.Fallbacks[0])
+		t.Setenv("NHU_HYDRA_MAX_BUILD_AGE", cenv.Hydra.MaxBuildAge.String())
+		t.Setenv("NHU_HYDRA_FRESHNESS", cenv.Hydra.Freshness.String())
+		t.Setenv("NHU_HYDRA_EXPECTED_ORIGIN", cenv.Hydra.ExpectedOrigin)
+		t.Setenv("NHU_HYDRA_DISCOVERY_DOMAIN", cenv.Hydra.DiscoveryDomain)
+		t.Setenv("NHU_HYDRA_INVENTORY", cenv.Hydra.Inventory)
+		t.Setenv("NHU_HYDRA_INVENTORY_FLAKE", cenv.Hydra.InventoryFlake)
+		t.Setenv("NHU_HYDRA_INVENTORY_JOB", cenv.Hydra.InventoryJob)
+		t.Setenv("NHU_HYDRA_DEPENDENCIES", cenv.Hydra.Dependencies[0])
+		t.Setenv("NHU_HYDRA_PRODUCTS", cenv.Hydra.Products[0])
+		t.Setenv("NHU_HYDRA_PRODUCTS_DIR", cenv.Hydra.ProductsDir)
+		t.Setenv("NHU_LOG_LEVELS", fmt.Sprintf("%v,%v", cenv.LogLevels[0], cenv.LogLevels[1]))
+		t.Setenv("NHU_MAX_DOWNLOAD_MIB", strconv.Itoa(cenv.MaxDownloadMiB))
+		t.Setenv("NHU_METRICS_TEXTFILE", cenv.MetricsTextfile)
+		t.Setenv("NHU_MOTD", cenv.Motd)
+		t.Setenv("NHU_ADVISORY_CHECKS", fmt.Sprintf("%v,%v", cenv.AdvisoryChecks[0], cenv.AdvisoryChecks[1]))
+		t.Setenv("NHU_ALLOW_RELEASE_CHANGE", strconv.FormatBool(cenv.AllowReleaseChange))
+		t.Setenv("NHU_ANNOTATION", cenv.Annotation)
+		t.Setenv("NHU_RESTARTS_CRITICAL_UNITS", fmt.Sprintf("%v,%v", cenv.Restarts.CriticalUnits[0], cenv.Restarts.CriticalUnits[1]))
+		t.Setenv("NHU_RESTARTS_POLICY", cenv.Restarts.Policy)
+		t.Setenv("NHU_DAEMON_INTERVAL", cenv.Daemon.Interval.String())
+		t.Setenv("NHU_DAEMON_SOCKET", cenv.Daemon.Socket)
+		t.Setenv("NHU_DAEMON_SCHEDULE", cenv.Daemon.Schedule)
+		t.Setenv("NHU_DAEMON_ACTIVATE_SCHEDULE", cenv.Daemon.ActivateSchedule)
+		t.Setenv("NHU_DAEMON_TIMEZONE", cenv.Daemon.Timezone)
+		t.Setenv("NHU_DAEMON_READ_ONLY_SOCKET", cenv.Daemon.ReadOnlySocket)
+		t.Setenv("NHU_DAEMON_MAX_BACKOFF", cenv.Daemon.MaxBackoff.String())
+		t.Setenv("NHU_DAEMON_JITTER", cenv.Daemon.Jitter.String())
+		t.Setenv("NHU_PHASES_RETRIES", strconv.Itoa(cenv.Phases.Retries))
+		t.Setenv("NHU_PHASES_RETRY_DELAY", cenv.Phases.RetryDelay.String())
+		t.Setenv("NHU_PLUGIN_DIR", cenv.PluginDir)
+		t.Setenv("NHU_POLICY_FROM_FLAKE", strconv.FormatBool(cenv.PolicyFromFlake))
+		t.Setenv("NHU_CACHE_DIR", cenv.Cache.Dir)
+		t.Setenv("NHU_CACHE_METADATA_TTL", cenv.Cache.MetadataTTL.String())
+		t.Setenv("NHU_OFFLINE_CHECK", strconv.FormatBool(cenv.OfflineCheck))
+		t.Setenv("NHU_REEXEC", strconv.FormatBool(cenv.Reexec))
+		t.Setenv("NHU_EVAL_FREE", strconv.FormatBool(cenv.EvalFree))
+		t.Setenv("NHU_EXECUTABLES", fmt.Sprintf("%v,%v", cenv.Executables[0], cenv.Executables[1]))
+		t.Setenv("NHU_CONSTRAINTS", fmt.Sprintf("%v,%v", cenv.Constraints[0], cenv.Constraints[1]))
+		t.Setenv("NHU_REPRODUCIBILITY", cenv.Reproducibility)
+		t.Setenv("NHU_FETCH_RETRIES", strconv.Itoa(cenv.Fetch.Retries))
+		t.Setenv("NHU_FETCH_RETRY_DELAY", cenv.Fetch.RetryDelay.String())
+		t.Setenv("NHU_GC_ROOT", cenv.GCRoot)
+		t.Setenv("NHU_NIX_SUBSTITUTERS", fmt.Sprintf("%v,%v", cenv.Nix.Substituters[0], cenv.Nix.Substituters[1]))
+		t.Setenv("NHU_NIX_TRUSTED_PUBLIC_KEYS", cenv.Nix.TrustedPublicKeys[0])
+		t.Setenv("NHU_NIX_MAX_JOBS", cenv.Nix.MaxJobs)
+		t.Setenv("NHU_NIX_CORES", strconv.Itoa(cenv.Nix.Cores))
+		t.Setenv("NHU_NIX_NETRC_FILE", cenv.Nix.NetrcFile)
+		t.Setenv("NHU_NIX_PREFER_CHUNKED", strconv.FormatBool(cenv.Nix.PreferChunked))
+		t.Setenv("NHU_NIX_PINNED_KEYS", cenv.Nix.PinnedKeys[0])
+		t.Setenv("NHU_SWITCH_RETRIES", strconv.Itoa(cenv.Switch.Retries))
+		t.Setenv("NHU_SWITCH_RETRY_DELAY", cenv.Switch.RetryDelay.String())
+		t.Setenv("NHU_SECRETS_PATHS", cenv.Secrets.Paths[0])
+		t.Setenv("NHU_SECURE_BOOT_VERIFY", strconv.FormatBool(cenv.SecureBoot.Verify))
+		t.Setenv("NHU_VERIFY_SYSTEM_RUNNING", strconv.FormatBool(cenv.Verify.SystemRunning))
+		t.Setenv("NHU_VERIFY_RUNNING_TIMEOUT", cenv.Verify.RunningTimeout.String())
+		t.Setenv("NHU_VERIFY_JOURNAL_WINDOW", cenv.Verify.JournalWindow.String())
+		t.Setenv("NHU_VERIFY_HEALTH_CHECKS", strconv.FormatBool(cenv.Verify.HealthChecks))
+		t.Setenv("NHU_VERIFY_MAX_JOURNAL_ERRORS", strconv.Itoa(cenv.Verify.MaxJournalErrors))
+		t.Setenv("NHU_WAIT_ENABLE", strconv.FormatBool(cenv.Wait.Enable))
+		t.Setenv("NHU_WAIT_INTERVAL", cenv.Wait.Interval.String())
+		t.Setenv("NHU_WAIT_TIMEOUT", cenv.Wait.Timeout.String())
+		t.Setenv("NHU_FLAKE_CHECK_ENABLE", strconv.FormatBool(cenv.FlakeCheck.Enable))
+		t.Setenv("NHU_FLAKE_CHECK_CHECKS", cenv.FlakeCheck.Checks[0])
+		t.Setenv("NHU_APPROVAL_REQUIRED", strconv.FormatBool(cenv.Approval.Required))
+		t.Setenv("NHU_APPROVAL_FILE", cenv.Approval.File)
+		t.Setenv("NHU_APPROVAL_ALLOWED_SIGNERS", cenv.Approval.AllowedSigners)
 
 		cmd := cmd.NewRootCmd()
 		c, err := config.InitializeConfig(cmd, []string{})
@@ -127,16 +1048,160 @@ func TestInitializeConfig(t *testing.T) {
 			panic(err)
 		}
 
+		assert.Equal(t, c.BootCounting.Enable, cenv.BootCounting.Enable)
+		assert.Equal(t, c.BootCounting.Tries, cenv.BootCounting.Tries)
+		assert.Equal(t, c.BootCounting.ESP, cenv.BootCounting.ESP)
+		assert.Equal(t, c.BootCounting.BlessBoot, cenv.BootCounting.BlessBoot)
 		assert.Equal(t, c.Debug, cenv.Debug)
+		assert.Equal(t, c.Degraded, cenv.Degraded)
 		assert.ArrayEqual(t, c.HealthCheck.CanaryHosts, cenv.HealthCheck.CanaryHosts)
+		assert.ArrayEqual(t, c.HealthCheck.SSHHosts, cenv.HealthCheck.SSHHosts)
+		assert.Equal(t, c.HealthCheck.SSHCommand, cenv.HealthCheck.SSHCommand)
+		assert.Equal(t, c.HealthCheck.SSHIdentity, cenv.HealthCheck.SSHIdentity)
+		assert.Equal(t, c.HealthCheck.SSHKnownHosts, cenv.HealthCheck.SSHKnownHosts)
+		assert.ArrayEqual(t, c.HealthCheck.Units, cenv.HealthCheck.Units)
+		assert.ArrayEqual(t, c.HealthCheck.Scripts, cenv.HealthCheck.Scripts)
+		assert.Equal(t, c.HealthCheck.ScriptTimeout, cenv.HealthCheck.ScriptTimeout)
+		assert.ArrayEqual(t, c.Hooks.PreSwitch, cenv.Hooks.PreSwitch)
+		assert.ArrayEqual(t, c.Hooks.PostSwitch, cenv.Hooks.PostSwitch)
+		assert.ArrayEqual(t, c.Hooks.PreReboot, cenv.Hooks.PreReboot)
+		assert.ArrayEqual(t, c.Hooks.OnFailure, cenv.Hooks.OnFailure)
+		assert.ArrayEqual(t, c.Hooks.OnRollback, cenv.Hooks.OnRollback)
 		assert.Equal(t, c.Hydra.Instance, cenv.Hydra.Instance)
 		assert.Equal(t, c.Hydra.Job, cenv.Hydra.Job)
 		assert.Equal(t, c.Hydra.JobSet, cenv.Hydra.JobSet)
 		assert.Equal(t, c.Hydra.Project, cenv.Hydra.Project)
+		assert.Equal(t, c.InhibitSleep, cenv.InhibitSleep)
+		assert.Equal(t, c.IPFamily, cenv.IPFamily)
+		assert.Equal(t, c.Kubernetes.Drain, cenv.Kubernetes.Drain)
+		assert.Equal(t, c.Kubernetes.Node, cenv.Kubernetes.Node)
+		assert.Equal(t, c.Kubernetes.Kubeconfig, cenv.Kubernetes.Kubeconfig)
+		assert.ArrayEqual(t, c.Kubernetes.DrainArgs, cenv.Kubernetes.DrainArgs)
+		assert.Equal(t, c.Limits.Eval.Nice, cenv.Limits.Eval.Nice)
+		assert.Equal(t, c.Limits.Eval.CPUWeight, cenv.Limits.Eval.CPUWeight)
+		assert.Equal(t, c.Limits.Eval.IOWeight, cenv.Limits.Eval.IOWeight)
+		assert.Equal(t, c.Limits.Eval.MemoryMax, cenv.Limits.Eval.MemoryMax)
+		assert.Equal(t, c.Limits.Download.Nice, cenv.Limits.Download.Nice)
+		assert.Equal(t, c.Limits.Download.CPUWeight, cenv.Limits.Download.CPUWeight)
+		assert.Equal(t, c.Limits.Download.IOWeight, cenv.Limits.Download.IOWeight)
+		assert.Equal(t, c.Limits.Download.MemoryMax, cenv.Limits.Download.MemoryMax)
 		assert.ArrayEqual(t, c.NixOSRebuild.Args, cenv.NixOSRebuild.Args)
 		assert.Equal(t, c.NixOSRebuild.Host, cenv.NixOSRebuild.Host)
 		assert.Equal(t, c.NixOSRebuild.Operation, cenv.NixOSRebuild.Operation)
+		assert.Equal(t, c.RandomDelay, cenv.RandomDelay)
 		assert.Equal(t, c.Reboot, cenv.Reboot)
+		assert.ArrayEqual(t, c.Gates.Inhibitors, cenv.Gates.Inhibitors)
+		assert.Equal(t, c.Rollout.Percentage, cenv.Rollout.Percentage)
+		assert.Equal(t, c.Rollout.WidenPerHour, cenv.Rollout.WidenPerHour)
+		assert.Equal(t, c.SBOM.Enable, cenv.SBOM.Enable)
+		assert.Equal(t, c.SBOM.Format, cenv.SBOM.Format)
+		assert.Equal(t, c.SBOM.Dir, cenv.SBOM.Dir)
+		assert.Equal(t, c.Gates.MinUptime, cenv.Gates.MinUptime)
+		assert.Equal(t, c.PendingBoot, cenv.PendingBoot)
+		assert.Equal(t, c.StateFile, cenv.StateFile)
+		assert.Equal(t, c.StallTimeout, cenv.StallTimeout)
+		assert.ArrayEqual(t, c.Gates.BackupUnits, cenv.Gates.BackupUnits)
+		assert.Equal(t, c.Gates.LibvirtDomains, cenv.Gates.LibvirtDomains)
+		assert.ArrayEqual(t, c.Gates.Containers, cenv.Gates.Containers)
+		assert.Equal(t, c.Gates.Tailscale, cenv.Gates.Tailscale)
+		assert.ArrayEqual(t, c.Gates.WireGuardInterfaces, cenv.Gates.WireGuardInterfaces)
+		assert.ArrayEqual(t, c.Gates.OverlayPeers, cenv.Gates.OverlayPeers)
+		assert.Equal(t, c.Gates.TimeSync, cenv.Gates.TimeSync)
+		assert.ArrayEqual(t, c.Hooks.Evacuate, cenv.Hooks.Evacuate)
+		assert.ArrayEqual(t, c.Hooks.Phase, cenv.Hooks.Phase)
+		assert.Equal(t, c.HoldFile, cenv.HoldFile)
+		assert.Equal(t, c.Hostname, cenv.Hostname)
+		assert.ArrayEqual(t, c.Snapshots.ZFSDatasets, cenv.Snapshots.ZFSDatasets)
+		assert.Equal(t, c.Snapshots.Keep, cenv.Snapshots.Keep)
+		assert.ArrayEqual(t, c.Snapshots.BtrfsSubvolumes, cenv.Snapshots.BtrfsSubvolumes)
+		assert.Equal(t, c.Rollback.MagicTimeout, cenv.Rollback.MagicTimeout)
+		assert.Equal(t, c.Rollback.ConfirmTimeout, cenv.Rollback.ConfirmTimeout)
+		assert.Equal(t, c.Rollback.RecoverActivation, cenv.Rollback.RecoverActivation)
+		assert.Equal(t, c.Rollback.VerifyFailure, cenv.Rollback.VerifyFailure)
+		assert.ArrayEqual(t, c.Hydra.AllowedRefs, cenv.Hydra.AllowedRefs)
+		assert.ArrayEqual(t, c.Hydra.Fallbacks, cenv.Hydra.Fallbacks)
+		assert.Equal(t, c.Hydra.MaxBuildAge, cenv.Hydra.MaxBuildAge)
+		assert.Equal(t, c.Hydra.Freshness, cenv.Hydra.Freshness)
+		assert.Equal(t, c.Hydra.ExpectedOrigin, cenv.Hydra.ExpectedOrigin)
+		assert.Equal(t, c.Hydra.DiscoveryDomain, cenv.Hydra.DiscoveryDomain)
+		assert.Equal(t, c.Hydra.Inventory, cenv.Hydra.Inventory)
+		assert.Equal(t, c.Hydra.InventoryFlake, cenv.Hydra.InventoryFlake)
+		assert.Equal(t, c.Hydra.InventoryJob, cenv.Hydra.InventoryJob)
+		assert.ArrayEqual(t, c.Hydra.Dependencies, cenv.Hydra.Dependencies)
+		assert.ArrayEqual(t, c.Hydra.Products, cenv.Hydra.Products)
+		assert.Equal(t, c.Hydra.ProductsDir, cenv.Hydra.ProductsDir)
+		assert.ArrayEqual(t, c.LogLevels, cenv.LogLevels)
+		assert.Equal(t, c.MaxDownloadMiB, cenv.MaxDownloadMiB)
+		assert.Equal(t, c.MetricsTextfile, cenv.MetricsTextfile)
+		assert.Equal(t, c.Motd, cenv.Motd)
+		assert.ArrayEqual(t, c.AdvisoryChecks, cenv.AdvisoryChecks)
+		assert.Equal(t, c.AllowReleaseChange, cenv.AllowReleaseChange)
+		assert.Equal(t, c.Annotation, cenv.Annotation)
+		assert.ArrayEqual(t, c.Restarts.CriticalUnits, cenv.Restarts.CriticalUnits)
+		assert.Equal(t, c.Restarts.Policy, cenv.Restarts.Policy)
+		assert.Equal(t, c.Daemon.Interval, cenv.Daemon.Interval)
+		assert.Equal(t, c.Daemon.Socket, cenv.Daemon.Socket)
+		assert.Equal(t, c.Daemon.Schedule, cenv.Daemon.Schedule)
+		assert.Equal(t, c.Daemon.ActivateSchedule, cenv.Daemon.ActivateSchedule)
+		assert.Equal(t, c.Daemon.Timezone, cenv.Daemon.Timezone)
+		assert.Equal(t, c.Daemon.ReadOnlySocket, cenv.Daemon.ReadOnlySocket)
+		assert.Equal(t, c.Daemon.MaxBackoff, cenv.Daemon.MaxBackoff)
+		assert.Equal(t, c.Daemon.Jitter, cenv.Daemon.Jitter)
+		assert.Equal(t, c.Phases.Retries, cenv.Phases.Retries)
+		assert.Equal(t, c.Phases.RetryDelay, cenv.Phases.RetryDelay)
+		assert.Equal(t, c.PluginDir, cenv.PluginDir)
+		assert.Equal(t, c.PolicyFromFlake, cenv.PolicyFromFlake)
+		assert.Equal(t, c.Cache.Dir, cenv.Cache.Dir)
+		assert.Equal(t, c.Cache.MetadataTTL, cenv.Cache.MetadataTTL)
+		assert.Equal(t, c.OfflineCheck, cenv.OfflineCheck)
+		assert.Equal(t, c.Reexec, cenv.Reexec)
+		assert.Equal(t, c.EvalFree, cenv.EvalFree)
+		assert.ArrayEqual(t, c.Executables, cenv.Executables)
+		assert.ArrayEqual(t, c.Constraints, cenv.Constraints)
+		assert.Equal(t, c.Reproducibility, cenv.Reproducibility)
+		assert.Equal(t, c.Fetch.Retries, cenv.Fetch.Retries)
+		assert.Equal(t, c.Fetch.RetryDelay, cenv.Fetch.RetryDelay)
+		assert.Equal(t, c.GCRoot, cenv.GCRoot)
+		assert.ArrayEqual(t, c.Nix.Substituters, cenv.Nix.Substituters)
+		assert.ArrayEqual(t, c.Nix.TrustedPublicKeys, cenv.Nix.TrustedPublicKeys)
+		assert.Equal(t, c.Nix.MaxJobs, cenv.Nix.MaxJobs)
+		assert.Equal(t, c.Nix.Cores, cenv.Nix.Cores)
+		assert.Equal(t, c.Nix.NetrcFile, cenv.Nix.NetrcFile)
+		assert.Equal(t, c.Nix.PreferChunked, cenv.Nix.PreferChunked)
+		assert.ArrayEqual(t, c.Nix.PinnedKeys, cenv.Nix.PinnedKeys)
+		assert.Equal(t, c.Switch.Retries, cenv.Switch.Retries)
+		assert.Equal(t, c.Switch.RetryDelay, cenv.Switch.RetryDelay)
+		assert.ArrayEqual(t, c.Secrets.Paths, cenv.Secrets.Paths)
+		assert.Equal(t, c.SecureBoot.Verify, cenv.SecureBoot.Verify)
+		assert.Equal(t, c.Verify.SystemRunning, cenv.Verify.SystemRunning)
+		assert.Equal(t, c.Verify.RunningTimeout, cenv.Verify.RunningTimeout)
+		assert.Equal(t, c.Verify.JournalWindow, cenv.Verify.JournalWindow)
+		assert.Equal(t, c.Verify.HealthChecks, cenv.Verify.HealthChecks)
+		assert.Equal(t, c.Verify.MaxJournalErrors, cenv.Verify.MaxJournalErrors)
+		assert.Equal(t, c.Wait.Enable, cenv.Wait.Enable)
+		assert.Equal(t, c.Wait.Interval, cenv.Wait.Interval)
+		assert.Equal(t, c.Wait.Timeout, cenv.Wait.Timeout)
+		assert.Equal(t, c.FlakeCheck.Enable, cenv.FlakeCheck.Enable)
+		assert.ArrayEqual(t, c.FlakeCheck.Checks, cenv.FlakeCheck.Checks)
+		assert.Equal(t, c.Approval.Required, cenv.Approval.Required)
+		assert.Equal(t, c.Approval.File, cenv.Approval.File)
+		assert.Equal(t, c.Approval.AllowedSigners, cenv.Approval.AllowedSigners)
+	})
+
+	t.Run("discovers config in the configuration directory", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		err := os.WriteFile(fmt.Sprintf("%v/config.yaml", tmpdir), cyaml, 0600)
+		if err != nil {
+			panic(err)
+		}
+		t.Setenv("CONFIGURATION_DIRECTORY", tmpdir)
+
+		c, err := config.InitializeConfig(cmd.NewRootCmd(), []string{})
+		if err != nil {
+			panic(err)
+		}
+
+		assert.Equal(t, c.Hydra.Instance, "https://hydra.example.com")
 	})
 
 	t.Run("environment variables override yaml config", func(t *testing.T) {
@@ -167,11 +1232,46 @@ func TestInitializeConfig(t *testing.T) {
 	t.Run("initialize config from flags", func(t *testing.T) {
 		cmd := cmd.NewRootCmd()
 		err := cmd.ParseFlags([]string{
+			"--boot-counting",
+			"--boot-tries",
+			strconv.Itoa(cflag.BootCounting.Tries),
+			"--esp",
+			cflag.BootCounting.ESP,
+			"--bless-boot",
+			cflag.BootCounting.BlessBoot,
 			"--debug",
+			"--degraded",
+			cflag.Degraded,
 			"--canary",
 			cflag.HealthCheck.CanaryHosts[0],
 			"--canary",
 			cflag.HealthCheck.CanaryHosts[1],
+			"--canary-ssh",
+			cflag.HealthCheck.SSHHosts[0],
+			"--canary-ssh-command",
+			cflag.HealthCheck.SSHCommand,
+			"--canary-ssh-identity",
+			cflag.HealthCheck.SSHIdentity,
+			"--canary-ssh-known-hosts",
+			cflag.HealthCheck.SSHKnownHosts,
+			"--healthcheck-units",
+			fmt.Sprintf("%v,%v", cflag.HealthCheck.Units[0], cflag.HealthCheck.Units[1]),
+			"--healthcheck-scripts",
+			cflag.HealthCheck.Scripts[0],
+			"--healthcheck-script-timeout",
+			cflag.HealthCheck.ScriptTimeout.String(),
+			"--hook-pre-switch",
+			cflag.Hooks.PreSwitch[0],
+			"--hook-pre-switch",
+			cflag.Hooks.PreSwitch[1],
+			"--hook-post-switch",
+			cflag.Hooks.PostSwitch[0],
+			"--hook-pre-reboot",
+			cflag.Hooks.PreReboot[0],
+			"--hook-on-failure",
+			cflag.Hooks.OnFailure[0],
+			"--hook-on-rollback",
+			cflag.Hooks.OnRollback[0],
 			"--instance",
 			cflag.Hydra.Instance,
 			"--job",
@@ -180,11 +1280,218 @@ func TestInitializeConfig(t *testing.T) {
 			cflag.Hydra.JobSet,
 			"--project",
 			cflag.Hydra.Project,
+			"--inhibit-sleep=false",
+			"--ip-family",
+			cflag.IPFamily,
+			"--k8s-drain",
+			"--k8s-node",
+			cflag.Kubernetes.Node,
+			"--kubeconfig",
+			cflag.Kubernetes.Kubeconfig,
+			"--k8s-drain-args",
+			fmt.Sprintf("%v,%v", cflag.Kubernetes.DrainArgs[0], cflag.Kubernetes.DrainArgs[1]),
+			"--limits-eval-nice",
+			strconv.Itoa(cflag.Limits.Eval.Nice),
+			"--limits-eval-cpu-weight",
+			strconv.Itoa(cflag.Limits.Eval.CPUWeight),
+			"--limits-eval-io-weight",
+			strconv.Itoa(cflag.Limits.Eval.IOWeight),
+			"--limits-eval-memory-max",
+			cflag.Limits.Eval.MemoryMax,
+			"--limits-download-nice",
+			strconv.Itoa(cflag.Limits.Download.Nice),
+			"--limits-download-cpu-weight",
+			strconv.Itoa(cflag.Limits.Download.CPUWeight),
+			"--limits-download-io-weight",
+			strconv.Itoa(cflag.Limits.Download.IOWeight),
+			"--limits-download-memory-max",
+			cflag.Limits.Download.MemoryMax,
 			"--passthru-args",
 			fmt.Sprintf("%v,%v", cflag.NixOSRebuild.Args[0], cflag.NixOSRebuild.Args[1]),
 			"--host",
 			cflag.NixOSRebuild.Host,
+			"--random-delay",
+			cflag.RandomDelay.String(),
 			"--reboot",
+			"--inhibitors",
+			fmt.Sprintf("%v,%v", cflag.Gates.Inhibitors[0], cflag.Gates.Inhibitors[1]),
+			"--rollout-percentage",
+			strconv.Itoa(cflag.Rollout.Percentage),
+			"--rollout-widen-per-hour",
+			strconv.Itoa(cflag.Rollout.WidenPerHour),
+			"--sbom",
+			"--sbom-format",
+			cflag.SBOM.Format,
+			"--sbom-dir",
+			cflag.SBOM.Dir,
+			"--min-uptime",
+			cflag.Gates.MinUptime.String(),
+			"--pending-boot",
+			cflag.PendingBoot,
+			"--state-file",
+			cflag.StateFile,
+			"--stall-timeout",
+			cflag.StallTimeout.String(),
+			"--backup-units",
+			cflag.Gates.BackupUnits[0],
+			"--backup-units",
+			cflag.Gates.BackupUnits[1],
+			"--libvirt-domains",
+			"--containers",
+			fmt.Sprintf("%v,%v", cflag.Gates.Containers[0], cflag.Gates.Containers[1]),
+			"--tailscale-gate",
+			"--wireguard-interfaces",
+			cflag.Gates.WireGuardInterfaces[0],
+			"--overlay-peers",
+			fmt.Sprintf("%v,%v", cflag.Gates.OverlayPeers[0], cflag.Gates.OverlayPeers[1]),
+			"--time-sync",
+			"--hook-evacuate",
+			cflag.Hooks.Evacuate[0],
+			"--hook-phase",
+			cflag.Hooks.Phase[0],
+			"--hold-file",
+			cflag.HoldFile,
+			"--hostname",
+			cflag.Hostname,
+			"--zfs-datasets",
+			fmt.Sprintf("%v,%v", cflag.Snapshots.ZFSDatasets[0], cflag.Snapshots.ZFSDatasets[1]),
+			"--snapshot-keep",
+			strconv.Itoa(cflag.Snapshots.Keep),
+			"--btrfs-subvolumes",
+			fmt.Sprintf("%v,%v", cflag.Snapshots.BtrfsSubvolumes[0], cflag.Snapshots.BtrfsSubvolumes[1]),
+			"--magic-rollback-timeout",
+			cflag.Rollback.MagicTimeout.String(),
+			"--confirm-timeout",
+			cflag.Rollback.ConfirmTimeout.String(),
+			"--recover-activation=false",
+			"--rollback-verify-failure",
+			"--allowed-refs",
+			fmt.Sprintf("%v,%v", cflag.Hydra.AllowedRefs[0], cflag.Hydra.AllowedRefs[1]),
+			"--hydra-fallbacks",
+			fmt.Sprintf("%v,%v", cflag.Hydra.Fallbacks[0], cflag.Hydra.Fallbacks[1]),
+			"--hydra-max-build-age",
+			cflag.Hydra.MaxBuildAge.String(),
+			"--hydra-freshness",
+			cflag.Hydra.Freshness.String(),
+			"--hydra-expected-origin",
+			cflag.Hydra.ExpectedOrigin,
+			"--hydra-discovery-domain",
+			cflag.Hydra.DiscoveryDomain,
+			"--hydra-inventory",
+			cflag.Hydra.Inventory,
+			"--hydra-inventory-flake",
+			cflag.Hydra.InventoryFlake,
+			"--hydra-inventory-job",
+			cflag.Hydra.InventoryJob,
+			"--hydra-dependencies",
+			fmt.Sprintf("%v,%v", cflag.Hydra.Dependencies[0], cflag.Hydra.Dependencies[1]),
+			"--hydra-products",
+			fmt.Sprintf("%v,%v", cflag.Hydra.Products[0], cflag.Hydra.Products[1]),
+			"--hydra-products-dir",
+			cflag.Hydra.ProductsDir,
+			"--log-levels",
+			fmt.Sprintf("%v,%v", cflag.LogLevels[0], cflag.LogLevels[1]),
+			"--max-download-mib",
+			strconv.Itoa(cflag.MaxDownloadMiB),
+			"--metrics-textfile",
+			cflag.MetricsTextfile,
+			"--motd",
+			cflag.Motd,
+			"--advisory-checks",
+			fmt.Sprintf("%v,%v", cflag.AdvisoryChecks[0], cflag.AdvisoryChecks[1]),
+			"--allow-release-change",
+			"--annotation",
+			cflag.Annotation,
+			"--critical-units",
+			fmt.Sprintf("%v,%v", cflag.Restarts.CriticalUnits[0], cflag.Restarts.CriticalUnits[1]),
+			"--critical-restart-policy",
+			cflag.Restarts.Policy,
+			"--daemon-interval",
+			cflag.Daemon.Interval.String(),
+			"--control-socket",
+			cflag.Daemon.Socket,
+			"--daemon-schedule",
+			cflag.Daemon.Schedule,
+			"--daemon-activate-schedule",
+			cflag.Daemon.ActivateSchedule,
+			"--daemon-timezone",
+			cflag.Daemon.Timezone,
+			"--daemon-read-only-socket",
+			cflag.Daemon.ReadOnlySocket,
+			"--daemon-max-backoff",
+			cflag.Daemon.MaxBackoff.String(),
+			"--daemon-jitter",
+			cflag.Daemon.Jitter.String(),
+			"--phase-retries",
+			strconv.Itoa(cflag.Phases.Retries),
+			"--phase-retry-delay",
+			cflag.Phases.RetryDelay.String(),
+			"--plugin-dir",
+			cflag.PluginDir,
+			"--policy-from-flake",
+			"--cache-dir",
+			cflag.Cache.Dir,
+			"--metadata-cache-ttl",
+			cflag.Cache.MetadataTTL.String(),
+			"--offline-check=false",
+			"--reexec=false",
+			"--eval-free",
+			"--executables",
+			fmt.Sprintf("%v,%v", cflag.Executables[0], cflag.Executables[1]),
+			"--constraints",
+			fmt.Sprintf("%v,%v", cflag.Constraints[0], cflag.Constraints[1]),
+			"--reproducibility",
+			cflag.Reproducibility,
+			"--fetch-retries",
+			strconv.Itoa(cflag.Fetch.Retries),
+			"--fetch-retry-delay",
+			cflag.Fetch.RetryDelay.String(),
+			"--gc-root",
+			cflag.GCRoot,
+			"--nix-substituters",
+			cflag.Nix.Substituters[0],
+			"--nix-trusted-public-keys",
+			fmt.Sprintf("%v,%v", cflag.Nix.TrustedPublicKeys[0], cflag.Nix.TrustedPublicKeys[1]),
+			"--nix-max-jobs",
+			cflag.Nix.MaxJobs,
+			"--nix-cores",
+			strconv.Itoa(cflag.Nix.Cores),
+			"--nix-netrc-file",
+			cflag.Nix.NetrcFile,
+			"--nix-prefer-chunked",
+			strconv.FormatBool(cflag.Nix.PreferChunked),
+			"--nix-pinned-keys",
+			fmt.Sprintf("%v,%v", cflag.Nix.PinnedKeys[0], cflag.Nix.PinnedKeys[1]),
+			"--switch-retries",
+			strconv.Itoa(cflag.Switch.Retries),
+			"--switch-retry-delay",
+			cflag.Switch.RetryDelay.String(),
+			"--secrets",
+			fmt.Sprintf("%v,%v", cflag.Secrets.Paths[0], cflag.Secrets.Paths[1]),
+			"--secure-boot-verify",
+			"--verify-system-running",
+			"--verify-running-timeout",
+			cflag.Verify.RunningTimeout.String(),
+			"--verify-journal-window",
+			cflag.Verify.JournalWindow.String(),
+			"--verify-health-checks",
+			"--verify-max-journal-errors",
+			strconv.Itoa(cflag.Verify.MaxJournalErrors),
+			"--wait",
+			"--wait-interval",
+			cflag.Wait.Interval.String(),
+			"--wait-timeout",
+			cflag.Wait.Timeout.String(),
+			"--flake-check",
+			"--flake-check-checks",
+			cflag.FlakeCheck.Checks[0],
+			"--flake-check-checks",
+			cflag.FlakeCheck.Checks[1],
+			"--approval-required",
+			"--approval-file",
+			cflag.Approval.File,
+			"--approval-allowed-signers",
+			cflag.Approval.AllowedSigners,
 		})
 		if err != nil {
 			panic(err)
@@ -194,16 +1501,144 @@ func TestInitializeConfig(t *testing.T) {
 			panic(err)
 		}
 
+		assert.Equal(t, c.BootCounting.Enable, cflag.BootCounting.Enable)
+		assert.Equal(t, c.BootCounting.Tries, cflag.BootCounting.Tries)
+		assert.Equal(t, c.BootCounting.ESP, cflag.BootCounting.ESP)
+		assert.Equal(t, c.BootCounting.BlessBoot, cflag.BootCounting.BlessBoot)
 		assert.Equal(t, c.Debug, cflag.Debug)
+		assert.Equal(t, c.Degraded, cflag.Degraded)
 		assert.ArrayEqual(t, c.HealthCheck.CanaryHosts, cflag.HealthCheck.CanaryHosts)
+		assert.ArrayEqual(t, c.HealthCheck.SSHHosts, cflag.HealthCheck.SSHHosts)
+		assert.Equal(t, c.HealthCheck.SSHCommand, cflag.HealthCheck.SSHCommand)
+		assert.Equal(t, c.HealthCheck.SSHIdentity, cflag.HealthCheck.SSHIdentity)
+		assert.Equal(t, c.HealthCheck.SSHKnownHosts, cflag.HealthCheck.SSHKnownHosts)
+		assert.ArrayEqual(t, c.HealthCheck.Units, cflag.HealthCheck.Units)
+		assert.ArrayEqual(t, c.HealthCheck.Scripts, cflag.HealthCheck.Scripts)
+		assert.Equal(t, c.HealthCheck.ScriptTimeout, cflag.HealthCheck.ScriptTimeout)
+		assert.ArrayEqual(t, c.Hooks.PreSwitch, cflag.Hooks.PreSwitch)
+		assert.ArrayEqual(t, c.Hooks.PostSwitch, cflag.Hooks.PostSwitch)
+		assert.ArrayEqual(t, c.Hooks.PreReboot, cflag.Hooks.PreReboot)
+		assert.ArrayEqual(t, c.Hooks.OnFailure, cflag.Hooks.OnFailure)
+		assert.ArrayEqual(t, c.Hooks.OnRollback, cflag.Hooks.OnRollback)
 		assert.Equal(t, c.Hydra.Instance, cflag.Hydra.Instance)
 		assert.Equal(t, c.Hydra.Job, cflag.Hydra.Job)
 		assert.Equal(t, c.Hydra.JobSet, cflag.Hydra.JobSet)
 		assert.Equal(t, c.Hydra.Project, cflag.Hydra.Project)
+		assert.Equal(t, c.InhibitSleep, cflag.InhibitSleep)
+		assert.Equal(t, c.IPFamily, cflag.IPFamily)
+		assert.Equal(t, c.Kubernetes.Drain, cflag.Kubernetes.Drain)
+		assert.Equal(t, c.Kubernetes.Node, cflag.Kubernetes.Node)
+		assert.Equal(t, c.Kubernetes.Kubeconfig, cflag.Kubernetes.Kubeconfig)
+		assert.ArrayEqual(t, c.Kubernetes.DrainArgs, cflag.Kubernetes.DrainArgs)
+		assert.Equal(t, c.Limits.Eval.Nice, cflag.Limits.Eval.Nice)
+		assert.Equal(t, c.Limits.Eval.CPUWeight, cflag.Limits.Eval.CPUWeight)
+		assert.Equal(t, c.Limits.Eval.IOWeight, cflag.Limits.Eval.IOWeight)
+		assert.Equal(t, c.Limits.Eval.MemoryMax, cflag.Limits.Eval.MemoryMax)
+		assert.Equal(t, c.Limits.Download.Nice, cflag.Limits.Download.Nice)
+		assert.Equal(t, c.Limits.Download.CPUWeight, cflag.Limits.Download.CPUWeight)
+		assert.Equal(t, c.Limits.Download.IOWeight, cflag.Limits.Download.IOWeight)
+		assert.Equal(t, c.Limits.Download.MemoryMax, cflag.Limits.Download.MemoryMax)
 		assert.ArrayEqual(t, c.NixOSRebuild.Args, cflag.NixOSRebuild.Args)
 		assert.Equal(t, c.NixOSRebuild.Host, cflag.NixOSRebuild.Host)
 		assert.Equal(t, c.NixOSRebuild.Operation, cflag.NixOSRebuild.Operation)
+		assert.Equal(t, c.RandomDelay, cflag.RandomDelay)
 		assert.Equal(t, c.Reboot, cflag.Reboot)
+		assert.ArrayEqual(t, c.Gates.Inhibitors, cflag.Gates.Inhibitors)
+		assert.Equal(t, c.Rollout.Percentage, cflag.Rollout.Percentage)
+		assert.Equal(t, c.Rollout.WidenPerHour, cflag.Rollout.WidenPerHour)
+		assert.Equal(t, c.SBOM.Enable, cflag.SBOM.Enable)
+		assert.Equal(t, c.SBOM.Format, cflag.SBOM.Format)
+		assert.Equal(t, c.SBOM.Dir, cflag.SBOM.Dir)
+		assert.Equal(t, c.Gates.MinUptime, cflag.Gates.MinUptime)
+		assert.Equal(t, c.PendingBoot, cflag.PendingBoot)
+		assert.Equal(t, c.StateFile, cflag.StateFile)
+		assert.Equal(t, c.StallTimeout, cflag.StallTimeout)
+		assert.ArrayEqual(t, c.Gates.BackupUnits, cflag.Gates.BackupUnits)
+		assert.Equal(t, c.Gates.LibvirtDomains, cflag.Gates.LibvirtDomains)
+		assert.ArrayEqual(t, c.Gates.Containers, cflag.Gates.Containers)
+		assert.Equal(t, c.Gates.Tailscale, cflag.Gates.Tailscale)
+		assert.ArrayEqual(t, c.Gates.WireGuardInterfaces, cflag.Gates.WireGuardInterfaces)
+		assert.ArrayEqual(t, c.Gates.OverlayPeers, cflag.Gates.OverlayPeers)
+		assert.Equal(t, c.Gates.TimeSync, cflag.Gates.TimeSync)
+		assert.ArrayEqual(t, c.Hooks.Evacuate, cflag.Hooks.Evacuate)
+		assert.ArrayEqual(t, c.Hooks.Phase, cflag.Hooks.Phase)
+		assert.Equal(t, c.HoldFile, cflag.HoldFile)
+		assert.Equal(t, c.Hostname, cflag.Hostname)
+		assert.ArrayEqual(t, c.Snapshots.ZFSDatasets, cflag.Snapshots.ZFSDatasets)
+		assert.Equal(t, c.Snapshots.Keep, cflag.Snapshots.Keep)
+		assert.ArrayEqual(t, c.Snapshots.BtrfsSubvolumes, cflag.Snapshots.BtrfsSubvolumes)
+		assert.Equal(t, c.Rollback.MagicTimeout, cflag.Rollback.MagicTimeout)
+		assert.Equal(t, c.Rollback.ConfirmTimeout, cflag.Rollback.ConfirmTimeout)
+		assert.Equal(t, c.Rollback.RecoverActivation, cflag.Rollback.RecoverActivation)
+		assert.Equal(t, c.Rollback.VerifyFailure, cflag.Rollback.VerifyFailure)
+		assert.ArrayEqual(t, c.Hydra.AllowedRefs, cflag.Hydra.AllowedRefs)
+		assert.ArrayEqual(t, c.Hydra.Fallbacks, cflag.Hydra.Fallbacks)
+		assert.Equal(t, c.Hydra.MaxBuildAge, cflag.Hydra.MaxBuildAge)
+		assert.Equal(t, c.Hydra.Freshness, cflag.Hydra.Freshness)
+		assert.Equal(t, c.Hydra.ExpectedOrigin, cflag.Hydra.ExpectedOrigin)
+		assert.Equal(t, c.Hydra.DiscoveryDomain, cflag.Hydra.DiscoveryDomain)
+		assert.Equal(t, c.Hydra.Inventory, cflag.Hydra.Inventory)
+		assert.Equal(t, c.Hydra.InventoryFlake, cflag.Hydra.InventoryFlake)
+		assert.Equal(t, c.Hydra.InventoryJob, cflag.Hydra.InventoryJob)
+		assert.ArrayEqual(t, c.Hydra.Dependencies, cflag.Hydra.Dependencies)
+		assert.ArrayEqual(t, c.Hydra.Products, cflag.Hydra.Products)
+		assert.Equal(t, c.Hydra.ProductsDir, cflag.Hydra.ProductsDir)
+		assert.ArrayEqual(t, c.LogLevels, cflag.LogLevels)
+		assert.Equal(t, c.MaxDownloadMiB, cflag.MaxDownloadMiB)
+		assert.Equal(t, c.MetricsTextfile, cflag.MetricsTextfile)
+		assert.Equal(t, c.Motd, cflag.Motd)
+		assert.ArrayEqual(t, c.AdvisoryChecks, cflag.AdvisoryChecks)
+		assert.Equal(t, c.AllowReleaseChange, cflag.AllowReleaseChange)
+		assert.Equal(t, c.Annotation, cflag.Annotation)
+		assert.ArrayEqual(t, c.Restarts.CriticalUnits, cflag.Restarts.CriticalUnits)
+		assert.Equal(t, c.Restarts.Policy, cflag.Restarts.Policy)
+		assert.Equal(t, c.Daemon.Interval, cflag.Daemon.Interval)
+		assert.Equal(t, c.Daemon.Socket, cflag.Daemon.Socket)
+		assert.Equal(t, c.Daemon.Schedule, cflag.Daemon.Schedule)
+		assert.Equal(t, c.Daemon.ActivateSchedule, cflag.Daemon.ActivateSchedule)
+		assert.Equal(t, c.Daemon.Timezone, cflag.Daemon.Timezone)
+		assert.Equal(t, c.Daemon.ReadOnlySocket, cflag.Daemon.ReadOnlySocket)
+		assert.Equal(t, c.Daemon.MaxBackoff, cflag.Daemon.MaxBackoff)
+		assert.Equal(t, c.Daemon.Jitter, cflag.Daemon.Jitter)
+		assert.Equal(t, c.Phases.Retries, cflag.Phases.Retries)
+		assert.Equal(t, c.Phases.RetryDelay, cflag.Phases.RetryDelay)
+		assert.Equal(t, c.PluginDir, cflag.PluginDir)
+		assert.Equal(t, c.PolicyFromFlake, cflag.PolicyFromFlake)
+		assert.Equal(t, c.Cache.Dir, cflag.Cache.Dir)
+		assert.Equal(t, c.Cache.MetadataTTL, cflag.Cache.MetadataTTL)
+		assert.Equal(t, c.OfflineCheck, cflag.OfflineCheck)
+		assert.Equal(t, c.Reexec, cflag.Reexec)
+		assert.Equal(t, c.EvalFree, cflag.EvalFree)
+		assert.ArrayEqual(t, c.Executables, cflag.Executables)
+		assert.ArrayEqual(t, c.Constraints, cflag.Constraints)
+		assert.Equal(t, c.Reproducibility, cflag.Reproducibility)
+		assert.Equal(t, c.Fetch.Retries, cflag.Fetch.Retries)
+		assert.Equal(t, c.Fetch.RetryDelay, cflag.Fetch.RetryDelay)
+		assert.Equal(t, c.GCRoot, cflag.GCRoot)
+		assert.ArrayEqual(t, c.Nix.Substituters, cflag.Nix.Substituters)
+		assert.ArrayEqual(t, c.Nix.TrustedPublicKeys, cflag.Nix.TrustedPublicKeys)
+		assert.Equal(t, c.Nix.MaxJobs, cflag.Nix.MaxJobs)
+		assert.Equal(t, c.Nix.Cores, cflag.Nix.Cores)
+		assert.Equal(t, c.Nix.NetrcFile, cflag.Nix.NetrcFile)
+		assert.Equal(t, c.Nix.PreferChunked, cflag.Nix.PreferChunked)
+		assert.ArrayEqual(t, c.Nix.PinnedKeys, cflag.Nix.PinnedKeys)
+		assert.Equal(t, c.Switch.Retries, cflag.Switch.Retries)
+		assert.Equal(t, c.Switch.RetryDelay, cflag.Switch.RetryDelay)
+		assert.ArrayEqual(t, c.Secrets.Paths, cflag.Secrets.Paths)
+		assert.Equal(t, c.SecureBoot.Verify, cflag.SecureBoot.Verify)
+		assert.Equal(t, c.Verify.SystemRunning, cflag.Verify.SystemRunning)
+		assert.Equal(t, c.Verify.RunningTimeout, cflag.Verify.RunningTimeout)
+		assert.Equal(t, c.Verify.JournalWindow, cflag.Verify.JournalWindow)
+		assert.Equal(t, c.Verify.HealthChecks, cflag.Verify.HealthChecks)
+		assert.Equal(t, c.Verify.MaxJournalErrors, cflag.Verify.MaxJournalErrors)
+		assert.Equal(t, c.Wait.Enable, cflag.Wait.Enable)
+		assert.Equal(t, c.Wait.Interval, cflag.Wait.Interval)
+		assert.Equal(t, c.Wait.Timeout, cflag.Wait.Timeout)
+		assert.Equal(t, c.FlakeCheck.Enable, cflag.FlakeCheck.Enable)
+		assert.ArrayEqual(t, c.FlakeCheck.Checks, cflag.FlakeCheck.Checks)
+		assert.Equal(t, c.Approval.Required, cflag.Approval.Required)
+		assert.Equal(t, c.Approval.File, cflag.Approval.File)
+		assert.Equal(t, c.Approval.AllowedSigners, cflag.Approval.AllowedSigners)
 	})
 
 	t.Run("flags override environment variables and yaml config", func(t *testing.T) {
@@ -239,14 +1674,209 @@ func TestInitializeConfig(t *testing.T) {
 		assert.ArrayEqual(t, c.HealthCheck.CanaryHosts, cflag.HealthCheck.CanaryHosts)
 		assert.Equal(t, c.Hydra.Instance, cflag.Hydra.Instance)
 	})
+
+	t.Run("hydra hosts select jobs by hostname", func(t *testing.T) {
+		configFileName := writeHostsConfig(t)
+
+		cmd := cmd.NewRootCmd()
+		err := cmd.ParseFlags([]string{"--config", configFileName})
+		if err != nil {
+			panic(err)
+		}
+		c, err := config.InitializeConfig(cmd, []string{})
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, c.Hydra.Job, "hosts.this")
+		assert.Equal(t, c.Hydra.JobSet, "staging")
+	})
+
+	t.Run("flags override hydra hosts", func(t *testing.T) {
+		configFileName := writeHostsConfig(t)
+
+		cmd := cmd.NewRootCmd()
+		err := cmd.ParseFlags([]string{"--config", configFileName, "--job", "hosts.flag"})
+		if err != nil {
+			panic(err)
+		}
+		c, err := config.InitializeConfig(cmd, []string{})
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, c.Hydra.Job, "hosts.flag")
+		assert.Equal(t, c.Hydra.JobSet, "staging")
+	})
+
+	t.Run("inventory nodes select jobs unless set by flags", func(t *testing.T) {
+		cmd := cmd.NewRootCmd()
+		err := cmd.ParseFlags([]string{"--jobset", "flag"})
+		if err != nil {
+			panic(err)
+		}
+		c, err := config.InitializeConfig(cmd, []string{})
+		if err != nil {
+			panic(err)
+		}
+		c.ApplyHost(cmd, config.HydraHostConfig{Job: "hosts.oak", JobSet: "staging", Host: "oak"})
+		assert.Equal(t, c.Hydra.Job, "hosts.oak")
+		assert.Equal(t, c.Hydra.JobSet, "flag")
+		assert.Equal(t, c.NixOSRebuild.Host, "oak")
+	})
+
+	t.Run("hydra hosts match the hostname override with globs", func(t *testing.T) {
+		configFileName := fmt.Sprintf("%v/config.yaml", t.TempDir())
+		err := os.WriteFile(configFileName, []byte(`hydra:
+  job: hosts.default
+  hosts:
+    web-*:
+      job: hosts.web
+      host: web
+    web-db-*:
+      job: hosts.web-db
+    web-db-1:
+      job: hosts.web-db-1
+`), 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		hosts := map[string]string{
+			"web-2":    "hosts.web",
+			"WEB-DB-2": "hosts.web-db",
+			"web-db-1": "hosts.web-db-1",
+			"mail-1":   "hosts.default",
+		}
+		for hostname, job := range hosts {
+			cmd := cmd.NewRootCmd()
+			err = cmd.ParseFlags([]string{"--config", configFileName, "--hostname", hostname})
+			if err != nil {
+				panic(err)
+			}
+			c, err := config.InitializeConfig(cmd, []string{})
+			if err != nil {
+				panic(err)
+			}
+			assert.Equal(t, c.Hostname, hostname)
+			assert.Equal(t, c.Hydra.Job, job)
+		}
+
+		cmd := cmd.NewRootCmd()
+		err = cmd.ParseFlags([]string{"--config", configFileName, "--hostname", "web-2"})
+		if err != nil {
+			panic(err)
+		}
+		c, err := config.InitializeConfig(cmd, []string{})
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, c.NixOSRebuild.Host, "web")
+		assert.Equal(t, c.Kubernetes.Node, "web-2")
+	})
+}
+
+func TestInitializeConfigWithPolicy(t *testing.T) {
+	configFileName := fmt.Sprintf("%v/config.yaml", t.TempDir())
+	err := os.WriteFile(configFileName, []byte(`reboot: false
+gates:
+  min-uptime: 1h
+  inhibitors:
+    - yaml
+`), 0600)
+	if err != nil {
+		panic(err)
+	}
+	policy, ignored := config.FilterPolicy(map[string]any{
+		"reboot": true,
+		"gates": map[string]any{
+			"min-uptime": "2h",
+		},
+		"max-download-mib": 512,
+		"nixos-rebuild": map[string]any{
+			"host": "policy",
+		},
+		"hydra": map[string]any{},
+	})
+	assert.ArrayEqual(t, ignored, []string{"hydra", "nixos-rebuild"})
+
+	t.Setenv("NHU_MAX_DOWNLOAD_MIB", "128")
+	cmd := cmd.NewRootCmd()
+	err = cmd.ParseFlags([]string{"--config", configFileName})
+	if err != nil {
+		panic(err)
+	}
+	c, err := config.InitializeConfigWithPolicy(cmd, []string{}, policy)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, c.Reboot, true)
+	assert.Equal(t, c.Gates.MinUptime, 2*time.Hour)
+	// merged with the config file, not replacing the whole section
+	assert.ArrayEqual(t, c.Gates.Inhibitors, []string{"yaml"})
+	assert.Equal(t, c.MaxDownloadMiB, 128)
+	assert.Equal(t, c.NixOSRebuild.Host, "")
+}
+
+// Writes a config mapping this host to a hydra job, returning its path.
+func writeHostsConfig(t *testing.T) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		panic(err)
+	}
+	configFileName := fmt.Sprintf("%v/config.yaml", t.TempDir())
+	err = os.WriteFile(configFileName, []byte(fmt.Sprintf(`hydra:
+  jobset: main
+  job: hosts.default
+  hosts:
+    %v:
+      job: hosts.this
+      jobset: staging
+    other-host:
+      job: hosts.other
+`, hostname)), 0600)
+	if err != nil {
+		panic(err)
+	}
+	return configFileName
 }
 
 func cloneConfig(c config.Config) config.Config {
 	c2 := c
 	c2.HealthCheck.CanaryHosts = []string{}
 	c2.HealthCheck.CanaryHosts = append(c2.HealthCheck.CanaryHosts, c.HealthCheck.CanaryHosts...)
+	c2.HealthCheck.SSHHosts = append([]string{}, c.HealthCheck.SSHHosts...)
+	c2.HealthCheck.Units = append([]string{}, c.HealthCheck.Units...)
+	c2.HealthCheck.Scripts = append([]string{}, c.HealthCheck.Scripts...)
+	c2.HealthCheck.Canaries = append([]config.CanaryConfig{}, c.HealthCheck.Canaries...)
 	c2.NixOSRebuild.Args = []string{}
 	c2.NixOSRebuild.Args = append(c2.NixOSRebuild.Args, c.NixOSRebuild.Args...)
+	c2.Hooks.PreSwitch = append([]string{}, c.Hooks.PreSwitch...)
+	c2.Hooks.PostSwitch = append([]string{}, c.Hooks.PostSwitch...)
+	c2.Hooks.PreReboot = append([]string{}, c.Hooks.PreReboot...)
+	c2.Hooks.OnFailure = append([]string{}, c.Hooks.OnFailure...)
+	c2.Hooks.OnRollback = append([]string{}, c.Hooks.OnRollback...)
+	c2.Kubernetes.DrainArgs = append([]string{}, c.Kubernetes.DrainArgs...)
+	c2.Gates.Inhibitors = append([]string{}, c.Gates.Inhibitors...)
+	c2.Gates.BackupUnits = append([]string{}, c.Gates.BackupUnits...)
+	c2.Gates.Containers = append([]string{}, c.Gates.Containers...)
+	c2.Gates.WireGuardInterfaces = append([]string{}, c.Gates.WireGuardInterfaces...)
+	c2.Gates.OverlayPeers = append([]string{}, c.Gates.OverlayPeers...)
+	c2.Hooks.Evacuate = append([]string{}, c.Hooks.Evacuate...)
+	c2.Hooks.Phase = append([]string{}, c.Hooks.Phase...)
+	c2.Snapshots.ZFSDatasets = append([]string{}, c.Snapshots.ZFSDatasets...)
+	c2.Snapshots.BtrfsSubvolumes = append([]string{}, c.Snapshots.BtrfsSubvolumes...)
+	c2.Hydra.AllowedRefs = append([]string{}, c.Hydra.AllowedRefs...)
+	c2.Hydra.Fallbacks = append([]string{}, c.Hydra.Fallbacks...)
+	c2.Hydra.Dependencies = append([]string{}, c.Hydra.Dependencies...)
+	c2.Hydra.Products = append([]string{}, c.Hydra.Products...)
+	c2.Restarts.CriticalUnits = append([]string{}, c.Restarts.CriticalUnits...)
+	c2.Nix.Substituters = append([]string{}, c.Nix.Substituters...)
+	c2.Nix.TrustedPublicKeys = append([]string{}, c.Nix.TrustedPublicKeys...)
+	c2.Nix.PinnedKeys = append([]string{}, c.Nix.PinnedKeys...)
+	c2.Secrets.Paths = append([]string{}, c.Secrets.Paths...)
+	c2.LogLevels = append([]string{}, c.LogLevels...)
+	c2.AdvisoryChecks = append([]string{}, c.AdvisoryChecks...)
+	c2.Executables = append([]string{}, c.Executables...)
+	c2.Constraints = append([]string{}, c.Constraints...)
 
 	return c2
 }
@@ -260,10 +1890,50 @@ func TestValidate(t *testing.T) {
 		}
 	})
 
+	t.Run("hydra.discovery-domain replaces hydra.instance", func(t *testing.T) {
+		c := cloneConfig(cenv)
+		c.Hydra.Instance = ""
+		err := c.Validate()
+
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
 	t.Run("required config passes validation without errors", func(t *testing.T) {
 		c := cloneConfig(cenv)
 		c.HealthCheck.CanaryHosts = []string{}
+		c.HealthCheck.SSHHosts = []string{}
 		c.NixOSRebuild.Args = []string{}
+		c.Hooks = config.HooksConfig{
+			PreSwitch:  []string{},
+			PostSwitch: []string{},
+			PreReboot:  []string{},
+			OnFailure:  []string{},
+			OnRollback: []string{},
+			Evacuate:   []string{},
+			Phase:      []string{},
+		}
+		c.Kubernetes = config.KubernetesConfig{
+			DrainArgs: []string{},
+		}
+		c.Gates.Inhibitors = []string{}
+		c.Gates.BackupUnits = []string{}
+		c.Gates.Containers = []string{}
+		c.Gates.WireGuardInterfaces = []string{}
+		c.Gates.OverlayPeers = []string{}
+		c.Snapshots.ZFSDatasets = []string{}
+		c.Snapshots.BtrfsSubvolumes = []string{}
+		c.Hydra.AllowedRefs = []string{}
+		c.Hydra.Fallbacks = []string{}
+		c.Hydra.Dependencies = []string{}
+		c.Hydra.Products = []string{}
+		c.Restarts.CriticalUnits = []string{}
+		c.Nix.Substituters = []string{}
+		c.Nix.TrustedPublicKeys = []string{}
+		c.Nix.PinnedKeys = []string{}
+		c.Secrets.Paths = []string{}
+		c.Approval.AllowedSigners = ""
 
 		err := c.Validate()
 
@@ -273,18 +1943,35 @@ func TestValidate(t *testing.T) {
 	})
 
 	// bad configurations
+	zeroTries := cloneConfig(cenv)
+	zeroTries.BootCounting.Tries = 0
+	emptyESP := cloneConfig(cenv)
+	emptyESP.BootCounting.ESP = ""
 	emptyCanary := cloneConfig(cenv)
 	emptyCanary.HealthCheck.CanaryHosts = []string{""}
+	emptyHook := cloneConfig(cenv)
+	emptyHook.Hooks.PreSwitch = []string{""}
 	nonUrlInstance := cloneConfig(cenv)
 	nonUrlInstance.Hydra.Instance = "asdf"
 	emptyInstance := cloneConfig(cenv)
 	emptyInstance.Hydra.Instance = ""
+	emptyInstance.Hydra.DiscoveryDomain = ""
 	emptyJob := cloneConfig(cenv)
 	emptyJob.Hydra.Job = ""
 	emptyJobSet := cloneConfig(cenv)
 	emptyJobSet.Hydra.JobSet = ""
 	emptyProject := cloneConfig(cenv)
 	emptyProject.Hydra.Project = ""
+	emptyNode := cloneConfig(cenv)
+	emptyNode.Kubernetes.Node = ""
+	emptyDrainArg := cloneConfig(cenv)
+	emptyDrainArg.Kubernetes.DrainArgs = []string{""}
+	highNice := cloneConfig(cenv)
+	highNice.Limits.Eval.Nice = 20
+	highWeight := cloneConfig(cenv)
+	highWeight.Limits.Download.IOWeight = 10001
+	badMemoryMax := cloneConfig(cenv)
+	badMemoryMax.Limits.Download.MemoryMax = "lots"
 	emptyOperation := cloneConfig(cenv)
 	emptyOperation.NixOSRebuild.Operation = ""
 	badOperation := cloneConfig(cenv)
@@ -293,21 +1980,176 @@ func TestValidate(t *testing.T) {
 	emptyHost.NixOSRebuild.Host = ""
 	emptyArg := cloneConfig(cenv)
 	emptyArg.NixOSRebuild.Args = []string{""}
+	badInhibitor := cloneConfig(cenv)
+	badInhibitor.Gates.Inhibitors = []string{"invalid"}
+	badPercentage := cloneConfig(cenv)
+	badPercentage.Rollout.Percentage = 101
+	negativeWiden := cloneConfig(cenv)
+	negativeWiden.Rollout.WidenPerHour = -1
+	badSBOMFormat := cloneConfig(cenv)
+	badSBOMFormat.SBOM.Format = "csv"
+	negativeUptime := cloneConfig(cenv)
+	negativeUptime.Gates.MinUptime = -time.Minute
+	badDegraded := cloneConfig(cenv)
+	badDegraded.Degraded = "invalid"
+	badReproducibility := cloneConfig(cenv)
+	badReproducibility.Reproducibility = "invalid"
+	badIPFamily := cloneConfig(cenv)
+	badIPFamily.IPFamily = "invalid"
+	badPendingBoot := cloneConfig(cenv)
+	badPendingBoot.PendingBoot = "invalid"
+	emptyStateFile := cloneConfig(cenv)
+	emptyStateFile.StateFile = ""
+	negativeStallTimeout := cloneConfig(cenv)
+	negativeStallTimeout.StallTimeout = -time.Second
+	emptyHoldFile := cloneConfig(cenv)
+	emptyHoldFile.HoldFile = ""
+	badHostsGlob := cloneConfig(cenv)
+	badHostsGlob.Hydra.Hosts = map[string]config.HydraHostConfig{"web-[": {Job: "hosts.web"}}
+	badInventory := cloneConfig(cenv)
+	badInventory.Hydra.Inventory = "ansible"
+	missingInventoryFlake := cloneConfig(cenv)
+	missingInventoryFlake.Hydra.InventoryFlake = ""
+	negativeKeep := cloneConfig(cenv)
+	negativeKeep.Snapshots.Keep = -1
+	negativeMagicTimeout := cloneConfig(cenv)
+	negativeMagicTimeout.Rollback.MagicTimeout = -time.Second
+	negativeJitter := cloneConfig(cenv)
+	negativeJitter.Daemon.Jitter = -time.Second
+	negativeConfirmTimeout := cloneConfig(cenv)
+	negativeConfirmTimeout.Rollback.ConfirmTimeout = -time.Second
+	negativeMaxDownload := cloneConfig(cenv)
+	negativeMaxDownload.MaxDownloadMiB = -1
+	badLogLevel := cloneConfig(cenv)
+	badLogLevel.LogLevels = []string{"hydra=loud"}
+	badAdvisoryCheck := cloneConfig(cenv)
+	badAdvisoryCheck.AdvisoryChecks = []string{"ping:["}
+	badCanaryType := cloneConfig(cenv)
+	badCanaryType.HealthCheck.Canaries[0].Type = "gopher"
+	missingCanaryURL := cloneConfig(cenv)
+	missingCanaryURL.HealthCheck.Canaries[0].URL = ""
+	badCanaryBody := cloneConfig(cenv)
+	badCanaryBody.HealthCheck.Canaries[0].Body = "ok("
+	emptyUnit := cloneConfig(cenv)
+	emptyUnit.HealthCheck.Units = []string{""}
+	emptyScript := cloneConfig(cenv)
+	emptyScript.HealthCheck.Scripts = []string{""}
+	zeroScriptTimeout := cloneConfig(cenv)
+	zeroScriptTimeout.HealthCheck.ScriptTimeout = 0
+	missingCanaryPort := cloneConfig(cenv)
+	missingCanaryPort.HealthCheck.Canaries[1].Port = 0
+	badCanaryPort := cloneConfig(cenv)
+	badCanaryPort.HealthCheck.Canaries[1].Port = 65536
+	relativeExecutable := cloneConfig(cenv)
+	relativeExecutable.Executables = []string{"nix=bin/nix"}
+	badConstraintRule := cloneConfig(cenv)
+	badConstraintRule.Constraints = []string{"system.stateVersion=newer"}
+	negativeMaxBuildAge := cloneConfig(cenv)
+	negativeMaxBuildAge.Hydra.MaxBuildAge = -time.Hour
+	negativeFreshness := cloneConfig(cenv)
+	negativeFreshness.Hydra.Freshness = -time.Hour
+	badRestartPolicy := cloneConfig(cenv)
+	badRestartPolicy.Restarts.Policy = "invalid"
+	zeroDaemonInterval := cloneConfig(cenv)
+	zeroDaemonInterval.Daemon.Interval = 0
+	emptyDaemonSocket := cloneConfig(cenv)
+	emptyDaemonSocket.Daemon.Socket = ""
+	negativePhaseRetries := cloneConfig(cenv)
+	negativePhaseRetries.Phases.Retries = -1
+	emptyCacheDir := cloneConfig(cenv)
+	emptyCacheDir.Cache.Dir = ""
+	negativeMetadataTTL := cloneConfig(cenv)
+	negativeMetadataTTL.Cache.MetadataTTL = -time.Minute
+	negativeFetchRetries := cloneConfig(cenv)
+	negativeFetchRetries.Fetch.Retries = -1
+	badMaxJobs := cloneConfig(cenv)
+	badMaxJobs.Nix.MaxJobs = "many"
+	negativeCores := cloneConfig(cenv)
+	negativeCores.Nix.Cores = -1
+	negativeSwitchRetries := cloneConfig(cenv)
+	negativeSwitchRetries.Switch.Retries = -1
+	emptySecret := cloneConfig(cenv)
+	emptySecret.Secrets.Paths = []string{""}
+	zeroRunningTimeout := cloneConfig(cenv)
+	zeroRunningTimeout.Verify.RunningTimeout = 0
+	negativeJournalErrors := cloneConfig(cenv)
+	negativeJournalErrors.Verify.MaxJournalErrors = -1
+	zeroWaitInterval := cloneConfig(cenv)
+	zeroWaitInterval.Wait.Interval = 0
+	emptyApprovalFile := cloneConfig(cenv)
+	emptyApprovalFile.Approval.File = ""
 
 	var validationFailureTests = []struct {
 		description string
 		conf        config.Config
 	}{
+		{"zero BootCounting.Tries", zeroTries},
+		{"empty BootCounting.ESP", emptyESP},
 		{"empty HealthCheck.CanaryHosts string", emptyCanary},
+		{"empty Hooks.PreSwitch string", emptyHook},
 		{"non-url Hydra.Instance", nonUrlInstance},
 		{"empty Hydra.Instance", emptyInstance},
 		{"empty Hydra.Job", emptyJob},
 		{"empty Hydra.JobSet", emptyJobSet},
 		{"empty Hydra.Project", emptyProject},
+		{"empty Kubernetes.Node with Kubernetes.Drain", emptyNode},
+		{"empty Kubernetes.DrainArgs string", emptyDrainArg},
+		{"Limits.Eval.Nice above 19", highNice},
+		{"Limits.Download.IOWeight above 10000", highWeight},
+		{"bad Limits.Download.MemoryMax", badMemoryMax},
 		{"empty NixOSRebuild.Operation", emptyOperation},
 		{"invalid NixOSRebuild.Operation", badOperation},
 		{"empty NixOSRebuild.Host", emptyHost},
 		{"empty NixOSRebuild.Args string", emptyArg},
+		{"invalid Gates.Inhibitors type", badInhibitor},
+		{"out of range Rollout.Percentage", badPercentage},
+		{"negative Rollout.WidenPerHour", negativeWiden},
+		{"invalid SBOM.Format", badSBOMFormat},
+		{"negative Gates.MinUptime", negativeUptime},
+		{"invalid Degraded", badDegraded},
+		{"invalid Reproducibility", badReproducibility},
+		{"invalid IPFamily", badIPFamily},
+		{"invalid PendingBoot", badPendingBoot},
+		{"empty StateFile", emptyStateFile},
+		{"negative StallTimeout", negativeStallTimeout},
+		{"empty HoldFile", emptyHoldFile},
+		{"bad Hydra.Hosts glob", badHostsGlob},
+		{"invalid Hydra.Inventory", badInventory},
+		{"missing Hydra.InventoryFlake", missingInventoryFlake},
+		{"negative Snapshots.Keep", negativeKeep},
+		{"negative Rollback.MagicTimeout", negativeMagicTimeout},
+		{"negative Daemon.Jitter", negativeJitter},
+		{"negative Rollback.ConfirmTimeout", negativeConfirmTimeout},
+		{"negative MaxDownloadMiB", negativeMaxDownload},
+		{"invalid LogLevels", badLogLevel},
+		{"invalid AdvisoryChecks", badAdvisoryCheck},
+		{"relative Executables", relativeExecutable},
+		{"invalid Constraints rule", badConstraintRule},
+		{"invalid HealthCheck.Canaries.Type", badCanaryType},
+		{"missing HealthCheck.Canaries.URL", missingCanaryURL},
+		{"invalid HealthCheck.Canaries.Body", badCanaryBody},
+		{"empty HealthCheck.Units string", emptyUnit},
+		{"empty HealthCheck.Scripts string", emptyScript},
+		{"zero HealthCheck.ScriptTimeout", zeroScriptTimeout},
+		{"missing HealthCheck.Canaries.Port", missingCanaryPort},
+		{"invalid HealthCheck.Canaries.Port", badCanaryPort},
+		{"negative Hydra.MaxBuildAge", negativeMaxBuildAge},
+		{"negative Hydra.Freshness", negativeFreshness},
+		{"invalid Restarts.Policy", badRestartPolicy},
+		{"zero Daemon.Interval", zeroDaemonInterval},
+		{"empty Daemon.Socket", emptyDaemonSocket},
+		{"negative Phases.Retries", negativePhaseRetries},
+		{"empty Cache.Dir", emptyCacheDir},
+		{"negative Cache.MetadataTTL", negativeMetadataTTL},
+		{"negative Fetch.Retries", negativeFetchRetries},
+		{"invalid Nix.MaxJobs", badMaxJobs},
+		{"negative Nix.Cores", negativeCores},
+		{"negative Switch.Retries", negativeSwitchRetries},
+		{"empty Secrets.Paths entry", emptySecret},
+		{"zero Verify.RunningTimeout", zeroRunningTimeout},
+		{"negative Verify.MaxJournalErrors", negativeJournalErrors},
+		{"zero Wait.Interval", zeroWaitInterval},
+		{"empty Approval.File", emptyApprovalFile},
 	}
 
 	for _, test := range validationFailureTests {
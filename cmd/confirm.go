@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hooks"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/plugins"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/rollback"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+	"github.com/spf13/cobra"
+)
+
+// confirmCmd represents the confirm command
+func NewConfirmCommand() *cobra.Command {
+	confirmCommand := &cobra.Command{
+		Use:   "confirm",
+		Short: "Confirms a successful boot or switch upgrade",
+		Long: `Confirms a successful boot following a boot upgrade. Intended to run from a systemd unit once the system has booted.
+
+If a switch armed an automatic rollback (rollback.confirm-timeout), the rollback is disarmed and the switched generation is kept instead. Run this manually or from post-switch hooks once the new generation is known to work.
+
+Before keeping a switched or booted generation, the post-switch checks (verify.*, secrets.paths) run. When they fail, a switch is left to roll back and a boot isn't marked good, so boot counting falls back once its attempts are used up, and on-failure hooks run with OUTCOME=verify-failed.
+
+If the staged generation was booted, the boot is marked good when boot counting is enabled. An upgrade that rebooted into it is then recorded as completed in state-file, shown by status, and notify plugins are sent its success. If boot counting exhausted the staged generation's boot attempts and systemd-boot fell back to a previous generation, the fallback is reported and on-failure hooks are run.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			err := initConfig(cmd, args)
+			if err != nil {
+				return err
+			}
+			return requireRoot("confirm")
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			guard := rollback.Guard{}
+			if guard.Armed(cmd.Context()) {
+				err := verify(cmd.Context())
+				if err != nil {
+					slog.Error("Switched generation failed verification, leaving rollback armed.", slog.String("error", err.Error()))
+					// best effort, the rollback is still triggered without them
+					current, _ := nix.SystemPath(nix.CurrentSystem)
+					previous, targetErr := guard.Target(cmd.Context())
+					if targetErr != nil {
+						slog.Warn("Unable to determine rollback generation.", slog.String("error", targetErr.Error()))
+					}
+					return rollingBack(cmd.Context(), hooks.Env{Operation: "switch"}, upgrade.OutcomeVerifyFailed, current, previous, err)
+				}
+				err = guard.Disarm(cmd.Context())
+				if err != nil {
+					slog.Error("Disarming rollback failed.", slog.String("error", err.Error()))
+					return err
+				}
+				slog.Info("Switch confirmed, rollback disarmed.")
+				return nil
+			}
+
+			booted, err := nix.SystemPath(nix.BootedSystem)
+			if err != nil {
+				slog.Error("Unable to resolve booted system.", slog.String("error", err.Error()))
+				return err
+			}
+			staged, err := nix.SystemPath(nix.SystemProfile)
+			if err != nil {
+				slog.Error("Unable to resolve system profile.", slog.String("error", err.Error()))
+				return err
+			}
+
+			if booted != staged {
+				generation, err := nix.SystemGeneration()
+				if err != nil {
+					slog.Error("Unable to determine staged generation.", slog.String("error", err.Error()))
+					return err
+				}
+				exhausted := false
+				if conf.BootCounting.Enable {
+					exhausted, err = systemdBoot().Exhausted(generation)
+					if err != nil {
+						slog.Error("Unable to read boot entries.", slog.String("error", err.Error()))
+						return err
+					}
+				}
+				if !exhausted {
+					slog.Info("Staged generation has not been booted.", slog.Int("generation", generation))
+					return nil
+				}
+
+				slog.Error("Staged generation failed to boot, fell back to a previous generation.",
+					slog.Int("generation", generation),
+					slog.String("booted", booted),
+					slog.String("staged", staged))
+				// keep booting the working fallback
+				err = systemdBoot().MarkGood()
+				if err != nil {
+					slog.Error("Marking boot good failed.", slog.String("error", err.Error()))
+				}
+				return rollingBack(cmd.Context(), hooks.Env{Operation: "boot"}, upgrade.OutcomeBootFallback, staged, booted,
+					fmt.Errorf("generation %d failed to boot", generation))
+			}
+
+			err = verify(cmd.Context())
+			if err != nil {
+				slog.Error("Booted generation failed verification.", slog.String("error", err.Error()))
+				return fail(cmd.Context(), hooks.Env{Operation: "boot"}, upgrade.OutcomeVerifyFailed, err)
+			}
+			if conf.BootCounting.Enable {
+				err = systemdBoot().MarkGood()
+				if err != nil {
+					slog.Error("Marking boot good failed.", slog.String("error", err.Error()))
+					return err
+				}
+			}
+			uncordon(cmd.Context())
+			slog.Info("Boot confirmed.", slog.String("system", booted))
+			completeUpgrade(cmd.Context(), booted)
+			return nil
+		},
+	}
+
+	return confirmCommand
+}
+
+/*
+Completes the upgrade in progress in the state file when it rebooted into
+`booted`, recording it and notifying plugins. Failures are only logged, the
+boot is already confirmed.
+*/
+func completeUpgrade(ctx context.Context, booted string) {
+	lock, err := state.Acquire(conf.StateFile)
+	if err != nil {
+		slog.Warn("Unable to lock upgrade state.", slog.String("error", err.Error()))
+		return
+	}
+	defer lock.Unlock()
+	upgradeState, err := state.Load(conf.StateFile)
+	if err != nil {
+		slog.Warn("Unable to load upgrade state.", slog.String("error", err.Error()))
+		return
+	}
+	run := upgradeState.Run
+	if run == nil || run.Phase != state.PhaseRebooted || run.Toplevel != booted {
+		return
+	}
+	upgradeState.Complete(time.Now())
+	err = upgradeState.Save(conf.StateFile)
+	if err != nil {
+		slog.Warn("Unable to record completed upgrade.", slog.String("error", err.Error()))
+	}
+	slog.Info("Upgrade complete after reboot.", slog.Int("buildid", run.BuildID))
+
+	if conf.PluginDir == "" {
+		return
+	}
+	found, err := plugins.Discover(conf.PluginDir)
+	if err != nil {
+		slog.Error("Unable to load plugins.", slog.String("dir", conf.PluginDir), slog.String("error", err.Error()))
+	}
+	plugins.Notify(ctx, found, plugins.Request{
+		Point:      plugins.PointNotify,
+		Operation:  run.Operation,
+		BuildID:    run.BuildID,
+		Flake:      run.Flake,
+		Outcome:    string(upgrade.OutcomeSuccess),
+		Rebooted:   true,
+		Annotation: run.Annotation,
+	})
+}
+
+// Runs the post-switch checks against the running system.
+func verify(ctx context.Context) error {
+	for _, checker := range postChecks() {
+		err := checker.Check(ctx, upgrade.Target{})
+		var advisory *upgrade.AdvisoryError
+		if errors.As(err, &advisory) {
+			slog.Warn("Advisory check failed.", slog.String("check", advisory.Name), slog.String("error", advisory.Err.Error()))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/control"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/schedule"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+	"github.com/spf13/cobra"
+)
+
+// control.Daemon performing upgrades with `conf`.
+type daemon struct {
+	// receives upgrade events in addition to the usual sinks
+	sink events.Sink
+	// failures of regular runs, backing them off
+	backoff *schedule.Backoff
+	/*
+		failures of runs activating upgrades when daemon.activate-schedule is
+		set. Kept apart so failed activations don't delay regular runs
+		fetching the next build, nil otherwise
+	*/
+	activations *schedule.Backoff
+}
+
+func (d daemon) Run(ctx context.Context, request control.Request) (upgrade.Outcome, error) {
+	opts := upgradeOptions()
+	opts.Check = request.Check
+	opts.Prefetch = request.Prefetch
+	// scheduled runs aren't annotated, the configured annotation is for single runs
+	opts.Annotation = request.Annotation
+	// the next poll finds unfinished builds once they finish, without holding up the control API
+	opts.Wait = 0
+	// polls mostly find the build they found last time
+	opts.SkipSettled = true
+	opts.Sinks = append(opts.Sinks, d.sink)
+	backoff := d.backoff
+	if d.activations != nil && !request.Check && !request.Prefetch {
+		backoff = d.activations
+	}
+	opts.PreviousFailure, opts.PreviousFailures = backoff.Previous()
+	outcome, err := upgrade.Run(ctx, opts)
+	backoff.Record(outcome)
+	return outcome, err
+}
+
+func (daemon) Hold(reason string) error {
+	return holdUpgrades(reason)
+}
+
+func (daemon) Unhold() error {
+	return releaseHold()
+}
+
+func (daemon) Approve(buildID int) error {
+	if conf.Approval.AllowedSigners != "" {
+		return errors.New("approvals must be signed, write a signed approval file instead")
+	}
+	return approveBuild(buildID, "control API")
+}
+
+func (daemon) State() (state.State, error) {
+	return state.Load(conf.StateFile)
+}
+
+func (daemon) Held() (*state.Hold, error) {
+	return state.LoadHold(conf.HoldFile)
+}
+
+// Runs a scheduled upgrade, unless another run is already in progress.
+func runScheduled(ctx context.Context, server *control.Server, request control.Request) {
+	result, err := server.Scheduled(ctx, request)
+	if errors.Is(err, control.ErrBusy) {
+		slog.Info("Skipping scheduled upgrade, a run is already in progress.")
+		return
+	}
+	if err != nil {
+		return
+	}
+	slog.Info("Scheduled upgrade complete.",
+		slog.String("outcome", string(result.Outcome)),
+		slog.Bool("prefetch", request.Prefetch))
+}
+
+// Cron schedules of the daemon, nil when unset.
+type cronSchedules struct {
+	// regular runs, daemon.interval when nil
+	run *schedule.Cron
+	// activating upgrades, regular runs activate when nil
+	activate *schedule.Cron
+}
+
+// Parses the daemon schedules from `conf`.
+func daemonSchedules() (cronSchedules, error) {
+	var schedules cronSchedules
+	location := time.Local
+	if conf.Daemon.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(conf.Daemon.Timezone)
+		if err != nil {
+			return schedules, err
+		}
+	}
+	for _, s := range []struct {
+		expr string
+		cron **schedule.Cron
+	}{
+		{conf.Daemon.Schedule, &schedules.run},
+		{conf.Daemon.ActivateSchedule, &schedules.activate},
+	} {
+		if s.expr == "" {
+			continue
+		}
+		cron, err := schedule.Parse(s.expr, location)
+		if err != nil {
+			return schedules, err
+		}
+		if cron.Next(time.Now()).IsZero() {
+			return schedules, fmt.Errorf("cron expression %q never matches", s.expr)
+		}
+		*s.cron = &cron
+	}
+	return schedules, nil
+}
+
+/*
+The next regular run after `now`, no earlier than `delay` from now, pushed
+back by `jitter`.
+*/
+func (schedules cronSchedules) nextRun(now time.Time, delay time.Duration, jitter time.Duration) time.Time {
+	if schedules.run != nil {
+		return schedules.run.Next(now.Add(delay)).Add(jitter)
+	}
+	return now.Add(max(conf.Daemon.Interval, delay) + jitter)
+}
+
+/*
+The next scheduled run, the earlier of the armed regular run and activation.
+`activation` is zero without an activation schedule.
+*/
+func nextScheduled(regular time.Time, activation time.Time) time.Time {
+	if !activation.IsZero() && activation.Before(regular) {
+		return activation
+	}
+	return regular
+}
+
+// daemonCmd represents the daemon command
+func NewDaemonCommand() *cobra.Command {
+	daemonCommand := &cobra.Command{
+		Use:   "daemon [boot|switch|test-then-boot]",
+		Short: "Upgrades on an interval and serves a local control API",
+		Long: `Keeps running, upgrading once at startup and then every daemon.interval, with the same config as single upgrades. daemon.jitter adds a random delay to each regular run. When runs keep failing the same way, the interval doubles for each failure in a row, up to daemon.max-backoff.
+
+daemon.schedule replaces the interval with a cron expression, evaluated in daemon.timezone, and the first run waits for it. With daemon.activate-schedule, scheduled runs only check for and prefetch newer builds, and upgrades are activated on the activation schedule, e.g. fetching hourly and activating at 3am.
+
+The daemon serves a control API on the unix socket daemon.socket, used by nixos-hydra-upgrade status and other host agents to query status and history, trigger checks and upgrades, and hold or release upgrades without racing separate invocations. daemon.read-only-socket serves status, history, and checks to any user.`,
+		ValidArgs: []string{"boot", "switch", upgrade.OperationTestThenBoot},
+		Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			err := initConfig(cmd, args)
+			if err != nil {
+				return err
+			}
+			err = requireRoot("daemon")
+			if err != nil {
+				return err
+			}
+			return checkBinaries(cmd.Context())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			schedules, _ := daemonSchedules()
+			server := &control.Server{}
+			backoff := &schedule.Backoff{Interval: conf.Daemon.Interval, Max: conf.Daemon.MaxBackoff}
+			d := daemon{sink: server, backoff: backoff}
+			if schedules.activate != nil {
+				d.activations = &schedule.Backoff{}
+			}
+			server.Daemon = d
+			served := make(chan error, 2)
+			go func() {
+				served <- server.Serve(ctx, conf.Daemon.Socket)
+			}()
+			if conf.Daemon.ReadOnlySocket != "" {
+				go func() {
+					served <- server.ServeReadOnly(ctx, conf.Daemon.ReadOnlySocket)
+				}()
+			}
+
+			// with a separate activation schedule, regular runs only prefetch
+			scheduled := control.Request{Prefetch: schedules.activate != nil}
+			// drawn again for every regular run, see schedule.Jitter
+			jitter := schedule.Jitter(conf.Daemon.Jitter)
+			// when the timers fire, kept alongside them for status
+			regular := time.Now()
+			var activation time.Time
+			timer := time.NewTimer(0)
+			defer timer.Stop()
+			if schedules.run != nil {
+				regular = schedules.run.Next(time.Now()).Add(jitter)
+				timer.Reset(time.Until(regular))
+			}
+			activate := time.NewTimer(0)
+			activate.Stop()
+			defer activate.Stop()
+			if schedules.activate != nil {
+				activation = schedules.activate.Next(time.Now())
+				activate.Reset(time.Until(activation))
+			}
+			server.SetNext(nextScheduled(regular, activation))
+
+			for {
+				select {
+				case <-ctx.Done():
+					slog.Info("Stopping daemon.")
+					return <-served
+				case err := <-served:
+					slog.Error("Control API failed.", slog.String("error", err.Error()))
+					return err
+				case <-timer.C:
+					runScheduled(ctx, server, scheduled)
+					delay := backoff.Delay()
+					if delay > 0 {
+						outcome, failures := backoff.Previous()
+						slog.Warn("Backing off after repeated failures.",
+							slog.String("outcome", string(outcome)),
+							slog.Int("failures", failures),
+							slog.Duration("delay", delay))
+					}
+					jitter = schedule.Jitter(conf.Daemon.Jitter)
+					regular = schedules.nextRun(time.Now(), delay, jitter)
+					timer.Reset(time.Until(regular))
+				case <-activate.C:
+					runScheduled(ctx, server, control.Request{})
+					activation = schedules.activate.Next(time.Now())
+					activate.Reset(time.Until(activation))
+				}
+				next := nextScheduled(regular, activation)
+				server.SetNext(next)
+				slog.Info("Next upgrade scheduled.", slog.Time("next", next))
+			}
+		},
+	}
+
+	return daemonCommand
+}
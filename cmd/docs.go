@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"log"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -16,7 +15,7 @@ func NewDocsCommand(rootCmd *cobra.Command) *cobra.Command {
 		Hidden:    true,
 		ValidArgs: []string{"man"},
 		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			switch args[0] {
 			case "man":
 				rootCmd.DisableAutoGenTag = true
@@ -25,11 +24,9 @@ func NewDocsCommand(rootCmd *cobra.Command) *cobra.Command {
 					Title:   rootCmd.Name(),
 					Section: "1",
 				}
-				err := doc.GenMan(rootCmd, header, os.Stdout)
-				if err != nil {
-					log.Fatal(err)
-				}
+				return doc.GenMan(rootCmd, header, os.Stdout)
 			}
+			return nil
 		},
 	}
 
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// holdCmd represents the hold command
+func NewHoldCommand() *cobra.Command {
+	holdCommand := &cobra.Command{
+		Use:   "hold [reason]",
+		Short: "Pauses automatic upgrades",
+		Long: `Pauses automatic upgrades until released with unhold, by writing the hold file. The reason is written to the hold file.
+
+Other automation may also write the hold file directly, its contents are used as the reason.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return initConfig(cmd, nil)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			return holdUpgrades(strings.Join(args, " "))
+		},
+	}
+
+	return holdCommand
+}
+
+// unholdCmd represents the unhold command
+func NewUnholdCommand() *cobra.Command {
+	unholdCommand := &cobra.Command{
+		Use:   "unhold",
+		Short: "Resumes automatic upgrades paused by hold",
+		Args:  cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return initConfig(cmd, nil)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			return releaseHold()
+		},
+	}
+
+	return unholdCommand
+}
+
+// Writes the hold file, see state.LoadHold.
+func holdUpgrades(reason string) error {
+	err := os.MkdirAll(filepath.Dir(conf.HoldFile), 0755)
+	if err == nil {
+		err = os.WriteFile(conf.HoldFile, []byte(reason+"\n"), 0644)
+	}
+	if err != nil {
+		slog.Error("Writing hold file failed.", slog.String("error", err.Error()))
+		return permissionHint("hold", err)
+	}
+	slog.Info("Upgrades held.", slog.String("file", conf.HoldFile), slog.String("reason", reason))
+	return nil
+}
+
+// Removes the hold file.
+func releaseHold() error {
+	err := os.Remove(conf.HoldFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Removing hold file failed.", slog.String("error", err.Error()))
+		return permissionHint("unhold", err)
+	}
+	slog.Info("Upgrades released.", slog.String("file", conf.HoldFile))
+	return nil
+}
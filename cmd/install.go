@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+	"github.com/spf13/cobra"
+)
+
+// The path of `dir` relative to `base` when it's inside it, otherwise empty.
+func systemdDirectory(base, dir string) string {
+	rel, err := filepath.Rel(base, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return rel
+}
+
+// installCmd represents the install command
+func NewInstallCommand() *cobra.Command {
+	var (
+		flagPrint           bool
+		flagDir             string
+		flagOnCalendar      string
+		flagRandomizedDelay time.Duration
+		flagPersistent      bool
+	)
+
+	installCommand := &cobra.Command{
+		Use:   "install",
+		Short: "Writes systemd service and timer units for scheduled upgrades",
+		Long: `Writes nixos-hydra-upgrade.service and nixos-hydra-upgrade.timer for deployments without the NixOS module. The service runs this executable with the same config file, and its state and cache directories and netrc credential are derived from the config.
+
+Enable the timer afterwards with systemctl daemon-reload && systemctl enable --now nixos-hydra-upgrade.timer. The service is hardened where switching allows, it still needs write access to /nix, /etc, and /boot.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return initConfig(cmd, nil)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			executable, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			executable, err = filepath.EvalSymlinks(executable)
+			if err != nil {
+				return err
+			}
+			configFile := cmd.Root().PersistentFlags().Lookup("config").Value.String()
+			if configFile != "" {
+				configFile, err = filepath.Abs(configFile)
+				if err != nil {
+					return err
+				}
+			}
+			opts := systemd.InstallOptions{
+				Executable:      executable,
+				ConfigFile:      configFile,
+				StateDirectory:  systemdDirectory("/var/lib", filepath.Dir(conf.StateFile)),
+				CacheDirectory:  systemdDirectory("/var/cache", conf.Cache.Dir),
+				NetrcFile:       conf.Nix.NetrcFile,
+				OnCalendar:      flagOnCalendar,
+				RandomizedDelay: flagRandomizedDelay,
+				Persistent:      flagPersistent,
+			}
+			units := []struct {
+				name     string
+				contents string
+			}{
+				{"nixos-hydra-upgrade.service", systemd.ServiceUnit(opts)},
+				{"nixos-hydra-upgrade.timer", systemd.TimerUnit(opts)},
+			}
+
+			if flagPrint {
+				for _, unit := range units {
+					fmt.Fprintf(cmd.OutOrStdout(), "# %s\n%s\n", unit.name, unit.contents)
+				}
+				return nil
+			}
+			for _, unit := range units {
+				path := filepath.Join(flagDir, unit.name)
+				err = os.WriteFile(path, []byte(unit.contents), 0644)
+				if err != nil {
+					return permissionHint("install", err)
+				}
+				slog.Info("Wrote unit.", slog.String("path", path))
+			}
+			slog.Info("Enable the timer with: systemctl daemon-reload && systemctl enable --now nixos-hydra-upgrade.timer")
+			return nil
+		},
+	}
+	installCommand.Flags().BoolVar(&flagPrint, "print", false, "Print the units instead of writing them")
+	installCommand.Flags().StringVar(&flagDir, "dir", "/etc/systemd/system", "Directory the units are written to")
+	installCommand.Flags().StringVar(&flagOnCalendar, "on-calendar", "04:40", "When the timer runs upgrades, see systemd.time(7)")
+	installCommand.Flags().DurationVar(&flagRandomizedDelay, "randomized-delay", 30*time.Minute, "Random delay added to each scheduled run, spreading load on hydra and binary caches across a fleet")
+	installCommand.Flags().BoolVar(&flagPersistent, "persistent", true, "Run on the next boot when a scheduled run was missed while powered off")
+
+	return installCommand
+}
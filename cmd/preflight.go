@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/spf13/cobra"
+)
+
+// Where the missing paths of the target closure would come from.
+type preflightReport struct {
+	BuildID int    `json:"buildId"`
+	Flake   string `json:"flake"`
+	// derivations built locally
+	Build []string `json:"build"`
+	// paths fetched from each substituter, in priority order
+	Substituters []substituterPaths `json:"substituters"`
+	// paths nix expects to substitute that no substituter currently has
+	Unavailable  []string `json:"unavailable"`
+	DownloadSize int64    `json:"downloadSize"`
+}
+
+type substituterPaths struct {
+	Url   string   `json:"url"`
+	Paths []string `json:"paths"`
+}
+
+func printPreflight(w io.Writer, report preflightReport) {
+	fmt.Fprintf(w, "build %d, %s\n", report.BuildID, report.Flake)
+	fmt.Fprintf(w, "%-10s%d derivations\n", "build:", len(report.Build))
+	for _, substituter := range report.Substituters {
+		fmt.Fprintf(w, "%-10s%d paths from %s\n", "fetch:", len(substituter.Paths), substituter.Url)
+	}
+	if len(report.Unavailable) > 0 {
+		fmt.Fprintf(w, "%-10s%d paths not on any substituter\n", "missing:", len(report.Unavailable))
+	}
+	fmt.Fprintf(w, "%-10s%.1f MiB\n", "download:", float64(report.DownloadSize)/(1<<20))
+}
+
+// preflightCmd represents the preflight command
+func NewPreflightCommand() *cobra.Command {
+	var flagJSON bool
+
+	preflightCommand := &cobra.Command{
+		Use:   "preflight",
+		Short: "Reports the store paths an upgrade would fetch or build",
+		Long: `Resolves the latest hydra build and lists the store paths of its system closure missing from the local store, showing how many each substituter would provide and how many need to be built locally. Nothing is downloaded or built.
+
+Paths nix expects to substitute that no substituter has are reported as missing, usually a sign that hydra hasn't finished uploading to the binary cache.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return initConfig(cmd, nil)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+			ctx := cmd.Context()
+
+			provider := upgradeOptions().Provider
+			target, err := provider.Latest(ctx)
+			if err != nil {
+				return err
+			}
+			missing, err := nix.MissingPaths(ctx, target.Flake, conf.NixOSRebuild.Host)
+			if err != nil {
+				return err
+			}
+			report := preflightReport{
+				BuildID:      target.BuildID,
+				Flake:        target.Flake,
+				Build:        missing.Build,
+				Substituters: []substituterPaths{},
+				DownloadSize: missing.DownloadSize,
+			}
+
+			substituters, err := nix.Substituters(ctx)
+			if err != nil {
+				return err
+			}
+			remaining := missing.Fetch
+			for _, url := range substituters {
+				has, err := nix.SubstituterHas(ctx, url, remaining)
+				if err != nil {
+					return fmt.Errorf("querying %s: %w", url, err)
+				}
+				report.Substituters = append(report.Substituters, substituterPaths{Url: url, Paths: has})
+				remaining = slices.DeleteFunc(slices.Clone(remaining), func(path string) bool {
+					return slices.Contains(has, path)
+				})
+			}
+			report.Unavailable = remaining
+
+			w := cmd.OutOrStdout()
+			if flagJSON {
+				encoder := json.NewEncoder(w)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(report)
+			}
+			printPreflight(w, report)
+			return nil
+		},
+	}
+	preflightCommand.Flags().BoolVar(&flagJSON, "json", false, "Output JSON")
+
+	return preflightCommand
+}
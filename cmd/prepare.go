@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+	"github.com/spf13/cobra"
+)
+
+// prepareCmd represents the prepare command
+func NewPrepareCommand() *cobra.Command {
+	prepareCommand := &cobra.Command{
+		Use:       "prepare [boot|switch|test-then-boot]",
+		Short:     "Fetches the latest build for a later activate",
+		Long:      `Runs an upgrade up to activation: gates, health checks, and fetching the latest build, which is protected from garbage collection by gc-root and recorded in state-file. Nothing is activated, run activate later, e.g. fetching during the day and activating at 3am.`,
+		ValidArgs: []string{"boot", "switch", upgrade.OperationTestThenBoot},
+		Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+		PreRunE:   initUpgrade,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			err := randomDelay(cmd.Context())
+			if err != nil {
+				return err
+			}
+			opts := upgradeOptions()
+			opts.Prefetch = true
+			outcome, err := upgrade.Run(cmd.Context(), opts)
+			if outcome.Failed() {
+				return &OutcomeError{Outcome: outcome, Err: err}
+			}
+			return nil
+		},
+	}
+
+	return prepareCommand
+}
+
+// activateCmd represents the activate command
+func NewActivateCommand() *cobra.Command {
+	activateCommand := &cobra.Command{
+		Use:       "activate [boot|switch|test-then-boot]",
+		Short:     "Activates the build fetched by prepare",
+		Long:      `Switches to or stages the build a previous prepare fetched, ignoring any newer builds, with the nothing-staged outcome when nothing was prepared. Gates are checked again before activating, and the rest of the upgrade runs as usual: post-switch checks and hooks, and reboots.`,
+		ValidArgs: []string{"boot", "switch", upgrade.OperationTestThenBoot},
+		Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+		PreRunE:   initUpgrade,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			err := randomDelay(cmd.Context())
+			if err != nil {
+				return err
+			}
+			opts := upgradeOptions()
+			opts.Provider = upgrade.StagedProvider{Provider: opts.Provider, StateFile: conf.StateFile}
+			opts.Reexec = reexec()
+			outcome, err := upgrade.Run(cmd.Context(), opts)
+			if outcome.Failed() {
+				return &OutcomeError{Outcome: outcome, Err: err}
+			}
+			return nil
+		},
+	}
+
+	return activateCommand
+}
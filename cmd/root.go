@@ -1,27 +1,76 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/hyperparabolic/nixos-hydra-upgrade/approval"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/bootloader"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hooks"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/hydra"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/kubernetes"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/logging"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/metrics"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/motd"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/network"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/plugins"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/schedule"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/snapshots"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
 	"github.com/spf13/cobra"
 )
 
 var Version = "development"
 
+// Error ending a command with an upgrade outcome, see upgrade.Outcome.
+type OutcomeError struct {
+	Outcome upgrade.Outcome
+	Err     error
+}
+
+func (err *OutcomeError) Error() string {
+	if err.Err == nil {
+		return string(err.Outcome)
+	}
+	return fmt.Sprintf("%s: %s", err.Outcome, err.Err)
+}
+
+func (err *OutcomeError) Unwrap() error {
+	return err.Err
+}
+
 var (
 	conf        config.Config
 	flagVersion bool
+	// the command and args `conf` was initialized from, see flakePolicy
+	confCmd  *cobra.Command
+	confArgs []string
 )
 
 func NewRootCmd() *cobra.Command {
 	rootCmd := &cobra.Command{
-		Use:   "nixos-hydra-upgrade [boot|switch]",
+		Use:   "nixos-hydra-upgrade [boot|switch|test-then-boot]",
 		Short: "nixos-hydra-upgrade performs NixOS system upgrades based on hydra build success",
 		Long: `A NixOS flake system upgrader that upgrades to derivations only after they are successfully built in Hydra, and built in validations pass.
 
@@ -30,98 +79,238 @@ Most config may be specified using CLI flags, a YAML config file, or environment
 Config follows the precedence CLI Flag > Environment varible > YAML config, with the higher priority sources replacing the entire variable.
 
   - boot - prepare a system to be upgraded on reboot
-  - switch - upgrade a system in place`,
+  - switch - upgrade a system in place
+  - test-then-boot - upgrade a system in place, and only make it the boot default once post-checks pass`,
 		CompletionOptions: cobra.CompletionOptions{HiddenDefaultCmd: true},
-		ValidArgs:         []string{"boot", "switch"},
+		ValidArgs:         []string{"boot", "switch", upgrade.OperationTestThenBoot},
 		Args:              cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if flagVersion {
+				return nil
+			}
+			return initUpgrade(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
 			if flagVersion {
 				fmt.Println(Version)
-				os.Exit(0)
+				return nil
 			}
+			// config is valid, later errors aren't usage errors
+			cmd.SilenceUsage = true
+			initLogging()
 
-			var err error
-			conf, err = config.InitializeConfig(cmd, args)
+			err := randomDelay(cmd.Context())
 			if err != nil {
 				return err
 			}
-			err = conf.Validate()
-			if err != nil {
-				cmd.Usage()
-				os.Exit(1)
+			opts := upgradeOptions()
+			opts.Reexec = reexec()
+			outcome, err := upgrade.Run(cmd.Context(), opts)
+			if outcome.Failed() {
+				return &OutcomeError{Outcome: outcome, Err: err}
 			}
 			return nil
 		},
-		Run: func(cmd *cobra.Command, args []string) {
-			// structured logging setup
-			logLevel := slog.LevelInfo
-			if conf.Debug {
-				logLevel = slog.LevelDebug
-			}
-			logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel, AddSource: true}))
-			slog.SetDefault(logger)
-
-			// get latest hydra build status and flake
-			hydraClient := hydra.HydraClient{
-				Instance: conf.Hydra.Instance,
-				JobSet:   conf.Hydra.JobSet,
-				Job:      conf.Hydra.Job,
-				Project:  conf.Hydra.Project,
-			}
-
-			build := hydraClient.GetLatestBuild()
-			if build.Finished != 1 {
-				slog.Info("Latest build unfinished. Exiting.")
-				os.Exit(0)
-			}
-			if build.BuildStatus != 0 {
-				slog.Info("Latest build unsuccessful. Exiting.", slog.Int("buildstatus", build.BuildStatus))
-				os.Exit(1)
-			}
-
-			eval := hydraClient.GetEval(build)
-
-			// check flake metadata to see if this is an update
-			selfMetadata := nix.GetFlakeMetadata("self")
-			slog.Debug("hydraMetadata", slog.String("flake", eval.Flake))
-			hydraMetadata := nix.GetFlakeMetadata(eval.Flake)
-
-			if selfMetadata.LastModified >= hydraMetadata.LastModified {
-				slog.Info("System is already up to date. Exiting.")
-				os.Exit(0)
-			}
-			flakeSpec := fmt.Sprintf("%s#%s", hydraMetadata.OriginalUrl, conf.NixOSRebuild.Host)
-
-			// health checks
-			for _, h := range conf.HealthCheck.CanaryHosts {
-				err := healthcheck.Ping(h)
-				if err != nil {
-					slog.Info("Ping healthcheck failed. Exiting.", slog.String("host", h))
-					os.Exit(1)
-				}
-			}
-			slog.Info("Performing system upgrade.", slog.String("flake", flakeSpec))
-
-			nix.NixosRebuild(conf.NixOSRebuild.Operation, flakeSpec, conf.NixOSRebuild.Args)
-			slog.Info("System upgrade complete.", slog.String("flake", flakeSpec))
-
-			if conf.Reboot {
-				slog.Info("Initiating reboot")
-				nix.Reboot()
-			}
-		},
 	}
 
-	rootCmd.PersistentFlags().StringP("config", "c", "", "Config file (yaml)")
+	rootCmd.PersistentFlags().StringP("config", "c", "", "Config file (yaml), config.yaml in $CONFIGURATION_DIRECTORY or "+config.DefaultConfigDir+" when unset")
 	rootCmd.PersistentFlags().BoolVarP(&flagVersion, "version", "v", false, "Output nixos-hydra-upgrade version")
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.AdvisoryChecks, []string{}, flagUsage(
+		config.ViperKeys.AdvisoryChecks,
+		"Multivalue - Gates and health checks whose failures are only logged and reported rather than stopping the upgrade, by name or glob, e.g. ssh:* or flake-check. YAML array",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.AllowReleaseChange, false, flagUsage(
+		config.ViperKeys.AllowReleaseChange,
+		"Allow upgrades to older NixOS releases or skipping more than one release",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Annotation, "", flagUsage(
+		config.ViperKeys.Annotation,
+		"Operator note on why this run was triggered, e.g. a change ticket, recorded in state, events, hooks, and notifications. The daemon takes annotations per run from its control API instead",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Approval.Required, false, flagUsage(
+		config.ViperKeys.Approval.Required,
+		"Stop upgrades once the new system is prefetched, until it's approved with nixos-hydra-upgrade approve, the control API, or a signed approval file",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Approval.File, "/var/lib/nixos-hydra-upgrade/approval", flagUsage(
+		config.ViperKeys.Approval.File,
+		"File approvals are read from, written by nixos-hydra-upgrade approve or change-control automation",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Approval.AllowedSigners, "", flagUsage(
+		config.ViperKeys.Approval.AllowedSigners,
+		"ssh allowed_signers file approvals must be signed by, as <file>.sig with ssh-keygen -Y sign -n nixos-hydra-upgrade. Empty accepts unsigned approvals",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.BootCounting.Enable, false, flagUsage(
+		config.ViperKeys.BootCounting.Enable,
+		"Enable systemd-boot boot counting for boot upgrades, confirm boots with nixos-hydra-upgrade confirm",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.BootCounting.Tries, 3, flagUsage(
+		config.ViperKeys.BootCounting.Tries,
+		"Boot attempts before systemd-boot falls back to the previous generation",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.BootCounting.ESP, "/boot", flagUsage(
+		config.ViperKeys.BootCounting.ESP,
+		"EFI system partition mount point",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.BootCounting.BlessBoot, "/run/current-system/systemd/lib/systemd/systemd-bless-boot", flagUsage(
+		config.ViperKeys.BootCounting.BlessBoot,
+		"systemd-bless-boot executable",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Cache.Dir, "/var/cache/nixos-hydra-upgrade", flagUsage(
+		config.ViperKeys.Cache.Dir,
+		"Directory for cached lookups",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Cache.MetadataTTL, 5*time.Minute, flagUsage(
+		config.ViperKeys.Cache.MetadataTTL,
+		"How long flake metadata lookups are cached, 0 disables caching",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Daemon.Interval, time.Hour, flagUsage(
+		config.ViperKeys.Daemon.Interval,
+		"Interval between upgrades in daemon mode",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Daemon.Socket, "/run/nixos-hydra-upgrade.sock", flagUsage(
+		config.ViperKeys.Daemon.Socket,
+		"Unix socket the daemon serves its control API on, see nixos-hydra-upgrade status",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Daemon.Schedule, "", flagUsage(
+		config.ViperKeys.Daemon.Schedule,
+		"Cron expression scheduling daemon runs instead of daemon.interval, e.g. \"0 3 * * *\". Empty uses the interval",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Daemon.ActivateSchedule, "", flagUsage(
+		config.ViperKeys.Daemon.ActivateSchedule,
+		"Cron expression for activating upgrades. When set, scheduled runs only check and prefetch, and activation waits for this schedule. Empty activates on every run",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Daemon.Timezone, "", flagUsage(
+		config.ViperKeys.Daemon.Timezone,
+		"Time zone for daemon schedules, e.g. Europe/Helsinki. Empty uses local time",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Daemon.ReadOnlySocket, "", flagUsage(
+		config.ViperKeys.Daemon.ReadOnlySocket,
+		"Unix socket serving status, history, and checks to any user, for unprivileged monitoring agents. Empty disables",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Daemon.MaxBackoff, 24*time.Hour, flagUsage(
+		config.ViperKeys.Daemon.MaxBackoff,
+		"Longest the daemon waits between runs that keep failing the same way, doubling daemon.interval for each failure in a row. 0 disables backoff",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Daemon.Jitter, 0, flagUsage(
+		config.ViperKeys.Daemon.Jitter,
+		"Longest random delay added to each regular daemon run, drawn again every run",
+		false))
 	rootCmd.PersistentFlags().BoolP(config.CobraKeys.Debug, "d", false, flagUsage(
 		config.ViperKeys.Debug,
 		"Enable debug logging",
 		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Degraded, "warn", flagUsage(
+		config.ViperKeys.Degraded,
+		"Policy for starting upgrades while systemctl is-system-running reports degraded: ignore, warn, or refuse",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Executables, []string{}, flagUsage(
+		config.ViperKeys.Executables,
+		"Multivalue - Absolute paths of executables run by name, e.g. nix=/nix/var/nix/profiles/default/bin/nix, instead of looking them up in PATH. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Constraints, []string{}, flagUsage(
+		config.ViperKeys.Constraints,
+		"Multivalue - Constraints between the running and target systems blocking upgrades that need manual migration, option=unchanged or option=same-major, e.g. system.stateVersion=unchanged. YAML array",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.EvalFree, false, flagUsage(
+		config.ViperKeys.EvalFree,
+		"Deploy the store path hydra built instead of running nixos-rebuild, never evaluating the flake locally. nixos-rebuild.args are ignored",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Fetch.Retries, 2, flagUsage(
+		config.ViperKeys.Fetch.Retries,
+		"Times nix flake metadata lookups and system builds failing with transient network errors are retried",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Fetch.RetryDelay, 5*time.Second, flagUsage(
+		config.ViperKeys.Fetch.RetryDelay,
+		"Delay before the first fetch retry, doubling for each further retry",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.FlakeCheck.Enable, false, flagUsage(
+		config.ViperKeys.FlakeCheck.Enable,
+		"Run nix flake check on the target revision before upgrading, failing the upgrade when it fails",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.FlakeCheck.Checks, []string{}, flagUsage(
+		config.ViperKeys.FlakeCheck.Checks,
+		"Multivalue - Only build these checks.<system> attributes instead of running the whole nix flake check",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.GCRoot, "/nix/var/nix/gcroots/nixos-hydra-upgrade", flagUsage(
+		config.ViperKeys.GCRoot,
+		"GC root protecting prefetched systems until they are activated, empty disables",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Gates.Inhibitors, []string{}, flagUsage(
+		config.ViperKeys.Gates.Inhibitors,
+		"Multivalue - Defer switching and rebooting while blocking logind inhibitor locks of these types are held (shutdown, sleep, idle, ...)",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Gates.MinUptime, 0, flagUsage(
+		config.ViperKeys.Gates.MinUptime,
+		"Minimum system uptime before upgrading with reboot enabled, prevents reboot loops",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Gates.BackupUnits, []string{}, flagUsage(
+		config.ViperKeys.Gates.BackupUnits,
+		"Multivalue - Defer switching and rebooting while systemd units matching these globs are running, e.g. restic-backups-*.service",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Gates.LibvirtDomains, false, flagUsage(
+		config.ViperKeys.Gates.LibvirtDomains,
+		"Defer reboots while libvirt domains are running",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Gates.Containers, []string{}, flagUsage(
+		config.ViperKeys.Gates.Containers,
+		"Multivalue - Defer reboots while podman or docker containers matching these name globs are running",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Gates.Tailscale, false, flagUsage(
+		config.ViperKeys.Gates.Tailscale,
+		"Defer upgrades while tailscale is not connected",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Gates.WireGuardInterfaces, []string{}, flagUsage(
+		config.ViperKeys.Gates.WireGuardInterfaces,
+		"Multivalue - Defer upgrades while these wireguard interfaces are down. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Gates.OverlayPeers, []string{}, flagUsage(
+		config.ViperKeys.Gates.OverlayPeers,
+		"Multivalue - Defer upgrades while these peers are unreachable, pinged over tailscale if enabled. YAML array",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Gates.TimeSync, false, flagUsage(
+		config.ViperKeys.Gates.TimeSync,
+		"Defer upgrades while the system clock isn't NTP synchronized, per timedatectl or chronyc",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.HoldFile, "/run/nixos-hydra-upgrade.hold", flagUsage(
+		config.ViperKeys.HoldFile,
+		"Automatic upgrades are paused while this file exists, see nixos-hydra-upgrade hold",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hostname, "", flagUsage(
+		config.ViperKeys.Hostname,
+		"Hostname identifying this machine, selecting hydra.hosts entries, rollout buckets, and random-delay, defaults to the system hostname",
+		false))
+	rootCmd.PersistentFlags().StringArray(config.CobraKeys.Hooks.PreSwitch, []string{}, flagUsage(
+		config.ViperKeys.Hooks.PreSwitch,
+		"Multivalue - Commands to run before nixos-rebuild, failures abort the upgrade. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringArray(config.CobraKeys.Hooks.PostSwitch, []string{}, flagUsage(
+		config.ViperKeys.Hooks.PostSwitch,
+		"Multivalue - Commands to run after a successful nixos-rebuild. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringArray(config.CobraKeys.Hooks.PreReboot, []string{}, flagUsage(
+		config.ViperKeys.Hooks.PreReboot,
+		"Multivalue - Commands to run before reboot, failures cancel the reboot. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringArray(config.CobraKeys.Hooks.OnFailure, []string{}, flagUsage(
+		config.ViperKeys.Hooks.OnFailure,
+		"Multivalue - Commands to run when the upgrade fails. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringArray(config.CobraKeys.Hooks.OnRollback, []string{}, flagUsage(
+		config.ViperKeys.Hooks.OnRollback,
+		"Multivalue - Commands to run when an automatic rollback is triggered, with ROLLBACK_FROM, ROLLBACK_TO, and ERROR. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringArray(config.CobraKeys.Hooks.Evacuate, []string{}, flagUsage(
+		config.ViperKeys.Hooks.Evacuate,
+		"Multivalue - Commands to run before reboot while workloads block it, e.g. shutting down or migrating guests. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringArray(config.CobraKeys.Hooks.Phase, []string{}, flagUsage(
+		config.ViperKeys.Hooks.Phase,
+		"Multivalue - Commands to run after each upgrade phase, with PHASE, PHASE_SECONDS, and the phase OUTCOME. YAML array",
+		false))
 	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Instance, "", flagUsage(
 		config.ViperKeys.Hydra.Instance,
-		"Hydra instance",
-		true))
+		"Hydra instance, required unless hydra.discovery-domain is set",
+		false))
 	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Project, "", flagUsage(
 		config.ViperKeys.Hydra.Project,
 		"Hydra project",
@@ -134,6 +323,126 @@ Config follows the precedence CLI Flag > Environment varible > YAML config, with
 		config.ViperKeys.Hydra.Job,
 		"Hydra job",
 		true))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Hydra.AllowedRefs, []string{}, flagUsage(
+		config.ViperKeys.Hydra.AllowedRefs,
+		"Multivalue - Only upgrade to evals of these flake git refs (e.g. refs/heads/main), HEAD for the default branch",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Inventory, "", flagUsage(
+		config.ViperKeys.Hydra.Inventory,
+		"Deployment inventory selecting the job of hosts without a hydra.hosts entry: colmena or deploy-rs. Empty disables",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.InventoryFlake, "", flagUsage(
+		config.ViperKeys.Hydra.InventoryFlake,
+		"Flake holding the colmena hive or deploy-rs deploy.nodes of hydra.inventory, e.g. github:example/nixos",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.InventoryJob, "hosts.{node}", flagUsage(
+		config.ViperKeys.Hydra.InventoryJob,
+		"Hydra job of hydra.inventory nodes, {node} is replaced with the node name",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Hydra.Fallbacks, []string{}, flagUsage(
+		config.ViperKeys.Hydra.Fallbacks,
+		"Multivalue - project/jobset/job fallbacks, in order, used when the primary job has no recent successful build",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Hydra.MaxBuildAge, 0, flagUsage(
+		config.ViperKeys.Hydra.MaxBuildAge,
+		"Builds older than this are stale and fall back to hydra.fallbacks. 0 only falls back when the primary job fails",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Hydra.Freshness, 0, flagUsage(
+		config.ViperKeys.Hydra.Freshness,
+		"Publish a jobset-stale warning when no successful build of the job landed within this long, paging through hydra's evaluations, 0 disables",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.ExpectedOrigin, "", flagUsage(
+		config.ViperKeys.Hydra.ExpectedOrigin,
+		"Flake url hydra's evaluations are expected to come from, without a rev, e.g. github:example/nixos. Builds from anywhere else publish an origin-drift warning. Empty disables",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.DiscoveryDomain, "", flagUsage(
+		config.ViperKeys.Hydra.DiscoveryDomain,
+		"Domain to discover the hydra instance from when hydra.instance is empty, with a _hydra._tcp SRV record or https://<domain>/.well-known/nixos-hydra-upgrade.json",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Hydra.Dependencies, []string{}, flagUsage(
+		config.ViperKeys.Hydra.Dependencies,
+		"Multivalue - project/jobset/job of other hydra jobs whose latest build must have succeeded before upgrading, e.g. a private overlay flake. Prefix with input= to also require the build to be of the revision the system flake locks that input to",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Hydra.Products, []string{}, flagUsage(
+		config.ViperKeys.Hydra.Products,
+		"Multivalue - Name globs of hydra build products downloaded to hydra.products-dir when the target build is fetched, e.g. *.iso or sbom.json",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.ProductsDir, "/var/lib/nixos-hydra-upgrade/products", flagUsage(
+		config.ViperKeys.Hydra.ProductsDir,
+		"Directory build products are downloaded to, in a subdirectory per build id",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.LogLevels, []string{}, flagUsage(
+		config.ViperKeys.LogLevels,
+		"Multivalue - Log levels of individual modules overriding the global level, e.g. hydra=debug or nix=warn. YAML array",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.MaxDownloadMiB, 0, flagUsage(
+		config.ViperKeys.MaxDownloadMiB,
+		"Abort upgrades that would download more than this many MiB from substituters, 0 disables",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.MetricsTextfile, "", flagUsage(
+		config.ViperKeys.MetricsTextfile,
+		"File upgrade metrics are written to in the prometheus text format after each run, for the node_exporter textfile collector, e.g. /var/lib/prometheus-node-exporter-text-files/nixos-hydra-upgrade.prom. Empty disables",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Motd, "", flagUsage(
+		config.ViperKeys.Motd,
+		"File the upgrade status is written to after each run for login banners, e.g. /etc/motd.d/nixos-hydra-upgrade or /run/motd.dynamic. Empty disables",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Nix.Substituters, []string{}, flagUsage(
+		config.ViperKeys.Nix.Substituters,
+		"Multivalue - Substituter urls passed to nix and nixos-rebuild with --option substituters, replacing the configured substituters",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Nix.TrustedPublicKeys, []string{}, flagUsage(
+		config.ViperKeys.Nix.TrustedPublicKeys,
+		"Multivalue - Binary cache signing keys passed to nix and nixos-rebuild with --option trusted-public-keys",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Nix.MaxJobs, "", flagUsage(
+		config.ViperKeys.Nix.MaxJobs,
+		"Builds nix runs in parallel, a number or auto. Empty uses nix.conf",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Nix.Cores, 0, flagUsage(
+		config.ViperKeys.Nix.Cores,
+		"Cores each build may use, 0 uses nix.conf",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Nix.NetrcFile, "", flagUsage(
+		config.ViperKeys.Nix.NetrcFile,
+		"netrc file with credentials for authenticated binary caches, passed to nix with --option netrc-file",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Nix.PreferChunked, false, flagUsage(
+		config.ViperKeys.Nix.PreferChunked,
+		"Detect http substituters serving chunked, deduplicated downloads (attic) and prefer them, logging download estimates when none do",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Nix.PinnedKeys, []string{}, flagUsage(
+		config.ViperKeys.Nix.PinnedKeys,
+		"Multivalue - Signing keys every substituted path of the target closure must be signed with, verified before activating independent of nix.conf",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.OfflineCheck, true, flagUsage(
+		config.ViperKeys.OfflineCheck,
+		"Skip upgrades quietly with the offline outcome when there is no default route or the hydra instance doesn't resolve",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.PendingBoot, "warn", flagUsage(
+		config.ViperKeys.PendingBoot,
+		"Policy when a previously staged boot upgrade has not been booted: skip, warn, restage, or reboot",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Phases.Retries, 0, flagUsage(
+		config.ViperKeys.Phases.Retries,
+		"Times failed resolve, preflight, and prefetch phases are retried",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Phases.RetryDelay, 30*time.Second, flagUsage(
+		config.ViperKeys.Phases.RetryDelay,
+		"Delay between phase retries",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.PluginDir, "", flagUsage(
+		config.ViperKeys.PluginDir,
+		"Directory of plugin executables run as upgrade gates, health checks, and notification sinks. Empty disables",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.PolicyFromFlake, false, flagUsage(
+		config.ViperKeys.PolicyFromFlake,
+		"Read upgrade policy (gates, health checks, verify, reboot, ...) from system.autoUpgradeHydra.settings of the target flake, overriding the config file",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.RandomDelay, 0, flagUsage(
+		config.ViperKeys.RandomDelay,
+		"Delay the start of upgrades by up to this long, by a fixed amount per host, spreading fleets with identical timers. 0 disables",
+		false))
 	rootCmd.PersistentFlags().Bool(config.CobraKeys.Reboot, false, flagUsage(
 		config.ViperKeys.Reboot,
 		"Reboot system on successful upgrade",
@@ -142,18 +451,1205 @@ Config follows the precedence CLI Flag > Environment varible > YAML config, with
 		config.ViperKeys.HealthCheck.CanaryHosts,
 		"Multivalue - Canary systems, only upgrade if these hostnames respond to ping",
 		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.HealthCheck.SSHHosts, []string{}, flagUsage(
+		config.ViperKeys.HealthCheck.SSHHosts,
+		"Multivalue - ssh destinations of canary hosts that must accept a login as a precondition for upgrade. YAML array",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.HealthCheck.SSHCommand, "", flagUsage(
+		config.ViperKeys.HealthCheck.SSHCommand,
+		"Command that must succeed on ssh canary hosts, empty only checks the login",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.HealthCheck.SSHIdentity, "", flagUsage(
+		config.ViperKeys.HealthCheck.SSHIdentity,
+		"Private key for ssh canary hosts, empty uses the ssh agent and default keys",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.HealthCheck.SSHKnownHosts, "", flagUsage(
+		config.ViperKeys.HealthCheck.SSHKnownHosts,
+		"known_hosts file pinning ssh canary host keys, empty uses the default known hosts",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.HealthCheck.Units, []string{}, flagUsage(
+		config.ViperKeys.HealthCheck.Units,
+		"Multivalue - Local systemd units that must be active before upgrading and after switching. YAML array",
+		false))
+	rootCmd.PersistentFlags().StringArray(config.CobraKeys.HealthCheck.Scripts, []string{}, flagUsage(
+		config.ViperKeys.HealthCheck.Scripts,
+		"Multivalue - Health check commands run with sh -c, which must exit 0 within healthcheck.script-timeout. YAML array",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.HealthCheck.ScriptTimeout, time.Minute, flagUsage(
+		config.ViperKeys.HealthCheck.ScriptTimeout,
+		"Time health check scripts are given to exit before they're killed and fail",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.InhibitSleep, true, flagUsage(
+		config.ViperKeys.InhibitSleep,
+		"Hold a systemd-inhibit lock keeping the system from sleeping or shutting down while the new system is fetched and activated",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.IPFamily, "any", flagUsage(
+		config.ViperKeys.IPFamily,
+		"Address family for hydra requests, connectivity checks, and canaries: any, ipv4, or ipv6. any tries both, preferring whichever connects first",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Kubernetes.Drain, false, flagUsage(
+		config.ViperKeys.Kubernetes.Drain,
+		"Drain this kubernetes node before switching or rebooting, uncordon after",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Kubernetes.Node, "", flagUsage(
+		config.ViperKeys.Kubernetes.Node,
+		"Kubernetes node name, defaults to hostname",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Kubernetes.Kubeconfig, "", flagUsage(
+		config.ViperKeys.Kubernetes.Kubeconfig,
+		"kubeconfig for kubectl, defaults to kubectl's own discovery",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Kubernetes.DrainArgs, []string{}, flagUsage(
+		config.ViperKeys.Kubernetes.DrainArgs,
+		"Multivalue - Additional args to provide to kubectl drain. YAML array",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Limits.Eval.Nice, 0, flagUsage(
+		config.ViperKeys.Limits.Eval.Nice,
+		"Nice level, 1-19, of commands evaluating the target system (resolve and preflight phases). 0 leaves it unchanged",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Limits.Eval.CPUWeight, 0, flagUsage(
+		config.ViperKeys.Limits.Eval.CPUWeight,
+		"systemd CPUWeight=, 1-10000, of commands evaluating the target system (resolve and preflight phases). 0 leaves it unset",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Limits.Eval.IOWeight, 0, flagUsage(
+		config.ViperKeys.Limits.Eval.IOWeight,
+		"systemd IOWeight=, 1-10000, of commands evaluating the target system (resolve and preflight phases). 0 leaves it unset",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Limits.Eval.MemoryMax, "", flagUsage(
+		config.ViperKeys.Limits.Eval.MemoryMax,
+		"systemd MemoryMax=, e.g. 4G or 50%, of commands evaluating the target system (resolve and preflight phases). Empty leaves it unset",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Limits.Download.Nice, 0, flagUsage(
+		config.ViperKeys.Limits.Download.Nice,
+		"Nice level, 1-19, of commands fetching the target system (prefetch phase). 0 leaves it unchanged",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Limits.Download.CPUWeight, 0, flagUsage(
+		config.ViperKeys.Limits.Download.CPUWeight,
+		"systemd CPUWeight=, 1-10000, of commands fetching the target system (prefetch phase). 0 leaves it unset",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Limits.Download.IOWeight, 0, flagUsage(
+		config.ViperKeys.Limits.Download.IOWeight,
+		"systemd IOWeight=, 1-10000, of commands fetching the target system (prefetch phase). 0 leaves it unset",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Limits.Download.MemoryMax, "", flagUsage(
+		config.ViperKeys.Limits.Download.MemoryMax,
+		"systemd MemoryMax=, e.g. 4G or 50%, of commands fetching the target system (prefetch phase). Empty leaves it unset",
+		false))
 	rootCmd.PersistentFlags().String(config.CobraKeys.NixOSRebuild.Host, "", flagUsage(
 		config.ViperKeys.NixOSRebuild.Host,
 		"Flake `nixosConfigurations.<name>`, usually hostname",
 		true))
 	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.NixOSRebuild.Args, []string{}, flagUsage(
 		config.ViperKeys.NixOSRebuild.Args,
-		"Multivalue - Additional args to provide to nixos-rebuild. YAML array",
+		"Multivalue - Additional args to provide to nixos-rebuild, expanding {buildid}, {rev}, and {hostname}. YAML array",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Reexec, true, flagUsage(
+		config.ViperKeys.Reexec,
+		"After switching, re-exec the nixos-hydra-upgrade of the new generation for the remaining phases when it differs from the running one",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Reproducibility, "off", flagUsage(
+		config.ViperKeys.Reproducibility,
+		"Verify fetched systems against hydra's build before activating: off, eval (compare output paths), or rebuild (also rebuild the toplevel locally with nix build --check)",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Restarts.CriticalUnits, []string{"sshd.service", "display-manager.service", "NetworkManager.service", "systemd-networkd.service", "systemd-resolved.service", "wpa_supplicant*.service", "iwd.service"}, flagUsage(
+		config.ViperKeys.Restarts.CriticalUnits,
+		"Multivalue - Unit globs whose restart by a switch may drop sessions or connectivity",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Restarts.Policy, "warn", flagUsage(
+		config.ViperKeys.Restarts.Policy,
+		"Policy when a switch restarts critical units: warn, boot (stage for reboot instead), prompt, or abort",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Rollback.MagicTimeout, 0, flagUsage(
+		config.ViperKeys.Rollback.MagicTimeout,
+		"Remote switches with --target-host roll back unless confirmed by reconnecting within this timeout, 0 disables",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Rollback.ConfirmTimeout, 0, flagUsage(
+		config.ViperKeys.Rollback.ConfirmTimeout,
+		"Local switches roll back unless nixos-hydra-upgrade confirm runs within this timeout, 0 disables",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Rollback.RecoverActivation, true, flagUsage(
+		config.ViperKeys.Rollback.RecoverActivation,
+		"Re-activate the previous system when switching fails partway, rather than leaving a partially activated system",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Rollback.VerifyFailure, false, flagUsage(
+		config.ViperKeys.Rollback.VerifyFailure,
+		"Re-activate the previous system right away when post-switch checks fail after a local switch",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Rollout.Percentage, 100, flagUsage(
+		config.ViperKeys.Rollout.Percentage,
+		"Percentage of hosts that upgrade to a new build, hosts are bucketed by hostname and build id",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Rollout.WidenPerHour, 0, flagUsage(
+		config.ViperKeys.Rollout.WidenPerHour,
+		"Percentage points the rollout widens by for every hour since the build finished",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.SBOM.Enable, false, flagUsage(
+		config.ViperKeys.SBOM.Enable,
+		"Write a software bill of materials of each fetched system, with the closure's packages, versions, and the licenses of system packages",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.SBOM.Format, "spdx", flagUsage(
+		config.ViperKeys.SBOM.Format,
+		"SBOM format, spdx or cyclonedx",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.SBOM.Dir, "/var/lib/nixos-hydra-upgrade/sbom", flagUsage(
+		config.ViperKeys.SBOM.Dir,
+		"Directory SBOMs are written to, named by build id",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Secrets.Paths, []string{}, flagUsage(
+		config.ViperKeys.Secrets.Paths,
+		"Multivalue - Secrets checked after switching, as path[:owner[:group[:mode]]]. Paths may be globs, e.g. /run/secrets/* or /run/agenix/db:postgres::0400",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.SecureBoot.Verify, false, flagUsage(
+		config.ViperKeys.SecureBoot.Verify,
+		"Verify EFI binaries are signed for Secure Boot with sbctl verify before rebooting, for lanzaboote systems",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Snapshots.ZFSDatasets, []string{}, flagUsage(
+		config.ViperKeys.Snapshots.ZFSDatasets,
+		"Multivalue - ZFS datasets to snapshot before switching",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Snapshots.Keep, 5, flagUsage(
+		config.ViperKeys.Snapshots.Keep,
+		"Upgrade snapshots to keep per dataset or subvolume, 0 keeps all",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Snapshots.BtrfsSubvolumes, []string{}, flagUsage(
+		config.ViperKeys.Snapshots.BtrfsSubvolumes,
+		"Multivalue - Btrfs subvolumes to snapshot read-only before switching",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.StallTimeout, 30*time.Minute, flagUsage(
+		config.ViperKeys.StallTimeout,
+		"Kill nix and nixos-rebuild when they produce no output for this long, ending the run as stalled. 0 disables",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.StateFile, "/var/lib/nixos-hydra-upgrade/state.json", flagUsage(
+		config.ViperKeys.StateFile,
+		"State file recording upgrade progress, interrupted upgrades resume from it",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Switch.Retries, 0, flagUsage(
+		config.ViperKeys.Switch.Retries,
+		"Times nixos-rebuild is retried when switching fails to fetch the system. Other switch failures are never retried",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Switch.RetryDelay, time.Minute, flagUsage(
+		config.ViperKeys.Switch.RetryDelay,
+		"Delay between switch retries",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Verify.SystemRunning, false, flagUsage(
+		config.ViperKeys.Verify.SystemRunning,
+		"After switching, and when confirming a boot, require systemctl is-system-running to reach running",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Verify.RunningTimeout, 5*time.Minute, flagUsage(
+		config.ViperKeys.Verify.RunningTimeout,
+		"How long to wait for the system to finish starting before verifying it is running",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Verify.JournalWindow, 0, flagUsage(
+		config.ViperKeys.Verify.JournalWindow,
+		"After switching, and when confirming a boot, watch the journal for errors for this long. 0 disables",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Verify.HealthChecks, false, flagUsage(
+		config.ViperKeys.Verify.HealthChecks,
+		"Also run healthcheck canary and ssh checks after switching, and when confirming",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Verify.MaxJournalErrors, 0, flagUsage(
+		config.ViperKeys.Verify.MaxJournalErrors,
+		"Journal entries of priority err or worse allowed during verify.journal-window",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Wait.Enable, false, flagUsage(
+		config.ViperKeys.Wait.Enable,
+		"Wait for an unfinished latest build to finish instead of exiting, polling hydra every wait.interval for up to wait.timeout. Ignored by the daemon",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Wait.Interval, time.Minute, flagUsage(
+		config.ViperKeys.Wait.Interval,
+		"Time between polls of an unfinished latest build",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Wait.Timeout, time.Hour, flagUsage(
+		config.ViperKeys.Wait.Timeout,
+		"Longest time waited for an unfinished latest build before exiting as unfinished",
 		false))
 
 	return rootCmd
 }
 
+// Initializes and validates `conf`, shared by all commands that need config.
+func initConfig(cmd *cobra.Command, args []string) error {
+	var err error
+	confCmd, confArgs = cmd.Root(), args
+	conf, err = config.InitializeConfig(cmd.Root(), args)
+	if err != nil {
+		return err
+	}
+	err = conf.Validate()
+	if err != nil {
+		return err
+	}
+	runner.Paths = executables()
+	err = importInventory(cmd.Context())
+	if err != nil {
+		return err
+	}
+	_, err = secrets()
+	if err != nil {
+		return err
+	}
+	_, err = daemonSchedules()
+	if err != nil {
+		return err
+	}
+	_, err = hydraProvider()
+	if err != nil {
+		return err
+	}
+	_, err = dependencies()
+	if err != nil {
+		return err
+	}
+	// constraints evaluate the running system's flake from the local registry
+	if len(conf.Constraints) > 0 && nix.TargetHost(conf.NixOSRebuild.Args) != "" {
+		return errors.New("constraints only apply to the local system, remove them or --target-host")
+	}
+	return evalFree()
+}
+
+/*
+Selects this host's job from hydra.inventory when hydra.hosts has no entry
+for it, so fleets deployed with colmena or deploy-rs don't keep a second
+list of hosts. Hosts missing from the inventory keep the default job.
+*/
+func importInventory(ctx context.Context) error {
+	if conf.Hydra.Inventory == "" {
+		return nil
+	}
+	if _, ok := conf.Hydra.HostConfig(conf.Hostname); ok {
+		return nil
+	}
+	nodes, err := nix.Inventory(ctx, conf.Hydra.Inventory, conf.Hydra.InventoryFlake)
+	if err != nil {
+		return fmt.Errorf("reading %s inventory: %w", conf.Hydra.Inventory, err)
+	}
+	node, ok := nix.InventoryNode(nodes, conf.Hostname)
+	if !ok {
+		slog.Warn("Host not found in inventory, using the default job.", slog.String("hostname", conf.Hostname), slog.String("inventory", conf.Hydra.Inventory))
+		return nil
+	}
+	conf.ApplyHost(confCmd, config.HydraHostConfig{
+		Job:  strings.ReplaceAll(conf.Hydra.InventoryJob, "{node}", node),
+		Host: node,
+	})
+	return nil
+}
+
+// Absolute paths of executables from conf.Executables, see runner.Paths.
+func executables() map[string]string {
+	paths := map[string]string{}
+	for _, executable := range conf.Executables {
+		// validated by conf.Validate
+		name, path, _ := strings.Cut(executable, "=")
+		paths[name] = path
+	}
+	return paths
+}
+
+// initConfig for commands that upgrade, which need root.
+func initUpgrade(cmd *cobra.Command, args []string) error {
+	err := initConfig(cmd, args)
+	if err != nil {
+		return err
+	}
+	// nixos-rebuild escalates on remote target hosts itself
+	if nix.TargetHost(conf.NixOSRebuild.Args) == "" {
+		err = requireRoot("upgrading")
+		if err != nil {
+			return err
+		}
+	}
+	return checkBinaries(cmd.Context())
+}
+
+/*
+Checks the external binaries upgrades run are installed, and that nix is
+new enough, so a missing or outdated binary fails at startup instead of
+partway through an upgrade.
+*/
+func checkBinaries(ctx context.Context) error {
+	required := []string{"nix"}
+	if !conf.EvalFree {
+		required = append(required, "nixos-rebuild")
+	}
+	for _, limits := range phaseLimits() {
+		if !limits.IsZero() {
+			required = append(required, "systemd-run")
+			break
+		}
+	}
+	hookCommands := []struct {
+		name     string
+		commands []string
+	}{
+		{"pre-switch", conf.Hooks.PreSwitch},
+		{"post-switch", conf.Hooks.PostSwitch},
+		{"pre-reboot", conf.Hooks.PreReboot},
+		{"evacuate", conf.Hooks.Evacuate},
+		{"on-failure", conf.Hooks.OnFailure},
+		{"on-rollback", conf.Hooks.OnRollback},
+		{"phase", conf.Hooks.Phase},
+	}
+	shell := len(conf.HealthCheck.Scripts) > 0
+	for _, hook := range hookCommands {
+		if len(hook.commands) > 0 {
+			shell = true
+			break
+		}
+	}
+	if shell {
+		required = append(required, "sh")
+	}
+	for _, name := range required {
+		_, err := runner.LookPath(name)
+		if err != nil {
+			return fmt.Errorf("%s is required, add it to PATH or set its path with executables: %w", name, err)
+		}
+	}
+
+	version, err := nix.NixVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("checking the nix version: %w", err)
+	}
+	slog.Debug("Found nix.", slog.String("version", version.String()))
+	if !version.AtLeast(nix.MinVersion) {
+		return fmt.Errorf("nix %s is too old, %s or newer is required", version, nix.MinVersion)
+	}
+
+	for _, hook := range hookCommands {
+		err = hooks.Check(ctx, hook.name, hook.commands)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rejects config eval-free upgrades can't honor.
+func evalFree() error {
+	if !conf.EvalFree {
+		return nil
+	}
+	if nix.TargetHost(conf.NixOSRebuild.Args) != "" {
+		return errors.New("eval-free upgrades only deploy to the local system, remove --target-host")
+	}
+	if conf.Reproducibility == "rebuild" {
+		return errors.New("eval-free upgrades can't rebuild the system locally, use reproducibility eval")
+	}
+	if conf.PolicyFromFlake {
+		return errors.New("eval-free upgrades can't evaluate policy from the flake, disable policy-from-flake")
+	}
+	if len(conf.Constraints) > 0 {
+		return errors.New("eval-free upgrades can't evaluate constraints, remove constraints")
+	}
+	return nil
+}
+
+/*
+Returns the provider of hydra builds from `conf`, failing over to
+hydra.fallbacks when any are set. {system} in jobset and job names is
+replaced with the local system, e.g. x86_64-linux.
+*/
+func hydraProvider() (upgrade.Provider, error) {
+	httpClient := network.HTTPClient(conf.IPFamily)
+	cache := nix.MetadataCache{
+		Dir: conf.Cache.Dir,
+		TTL: conf.Cache.MetadataTTL,
+	}
+	primary := upgrade.HydraProvider{
+		Client: hydra.HydraClient{
+			Instance: conf.Hydra.Instance,
+			Domain:   conf.Hydra.DiscoveryDomain,
+			JobSet:   nix.ExpandSystem(conf.Hydra.JobSet),
+			Job:      nix.ExpandSystem(conf.Hydra.Job),
+			Project:  conf.Hydra.Project,
+			HTTP:     httpClient,
+		},
+		Cache: cache,
+	}
+	if len(conf.Hydra.Fallbacks) == 0 {
+		return primary, nil
+	}
+	providers := []upgrade.Provider{primary}
+	for _, fallback := range conf.Hydra.Fallbacks {
+		client, err := hydraJob(fallback, httpClient)
+		if err != nil {
+			return nil, fmt.Errorf("hydra fallback %w", err)
+		}
+		providers = append(providers, upgrade.HydraProvider{Client: client, Cache: cache})
+	}
+	return &upgrade.FailoverProvider{Providers: providers, MaxAge: conf.Hydra.MaxBuildAge}, nil
+}
+
+// Returns a client of the project/jobset/job `spec` on the configured instance.
+func hydraJob(spec string, httpClient *http.Client) (hydra.HydraClient, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 3 || slices.Contains(parts, "") {
+		return hydra.HydraClient{}, fmt.Errorf("%q: expected project/jobset/job", spec)
+	}
+	return hydra.HydraClient{
+		Instance: conf.Hydra.Instance,
+		Domain:   conf.Hydra.DiscoveryDomain,
+		Project:  parts[0],
+		JobSet:   nix.ExpandSystem(parts[1]),
+		Job:      nix.ExpandSystem(parts[2]),
+		HTTP:     httpClient,
+	}, nil
+}
+
+/*
+Returns upgrade gates requiring the latest builds of hydra.dependencies, e.g.
+overlay=private/main/checks, to have succeeded.
+*/
+func dependencies() ([]upgrade.Checker, error) {
+	httpClient := network.HTTPClient(conf.IPFamily)
+	var checkers []upgrade.Checker
+	for _, dependency := range conf.Hydra.Dependencies {
+		input, job, found := strings.Cut(dependency, "=")
+		if !found {
+			input, job = "", dependency
+		}
+		client, err := hydraJob(job, httpClient)
+		if err != nil {
+			return nil, fmt.Errorf("hydra dependency %w", err)
+		}
+		checkers = append(checkers, severity("dependency:"+job, upgrade.DependencyChecker{Client: client, Input: input}))
+	}
+	return checkers, nil
+}
+
+/*
+Fails commands that change the system early when not running as root,
+rather than halfway through an upgrade.
+*/
+func requireRoot(action string) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s needs root, status, check, and preflight run as any user", action)
+}
+
+// Explains permission errors of commands writing system files.
+func permissionHint(action string, err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("%w, %s needs root", err, action)
+	}
+	return err
+}
+
+// Parses the secrets checked after switching from `conf`.
+func secrets() ([]healthcheck.Secret, error) {
+	parsed := []healthcheck.Secret{}
+	for _, spec := range conf.Secrets.Paths {
+		secret, err := healthcheck.ParseSecret(spec)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, secret)
+	}
+	return parsed, nil
+}
+
+/*
+Waits out this host's share of random-delay before an upgrade, see
+schedule.HostDelay.
+*/
+func randomDelay(ctx context.Context) error {
+	if conf.RandomDelay <= 0 {
+		return nil
+	}
+	delay := schedule.HostDelay(conf.Hostname, conf.RandomDelay)
+	slog.Info("Delaying upgrade.", slog.Duration("delay", delay))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// structured logging setup
+func initLogging() {
+	logLevel := slog.LevelInfo
+	if conf.Debug {
+		logLevel = slog.LevelDebug
+	}
+	// validated with the config
+	levels, _ := logging.ParseLevels(conf.LogLevels)
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug, AddSource: true})
+	logger := slog.New(logging.ModuleHandler{Handler: handler, Level: logLevel, Levels: levels})
+	slog.SetDefault(logger)
+}
+
+// nix.conf settings from `conf`, unset options are left to nix.conf.
+func nixOptions() map[string]string {
+	options := map[string]string{}
+	if len(conf.Nix.Substituters) > 0 {
+		options["substituters"] = strings.Join(conf.Nix.Substituters, " ")
+	}
+	if len(conf.Nix.TrustedPublicKeys) > 0 {
+		options["trusted-public-keys"] = strings.Join(conf.Nix.TrustedPublicKeys, " ")
+	}
+	if conf.Nix.MaxJobs != "" {
+		options["max-jobs"] = conf.Nix.MaxJobs
+	}
+	if conf.Nix.Cores > 0 {
+		options["cores"] = strconv.Itoa(conf.Nix.Cores)
+	}
+	if conf.Nix.NetrcFile != "" {
+		options["netrc-file"] = conf.Nix.NetrcFile
+	}
+	return options
+}
+
+/*
+Prefers http substituters serving chunked, deduplicated downloads, ordering
+them first and lowering their priority below the other caches'. nix sorts
+substituters by priority. Returns whether any were found, nix's download
+estimates overstate what chunked caches transfer.
+*/
+func preferChunked() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	substituters := conf.Nix.Substituters
+	if len(substituters) == 0 {
+		var err error
+		substituters, err = nix.Substituters(ctx)
+		if err != nil {
+			slog.Warn("Unable to list substituters.", slog.String("error", err.Error()))
+			return false
+		}
+	}
+	httpClient := network.HTTPClient(conf.IPFamily)
+	chunked := []nix.CacheInfo{}
+	others := []string{}
+	// nix's default for caches not advertising one
+	priority := 50
+	for _, substituter := range substituters {
+		if !strings.HasPrefix(substituter, "http://") && !strings.HasPrefix(substituter, "https://") {
+			others = append(others, substituter)
+			continue
+		}
+		info, err := nix.GetCacheInfo(ctx, httpClient, substituter)
+		if err != nil {
+			slog.Warn("Unable to get cache info.", slog.String("substituter", substituter), slog.String("error", err.Error()))
+			others = append(others, substituter)
+			continue
+		}
+		if info.Chunked {
+			chunked = append(chunked, info)
+			continue
+		}
+		others = append(others, substituter)
+		if info.Priority > 0 {
+			priority = min(priority, info.Priority)
+		}
+	}
+	if len(chunked) == 0 {
+		slog.Info("No substituters serve chunked downloads.")
+		return false
+	}
+	preferred := []string{}
+	for _, info := range chunked {
+		url := info.Url
+		if (info.Priority == 0 || info.Priority >= priority) && !strings.Contains(url, "priority=") {
+			separator := "?"
+			if strings.Contains(url, "?") {
+				separator = "&"
+			}
+			url += separator + "priority=" + strconv.Itoa(max(priority-1, 1))
+		}
+		preferred = append(preferred, url)
+	}
+	slog.Info("Preferring substituters serving chunked downloads.", slog.Any("substituters", preferred))
+	nix.Options["substituters"] = strings.Join(append(preferred, others...), " ")
+	return true
+}
+
+// Builds the upgrade options from `conf`.
+func upgradeOptions() upgrade.Options {
+	nix.Options = nixOptions()
+	nix.Runner = runner.Exec{StallTimeout: conf.StallTimeout}
+	nix.Retry = nix.RetryPolicy{
+		Retries: conf.Fetch.Retries,
+		Delay:   conf.Fetch.RetryDelay,
+	}
+	// validated by initConfig
+	provider, _ := hydraProvider()
+	opts := upgrade.Options{
+		Operation: conf.NixOSRebuild.Operation,
+		Reboot:    conf.Reboot,
+		Provider:  provider,
+		Rebuilder: upgrade.NixRebuilder{
+			Host:     conf.NixOSRebuild.Host,
+			Args:     conf.NixOSRebuild.Args,
+			Hostname: conf.Hostname,
+		},
+		Gates: upgradeGates(),
+		Hooks: upgrade.Hooks{
+			PreSwitch:  conf.Hooks.PreSwitch,
+			PostSwitch: conf.Hooks.PostSwitch,
+			PreReboot:  conf.Hooks.PreReboot,
+			Evacuate:   conf.Hooks.Evacuate,
+			OnFailure:  conf.Hooks.OnFailure,
+			OnRollback: conf.Hooks.OnRollback,
+			Phase:      conf.Hooks.Phase,
+		},
+		StateFile:          conf.StateFile,
+		GCRoot:             conf.GCRoot,
+		PendingBoot:        conf.PendingBoot,
+		AllowedRefs:        conf.Hydra.AllowedRefs,
+		ExpectedOrigin:     conf.Hydra.ExpectedOrigin,
+		MaxDownloadMiB:     conf.MaxDownloadMiB,
+		AllowReleaseChange: conf.AllowReleaseChange,
+		Annotation:         conf.Annotation,
+		TargetHost:         nix.TargetHost(conf.NixOSRebuild.Args),
+		Restarts: upgrade.RestartPolicy{
+			CriticalUnits: conf.Restarts.CriticalUnits,
+			Policy:        conf.Restarts.Policy,
+		},
+		Prompt:       prompt,
+		SnapshotKeep: conf.Snapshots.Keep,
+		Rollback: upgrade.RollbackPolicy{
+			ConfirmTimeout:    conf.Rollback.ConfirmTimeout,
+			MagicTimeout:      conf.Rollback.MagicTimeout,
+			RecoverActivation: conf.Rollback.RecoverActivation,
+			VerifyFailure:     conf.Rollback.VerifyFailure,
+		},
+		// activation isn't retried, failed switches need an operator
+		Retries: map[upgrade.Phase]int{
+			upgrade.PhaseResolve:   conf.Phases.Retries,
+			upgrade.PhasePreflight: conf.Phases.Retries,
+			upgrade.PhasePrefetch:  conf.Phases.Retries,
+		},
+		RetryDelay:       conf.Phases.RetryDelay,
+		Limits:           phaseLimits(),
+		SwitchRetries:    conf.Switch.Retries,
+		SwitchRetryDelay: conf.Switch.RetryDelay,
+		PluginDir:        conf.PluginDir,
+	}
+	if conf.EvalFree {
+		opts.Rebuilder = upgrade.StorePathRebuilder{}
+	}
+	if conf.PolicyFromFlake {
+		opts.Policy = flakePolicy
+	}
+	if conf.InhibitSleep {
+		opts.Inhibit = func(ctx context.Context) (func(), error) {
+			return systemd.Inhibit(ctx, []string{"sleep", "shutdown"}, "Upgrading NixOS")
+		}
+	}
+	opts.PinnedKeys = conf.Nix.PinnedKeys
+	if conf.Nix.PreferChunked {
+		opts.EstimateDownload = !preferChunked()
+	}
+	if conf.Reproducibility != "off" {
+		opts.Reproducibility = conf.Reproducibility
+	}
+	if conf.OfflineCheck {
+		opts.Connectivity = upgrade.CheckerFunc(online)
+	}
+	// the local system's state says nothing about a --target-host
+	if conf.Degraded != "ignore" && opts.TargetHost == "" {
+		opts.HealthChecks = append(opts.HealthChecks, severity("system-state", upgrade.SystemStateChecker{Policy: conf.Degraded}))
+	}
+	if len(conf.HealthCheck.Units) > 0 && opts.TargetHost == "" {
+		opts.HealthChecks = append(opts.HealthChecks, severity("units", upgrade.UnitsChecker{Units: conf.HealthCheck.Units}))
+	}
+	opts.HealthChecks = append(opts.HealthChecks, canaryChecks()...)
+	opts.PostChecks = postChecks()
+	// the motd describes this machine, not a --target-host
+	if conf.Motd != "" && opts.TargetHost == "" {
+		opts.Sinks = append(opts.Sinks, events.SinkFunc(writeMotd))
+	}
+	if conf.MetricsTextfile != "" && opts.TargetHost == "" {
+		opts.Sinks = append(opts.Sinks, events.SinkFunc(writeMetrics))
+	}
+	if conf.Hydra.Freshness > 0 {
+		// the primary job, fallbacks are there for when it goes stale
+		opts.Freshness = &upgrade.Freshness{
+			Client: hydra.HydraClient{
+				Instance: conf.Hydra.Instance,
+				Domain:   conf.Hydra.DiscoveryDomain,
+				JobSet:   nix.ExpandSystem(conf.Hydra.JobSet),
+				Job:      nix.ExpandSystem(conf.Hydra.Job),
+				Project:  conf.Hydra.Project,
+				HTTP:     network.HTTPClient(conf.IPFamily),
+			},
+			Window: conf.Hydra.Freshness,
+		}
+	}
+	if len(conf.Hydra.Products) > 0 {
+		// build ids are unique to the instance, whichever job the target came from
+		opts.Artifacts = upgrade.HydraProducts{
+			Client: hydra.HydraClient{
+				Instance: conf.Hydra.Instance,
+				Domain:   conf.Hydra.DiscoveryDomain,
+				HTTP:     network.HTTPClient(conf.IPFamily),
+			},
+			Names: conf.Hydra.Products,
+			Dir:   conf.Hydra.ProductsDir,
+		}
+	}
+	if conf.SBOM.Enable {
+		opts.SBOM = &upgrade.SBOM{
+			Format: conf.SBOM.Format,
+			Dir:    conf.SBOM.Dir,
+		}
+		// licenses are evaluated from the flake, which eval-free upgrades avoid
+		if !conf.EvalFree {
+			opts.SBOM.Host = conf.NixOSRebuild.Host
+		}
+	}
+	if len(conf.Snapshots.ZFSDatasets) > 0 {
+		opts.Snapshotters = append(opts.Snapshotters, snapshots.ZFS{Datasets: conf.Snapshots.ZFSDatasets})
+	}
+	if len(conf.Snapshots.BtrfsSubvolumes) > 0 {
+		opts.Snapshotters = append(opts.Snapshotters, snapshots.Btrfs{Subvolumes: conf.Snapshots.BtrfsSubvolumes})
+	}
+	if conf.Approval.Required {
+		opts.Approval = &approval.File{
+			Path:           conf.Approval.File,
+			AllowedSigners: conf.Approval.AllowedSigners,
+		}
+	}
+	if conf.BootCounting.Enable {
+		opts.BootCounting = &upgrade.BootCounting{
+			Loader: systemdBoot(),
+			Tries:  conf.BootCounting.Tries,
+		}
+	}
+	if conf.Wait.Enable {
+		opts.Wait = conf.Wait.Timeout
+		opts.WaitInterval = conf.Wait.Interval
+	}
+	if conf.Kubernetes.Drain {
+		opts.Kubernetes = &upgrade.Kubernetes{
+			Node:      kubernetesNode(),
+			DrainArgs: conf.Kubernetes.DrainArgs,
+		}
+	}
+	return opts
+}
+
+/*
+Reads upgrade policy from system.autoUpgradeHydra.settings of the target's
+flake, replacing `conf` with one layering it over the config file, and the
+policy of `opts` with options built from it.
+*/
+func flakePolicy(ctx context.Context, target upgrade.Target, opts *upgrade.Options) error {
+	settings, err := nix.SystemSettings(ctx, target.Flake, conf.NixOSRebuild.Host)
+	if err != nil {
+		return err
+	}
+	policy, ignored := config.FilterPolicy(settings)
+	if len(ignored) > 0 {
+		slog.Debug("Ignoring flake settings that aren't upgrade policy.", slog.String("settings", strings.Join(ignored, ", ")))
+	}
+	policyConf, err := config.InitializeConfigWithPolicy(confCmd, confArgs, policy)
+	if err != nil {
+		return fmt.Errorf("flake policy: %w", err)
+	}
+	err = policyConf.Validate()
+	if err != nil {
+		return fmt.Errorf("flake policy: %w", err)
+	}
+	conf = policyConf
+
+	// gates read `conf` when checked, the rest is rebuilt
+	applied := upgradeOptions()
+	opts.Reboot = applied.Reboot
+	opts.Gates = applied.Gates
+	opts.HealthChecks = applied.HealthChecks
+	opts.PostChecks = applied.PostChecks
+	opts.Restarts = applied.Restarts
+	opts.Rollback = applied.Rollback
+	opts.MaxDownloadMiB = applied.MaxDownloadMiB
+	slog.Info("Applied upgrade policy from the flake.", slog.String("flake", target.Flake))
+	return nil
+}
+
+/*
+Resource limits of the phases evaluating and fetching the target system.
+Transient scopes need root, read-only runs like check aren't limited.
+*/
+func phaseLimits() map[upgrade.Phase]runner.Limits {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	eval := resourceLimits(conf.Limits.Eval)
+	return map[upgrade.Phase]runner.Limits{
+		upgrade.PhaseResolve:   eval,
+		upgrade.PhasePreflight: eval,
+		upgrade.PhasePrefetch:  resourceLimits(conf.Limits.Download),
+	}
+}
+
+func resourceLimits(limits config.ResourceLimitsConfig) runner.Limits {
+	return runner.Limits{
+		Nice:      limits.Nice,
+		CPUWeight: limits.CPUWeight,
+		IOWeight:  limits.IOWeight,
+		MemoryMax: limits.MemoryMax,
+	}
+}
+
+// Pings canary hosts, connects to ssh hosts, and runs health check scripts, see healthcheck.
+func canaryChecks() []upgrade.Checker {
+	canaries := []healthcheck.Check{}
+	for _, host := range conf.HealthCheck.CanaryHosts {
+		canaries = append(canaries, healthcheck.PingCheck{Host: host, Family: conf.IPFamily})
+	}
+	for _, host := range conf.HealthCheck.SSHHosts {
+		canaries = append(canaries, healthcheck.SSHCheck{Host: host, Options: healthcheck.SSHOptions{
+			Command:    conf.HealthCheck.SSHCommand,
+			Identity:   conf.HealthCheck.SSHIdentity,
+			KnownHosts: conf.HealthCheck.SSHKnownHosts,
+			Family:     conf.IPFamily,
+		}})
+	}
+	for _, canary := range conf.HealthCheck.Canaries {
+		if canary.Type == "tcp" {
+			canaries = append(canaries, healthcheck.TCPCheck{
+				Host:    canary.Host,
+				Port:    canary.Port,
+				Timeout: canary.Timeout,
+				Family:  conf.IPFamily,
+			})
+			continue
+		}
+		check := healthcheck.HTTPCheck{
+			URL:     canary.URL,
+			Status:  canary.Status,
+			Timeout: canary.Timeout,
+			Family:  conf.IPFamily,
+		}
+		// validated with the config
+		if canary.Body != "" {
+			check.Body = regexp.MustCompile(canary.Body)
+		}
+		canaries = append(canaries, check)
+	}
+	for _, script := range conf.HealthCheck.Scripts {
+		canaries = append(canaries, healthcheck.ScriptCheck{Command: script, Timeout: conf.HealthCheck.ScriptTimeout})
+	}
+	checks := []upgrade.Checker{}
+	for _, canary := range canaries {
+		checks = append(checks, severity(canary.Name(), upgrade.CanaryChecker{Canary: canary}))
+	}
+	return checks
+}
+
+// Checks run after switching, and by confirm before keeping a new generation.
+func postChecks() []upgrade.Checker {
+	checks := []upgrade.Checker{}
+	if conf.Verify.SystemRunning {
+		checks = append(checks, severity("system-running", upgrade.RunningChecker{Timeout: conf.Verify.RunningTimeout}))
+	}
+	if len(conf.HealthCheck.Units) > 0 {
+		// switches restart units, give them as long as the system gets to start
+		checks = append(checks, severity("units", upgrade.UnitsChecker{
+			Units:   conf.HealthCheck.Units,
+			Timeout: conf.Verify.RunningTimeout,
+		}))
+	}
+	if len(conf.Secrets.Paths) > 0 {
+		// validated by initConfig
+		secrets, _ := secrets()
+		checks = append(checks, severity("secrets", upgrade.SecretsChecker{Secrets: secrets}))
+	}
+	if conf.Verify.JournalWindow > 0 {
+		checks = append(checks, severity("journal", upgrade.JournalChecker{
+			Window:    conf.Verify.JournalWindow,
+			MaxErrors: conf.Verify.MaxJournalErrors,
+		}))
+	}
+	if conf.Verify.HealthChecks {
+		checks = append(checks, canaryChecks()...)
+	}
+	return checks
+}
+
+// Set in the environment of re-executed processes, so they never re-exec again.
+const reexecEnv = "NIXOS_HYDRA_UPGRADE_REEXECED"
+
+/*
+Re-execs the upgraded executable with our arguments, nil when disabled or
+already re-executed. Only the upgrade command re-execs, the daemon picks up
+a new executable when its service restarts.
+*/
+func reexec() *upgrade.Reexec {
+	if !conf.Reexec || os.Getenv(reexecEnv) != "" {
+		return nil
+	}
+	return &upgrade.Reexec{
+		Binary: "sw/bin/nixos-hydra-upgrade",
+		Exec: func(binary string) error {
+			args := append([]string{binary}, os.Args[1:]...)
+			return syscall.Exec(binary, args, append(os.Environ(), reexecEnv+"=1"))
+		},
+	}
+}
+
+// Writes the system's upgrade status to `conf.Motd` after each run.
+func writeMotd(ctx context.Context, event events.Event) {
+	if event.Type != events.RunFinished {
+		return
+	}
+	status := motd.Status{}
+	switch upgrade.Outcome(event.Outcome) {
+	case upgrade.OutcomeSuccess, upgrade.OutcomeUpToDate:
+		status.BuildID = event.BuildID
+		status.Revision = event.FlakeRev
+	case upgrade.OutcomeAvailable:
+		status.Available = event.BuildID
+	}
+	if event.Failed {
+		status.Failed = event.Outcome
+		status.Finished = event.Time
+	}
+	generation, err := nix.SystemGeneration()
+	if err == nil {
+		status.Generation = generation
+	}
+	// the profile link is replaced whenever a new generation is set
+	info, err := os.Lstat(nix.SystemProfile)
+	if err == nil {
+		status.Upgraded = info.ModTime()
+	}
+	booted, bootedErr := nix.SystemPath(nix.BootedSystem)
+	staged, stagedErr := nix.SystemPath(nix.SystemProfile)
+	status.RebootPending = bootedErr == nil && stagedErr == nil && booted != staged
+
+	err = motd.Write(conf.Motd, status)
+	if err != nil {
+		slog.Warn("Unable to write motd.", slog.String("path", conf.Motd), slog.String("error", err.Error()))
+	}
+}
+
+// Writes generation metrics to `conf.MetricsTextfile` after each run.
+func writeMetrics(ctx context.Context, event events.Event) {
+	if event.Type != events.RunFinished {
+		return
+	}
+	status := metrics.Status{
+		LatestBuildID:   event.BuildID,
+		CurrentRevision: event.CurrentRev,
+		LatestRevision:  event.FlakeRev,
+		Current:         event.CurrentModified,
+		Latest:          event.LatestModified,
+		Outcome:         event.Outcome,
+		Finished:        event.Time,
+	}
+	// the target is now the system profile
+	if upgrade.Outcome(event.Outcome) == upgrade.OutcomeSuccess {
+		status.CurrentRevision = status.LatestRevision
+		status.Current = status.Latest
+	}
+	booted, bootedErr := nix.SystemPath(nix.BootedSystem)
+	staged, stagedErr := nix.SystemPath(nix.SystemProfile)
+	status.RebootPending = bootedErr == nil && stagedErr == nil && booted != staged
+
+	err := metrics.Write(conf.MetricsTextfile, status)
+	if err != nil {
+		slog.Warn("Unable to write metrics.", slog.String("path", conf.MetricsTextfile), slog.String("error", err.Error()))
+	}
+}
+
+// Builds the upgrade gates from `conf`.
+func upgradeGates() upgrade.Gates {
+	hold := severity("hold", gate(func() error { return gates.Hold(conf.HoldFile) }))
+	uptime := severity("uptime", gate(func() error { return gates.Uptime(conf.Gates.MinUptime) }))
+	inhibitors := severity("inhibitors", gate(func() error { return gates.Inhibitors(conf.Gates.Inhibitors) }))
+	backups := severity("backups", gate(func() error { return gates.Backups(conf.Gates.BackupUnits) }))
+	overlay := severity("overlay", gate(func() error {
+		return gates.Overlay(gates.OverlayPolicy{
+			Tailscale:           conf.Gates.Tailscale,
+			WireGuardInterfaces: conf.Gates.WireGuardInterfaces,
+			Peers:               conf.Gates.OverlayPeers,
+			Family:              conf.IPFamily,
+		})
+	}))
+	workloads := severity("workloads", gate(func() error {
+		return gates.Workloads(gates.WorkloadPolicy{
+			LibvirtDomains: conf.Gates.LibvirtDomains,
+			Containers:     conf.Gates.Containers,
+		})
+	}))
+
+	start := []upgrade.Checker{hold, overlay}
+	if conf.Gates.TimeSync {
+		// build ages, rollouts, and freshness are measured against the clock
+		start = append(start, severity("time-sync", gate(gates.TimeSync)))
+	}
+	if conf.Reboot {
+		start = append(start, uptime)
+	}
+	reboot := []upgrade.Checker{uptime, inhibitors, backups}
+	if conf.SecureBoot.Verify {
+		reboot = append(reboot, severity("secure-boot", upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return bootloader.VerifySecureBoot(ctx)
+		})))
+	}
+	// validated by initConfig
+	built, _ := dependencies()
+	upgrades := append([]upgrade.Checker{severity("rollout", upgrade.CheckerFunc(rollout))}, built...)
+	for _, spec := range conf.Constraints {
+		// validated by conf.Validate
+		constraint, _ := gates.ParseConstraint(spec)
+		upgrades = append(upgrades, severity("constraint:"+constraint.Option, upgrade.ConstraintChecker{
+			Host:       conf.NixOSRebuild.Host,
+			Constraint: constraint,
+		}))
+	}
+	if conf.FlakeCheck.Enable {
+		upgrades = append(upgrades, severity("flake-check", upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			slog.Info("Checking flake.", slog.String("flake", target.Flake))
+			return nix.FlakeCheck(ctx, target.Flake, conf.FlakeCheck.Checks)
+		})))
+	}
+	return upgrade.Gates{
+		Start:     start,
+		Upgrade:   upgrades,
+		Switch:    []upgrade.Checker{inhibitors, backups},
+		Reboot:    reboot,
+		Workloads: workloads,
+	}
+}
+
+/*
+Marks the gate or health check `name` advisory when it matches a pattern of
+conf.AdvisoryChecks, see upgrade.Advisory.
+*/
+func severity(name string, checker upgrade.Checker) upgrade.Checker {
+	for _, pattern := range conf.AdvisoryChecks {
+		// validated by initConfig
+		matched, _ := path.Match(pattern, name)
+		if matched {
+			return upgrade.Advisory{Name: name, Checker: checker}
+		}
+	}
+	return checker
+}
+
+// Adapts a gate that doesn't depend on the upgrade target.
+func gate(check func() error) upgrade.Checker {
+	return upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+		return check()
+	})
+}
+
+// Checks that the hydra instance is reachable. Only fails when the network is known to be offline.
+func online(ctx context.Context, target upgrade.Target) error {
+	host := conf.Hydra.DiscoveryDomain
+	if conf.Hydra.Instance != "" {
+		instance, err := url.Parse(conf.Hydra.Instance)
+		if err != nil {
+			return nil
+		}
+		host = instance.Hostname()
+	}
+	err := network.Online(host, conf.IPFamily)
+	if err != nil && !errors.Is(err, network.ErrOffline) {
+		slog.Warn("Unable to check connectivity.", slog.String("error", err.Error()))
+		return nil
+	}
+	return err
+}
+
+// Staged rollout gate for this host.
+func rollout(ctx context.Context, target upgrade.Target) error {
+	policy := gates.RolloutPolicy{
+		Percentage:   conf.Rollout.Percentage,
+		WidenPerHour: conf.Rollout.WidenPerHour,
+	}
+	return gates.Rollout(policy, conf.Hostname, target.BuildID, target.Finished)
+}
+
+func systemdBoot() bootloader.SystemdBoot {
+	return bootloader.SystemdBoot{
+		ESP:       conf.BootCounting.ESP,
+		BlessBoot: conf.BootCounting.BlessBoot,
+	}
+}
+
+func kubernetesNode() kubernetes.Node {
+	return kubernetes.Node{
+		Name:       conf.Kubernetes.Node,
+		Kubeconfig: conf.Kubernetes.Kubeconfig,
+	}
+}
+
+/*
+Uncordons the kubernetes node if enabled. Only nodes drained by
+nixos-hydra-upgrade are uncordoned, including drains from runs that
+rebooted the system.
+*/
+func uncordon(ctx context.Context) {
+	if !conf.Kubernetes.Drain {
+		return
+	}
+	err := kubernetesNode().Uncordon(ctx)
+	if err != nil {
+		slog.Error("Kubernetes node uncordon failed.", slog.String("error", err.Error()))
+	}
+}
+
+// Asks a yes/no question on the terminal, answering no when not interactive.
+func prompt(question string) bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Print(question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// Runs on-failure hooks for `outcome`, returning an OutcomeError for `err`.
+func fail(ctx context.Context, env hooks.Env, outcome upgrade.Outcome, err error) error {
+	env.Outcome = string(outcome)
+	hookErr := hooks.Run(ctx, "on-failure", conf.Hooks.OnFailure, env)
+	if hookErr != nil {
+		slog.Error("On-failure hook failed.", slog.String("error", hookErr.Error()))
+	}
+	return &OutcomeError{Outcome: outcome, Err: err}
+}
+
+/*
+Runs on-rollback hooks and rollback plugins for an automatic rollback from
+`from` to `to`, then fails like fail.
+*/
+func rollingBack(ctx context.Context, env hooks.Env, outcome upgrade.Outcome, from string, to string, err error) error {
+	slog.Error("Automatic rollback triggered.", slog.String("outcome", string(outcome)), slog.String("from", from), slog.String("to", to))
+	rollbackEnv := env
+	rollbackEnv.Outcome = string(outcome)
+	rollbackEnv.RollbackFrom = from
+	rollbackEnv.RollbackTo = to
+	rollbackEnv.Error = err.Error()
+	hookErr := hooks.Run(ctx, "on-rollback", conf.Hooks.OnRollback, rollbackEnv)
+	if hookErr != nil {
+		slog.Error("On-rollback hook failed.", slog.String("error", hookErr.Error()))
+	}
+	if conf.PluginDir != "" {
+		found, pluginErr := plugins.Discover(conf.PluginDir)
+		if pluginErr != nil {
+			slog.Error("Unable to load plugins.", slog.String("dir", conf.PluginDir), slog.String("error", pluginErr.Error()))
+		}
+		plugins.Notify(ctx, found, plugins.Request{
+			Point:        plugins.PointRollback,
+			Operation:    env.Operation,
+			Outcome:      string(outcome),
+			Error:        err.Error(),
+			Priority:     "high",
+			RollbackFrom: from,
+			RollbackTo:   to,
+		})
+	}
+	return fail(ctx, env, outcome, err)
+}
+
 // usage string Sprintf helper
 func flagUsage(viperKey, usage string, required bool) string {
 	reqStr := ""
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/control"
+	"github.com/spf13/cobra"
+)
+
+// Lines of stderr printed for failed runs.
+const statusStderrLines = 5
+
+func printResult(w io.Writer, label string, result control.Result) {
+	kind := "upgrade"
+	if result.Check {
+		kind = "check"
+	} else if result.Prefetch {
+		kind = "prefetch"
+	}
+	fmt.Fprintf(w, "%-10s%s %s at %s (%s)\n", label, kind, result.Outcome,
+		result.Finished.Format(time.RFC3339), result.Finished.Sub(result.Started).Round(time.Second))
+	if result.Annotation != "" {
+		fmt.Fprintf(w, "%-10s%s\n", "", result.Annotation)
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "%-10s%s\n", "", result.Error)
+	}
+	// the last few lines are usually enough to tell what went wrong
+	stderr := strings.Split(strings.TrimRight(result.Stderr, "\n"), "\n")
+	for _, line := range stderr[max(len(stderr)-statusStderrLines, 0):] {
+		if line != "" {
+			fmt.Fprintf(w, "%-12s%s\n", "", line)
+		}
+	}
+	if len(result.FailedUnits) > 0 {
+		fmt.Fprintf(w, "%-10sunits failed after switching: %s\n", "", strings.Join(result.FailedUnits, ", "))
+	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(w, "%-10sadvisory check failed: %s\n", "", warning)
+	}
+	if len(result.Phases) > 0 {
+		timings := []string{}
+		for _, timing := range result.Phases {
+			timings = append(timings, fmt.Sprintf("%s %s", timing.Phase, timing.Duration.Round(time.Millisecond)))
+		}
+		fmt.Fprintf(w, "%-10sphases: %s\n", "", strings.Join(timings, ", "))
+	}
+	if len(result.SwitchAttempts) > 1 {
+		fmt.Fprintf(w, "%-10sswitched in %d attempts\n", "", len(result.SwitchAttempts))
+	}
+}
+
+func printStatus(w io.Writer, status control.Status) {
+	state := "idle"
+	if status.Running && status.Phase != "" {
+		state = "running, " + status.Phase
+	} else if status.Running {
+		state = "running"
+	}
+	fmt.Fprintf(w, "%-10s%s\n", "daemon:", state)
+	if !status.Next.IsZero() {
+		fmt.Fprintf(w, "%-10s%s\n", "next:", status.Next.Format(time.RFC3339))
+	}
+	if status.Last != nil {
+		printResult(w, "last:", *status.Last)
+	}
+	if status.Run != nil {
+		fmt.Fprintf(w, "%-10sbuild %d %s, %s\n", "upgrade:", status.Run.BuildID, status.Run.Operation, status.Run.Phase)
+		if status.Run.Annotation != "" {
+			fmt.Fprintf(w, "%-10s%s\n", "", status.Run.Annotation)
+		}
+	}
+	if status.Completed != nil {
+		fmt.Fprintf(w, "%-10sbuild %d after reboot at %s\n", "booted:", status.Completed.BuildID, status.Completed.Completed.Format(time.RFC3339))
+	}
+	if status.Hold != nil {
+		fmt.Fprintf(w, "%-10s%s (since %s)\n", "held:", status.Hold.Reason, status.Hold.Since.Format(time.RFC3339))
+	}
+}
+
+// statusCmd represents the status command
+func NewStatusCommand() *cobra.Command {
+	var flagJSON, flagHistory bool
+
+	statusCommand := &cobra.Command{
+		Use:   "status",
+		Short: "Shows the status of the running daemon",
+		Long: `Queries the control API of a running nixos-hydra-upgrade daemon on daemon.socket, showing whether a run is in progress, the next scheduled upgrade, the most recent run, upgrade progress, and holds.
+
+Users without access to daemon.socket fall back to daemon.read-only-socket when it's set.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			// only the socket is needed, the rest of the config may be incomplete
+			var err error
+			conf, err = config.InitializeConfig(cmd.Root(), nil)
+			return err
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			query := func(socket string) (any, error) {
+				client := control.Client{Socket: socket}
+				if flagHistory {
+					return client.History(cmd.Context())
+				}
+				return client.Status(cmd.Context())
+			}
+
+			socket := conf.Daemon.Socket
+			v, err := query(socket)
+			// unprivileged users fall back to the read-only socket
+			if errors.Is(err, fs.ErrPermission) && conf.Daemon.ReadOnlySocket != "" {
+				socket = conf.Daemon.ReadOnlySocket
+				v, err = query(socket)
+			}
+			if err != nil {
+				return fmt.Errorf("querying daemon on %s: %w", socket, err)
+			}
+
+			w := cmd.OutOrStdout()
+			if flagJSON {
+				encoder := json.NewEncoder(w)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(v)
+			}
+			switch v := v.(type) {
+			case control.Status:
+				printStatus(w, v)
+			case []control.Result:
+				for _, result := range v {
+					printResult(w, "", result)
+				}
+			}
+			return nil
+		},
+	}
+	statusCommand.Flags().BoolVar(&flagJSON, "json", false, "Output JSON")
+	statusCommand.Flags().BoolVar(&flagHistory, "history", false, "Show results of recent runs instead")
+
+	return statusCommand
+}
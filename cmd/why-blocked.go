@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+	"github.com/spf13/cobra"
+)
+
+func printBlockers(w io.Writer, blockers []upgrade.Blocker) {
+	if len(blockers) == 0 {
+		fmt.Fprintln(w, "Nothing is blocking an upgrade.")
+		return
+	}
+	for _, blocker := range blockers {
+		reason := blocker.Reason
+		if blocker.Failed {
+			reason += " (fails the upgrade)"
+		}
+		if blocker.Advisory {
+			reason += " (advisory, doesn't block)"
+		}
+		fmt.Fprintf(w, "%-20s%s\n", blocker.Check+":", reason)
+	}
+}
+
+// whyBlockedCmd represents the why-blocked command
+func NewWhyBlockedCommand() *cobra.Command {
+	var flagJSON bool
+
+	whyBlockedCommand := &cobra.Command{
+		Use:   "why-blocked",
+		Short: "Explains what is preventing an upgrade",
+		Long: `Checks every condition an upgrade checks, in report-only mode, and explains each one currently preventing an upgrade, e.g. an unfinished build, a canary that's down, a hold file, or gates deferring the upgrade. Unlike an upgrade run, checking doesn't stop at the first blocker.
+
+Nothing is fetched or activated, no state, motd, or notifications are written, and no hooks or plugins run. Reboot gates are only checked when rebooting is enabled, and switch gates only for switches.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return initConfig(cmd, nil)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			initLogging()
+
+			blockers := upgrade.Explain(cmd.Context(), upgradeOptions())
+			// validated by initConfig
+			schedules, _ := daemonSchedules()
+			if schedules.activate != nil {
+				blockers = append(blockers, upgrade.Blocker{
+					Check:  "activate schedule",
+					Reason: fmt.Sprintf("the daemon only activates upgrades on daemon.activate-schedule, next at %s", schedules.activate.Next(time.Now()).Format(time.DateTime)),
+				})
+			}
+
+			w := cmd.OutOrStdout()
+			if flagJSON {
+				if blockers == nil {
+					blockers = []upgrade.Blocker{}
+				}
+				encoder := json.NewEncoder(w)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(blockers)
+			}
+			printBlockers(w, blockers)
+			return nil
+		},
+	}
+	whyBlockedCommand.Flags().BoolVar(&flagJSON, "json", false, "Output JSON")
+
+	return whyBlockedCommand
+}
@@ -0,0 +1,107 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Client of the control API of a running daemon.
+type Client struct {
+	// unix socket the daemon serves the control API on
+	Socket string
+}
+
+func (client Client) do(ctx context.Context, method string, path string, body any, v any) error {
+	var payload bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&payload).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+	// the host is ignored, requests are always sent to the socket
+	request, err := http.NewRequestWithContext(ctx, method, "http://nixos-hydra-upgrade"+path, &payload)
+	if err != nil {
+		return err
+	}
+	httpClient := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", client.Socket)
+		},
+	}}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusConflict {
+		return ErrBusy
+	}
+	if response.StatusCode != http.StatusOK {
+		var errResponse errorResponse
+		err = json.NewDecoder(response.Body).Decode(&errResponse)
+		if err != nil || errResponse.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, path, response.Status)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, errResponse.Error)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func (client Client) Status(ctx context.Context) (Status, error) {
+	var status Status
+	err := client.do(ctx, http.MethodGet, "/status", nil, &status)
+	return status, err
+}
+
+func (client Client) History(ctx context.Context) ([]Result, error) {
+	var history []Result
+	err := client.do(ctx, http.MethodGet, "/history", nil, &history)
+	return history, err
+}
+
+// Checks for a newer build, returning ErrBusy if a run is in progress.
+func (client Client) Check(ctx context.Context) (Result, error) {
+	var result Result
+	err := client.do(ctx, http.MethodPost, "/check", nil, &result)
+	return result, err
+}
+
+/*
+Runs an upgrade annotated with `annotation`, see Request.Annotation.
+Returns ErrBusy if a run is in progress.
+*/
+func (client Client) Upgrade(ctx context.Context, annotation string) (Result, error) {
+	var result Result
+	err := client.do(ctx, http.MethodPost, "/upgrade", upgradeRequest{Annotation: annotation}, &result)
+	return result, err
+}
+
+/*
+Approves a build, or the prefetched build when 0, and runs an upgrade
+activating it, annotated with `annotation`. Returns ErrBusy if a run is in
+progress.
+*/
+func (client Client) Approve(ctx context.Context, buildID int, annotation string) (Result, error) {
+	var result Result
+	err := client.do(ctx, http.MethodPost, "/approve", approveRequest{BuildID: buildID, Annotation: annotation}, &result)
+	return result, err
+}
+
+func (client Client) Hold(ctx context.Context, reason string) (Status, error) {
+	var status Status
+	err := client.do(ctx, http.MethodPost, "/hold", holdRequest{Reason: reason}, &status)
+	return status, err
+}
+
+func (client Client) Unhold(ctx context.Context) (Status, error) {
+	var status Status
+	err := client.do(ctx, http.MethodDelete, "/hold", nil, &status)
+	return status, err
+}
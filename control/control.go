@@ -0,0 +1,123 @@
+/*
+Package control implements the local control API of the daemon, served as
+JSON over HTTP on a unix socket, and a client for it.
+
+	GET    /status   daemon status
+	GET    /history  results of recent runs, oldest first
+	POST   /check    checks for a newer build
+	POST   /upgrade  runs an upgrade, optional body {"annotation": "..."}
+	POST   /hold     pauses upgrades, body {"reason": "..."}
+	DELETE /hold     resumes upgrades
+	POST   /approve  approves and activates a prefetched build, body {"buildId": 123, "annotation": "..."}, the staged build if omitted
+
+Checks, upgrades, and approvals respond once the run completes, with 409 Conflict if
+another run is already in progress.
+*/
+package control
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+)
+
+// Returned when a run is requested while another is in progress.
+var ErrBusy = errors.New("a run is already in progress")
+
+// What a run does, a full upgrade when empty.
+type Request struct {
+	// only check for a newer build
+	Check bool
+	// stop once the newer build is fetched, see upgrade.Options.Prefetch
+	Prefetch bool
+	// operator note on why the run was triggered, see upgrade.Options.Annotation
+	Annotation string
+}
+
+// Result of a check or upgrade run by the daemon.
+type Result struct {
+	// only checked for a newer build
+	Check bool `json:"check"`
+	// only fetched the newer build
+	Prefetch bool            `json:"prefetch,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Outcome  upgrade.Outcome `json:"outcome"`
+	Error    string          `json:"error,omitempty"`
+	// the end of the stderr of the command that failed the run
+	Stderr string `json:"stderr,omitempty"`
+	// units that failed after switching
+	FailedUnits []string `json:"failedUnits,omitempty"`
+	// failures of advisory checks that didn't stop the run
+	Warnings []string `json:"warnings,omitempty"`
+	// nixos-rebuild attempts, more than one when switching was retried
+	SwitchAttempts []SwitchAttempt `json:"switchAttempts,omitempty"`
+	// wall-clock time of each phase run, in order
+	Phases []events.PhaseTiming `json:"phases,omitempty"`
+	// see Request.Annotation
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// A nixos-rebuild attempt of a run, see upgrade.Options.SwitchRetries.
+type SwitchAttempt struct {
+	Finished time.Time     `json:"finished"`
+	Duration time.Duration `json:"duration"`
+	// empty when the attempt succeeded
+	Outcome upgrade.Outcome `json:"outcome,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type Status struct {
+	// a check or upgrade is in progress
+	Running bool `json:"running"`
+	// phase of the run in progress, see upgrade.Phase
+	Phase string `json:"phase,omitempty"`
+	// next scheduled upgrade, zero if none is scheduled
+	Next time.Time `json:"next,omitzero"`
+	// most recent run, nil before the first run completes
+	Last *Result `json:"last,omitempty"`
+	// upgrade in progress, see state.State
+	Run *state.Run `json:"run,omitempty"`
+	// operator hold, see state.State
+	Hold *state.Hold `json:"hold,omitempty"`
+	// most recent upgrade completed after rebooting, see state.State
+	Completed *state.Completion `json:"completed,omitempty"`
+}
+
+type holdRequest struct {
+	Reason string `json:"reason"`
+}
+
+type upgradeRequest struct {
+	Annotation string `json:"annotation,omitempty"`
+}
+
+type approveRequest struct {
+	// 0 approves the prefetched build
+	BuildID    int    `json:"buildId,omitempty"`
+	Annotation string `json:"annotation,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Operations the daemon performs on behalf of API clients.
+type Daemon interface {
+	// Runs an upgrade, or only part of one, see Request.
+	Run(ctx context.Context, request Request) (upgrade.Outcome, error)
+	// Pauses upgrades, see gates.Hold.
+	Hold(reason string) error
+	// Resumes upgrades paused by Hold.
+	Unhold() error
+	// Approves activating a build, or the prefetched build when 0, see upgrade.Options.Approval.
+	Approve(buildID int) error
+	// Loads the persisted upgrade state.
+	State() (state.State, error)
+	// Loads the hold pausing upgrades, nil when not held.
+	Held() (*state.Hold, error)
+}
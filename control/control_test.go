@@ -0,0 +1,264 @@
+package control_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/control"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+)
+
+type fakeDaemon struct {
+	// blocks runs until closed
+	release chan struct{}
+	hold    *state.Hold
+	// build id passed to Approve
+	approved int
+	// annotation of the last run
+	annotation string
+	// delivered to sink during runs
+	events []events.Event
+	sink   events.Sink
+}
+
+func (daemon *fakeDaemon) Run(ctx context.Context, request control.Request) (upgrade.Outcome, error) {
+	<-daemon.release
+	daemon.annotation = request.Annotation
+	for _, event := range daemon.events {
+		daemon.sink.Handle(ctx, event)
+	}
+	if request.Check {
+		return upgrade.OutcomeAvailable, nil
+	}
+	return upgrade.OutcomeRebuildFailed, errors.New("exit status 1")
+}
+
+func (daemon *fakeDaemon) Hold(reason string) error {
+	daemon.hold = &state.Hold{Reason: reason}
+	return nil
+}
+
+func (daemon *fakeDaemon) Unhold() error {
+	daemon.hold = nil
+	return nil
+}
+
+func (daemon *fakeDaemon) Approve(buildID int) error {
+	daemon.approved = buildID
+	return nil
+}
+
+func (daemon *fakeDaemon) State() (state.State, error) {
+	return state.State{}, nil
+}
+
+func (daemon *fakeDaemon) Held() (*state.Hold, error) {
+	return daemon.hold, nil
+}
+
+func serve(t *testing.T, daemon control.Daemon) control.Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	server := &control.Server{Daemon: daemon}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, socket)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+
+	client := control.Client{Socket: socket}
+	for range 100 {
+		_, err := client.Status(ctx)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client
+}
+
+func TestControl(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("runs checks and upgrades", func(t *testing.T) {
+		daemon := &fakeDaemon{release: make(chan struct{})}
+		close(daemon.release)
+		client := serve(t, daemon)
+
+		result, err := client.Check(ctx)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, result.Check, true)
+		assert.Equal(t, result.Outcome, upgrade.OutcomeAvailable)
+
+		result, err = client.Upgrade(ctx, "CHG-1234: kernel CVE")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, result.Outcome, upgrade.OutcomeRebuildFailed)
+		assert.Equal(t, result.Error, "exit status 1")
+		assert.Equal(t, result.Annotation, "CHG-1234: kernel CVE")
+		assert.Equal(t, daemon.annotation, "CHG-1234: kernel CVE")
+
+		status, err := client.Status(ctx)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, status.Running, false)
+		assert.Equal(t, status.Last.Outcome, upgrade.OutcomeRebuildFailed)
+
+		history, err := client.History(ctx)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(history), 2)
+		assert.Equal(t, history[1].Annotation, "CHG-1234: kernel CVE")
+	})
+
+	t.Run("rejects concurrent runs", func(t *testing.T) {
+		daemon := &fakeDaemon{release: make(chan struct{})}
+		client := serve(t, daemon)
+
+		done := make(chan struct{})
+		go func() {
+			client.Upgrade(ctx, "")
+			close(done)
+		}()
+		for {
+			status, _ := client.Status(ctx)
+			if status.Running {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, err := client.Check(ctx)
+		assert.Equal(t, err, control.ErrBusy)
+		close(daemon.release)
+		<-done
+	})
+
+	t.Run("scheduled runs wait for checks", func(t *testing.T) {
+		daemon := &fakeDaemon{release: make(chan struct{})}
+		server := &control.Server{Daemon: daemon}
+
+		checked := make(chan control.Result)
+		go func() {
+			result, _ := server.Trigger(ctx, control.Request{Check: true})
+			checked <- result
+		}()
+		for !server.Status().Running {
+			time.Sleep(10 * time.Millisecond)
+		}
+		scheduled := make(chan error)
+		go func() {
+			_, err := server.Scheduled(ctx, control.Request{})
+			scheduled <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		daemon.release <- struct{}{}
+		result := <-checked
+		assert.Equal(t, result.Check, true)
+		for !server.Status().Running {
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, err := server.Trigger(ctx, control.Request{Check: true})
+		assert.Equal(t, err, control.ErrBusy)
+		daemon.release <- struct{}{}
+		assert.Equal(t, <-scheduled, nil)
+		assert.Equal(t, server.History()[1].Check, false)
+	})
+
+	t.Run("skips scheduled runs during upgrades", func(t *testing.T) {
+		daemon := &fakeDaemon{release: make(chan struct{})}
+		server := &control.Server{Daemon: daemon}
+
+		done := make(chan struct{})
+		go func() {
+			server.Trigger(ctx, control.Request{})
+			close(done)
+		}()
+		for !server.Status().Running {
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, err := server.Scheduled(ctx, control.Request{})
+		assert.Equal(t, err, control.ErrBusy)
+		close(daemon.release)
+		<-done
+	})
+
+	t.Run("holds and releases upgrades", func(t *testing.T) {
+		client := serve(t, &fakeDaemon{})
+
+		status, err := client.Hold(ctx, "maintenance")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, status.Hold.Reason, "maintenance")
+
+		status, err = client.Unhold(ctx)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, status.Hold == nil, true)
+	})
+
+	t.Run("approves and activates builds", func(t *testing.T) {
+		daemon := &fakeDaemon{release: make(chan struct{})}
+		close(daemon.release)
+		client := serve(t, daemon)
+
+		result, err := client.Approve(ctx, 1234, "")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, daemon.approved, 1234)
+		assert.Equal(t, result.Check, false)
+	})
+
+	t.Run("refuses privileged requests on the read-only socket", func(t *testing.T) {
+		server := &control.Server{Daemon: &fakeDaemon{}}
+		handler := server.ReadOnlyHandler(ctx)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/upgrade", nil))
+		assert.Equal(t, recorder.Code, http.StatusForbidden)
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+		assert.Equal(t, recorder.Code, http.StatusOK)
+	})
+
+	t.Run("reports the running phase", func(t *testing.T) {
+		server := &control.Server{Daemon: &fakeDaemon{}}
+		server.Handle(ctx, events.Event{Type: events.PhaseStarted, Phase: "prefetch"})
+		assert.Equal(t, server.Status().Phase, "prefetch")
+	})
+	t.Run("records switch attempts", func(t *testing.T) {
+		release := make(chan struct{})
+		close(release)
+		daemon := &fakeDaemon{release: release, events: []events.Event{
+			{Type: events.SwitchAttempted, Attempts: 1, Outcome: string(upgrade.OutcomeFetchFailed), Error: "unable to download"},
+			{Type: events.SwitchAttempted, Attempts: 2, Outcome: string(upgrade.OutcomeRebuildFailed), Error: "exit status 1"},
+		}}
+		server := &control.Server{Daemon: daemon}
+		daemon.sink = server
+		result, err := server.Trigger(ctx, control.Request{})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(result.SwitchAttempts), 2)
+		assert.Equal(t, result.SwitchAttempts[0].Outcome, upgrade.OutcomeFetchFailed)
+		assert.Equal(t, server.History()[0].SwitchAttempts[1].Error, "exit status 1")
+	})
+}
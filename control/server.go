@@ -0,0 +1,352 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+)
+
+// Results of recent runs kept for /history.
+const historySize = 20
+
+/*
+Serves the control API and serializes runs of a Daemon. Subscribe the
+server to upgrade events to report the phase of runs in progress.
+*/
+type Server struct {
+	Daemon Daemon
+
+	mu      sync.Mutex
+	running bool
+	// the run in progress is a check
+	check bool
+	// closed when the run in progress finishes
+	done chan struct{}
+	// scheduled runs waiting for a check to finish
+	waiting int
+	phase   string
+	// switch attempts, failed units, warnings, and phase timing of the run in progress
+	attempts    []SwitchAttempt
+	failedUnits []string
+	warnings    []string
+	phases      []events.PhaseTiming
+	next        time.Time
+	history     []Result
+}
+
+// Records when the next scheduled upgrade runs, reported by /status.
+func (server *Server) SetNext(next time.Time) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.next = next
+}
+
+/*
+Runs an upgrade, or only part of one, unless another run is in progress.
+Returns ErrBusy in that case, and for checks while a scheduled run waits.
+*/
+func (server *Server) Trigger(ctx context.Context, request Request) (Result, error) {
+	server.mu.Lock()
+	if server.running || (request.Check && server.waiting > 0) {
+		server.mu.Unlock()
+		return Result{}, ErrBusy
+	}
+	server.begin(request)
+	server.mu.Unlock()
+	return server.run(ctx, request), nil
+}
+
+/*
+Runs a scheduled upgrade. Checks are open to any local user on the
+read-only socket, so rather than being skipped the run waits for a check
+in progress, and new checks are refused until it starts. Returns ErrBusy
+when another upgrade is in progress.
+*/
+func (server *Server) Scheduled(ctx context.Context, request Request) (Result, error) {
+	server.mu.Lock()
+	for server.running && server.check {
+		done := server.done
+		server.waiting++
+		server.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			server.mu.Lock()
+			server.waiting--
+			server.mu.Unlock()
+			return Result{}, ctx.Err()
+		}
+		server.mu.Lock()
+		server.waiting--
+	}
+	if server.running {
+		server.mu.Unlock()
+		return Result{}, ErrBusy
+	}
+	server.begin(request)
+	server.mu.Unlock()
+	return server.run(ctx, request), nil
+}
+
+// Marks `request` as the run in progress. The caller must hold server.mu.
+func (server *Server) begin(request Request) {
+	server.running = true
+	server.check = request.Check
+	server.done = make(chan struct{})
+	server.attempts = nil
+	server.failedUnits = nil
+	server.warnings = nil
+	server.phases = nil
+}
+
+// Runs `request` started by begin and records its result.
+func (server *Server) run(ctx context.Context, request Request) Result {
+	result := Result{Check: request.Check, Prefetch: request.Prefetch, Annotation: request.Annotation, Started: time.Now()}
+	outcome, err := server.Daemon.Run(ctx, request)
+	result.Finished = time.Now()
+	result.Outcome = outcome
+	if err != nil {
+		result.Error = err.Error()
+		result.Stderr = runner.Stderr(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.running = false
+	server.check = false
+	close(server.done)
+	server.phase = ""
+	result.SwitchAttempts = server.attempts
+	result.FailedUnits = server.failedUnits
+	result.Warnings = server.warnings
+	result.Phases = server.phases
+	server.record(result)
+	return result
+}
+
+// Adds `result` to the history. The caller must hold server.mu.
+func (server *Server) record(result Result) {
+	server.history = append(server.history, result)
+	if len(server.history) > historySize {
+		server.history = server.history[len(server.history)-historySize:]
+	}
+}
+
+func (server *Server) Status() Status {
+	server.mu.Lock()
+	status := Status{Running: server.running, Phase: server.phase, Next: server.next}
+	if len(server.history) > 0 {
+		last := server.history[len(server.history)-1]
+		status.Last = &last
+	}
+	server.mu.Unlock()
+
+	persisted, err := server.Daemon.State()
+	if err != nil {
+		slog.Warn("Unable to load upgrade state.", slog.String("error", err.Error()))
+	}
+	status.Run = persisted.Run
+	status.Hold, err = server.Daemon.Held()
+	if err != nil {
+		slog.Warn("Unable to load hold.", slog.String("error", err.Error()))
+	}
+	if len(persisted.Completed) > 0 {
+		status.Completed = &persisted.Completed[len(persisted.Completed)-1]
+	}
+	return status
+}
+
+// Tracks the progress of the run in progress, see events.Sink.
+func (server *Server) Handle(ctx context.Context, event events.Event) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	switch event.Type {
+	case events.PhaseStarted:
+		server.phase = event.Phase
+	case events.SwitchAttempted:
+		server.attempts = append(server.attempts, SwitchAttempt{
+			Finished: event.Time,
+			Duration: event.Duration,
+			Outcome:  upgrade.Outcome(event.Outcome),
+			Error:    event.Error,
+		})
+	case events.RunCrashed:
+		// the crashed run never finished, recorded when the run finding it starts
+		server.record(Result{
+			Started:  event.Time,
+			Finished: event.Time,
+			Outcome:  upgrade.Outcome(event.Outcome),
+			Error:    event.Error,
+		})
+	case events.RunFinished:
+		server.failedUnits = event.FailedUnits
+		server.warnings = event.Warnings
+		server.phases = event.Phases
+	}
+}
+
+func (server *Server) History() []Result {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]Result{}, server.history...)
+}
+
+func respond(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func respondError(w http.ResponseWriter, status int, err error) {
+	respond(w, status, errorResponse{Error: err.Error()})
+}
+
+/*
+The control API handler. Runs use `ctx` rather than request contexts, so
+clients disconnecting don't interrupt an upgrade.
+*/
+func (server *Server) Handler(ctx context.Context) http.Handler {
+	trigger := func(request Request) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			result, err := server.Trigger(ctx, request)
+			if errors.Is(err, ErrBusy) {
+				respondError(w, http.StatusConflict, err)
+				return
+			}
+			respond(w, http.StatusOK, result)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, server.Status())
+	})
+	mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, server.History())
+	})
+	mux.HandleFunc("POST /check", trigger(Request{Check: true}))
+	mux.HandleFunc("POST /upgrade", func(w http.ResponseWriter, r *http.Request) {
+		var request upgradeRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil && !errors.Is(err, io.EOF) {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		trigger(Request{Annotation: request.Annotation})(w, r)
+	})
+	mux.HandleFunc("POST /hold", func(w http.ResponseWriter, r *http.Request) {
+		var request holdRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = server.Daemon.Hold(request.Reason)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		respond(w, http.StatusOK, server.Status())
+	})
+	mux.HandleFunc("DELETE /hold", func(w http.ResponseWriter, r *http.Request) {
+		err := server.Daemon.Unhold()
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		respond(w, http.StatusOK, server.Status())
+	})
+	mux.HandleFunc("POST /approve", func(w http.ResponseWriter, r *http.Request) {
+		var request approveRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil && !errors.Is(err, io.EOF) {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = server.Daemon.Approve(request.BuildID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		trigger(Request{Annotation: request.Annotation})(w, r)
+	})
+	return mux
+}
+
+// Requests any user may make on the read-only socket, see ReadOnlyHandler.
+var readOnlyRoutes = []string{"GET /status", "GET /history", "POST /check"}
+
+/*
+The control API handler for unprivileged monitoring agents. Serves status,
+history, and checks, refusing requests that hold or upgrade with 403.
+*/
+func (server *Server) ReadOnlyHandler(ctx context.Context) http.Handler {
+	handler := server.Handler(ctx)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " " + r.URL.Path
+		if !slices.Contains(readOnlyRoutes, route) {
+			respondError(w, http.StatusForbidden, fmt.Errorf("%s needs the privileged control socket, the read-only socket serves status, history, and checks", route))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+/*
+Serves the control API on the unix socket `socket` until `ctx` is done.
+The socket is only accessible to its owner and group.
+*/
+func (server *Server) Serve(ctx context.Context, socket string) error {
+	return server.serve(ctx, socket, 0660, server.Handler(ctx))
+}
+
+/*
+Serves the read-only control API on the unix socket `socket` until `ctx` is
+done. The socket is accessible to every user, see ReadOnlyHandler.
+*/
+func (server *Server) ServeReadOnly(ctx context.Context, socket string) error {
+	return server.serve(ctx, socket, 0666, server.ReadOnlyHandler(ctx))
+}
+
+func (server *Server) serve(ctx context.Context, socket string, mode fs.FileMode, handler http.Handler) error {
+	// left behind by a daemon that didn't shut down cleanly
+	err := os.Remove(socket)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(socket, mode)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	httpServer := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	slog.Info("Serving control API.", slog.String("socket", socket))
+	err = httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+/*
+Package events models upgrade lifecycle transitions as typed events, so
+logging, hooks, plugins, and the control API subscribe to one stream and new
+sinks only need to implement Sink.
+*/
+package events
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	RunStarted    Type = "run-started"
+	PhaseStarted  Type = "phase-started"
+	PhaseFinished Type = "phase-finished"
+	// a nixos-rebuild attempt of the activate phase finished, see upgrade.Options.SwitchRetries
+	SwitchAttempted Type = "switch-attempted"
+	// an automatic rollback of the upgraded system was triggered, published before RunFinished
+	RollbackTriggered Type = "rollback-triggered"
+	// the latest build's flake isn't from the expected origin, see upgrade.Options.ExpectedOrigin
+	OriginDrift Type = "origin-drift"
+	// no successful build landed within the freshness window, see upgrade.Freshness
+	JobsetStale Type = "jobset-stale"
+	/*
+		the process running a previous upgrade exited mid-run, published when
+		the next run finds its progress, see state.Run.Crashed
+	*/
+	RunCrashed  Type = "run-crashed"
+	RunFinished Type = "run-finished"
+)
+
+// A lifecycle transition of an upgrade run.
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	// nixos-rebuild operation
+	Operation string `json:"operation"`
+	// only checking for a newer build
+	Check bool `json:"check,omitempty"`
+	// phase events, and crashed events with the last phase the upgrade completed, see state.Phase
+	Phase string `json:"phase,omitempty"`
+	// hydra build id and flake revision of the target system, once known
+	BuildID  int    `json:"buildId,omitempty"`
+	FlakeRev string `json:"flakeRev,omitempty"`
+	// units that failed when switching, once the switch completes
+	FailedUnits []string `json:"failedUnits,omitempty"`
+	// finished events only, empty for phases that don't end the run
+	Outcome string `json:"outcome,omitempty"`
+	Failed  bool   `json:"failed,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// the end of the stderr of the command that failed, if one did
+	Stderr string `json:"stderr,omitempty"`
+	// rollback events only, the system rolled back from and to
+	RollbackFrom string `json:"rollbackFrom,omitempty"`
+	RollbackTo   string `json:"rollbackTo,omitempty"`
+	// drift events only, the latest build's flake and the origin it was expected from
+	Flake          string `json:"flake,omitempty"`
+	ExpectedOrigin string `json:"expectedOrigin,omitempty"`
+	// stale events only, when the latest successful build finished, zero if none was found
+	LastSuccess time.Time `json:"lastSuccess,omitzero"`
+	// finished and attempt events only
+	Duration time.Duration `json:"duration,omitempty"`
+	Attempts int           `json:"attempts,omitempty"`
+	// failed finished events only, runs failing with this outcome in a row
+	Failures int `json:"failures,omitempty"`
+	// run finished events only, the phases run, in order
+	Phases []PhaseTiming `json:"phases,omitempty"`
+	/*
+		Run finished events only, the running system's flake revision and when
+		it and the target's flake were last modified, once known.
+	*/
+	CurrentRev      string    `json:"currentRev,omitempty"`
+	CurrentModified time.Time `json:"currentModified,omitzero"`
+	LatestModified  time.Time `json:"latestModified,omitzero"`
+	// run finished events only, bill of materials of the target system, once written
+	SBOM string `json:"sbom,omitempty"`
+	// run finished events only, failures of advisory checks that didn't stop the run
+	Warnings []string `json:"warnings,omitempty"`
+	// operator note on why the run was triggered, e.g. a change ticket
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// Wall-clock time a phase of a run took, including retries.
+type PhaseTiming struct {
+	Phase    string        `json:"phase"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Receives events. Sinks are called synchronously and should not block.
+type Sink interface {
+	Handle(ctx context.Context, event Event)
+}
+
+// Adapts a function to a Sink.
+type SinkFunc func(ctx context.Context, event Event)
+
+func (f SinkFunc) Handle(ctx context.Context, event Event) {
+	f(ctx, event)
+}
+
+// Delivers events to subscribed sinks in subscription order.
+type Bus struct {
+	mu    sync.Mutex
+	sinks []Sink
+}
+
+func (bus *Bus) Subscribe(sinks ...Sink) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.sinks = append(bus.sinks, sinks...)
+}
+
+// Delivers `event` to every sink, stamping the time if unset.
+func (bus *Bus) Publish(ctx context.Context, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.mu.Lock()
+	sinks := bus.sinks
+	bus.mu.Unlock()
+	for _, sink := range sinks {
+		sink.Handle(ctx, event)
+	}
+}
+
+// Logs events with slog, phase events at debug level.
+type LogSink struct{}
+
+func (LogSink) Handle(ctx context.Context, event Event) {
+	switch event.Type {
+	case RunStarted:
+		attrs := []any{
+			slog.String("operation", event.Operation),
+			slog.Bool("check", event.Check),
+		}
+		if event.Annotation != "" {
+			attrs = append(attrs, slog.String("annotation", event.Annotation))
+		}
+		slog.InfoContext(ctx, "Upgrade started.", attrs...)
+	case PhaseStarted:
+		slog.DebugContext(ctx, "Phase started.", slog.String("phase", event.Phase))
+	case PhaseFinished:
+		slog.DebugContext(ctx, "Phase complete.",
+			slog.String("phase", event.Phase),
+			slog.Duration("duration", event.Duration),
+			slog.Int("attempts", event.Attempts),
+			slog.String("outcome", event.Outcome))
+	case SwitchAttempted:
+		slog.DebugContext(ctx, "Switch attempted.",
+			slog.Int("attempt", event.Attempts),
+			slog.Duration("duration", event.Duration),
+			slog.String("outcome", event.Outcome))
+	case RollbackTriggered:
+		slog.ErrorContext(ctx, "Automatic rollback triggered.",
+			slog.String("outcome", event.Outcome),
+			slog.String("from", event.RollbackFrom),
+			slog.String("to", event.RollbackTo),
+			slog.String("error", event.Error))
+	case OriginDrift:
+		slog.WarnContext(ctx, "Build flake drifted from the expected origin.",
+			slog.Int("buildId", event.BuildID),
+			slog.String("flake", event.Flake),
+			slog.String("expected", event.ExpectedOrigin))
+	case JobsetStale:
+		slog.WarnContext(ctx, "Jobset is stale.",
+			slog.Time("lastSuccess", event.LastSuccess),
+			slog.String("error", event.Error))
+	case RunCrashed:
+		slog.ErrorContext(ctx, "Previous run crashed.",
+			slog.Int("buildId", event.BuildID),
+			slog.String("phase", event.Phase),
+			slog.String("error", event.Error))
+	case RunFinished:
+		level := slog.LevelInfo
+		if event.Failed {
+			level = slog.LevelError
+		}
+		phases := []any{}
+		for _, timing := range event.Phases {
+			phases = append(phases, slog.Duration(timing.Phase, timing.Duration))
+		}
+		attrs := []any{
+			slog.String("outcome", event.Outcome),
+			slog.Int("buildId", event.BuildID),
+			slog.Duration("duration", event.Duration),
+			slog.Group("phases", phases...),
+		}
+		if event.Stderr != "" {
+			attrs = append(attrs, slog.String("stderr", event.Stderr))
+		}
+		if len(event.Warnings) > 0 {
+			attrs = append(attrs, slog.Any("warnings", event.Warnings))
+		}
+		if event.Annotation != "" {
+			attrs = append(attrs, slog.String("annotation", event.Annotation))
+		}
+		slog.Log(ctx, level, "Upgrade finished.", attrs...)
+	}
+}
@@ -71,6 +71,13 @@
           installManPage nixos-hydra-upgrade.1
         '';
       };
+
+      # fully static, for appliance images and portable services without a nix-provided PATH
+      static = self.packages.${system}.default.overrideAttrs (old: {
+        pname = "${pname}-static";
+        env = (old.env or {}) // {CGO_ENABLED = "0";};
+        tags = ["netgo" "osusergo"];
+      });
     });
   };
 }
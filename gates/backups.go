@@ -0,0 +1,36 @@
+package gates
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+/*
+Blocks while any systemd unit matching `units` is running, so upgrades
+don't interrupt backup jobs. Unit names may be globs.
+*/
+func Backups(units []string) error {
+	if len(units) == 0 {
+		return nil
+	}
+
+	listed, err := systemd.ListUnits(units)
+	if err != nil {
+		return err
+	}
+	running := []string{}
+	for _, unit := range listed {
+		if unit.Running() {
+			running = append(running, unit.Name)
+		}
+	}
+	if len(running) > 0 {
+		return &BlockedError{
+			Gate:   "backups",
+			Reason: fmt.Sprintf("backup units running: %s", strings.Join(running, ", ")),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package gates_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+func TestBackups(t *testing.T) {
+	original := systemd.Runner
+	t.Cleanup(func() { systemd.Runner = original })
+	listUnits := "systemctl list-units --all --full --plain --no-legend --no-pager restic-backups-*.service"
+
+	tests := []struct {
+		name    string
+		output  string
+		blocked string
+	}{
+		{"no units loaded", "", ""},
+		{"exited and inactive units don't block", "" +
+			"restic-backups-local.service  loaded active   exited restic backup local\n" +
+			"restic-backups-remote.service loaded inactive dead   restic backup remote\n", ""},
+		{"activating oneshot units block", "" +
+			"restic-backups-local.service  loaded activating start restic backup local\n" +
+			"restic-backups-remote.service loaded inactive   dead  restic backup remote\n",
+			"backup units running: restic-backups-local.service"},
+		{"every running unit is reported", "" +
+			"restic-backups-local.service  loaded activating start   restic backup local\n" +
+			"restic-backups-remote.service loaded active     running restic backup remote\n",
+			"backup units running: restic-backups-local.service, restic-backups-remote.service"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			systemd.Runner = &runner.Fake{Outputs: map[string]string{listUnits: test.output}}
+			err := gates.Backups([]string{"restic-backups-*.service"})
+			var blocked *gates.BlockedError
+			if test.blocked == "" {
+				assert.Equal(t, err, nil)
+				return
+			}
+			if !errors.As(err, &blocked) {
+				t.Fatalf("expected backups to block, got %v", err)
+			}
+			assert.Equal(t, blocked.Gate, "backups")
+			assert.Equal(t, blocked.Reason, test.blocked)
+		})
+	}
+
+	t.Run("nothing checked without units", func(t *testing.T) {
+		fake := &runner.Fake{}
+		systemd.Runner = fake
+		assert.Equal(t, gates.Backups(nil), nil)
+		assert.Equal(t, len(fake.Ran), 0)
+	})
+
+	t.Run("fails when listing units fails", func(t *testing.T) {
+		systemd.Runner = &runner.Fake{Errors: map[string]error{listUnits: errors.New("exit status 1")}}
+		var blocked *gates.BlockedError
+		err := gates.Backups([]string{"restic-backups-*.service"})
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, errors.As(err, &blocked), false)
+	})
+}
@@ -0,0 +1,77 @@
+package gates
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/*
+A constraint between the running and target systems' values of a NixOS
+option, for upgrades needing manual migration steps, e.g. a stateVersion
+change or a postgresql major version upgrade.
+*/
+type Constraint struct {
+	// NixOS option path, e.g. system.stateVersion
+	Option string
+	/*
+		unchanged blocks any change of the value, same-major blocks changes
+		of the leading version component, e.g. 15.7 to 16.3
+	*/
+	Rule string
+}
+
+// Parses an option=rule constraint.
+func ParseConstraint(spec string) (Constraint, error) {
+	option, rule, ok := strings.Cut(spec, "=")
+	if !ok || option == "" {
+		return Constraint{}, fmt.Errorf("constraint %q is not option=rule", spec)
+	}
+	if rule != "unchanged" && rule != "same-major" {
+		return Constraint{}, fmt.Errorf("constraint %q has unknown rule %q", spec, rule)
+	}
+	return Constraint{Option: option, Rule: rule}, nil
+}
+
+func (constraint Constraint) String() string {
+	return constraint.Option + "=" + constraint.Rule
+}
+
+// The leading version component of `value`, e.g. 16 of 16.3.
+func major(value string) string {
+	major, _, _ := strings.Cut(value, ".")
+	return major
+}
+
+/*
+Compares the `running` and `target` values of the constraint's option,
+evaluated as JSON, returning a *BlockedError when the upgrade crosses it.
+*/
+func (constraint Constraint) Check(running any, target any) error {
+	from, err := json.Marshal(running)
+	if err != nil {
+		return err
+	}
+	to, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	blocked := &BlockedError{
+		Gate:   "constraint " + constraint.Option,
+		Reason: fmt.Sprintf("changes from %s to %s, migrate manually before upgrading", from, to),
+	}
+	switch constraint.Rule {
+	case "unchanged":
+		if string(from) != string(to) {
+			return blocked
+		}
+	case "same-major":
+		if major(fmt.Sprint(running)) != major(fmt.Sprint(target)) {
+			blocked.Reason = fmt.Sprintf("major version changes from %s to %s, migrate manually before upgrading", from, to)
+			return blocked
+		}
+	default:
+		return fmt.Errorf("constraint %s has unknown rule %q", constraint.Option, constraint.Rule)
+	}
+	return nil
+}
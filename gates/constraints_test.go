@@ -0,0 +1,31 @@
+package gates_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+)
+
+func TestConstraint(t *testing.T) {
+	var blocked *gates.BlockedError
+
+	stateVersion, err := gates.ParseConstraint("system.stateVersion=unchanged")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, stateVersion, gates.Constraint{Option: "system.stateVersion", Rule: "unchanged"})
+	assert.Equal(t, stateVersion.Check("24.05", "24.05"), nil)
+	err = stateVersion.Check("24.05", "24.11")
+	assert.Equal(t, errors.As(err, &blocked), true)
+	assert.Equal(t, err.Error(), `constraint system.stateVersion: changes from "24.05" to "24.11", migrate manually before upgrading`)
+
+	postgres := gates.Constraint{Option: "services.postgresql.package.version", Rule: "same-major"}
+	assert.Equal(t, postgres.Check("15.7", "15.10"), nil)
+	err = postgres.Check("15.7", "16.3")
+	assert.Equal(t, errors.As(err, &blocked), true)
+
+	_, err = gates.ParseConstraint("system.stateVersion=newer")
+	assert.Equal(t, err != nil, true)
+}
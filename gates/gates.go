@@ -0,0 +1,18 @@
+package gates
+
+import "fmt"
+
+/*
+Gates are local preconditions for performing an upgrade or reboot. A gate
+that is not satisfied returns a *BlockedError, and the upgrade is deferred
+to a later run rather than failed. Any other error means the gate could not
+be evaluated.
+*/
+type BlockedError struct {
+	Gate   string
+	Reason string
+}
+
+func (err *BlockedError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Gate, err.Reason)
+}
@@ -0,0 +1,30 @@
+package gates
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+Blocks while the hold file at `path` exists, written by operators or other
+automation to pause upgrades. The file contents are the hold reason.
+*/
+func Hold(path string) error {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	reason := strings.TrimSpace(string(contents))
+	if reason == "" {
+		reason = "no reason given"
+	}
+	return &BlockedError{
+		Gate:   "hold",
+		Reason: fmt.Sprintf("upgrades held by %s: %s", path, reason),
+	}
+}
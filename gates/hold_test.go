@@ -0,0 +1,34 @@
+package gates_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+)
+
+func TestHold(t *testing.T) {
+	t.Run("missing hold file does not block", func(t *testing.T) {
+		err := gates.Hold(filepath.Join(t.TempDir(), "hold"))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("hold file blocks with its reason", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "hold")
+		err := os.WriteFile(path, []byte("maintenance window\n"), 0644)
+		if err != nil {
+			panic(err)
+		}
+
+		var blocked *gates.BlockedError
+		if !errors.As(gates.Hold(path), &blocked) {
+			t.Fatalf("expected hold to block")
+		}
+		assert.Equal(t, blocked.Reason, "upgrades held by "+path+": maintenance window")
+	})
+}
@@ -0,0 +1,36 @@
+package gates
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+// Blocks while logind holds blocking inhibitor locks of the given types.
+func Inhibitors(what []string) error {
+	if len(what) == 0 {
+		return nil
+	}
+
+	inhibitors, err := systemd.ListInhibitors()
+	if err != nil {
+		return err
+	}
+	for _, inhibitor := range inhibitors {
+		// our own lock, see systemd.Inhibit
+		if inhibitor.Mode != "block" || inhibitor.Who == systemd.InhibitorWho {
+			continue
+		}
+		for _, w := range what {
+			if inhibitor.Inhibits(w) {
+				slog.Debug("Blocking inhibitor.", slog.String("inhibitor", fmt.Sprintf("%+v", inhibitor)))
+				return &BlockedError{
+					Gate:   "inhibitors",
+					Reason: fmt.Sprintf("%s inhibited by %s (pid %d): %s", w, inhibitor.Who, inhibitor.PID, inhibitor.Why),
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package gates_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+func TestInhibitors(t *testing.T) {
+	listInhibitors := "busctl --system --json=short call org.freedesktop.login1 /org/freedesktop/login1 org.freedesktop.login1.Manager ListInhibitors"
+	original := systemd.Runner
+	t.Cleanup(func() { systemd.Runner = original })
+	// a delay lock, our own lock, and a blocking backup
+	systemd.Runner = &runner.Fake{Outputs: map[string]string{listInhibitors: `{"type":"a(ssssuu)","data":[[` +
+		`["sleep","NetworkManager","NetworkManager needs to turn off networks","delay",0,1187],` +
+		`["sleep:shutdown","nixos-hydra-upgrade","Upgrading the system","block",0,812],` +
+		`["shutdown","restic","Backup in progress","block",0,40213]]]}`}}
+
+	tests := []struct {
+		name    string
+		what    []string
+		blocked string
+	}{
+		{"nothing checked", nil, ""},
+		{"delay locks and our own lock don't block", []string{"sleep"}, ""},
+		{"blocking locks of checked types block", []string{"sleep", "shutdown"}, "shutdown inhibited by restic (pid 40213): Backup in progress"},
+		{"other types don't block", []string{"idle"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := gates.Inhibitors(test.what)
+			var blocked *gates.BlockedError
+			if test.blocked == "" {
+				assert.Equal(t, err, nil)
+				return
+			}
+			if !errors.As(err, &blocked) {
+				t.Fatalf("expected inhibitors to block, got %v", err)
+			}
+			assert.Equal(t, blocked.Reason, test.blocked)
+		})
+	}
+
+	t.Run("fails when listing locks fails", func(t *testing.T) {
+		systemd.Runner = &runner.Fake{Errors: map[string]error{listInhibitors: errors.New("exit status 1")}}
+		var blocked *gates.BlockedError
+		err := gates.Inhibitors([]string{"shutdown"})
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, errors.As(err, &blocked), false)
+	})
+}
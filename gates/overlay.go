@@ -0,0 +1,58 @@
+package gates
+
+import (
+	"fmt"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/network"
+)
+
+// Overlay networks that must be healthy before upgrading.
+type OverlayPolicy struct {
+	// block unless tailscale is connected
+	Tailscale bool
+	// block unless these wireguard interfaces are up
+	WireGuardInterfaces []string
+	// block unless these peers respond, over tailscale if enabled or ICMP ping otherwise
+	Peers []string
+	// address family of ICMP pings, any, ipv4, or ipv6
+	Family string
+}
+
+/*
+Blocks while the tailscale or wireguard overlay is down or key peers are
+unreachable, so remote machines aren't upgraded while a regression could
+strand them.
+*/
+func Overlay(policy OverlayPolicy) error {
+	if policy.Tailscale {
+		state, err := network.TailscaleState()
+		if err != nil {
+			return err
+		}
+		if state != "Running" {
+			return &BlockedError{Gate: "overlay", Reason: fmt.Sprintf("tailscale is %s", state)}
+		}
+	}
+	for _, name := range policy.WireGuardInterfaces {
+		up, err := network.InterfaceUp(name)
+		if err != nil {
+			return err
+		}
+		if !up {
+			return &BlockedError{Gate: "overlay", Reason: fmt.Sprintf("wireguard interface %s is down", name)}
+		}
+	}
+	for _, peer := range policy.Peers {
+		var err error
+		if policy.Tailscale {
+			err = network.TailscalePing(peer)
+		} else {
+			err = healthcheck.Ping(peer, policy.Family)
+		}
+		if err != nil {
+			return &BlockedError{Gate: "overlay", Reason: fmt.Sprintf("peer %s unreachable: %s", peer, err)}
+		}
+	}
+	return nil
+}
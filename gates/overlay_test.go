@@ -0,0 +1,43 @@
+package gates_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/network"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestOverlay(t *testing.T) {
+	fake := &runner.Fake{Outputs: map[string]string{}, Errors: map[string]error{}}
+	original := network.Runner
+	network.Runner = fake
+	t.Cleanup(func() { network.Runner = original })
+
+	fake.Outputs["tailscale status --json"] = `{"BackendState": "Running"}`
+	fake.Outputs["ip -json link show dev wg0"] = `[{"ifname": "wg0", "flags": ["POINTOPOINT", "NOARP", "UP", "LOWER_UP"]}]`
+	fake.Outputs["ip -json link show dev wg1"] = `[{"ifname": "wg1", "flags": ["POINTOPOINT", "NOARP"]}]`
+	fake.Errors["tailscale ping --c 1 --timeout 5s gateway"] = errors.New("exit status 1")
+
+	t.Run("passes while the overlay is up", func(t *testing.T) {
+		err := gates.Overlay(gates.OverlayPolicy{Tailscale: true, WireGuardInterfaces: []string{"wg0"}, Peers: []string{"bastion"}})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("blocks on down interfaces", func(t *testing.T) {
+		var blocked *gates.BlockedError
+		err := gates.Overlay(gates.OverlayPolicy{WireGuardInterfaces: []string{"wg0", "wg1"}})
+		assert.Equal(t, errors.As(err, &blocked), true)
+		assert.Equal(t, blocked.Reason, "wireguard interface wg1 is down")
+	})
+
+	t.Run("blocks on unreachable peers", func(t *testing.T) {
+		var blocked *gates.BlockedError
+		err := gates.Overlay(gates.OverlayPolicy{Tailscale: true, Peers: []string{"gateway"}})
+		assert.Equal(t, errors.As(err, &blocked), true)
+	})
+}
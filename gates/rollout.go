@@ -0,0 +1,45 @@
+package gates
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Staged rollout policy. Each host is assigned a stable bucket per build,
+// and only hosts in buckets below the rollout percentage upgrade.
+type RolloutPolicy struct {
+	// percentage of hosts that upgrade immediately
+	Percentage int
+	// percentage points added for every hour since the build finished
+	WidenPerHour int
+}
+
+// Returns the bucket, [0, 100), of a host for a build.
+func RolloutBucket(host string, buildID int) int {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s/%d", host, buildID))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
+// Returns the rollout percentage for a build that finished at `finished`.
+func (policy RolloutPolicy) Effective(finished time.Time, now time.Time) int {
+	percentage := policy.Percentage
+	if policy.WidenPerHour > 0 && now.After(finished) {
+		percentage += int(now.Sub(finished).Hours()) * policy.WidenPerHour
+	}
+	return min(percentage, 100)
+}
+
+// Blocks until the build has rolled out to the host's bucket.
+func Rollout(policy RolloutPolicy, host string, buildID int, finished time.Time) error {
+	bucket := RolloutBucket(host, buildID)
+	percentage := policy.Effective(finished, time.Now())
+	if bucket >= percentage {
+		return &BlockedError{
+			Gate:   "rollout",
+			Reason: fmt.Sprintf("host bucket %d is outside of rollout percentage %d", bucket, percentage),
+		}
+	}
+	return nil
+}
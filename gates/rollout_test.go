@@ -0,0 +1,69 @@
+package gates_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+)
+
+func TestRolloutBucket(t *testing.T) {
+	t.Run("buckets are stable", func(t *testing.T) {
+		assert.Equal(t, gates.RolloutBucket("host", 1234), gates.RolloutBucket("host", 1234))
+	})
+
+	t.Run("buckets are distributed across hosts", func(t *testing.T) {
+		counts := make([]int, 10)
+		for i := range 1000 {
+			bucket := gates.RolloutBucket(string(rune('a'+i%26))+string(rune('a'+i/26)), 1234)
+			if bucket < 0 || bucket >= 100 {
+				t.Fatalf("bucket out of range: %v", bucket)
+			}
+			counts[bucket/10]++
+		}
+		for decile, count := range counts {
+			if count < 50 || count > 150 {
+				t.Errorf("uneven distribution, decile %v has %v of 1000 hosts", decile, count)
+			}
+		}
+	})
+}
+
+func TestRolloutEffective(t *testing.T) {
+	finished := time.Unix(1700000000, 0)
+
+	var effectiveTests = []struct {
+		description string
+		policy      gates.RolloutPolicy
+		now         time.Time
+		expected    int
+	}{
+		{"fixed percentage", gates.RolloutPolicy{Percentage: 20}, finished.Add(48 * time.Hour), 20},
+		{"widens per hour", gates.RolloutPolicy{Percentage: 20, WidenPerHour: 10}, finished.Add(150 * time.Minute), 40},
+		{"widens to at most 100", gates.RolloutPolicy{Percentage: 20, WidenPerHour: 10}, finished.Add(48 * time.Hour), 100},
+		{"clock before finish", gates.RolloutPolicy{Percentage: 20, WidenPerHour: 10}, finished.Add(-time.Hour), 20},
+	}
+
+	for _, test := range effectiveTests {
+		t.Run(test.description, func(t *testing.T) {
+			assert.Equal(t, test.policy.Effective(finished, test.now), test.expected)
+		})
+	}
+}
+
+func TestRollout(t *testing.T) {
+	t.Run("full rollout never blocks", func(t *testing.T) {
+		err := gates.Rollout(gates.RolloutPolicy{Percentage: 100}, "host", 1234, time.Now())
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("zero rollout always blocks", func(t *testing.T) {
+		err := gates.Rollout(gates.RolloutPolicy{Percentage: 0}, "host", 1234, time.Now())
+		if err == nil {
+			t.Error("unexpected success")
+		}
+	})
+}
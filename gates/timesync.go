@@ -0,0 +1,26 @@
+package gates
+
+import (
+	"context"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+/*
+Blocks while the system clock isn't synchronized. Build ages, staged
+rollouts, and freshness windows are measured against it, and freshly imaged
+machines often boot with a clock far off until NTP catches up.
+*/
+func TimeSync() error {
+	synchronized, err := systemd.TimeSynchronized(context.Background())
+	if err != nil {
+		return err
+	}
+	if !synchronized {
+		return &BlockedError{
+			Gate:   "time-sync",
+			Reason: "system clock isn't synchronized",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package gates
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read by SystemUptime, replaced by tests.
+var UptimePath = "/proc/uptime"
+
+// Reads system uptime from /proc/uptime.
+func SystemUptime() (time.Duration, error) {
+	contents, err := os.ReadFile(UptimePath)
+	if err != nil {
+		return 0, err
+	}
+	// "<uptime seconds> <idle seconds>"
+	fields := strings.Fields(string(contents))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected %s contents: %q", UptimePath, contents)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+/*
+Blocks until the system has been up for at least `minimum`. Prevents reboot
+loops when a new generation crashes the machine shortly after boot.
+*/
+func Uptime(minimum time.Duration) error {
+	if minimum <= 0 {
+		return nil
+	}
+	uptime, err := SystemUptime()
+	if err != nil {
+		return err
+	}
+	if uptime < minimum {
+		return &BlockedError{
+			Gate:   "uptime",
+			Reason: fmt.Sprintf("uptime %s is less than minimum %s", uptime.Truncate(time.Second), minimum),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package gates_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+)
+
+// Points gates.UptimePath at a file holding `contents`.
+func fakeUptime(t *testing.T, contents string) {
+	original := gates.UptimePath
+	t.Cleanup(func() { gates.UptimePath = original })
+	gates.UptimePath = filepath.Join(t.TempDir(), "uptime")
+	err := os.WriteFile(gates.UptimePath, []byte(contents), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSystemUptime(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		uptime   time.Duration
+		fails    bool
+	}{
+		{"uptime and idle seconds", "3725.42 14511.90\n", 3725*time.Second + 420*time.Millisecond, false},
+		{"whole seconds", "60 120\n", time.Minute, false},
+		{"empty", "", 0, true},
+		{"not a number", "up 14511.90\n", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeUptime(t, test.contents)
+			uptime, err := gates.SystemUptime()
+			assert.Equal(t, err != nil, test.fails)
+			assert.Equal(t, uptime.Round(time.Millisecond), test.uptime)
+		})
+	}
+
+	t.Run("fails without /proc/uptime", func(t *testing.T) {
+		original := gates.UptimePath
+		t.Cleanup(func() { gates.UptimePath = original })
+		gates.UptimePath = filepath.Join(t.TempDir(), "missing")
+		_, err := gates.SystemUptime()
+		assert.Equal(t, errors.Is(err, os.ErrNotExist), true)
+	})
+}
+
+func TestUptime(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		minimum  time.Duration
+		blocked  string
+	}{
+		{"nothing checked", "", 0, ""},
+		{"allowed past the minimum", "3725.42 14511.90\n", time.Hour, ""},
+		{"allowed at the minimum", "3600.00 14511.90\n", time.Hour, ""},
+		{"blocked below the minimum", "1805.73 7022.11\n", time.Hour, "uptime 30m5s is less than minimum 1h0m0s"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeUptime(t, test.contents)
+			err := gates.Uptime(test.minimum)
+			var blocked *gates.BlockedError
+			if test.blocked == "" {
+				assert.Equal(t, err, nil)
+				return
+			}
+			if !errors.As(err, &blocked) {
+				t.Fatalf("expected uptime to block, got %v", err)
+			}
+			assert.Equal(t, blocked.Gate, "uptime")
+			assert.Equal(t, blocked.Reason, test.blocked)
+		})
+	}
+
+	t.Run("fails on malformed uptime", func(t *testing.T) {
+		fakeUptime(t, "garbage")
+		var blocked *gates.BlockedError
+		err := gates.Uptime(time.Hour)
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, errors.As(err, &blocked), false)
+	})
+}
@@ -0,0 +1,64 @@
+package gates
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/virtualization"
+)
+
+// Virtualization workloads that block reboots while running.
+type WorkloadPolicy struct {
+	// block while any libvirt domain is running
+	LibvirtDomains bool
+	// container name globs, block while any matching container is running
+	Containers []string
+}
+
+func (policy WorkloadPolicy) running() ([]string, error) {
+	running := []string{}
+	if policy.LibvirtDomains {
+		domains, err := virtualization.RunningDomains()
+		if err != nil {
+			return nil, err
+		}
+		for _, domain := range domains {
+			running = append(running, "domain "+domain)
+		}
+	}
+	if len(policy.Containers) > 0 {
+		containers, err := virtualization.RunningContainers()
+		if err != nil {
+			return nil, err
+		}
+		for _, container := range containers {
+			for _, pattern := range policy.Containers {
+				matched, err := path.Match(pattern, container)
+				if err != nil {
+					return nil, err
+				}
+				if matched {
+					running = append(running, "container "+container)
+					break
+				}
+			}
+		}
+	}
+	return running, nil
+}
+
+// Blocks while workloads selected by `policy` are running.
+func Workloads(policy WorkloadPolicy) error {
+	running, err := policy.running()
+	if err != nil {
+		return err
+	}
+	if len(running) > 0 {
+		return &BlockedError{
+			Gate:   "workloads",
+			Reason: fmt.Sprintf("workloads running: %s", strings.Join(running, ", ")),
+		}
+	}
+	return nil
+}
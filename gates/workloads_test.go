@@ -0,0 +1,56 @@
+package gates_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/virtualization"
+)
+
+func TestWorkloads(t *testing.T) {
+	// only installed container runtimes are listed
+	bin := t.TempDir()
+	err := os.WriteFile(filepath.Join(bin, "podman"), []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		panic(err)
+	}
+	t.Setenv("PATH", bin)
+	fake := &runner.Fake{Outputs: map[string]string{
+		"virsh --connect qemu:///system list --name --state-running": "vm1\n\n",
+		"podman ps --format {{.Names}}":                              "db-1\nweb\n",
+	}, Errors: map[string]error{}}
+	original := virtualization.Runner
+	virtualization.Runner = fake
+	t.Cleanup(func() { virtualization.Runner = original })
+
+	t.Run("blocks while selected workloads are running", func(t *testing.T) {
+		var blocked *gates.BlockedError
+		err := gates.Workloads(gates.WorkloadPolicy{LibvirtDomains: true, Containers: []string{"db-*"}})
+		if !errors.As(err, &blocked) {
+			t.Fatalf("expected workloads to block")
+		}
+		assert.Equal(t, blocked.Reason, "workloads running: domain vm1, container db-1")
+	})
+
+	t.Run("ignores unselected workloads", func(t *testing.T) {
+		fake.Ran = nil
+		err := gates.Workloads(gates.WorkloadPolicy{Containers: []string{"cache"}})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, fake.Ran, []string{"podman ps --format {{.Names}}"})
+	})
+
+	t.Run("fails when listing workloads fails", func(t *testing.T) {
+		fake.Errors["virsh --connect qemu:///system list --name --state-running"] = errors.New("exit status 1")
+		var blocked *gates.BlockedError
+		err := gates.Workloads(gates.WorkloadPolicy{LibvirtDomains: true})
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, errors.As(err, &blocked), false)
+	})
+}
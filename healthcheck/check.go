@@ -0,0 +1,46 @@
+package healthcheck
+
+import (
+	"context"
+)
+
+/*
+A health check of a canary. Checks of every type are configured and run the
+same way, so new types only need to implement Check.
+*/
+type Check interface {
+	// Names the check in logs and advisory-checks, e.g. ping:<host>
+	Name() string
+	// Returns why the canary is unhealthy, nil when it's healthy.
+	Check(ctx context.Context) error
+}
+
+// Pings a canary, see Ping.
+type PingCheck struct {
+	Host string
+	// address family, any, ipv4, or ipv6
+	Family string
+}
+
+func (check PingCheck) Name() string {
+	return "ping:" + check.Host
+}
+
+func (check PingCheck) Check(ctx context.Context) error {
+	return Ping(check.Host, check.Family)
+}
+
+// Logs in to a canary over ssh, see SSH.
+type SSHCheck struct {
+	// ssh destination
+	Host    string
+	Options SSHOptions
+}
+
+func (check SSHCheck) Name() string {
+	return "ssh:" + check.Host
+}
+
+func (check SSHCheck) Check(ctx context.Context) error {
+	return SSH(ctx, check.Host, check.Options)
+}
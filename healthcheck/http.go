@@ -0,0 +1,78 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/network"
+)
+
+// Timeout of HTTPCheck requests, unless HTTPCheck.Timeout is set.
+const httpTimeout = 10 * time.Second
+
+// Bytes of response bodies matched against HTTPCheck.Body.
+const httpBodyLimit = 1 << 20
+
+/*
+Requests a URL from a canary, requiring the expected status and, optionally,
+a body matching a regular expression. A box answering pings while its
+services are dead fails the check.
+*/
+type HTTPCheck struct {
+	URL string
+	// expected status, 0 expects 200
+	Status int
+	// matched against the response body, up to its first MiB. nil skips matching
+	Body *regexp.Regexp
+	// 0 waits httpTimeout
+	Timeout time.Duration
+	// address family, any, ipv4, or ipv6
+	Family string
+}
+
+func (check HTTPCheck) Name() string {
+	return "http:" + check.URL
+}
+
+func (check HTTPCheck) Check(ctx context.Context) error {
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = httpTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return fmt.Errorf("http canary %s: %w", check.URL, err)
+	}
+	resp, err := network.HTTPClient(check.Family).Do(req)
+	if err != nil {
+		return fmt.Errorf("http canary %s: %w", check.URL, err)
+	}
+	defer resp.Body.Close()
+
+	status := check.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	slog.Debug("http canary response:", slog.String("url", check.URL), slog.Int("status", resp.StatusCode))
+	if resp.StatusCode != status {
+		return fmt.Errorf("http canary %s: status %d, expected %d", check.URL, resp.StatusCode, status)
+	}
+	if check.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpBodyLimit))
+	if err != nil {
+		return fmt.Errorf("http canary %s: %w", check.URL, err)
+	}
+	if !check.Body.Match(body) {
+		return fmt.Errorf("http canary %s: body doesn't match %q", check.URL, check.Body.String())
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package healthcheck_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+)
+
+func TestHTTPCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte(`{"status": "ok"}`))
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		description string
+		check       healthcheck.HTTPCheck
+		healthy     bool
+	}{
+		{"expects 200 by default", healthcheck.HTTPCheck{URL: server.URL + "/healthz"}, true},
+		{"fails other statuses", healthcheck.HTTPCheck{URL: server.URL + "/missing"}, false},
+		{"expects the configured status", healthcheck.HTTPCheck{URL: server.URL + "/created", Status: http.StatusCreated}, true},
+		{"matches the body", healthcheck.HTTPCheck{URL: server.URL + "/healthz", Body: regexp.MustCompile(`"status": "ok"`)}, true},
+		{"fails bodies not matching", healthcheck.HTTPCheck{URL: server.URL + "/healthz", Body: regexp.MustCompile(`"status": "degraded"`)}, false},
+		{"times out", healthcheck.HTTPCheck{URL: server.URL + "/slow", Timeout: 10 * time.Millisecond}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := test.check.Check(context.Background())
+			assert.Equal(t, err == nil, test.healthy)
+		})
+	}
+	assert.Equal(t, healthcheck.HTTPCheck{URL: "https://canary.example.com"}.Name(), "http:https://canary.example.com")
+}
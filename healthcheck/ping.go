@@ -4,13 +4,20 @@ import (
 	"fmt"
 	"log/slog"
 
+	"github.com/hyperparabolic/nixos-hydra-upgrade/network"
 	"github.com/prometheus-community/pro-bing"
 )
 
-func Ping(host string) error {
-	pinger, err := probing.NewPinger(host)
+/*
+Pings `host` over address family `family`, any, ipv4, or ipv6. Literal ipv6
+addresses may be bracketed, e.g. [2001:db8::1].
+*/
+func Ping(host string, family string) error {
+	pinger := probing.New(network.HostLiteral(host))
+	pinger.SetNetwork(network.Network(family, "ip"))
+	err := pinger.Resolve()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	pinger.Count = 3
 	err = pinger.Run()
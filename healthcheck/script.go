@@ -0,0 +1,50 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Time a ScriptCheck is given to exit, unless ScriptCheck.Timeout is set.
+const scriptTimeout = time.Minute
+
+/*
+Runs a user defined command with `sh -c`, healthy when it exits 0 within its
+timeout. Covers whatever the other checks don't know how to probe.
+*/
+type ScriptCheck struct {
+	Command string
+	// 0 waits scriptTimeout
+	Timeout time.Duration
+}
+
+func (check ScriptCheck) Name() string {
+	return "script:" + check.Command
+}
+
+func (check ScriptCheck) Check(ctx context.Context) error {
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = scriptTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	out, err := Runner.CombinedOutput(ctx, runner.Command("sh", "-c", check.Command))
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		slog.Warn("Health check script failed.",
+			slog.String("command", check.Command),
+			slog.String("error", err.Error()),
+			slog.String("output", string(out)))
+		return fmt.Errorf("script %q: %w", check.Command, err)
+	}
+	slog.Debug("Health check script output:", slog.String("command", check.Command), slog.String("output", string(out)))
+	return nil
+}
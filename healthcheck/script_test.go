@@ -0,0 +1,47 @@
+package healthcheck_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestScriptCheck(t *testing.T) {
+	fake := &runner.Fake{Errors: map[string]error{}}
+	original := healthcheck.Runner
+	healthcheck.Runner = fake
+	t.Cleanup(func() { healthcheck.Runner = original })
+
+	t.Run("passes when the command exits 0", func(t *testing.T) {
+		check := healthcheck.ScriptCheck{Command: "curl -sf http://localhost/healthz"}
+		err := check.Check(context.Background())
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, fake.Ran[len(fake.Ran)-1], "sh -c curl -sf http://localhost/healthz")
+		assert.Equal(t, check.Name(), "script:curl -sf http://localhost/healthz")
+	})
+
+	t.Run("fails when the command fails", func(t *testing.T) {
+		fake.Errors["sh -c false"] = errors.New("exit status 1")
+		err := healthcheck.ScriptCheck{Command: "false"}.Check(context.Background())
+		assert.Equal(t, err != nil, true)
+	})
+
+	t.Run("fails when the command times out", func(t *testing.T) {
+		healthcheck.Runner = original
+		t.Cleanup(func() { healthcheck.Runner = fake })
+		started := time.Now()
+		// sleep outlives sh unless the whole process group is killed
+		err := healthcheck.ScriptCheck{Command: "sleep 5; true", Timeout: 100 * time.Millisecond}.Check(context.Background())
+		assert.Equal(t, err != nil, true)
+		if time.Since(started) > 2*time.Second {
+			t.Errorf("timed out check ran for %s", time.Since(started))
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package healthcheck
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A secret file deployed by sops-nix, agenix, or similar, and its expected ownership.
+type Secret struct {
+	// path or glob, globs must match at least one file
+	Path string
+	// user and group names, empty doesn't check
+	Owner string
+	Group string
+	// permission bits, 0 doesn't check
+	Mode fs.FileMode
+}
+
+/*
+Parses a secret spec, `path[:owner[:group[:mode]]]`, e.g.
+/run/secrets/db-password:postgres:postgres:0400. Empty fields aren't checked.
+*/
+func ParseSecret(spec string) (Secret, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) > 4 || fields[0] == "" {
+		return Secret{}, fmt.Errorf("invalid secret %q, expected path[:owner[:group[:mode]]]", spec)
+	}
+	fields = append(fields, "", "", "")
+	secret := Secret{Path: fields[0], Owner: fields[1], Group: fields[2]}
+	if fields[3] != "" {
+		mode, err := strconv.ParseUint(fields[3], 8, 32)
+		if err != nil || mode > 0o777 {
+			return Secret{}, fmt.Errorf("invalid secret %q, mode %q isn't octal permissions", spec, fields[3])
+		}
+		secret.Mode = fs.FileMode(mode)
+	}
+	return secret, nil
+}
+
+/*
+Checks that the secret exists, is non-empty, and has the expected owner,
+group, and mode. Secrets are stat'ed and never read.
+*/
+func CheckSecret(secret Secret) error {
+	paths, err := filepath.Glob(secret.Path)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("secret %s missing", secret.Path)
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", path, err)
+		}
+		if info.Size() == 0 {
+			return fmt.Errorf("secret %s is empty", path)
+		}
+		if secret.Mode != 0 && info.Mode().Perm() != secret.Mode {
+			return fmt.Errorf("secret %s has mode %04o, expected %04o", path, info.Mode().Perm(), secret.Mode)
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+		if secret.Owner != "" {
+			owner := strconv.Itoa(int(stat.Uid))
+			if u, err := user.LookupId(owner); err == nil {
+				owner = u.Username
+			}
+			if owner != secret.Owner {
+				return fmt.Errorf("secret %s is owned by %s, expected %s", path, owner, secret.Owner)
+			}
+		}
+		if secret.Group != "" {
+			group := strconv.Itoa(int(stat.Gid))
+			if g, err := user.LookupGroupId(group); err == nil {
+				group = g.Name
+			}
+			if group != secret.Group {
+				return fmt.Errorf("secret %s has group %s, expected %s", path, group, secret.Group)
+			}
+		}
+	}
+	return nil
+}
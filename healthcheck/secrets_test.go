@@ -0,0 +1,69 @@
+package healthcheck_test
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+)
+
+func TestParseSecret(t *testing.T) {
+	secret, err := healthcheck.ParseSecret("/run/secrets/db:postgres:postgres:0400")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, secret, healthcheck.Secret{Path: "/run/secrets/db", Owner: "postgres", Group: "postgres", Mode: 0o400})
+
+	secret, err = healthcheck.ParseSecret("/run/agenix/*")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, secret, healthcheck.Secret{Path: "/run/agenix/*"})
+
+	for _, spec := range []string{"", ":root", "/run/secrets/db::::", "/run/secrets/db:::rw"} {
+		_, err = healthcheck.ParseSecret(spec)
+		if err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestCheckSecret(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db-password")
+	err := os.WriteFile(path, []byte("hunter2"), 0o400)
+	if err != nil {
+		panic(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "empty"), []byte{}, 0o400)
+	if err != nil {
+		panic(err)
+	}
+	current, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	err = healthcheck.CheckSecret(healthcheck.Secret{Path: path, Owner: current.Username, Mode: 0o400})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for name, secret := range map[string]healthcheck.Secret{
+		"missing":     {Path: filepath.Join(dir, "missing")},
+		"no matches":  {Path: filepath.Join(dir, "*.age")},
+		"empty":       {Path: filepath.Join(dir, "*")},
+		"wrong mode":  {Path: path, Mode: 0o440},
+		"wrong owner": {Path: path, Owner: "nobody-" + current.Username},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := healthcheck.CheckSecret(secret)
+			if err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
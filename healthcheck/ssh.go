@@ -0,0 +1,60 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{KillGroup: true}
+
+type SSHOptions struct {
+	// command run on the canary, empty only checks that login succeeds
+	Command string
+	// private key, empty uses the ssh agent and default keys
+	Identity string
+	// pinned host keys in known_hosts format, empty uses the default known hosts
+	KnownHosts string
+	// address family, any, ipv4, or ipv6
+	Family string
+}
+
+/*
+Logs in to the ssh destination `host` and runs `opts.Command`. Runs
+non-interactively and never accepts unknown host keys, so a canary that was
+reinstalled or replaced fails the check.
+*/
+func SSH(ctx context.Context, host string, opts SSHOptions) error {
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "ConnectTimeout=10",
+	}
+	if opts.Identity != "" {
+		args = append(args, "-i", opts.Identity, "-o", "IdentitiesOnly=yes")
+	}
+	if opts.KnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+opts.KnownHosts)
+	}
+	switch opts.Family {
+	case "ipv4":
+		args = append(args, "-4")
+	case "ipv6":
+		args = append(args, "-6")
+	}
+	command := opts.Command
+	if command == "" {
+		command = "true"
+	}
+	args = append(args, host, "--", command)
+
+	out, err := Runner.CombinedOutput(ctx, runner.Command("ssh", args...))
+	slog.Debug("ssh canary output:", slog.String("host", host), slog.String("output", string(out)))
+	if err != nil {
+		return fmt.Errorf("ssh canary %s: %w: %s", host, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package healthcheck_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestSSH(t *testing.T) {
+	fake := &runner.Fake{Errors: map[string]error{}}
+	original := healthcheck.Runner
+	healthcheck.Runner = fake
+	t.Cleanup(func() { healthcheck.Runner = original })
+
+	t.Run("pins host keys and runs the command", func(t *testing.T) {
+		err := healthcheck.SSH(context.Background(), "root@canary", healthcheck.SSHOptions{
+			Command:    "systemctl is-active nginx.service",
+			Identity:   "/etc/nhu/id_ed25519",
+			KnownHosts: "/etc/nhu/known_hosts",
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, fake.Ran[len(fake.Ran)-1], "ssh -o BatchMode=yes -o StrictHostKeyChecking=yes -o ConnectTimeout=10 -i /etc/nhu/id_ed25519 -o IdentitiesOnly=yes -o UserKnownHostsFile=/etc/nhu/known_hosts root@canary -- systemctl is-active nginx.service")
+	})
+
+	t.Run("fails when the login fails", func(t *testing.T) {
+		fake.Errors["ssh -o BatchMode=yes -o StrictHostKeyChecking=yes -o ConnectTimeout=10 down -- true"] = errors.New("exit status 255")
+		err := healthcheck.SSH(context.Background(), "down", healthcheck.SSHOptions{})
+		assert.Equal(t, err != nil, true)
+	})
+
+	t.Run("restricts the address family", func(t *testing.T) {
+		err := healthcheck.SSH(context.Background(), "root@2001:db8::1", healthcheck.SSHOptions{Family: "ipv6"})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, fake.Ran[len(fake.Ran)-1], "ssh -o BatchMode=yes -o StrictHostKeyChecking=yes -o ConnectTimeout=10 -6 root@2001:db8::1 -- true")
+	})
+}
@@ -0,0 +1,93 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+/*
+Waits up to `timeout` for the system to finish starting up, and requires
+it to reach the running state. Degraded systems, with failed units, fail.
+*/
+func SystemRunning(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// exits non-zero for any state other than running
+	output, err := Runner.Output(ctx, runner.Command("systemctl", "is-system-running", "--wait"))
+	state := strings.TrimSpace(string(output))
+	if state == "" && err != nil {
+		return fmt.Errorf("systemctl is-system-running: %w", err)
+	}
+	if state != "running" {
+		return fmt.Errorf("system is %s, not running", state)
+	}
+	return nil
+}
+
+// How often UnitsActive checks units still starting.
+const unitPollInterval = time.Second
+
+/*
+Requires each of `units` to be active, waiting up to `timeout` for units
+still activating or reloading, e.g. restarted by a switch.
+*/
+func UnitsActive(ctx context.Context, units []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		// exits non-zero unless every unit is active, states are still printed
+		output, err := Runner.Output(ctx, runner.Command("systemctl", append([]string{"is-active"}, units...)...))
+		states := strings.Fields(string(output))
+		if len(states) != len(units) {
+			if err == nil {
+				err = fmt.Errorf("unexpected output %q", output)
+			}
+			return fmt.Errorf("systemctl is-active: %w", err)
+		}
+		inactive := []string{}
+		starting := false
+		for i, state := range states {
+			if state == "active" {
+				continue
+			}
+			inactive = append(inactive, fmt.Sprintf("%s is %s", units[i], state))
+			starting = starting || state == "activating" || state == "reloading"
+		}
+		if len(inactive) == 0 {
+			return nil
+		}
+		if !starting || time.Now().After(deadline) {
+			return fmt.Errorf("units not active: %s", strings.Join(inactive, ", "))
+		}
+		select {
+		case <-time.After(unitPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Counts journal entries with priority err or more severe logged since `since`.
+func JournalErrors(ctx context.Context, since time.Time) (int, error) {
+	cmd := runner.Command("journalctl",
+		"--priority=err",
+		fmt.Sprintf("--since=@%d", since.Unix()),
+		// one entry per line, messages may span lines
+		"--output=json",
+		"--no-pager",
+		"--quiet")
+	output, err := Runner.Output(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+	return count, nil
+}
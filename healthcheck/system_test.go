@@ -0,0 +1,66 @@
+package healthcheck_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestSystemRunning(t *testing.T) {
+	original := healthcheck.Runner
+	t.Cleanup(func() { healthcheck.Runner = original })
+
+	healthcheck.Runner = &runner.Fake{Outputs: map[string]string{"systemctl is-system-running --wait": "running\n"}}
+	err := healthcheck.SystemRunning(context.Background(), time.Minute)
+	assert.Equal(t, err, nil)
+
+	healthcheck.Runner = &runner.Fake{
+		Outputs: map[string]string{"systemctl is-system-running --wait": "degraded\n"},
+		Errors:  map[string]error{"systemctl is-system-running --wait": errors.New("exit status 1")},
+	}
+	err = healthcheck.SystemRunning(context.Background(), time.Minute)
+	assert.Equal(t, err.Error(), "system is degraded, not running")
+}
+
+func TestJournalErrors(t *testing.T) {
+	original := healthcheck.Runner
+	t.Cleanup(func() { healthcheck.Runner = original })
+
+	since := time.Unix(1700000000, 0)
+	line := fmt.Sprintf("journalctl --priority=err --since=@%d --output=json --no-pager --quiet", since.Unix())
+	healthcheck.Runner = &runner.Fake{Outputs: map[string]string{line: "{\"MESSAGE\":\"a\"}\n{\"MESSAGE\":\"b\"}\n"}}
+	count, err := healthcheck.JournalErrors(context.Background(), since)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 2)
+}
+
+func TestUnitsActive(t *testing.T) {
+	original := healthcheck.Runner
+	t.Cleanup(func() { healthcheck.Runner = original })
+
+	line := "systemctl is-active nginx.service postgresql.service"
+	healthcheck.Runner = &runner.Fake{Outputs: map[string]string{line: "active\nactive\n"}}
+	err := healthcheck.UnitsActive(context.Background(), []string{"nginx.service", "postgresql.service"}, 0)
+	assert.Equal(t, err, nil)
+
+	healthcheck.Runner = &runner.Fake{
+		Outputs: map[string]string{line: "active\nfailed\n"},
+		Errors:  map[string]error{line: errors.New("exit status 3")},
+	}
+	err = healthcheck.UnitsActive(context.Background(), []string{"nginx.service", "postgresql.service"}, time.Minute)
+	assert.Equal(t, err.Error(), "units not active: postgresql.service is failed")
+
+	// units still starting are waited for until the timeout
+	healthcheck.Runner = &runner.Fake{
+		Outputs: map[string]string{line: "activating\nactive\n"},
+		Errors:  map[string]error{line: errors.New("exit status 3")},
+	}
+	err = healthcheck.UnitsActive(context.Background(), []string{"nginx.service", "postgresql.service"}, 0)
+	assert.Equal(t, err.Error(), "units not active: nginx.service is activating")
+}
@@ -0,0 +1,48 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/network"
+)
+
+// Timeout of TCPCheck dials, unless TCPCheck.Timeout is set.
+const tcpTimeout = 5 * time.Second
+
+/*
+Requires a canary to accept a TCP connection on a port, for canaries
+blocking ICMP that still expose a service like ssh or https.
+*/
+type TCPCheck struct {
+	Host string
+	Port int
+	// 0 waits tcpTimeout
+	Timeout time.Duration
+	// address family, any, ipv4, or ipv6
+	Family string
+}
+
+func (check TCPCheck) address() string {
+	return net.JoinHostPort(network.HostLiteral(check.Host), strconv.Itoa(check.Port))
+}
+
+func (check TCPCheck) Name() string {
+	return "tcp:" + check.address()
+}
+
+func (check TCPCheck) Check(ctx context.Context) error {
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = tcpTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network.Network(check.Family, "tcp"), check.address())
+	if err != nil {
+		return fmt.Errorf("tcp canary %s: %w", check.address(), err)
+	}
+	return conn.Close()
+}
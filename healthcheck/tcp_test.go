@@ -0,0 +1,30 @@
+package healthcheck_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+)
+
+func TestTCPCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	check := healthcheck.TCPCheck{Host: "127.0.0.1", Port: port}
+
+	err = check.Check(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	listener.Close()
+	err = check.Check(context.Background())
+	assert.Equal(t, err != nil, true)
+
+	assert.Equal(t, healthcheck.TCPCheck{Host: "[2001:db8::1]", Port: 22}.Name(), "tcp:[2001:db8::1]:22")
+}
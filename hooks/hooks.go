@@ -0,0 +1,113 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Environment provided to hook commands, describing the upgrade in progress.
+type Env struct {
+	// hydra build id of the target system
+	BuildID int
+	// flake revision of the target system
+	FlakeRev string
+	// nixos-rebuild operation
+	Operation string
+	// outcome of the upgrade, empty for hooks that run before it is known
+	Outcome string
+	// pipeline phase and its duration, only for phase hooks
+	Phase    string
+	Duration time.Duration
+	// units that failed when switching, once the switch completes
+	FailedUnits []string
+	// on-failure hooks only, runs failing with this outcome in a row
+	Failures int
+	// rollback hooks only, the system rolled back from and to, and why
+	RollbackFrom string
+	RollbackTo   string
+	Error        string
+	// operator note on why the run was triggered, e.g. a change ticket
+	Annotation string
+}
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+func (env Env) environ() []string {
+	return []string{
+		fmt.Sprintf("BUILD_ID=%s", strconv.Itoa(env.BuildID)),
+		fmt.Sprintf("FLAKE_REV=%s", env.FlakeRev),
+		fmt.Sprintf("OPERATION=%s", env.Operation),
+		fmt.Sprintf("OUTCOME=%s", env.Outcome),
+		fmt.Sprintf("PHASE=%s", env.Phase),
+		fmt.Sprintf("PHASE_SECONDS=%d", int(env.Duration.Seconds())),
+		fmt.Sprintf("FAILED_UNITS=%s", strings.Join(env.FailedUnits, " ")),
+		fmt.Sprintf("FAILURES=%d", env.Failures),
+		fmt.Sprintf("ROLLBACK_FROM=%s", env.RollbackFrom),
+		fmt.Sprintf("ROLLBACK_TO=%s", env.RollbackTo),
+		fmt.Sprintf("ERROR=%s", env.Error),
+		fmt.Sprintf("ANNOTATION=%s", env.Annotation),
+	}
+}
+
+/*
+Runs each hook command with `sh -c` in order. Stops and returns an error
+at the first command that fails.
+*/
+func Run(ctx context.Context, name string, commands []string, env Env) error {
+	for _, command := range commands {
+		slog.Info("Running hook.", slog.String("hook", name), slog.String("command", command))
+		cmd := runner.Command("sh", "-c", command)
+		cmd.Env = env.environ()
+
+		err := Runner.Run(ctx, cmd)
+		if err != nil {
+			return fmt.Errorf("%s hook %q: %w", name, command, err)
+		}
+	}
+	return nil
+}
+
+// Shell syntax that keeps a hook's command from being resolved before it runs.
+const shellSyntax = "$`'\"(){}[]|&;<>*?~\\"
+
+/*
+Checks that `sh` can find the command each hook starts with, as a builtin,
+function, or executable in PATH, so a missing binary fails at startup rather
+than mid-upgrade. Commands starting with shell syntax, like variables or
+subshells, can't be resolved ahead of time and are skipped.
+*/
+func Check(ctx context.Context, name string, commands []string) error {
+	for _, command := range commands {
+		executable := commandName(command)
+		if executable == "" {
+			continue
+		}
+		_, err := Runner.Output(ctx, runner.Command("sh", "-c", `command -v "$1"`, "sh", executable))
+		if err != nil {
+			return fmt.Errorf("%s hook %q: %s not found", name, command, executable)
+		}
+	}
+	return nil
+}
+
+// The command `command` runs, after any variable assignments, or "" when it's shell syntax.
+func commandName(command string) string {
+	for _, word := range strings.Fields(command) {
+		variable, _, assignment := strings.Cut(word, "=")
+		if assignment && variable != "" && !strings.ContainsAny(variable, shellSyntax+"/") {
+			continue
+		}
+		if strings.ContainsAny(word, shellSyntax) {
+			return ""
+		}
+		return word
+	}
+	return ""
+}
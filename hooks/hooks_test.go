@@ -0,0 +1,36 @@
+package hooks_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hooks"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestCheck(t *testing.T) {
+	fake := &runner.Fake{Errors: map[string]error{
+		`sh -c command -v "$1" sh notify-oncall`: errors.New("exit status 1"),
+	}}
+	hooks.Runner = fake
+	t.Cleanup(func() { hooks.Runner = runner.Exec{} })
+
+	err := hooks.Check(context.Background(), "pre-switch", []string{
+		"systemctl stop backup.service",
+		"ENV=prod /usr/local/bin/drain --wait",
+		"$HOME/bin/hook",
+		"(cd /tmp && make)",
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.ArrayEqual(t, fake.Ran, []string{
+		`sh -c command -v "$1" sh systemctl`,
+		`sh -c command -v "$1" sh /usr/local/bin/drain`,
+	})
+
+	err = hooks.Check(context.Background(), "on-failure", []string{"notify-oncall failed"})
+	assert.Equal(t, err.Error(), `on-failure hook "notify-oncall failed": notify-oncall not found`)
+}
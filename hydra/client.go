@@ -1,32 +1,66 @@
 package hydra
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 type HydraClient struct {
 	Instance string
-	JobSet   string
-	Job      string
-	Project  string
+	// discovers the instance when Instance is empty, see Discover
+	Domain  string
+	JobSet  string
+	Job     string
+	Project string
+	// nil uses http.DefaultClient
+	HTTP *http.Client
 }
 
 // see https://github.com/NixOS/hydra/blob/master/hydra-api.yaml
 // These are partial implementations, just grabbing what I need.
 
 type Build struct {
+	// build id
+	ID int `json:"id"`
+	// job name, e.g. nixosConfigurations.host
+	Job string `json:"job"`
 	// 1 is finished, else not
 	Finished int `json:"finished"`
 	// may be nil if not finished, 1 is success, else not
 	BuildStatus int `json:"buildstatus"`
 	// should be length 1
 	JobSetEvals []int `json:"jobsetevals"`
+	// unix timestamp, build completion
+	StopTime int64 `json:"stoptime"`
+	// outputs by name, "out" for system toplevels
+	BuildOutputs map[string]BuildOutput `json:"buildoutputs"`
+	// files the build declared in nix-support/hydra-build-products, by product number
+	BuildProducts map[string]BuildProduct `json:"buildproducts"`
+}
+
+type BuildProduct struct {
+	// file name, e.g. nixos.iso
+	Name string `json:"name"`
+	// e.g. file or doc, and iso or tarball
+	Type    string `json:"type"`
+	SubType string `json:"subtype"`
+	// hex sha256 of the file, empty for directories
+	SHA256 string `json:"sha256hash"`
+}
+
+type BuildOutput struct {
+	// store path
+	Path string `json:"path"`
 }
 
 type Eval struct {
@@ -34,84 +68,202 @@ type Eval struct {
 	Flake string `json:"flake"`
 }
 
-/*
-Gets a the latest build. These are host toplevel derivations in this
-use case.
-*/
-func (client HydraClient) GetLatestBuild() Build {
-	httpClient := http.Client{}
+// A page of a jobset's evaluations, newest first.
+type Evals struct {
+	Evals []JobsetEval `json:"evals"`
+	// query string of the next page, e.g. ?page=2, empty on the last page
+	Next string `json:"next"`
+}
+
+type JobsetEval struct {
+	// eval id
+	ID int `json:"id"`
+	// unix timestamp, evaluation completion
+	Timestamp int64 `json:"timestamp"`
+}
 
-	requestUrl, err := url.JoinPath(client.Instance, "job", client.Project, client.JobSet, client.Job, "latest")
+type Jobset struct {
+	// flake specification the jobset evaluates, empty for legacy jobsets
+	Flake string `json:"flake"`
+}
+
+// GETs a hydra path, discovering the instance when Instance is empty.
+func (client HydraClient) request(ctx context.Context, accept string, query url.Values, path ...string) (*http.Response, error) {
+	instance := client.Instance
+	if instance == "" && client.Domain != "" {
+		var err error
+		instance, err = client.Discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	requestUrl, err := url.JoinPath(instance, path...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl, nil)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	req.Header.Add("Accept", accept)
+	httpClient := client.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
 	}
+	return httpClient.Do(req)
+}
 
-	req.Header.Add("Accept", "application/json")
-	resp, err := httpClient.Do(req)
+// GETs a hydra API path and decodes the JSON response into `v`.
+func (client HydraClient) get(ctx context.Context, name string, v any, path ...string) error {
+	return client.getQuery(ctx, name, v, nil, path...)
+}
+
+// GETs a hydra API path with `query`, see get.
+func (client HydraClient) getQuery(ctx context.Context, name string, v any, query url.Values, path ...string) error {
+	resp, err := client.request(ctx, "application/json", query, path...)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer resp.Body.Close()
+	requestUrl := resp.Request.URL.String()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	slog.Debug("GetLatestBuild",
+	slog.Debug(name,
 		slog.String("body", string(body)),
 		slog.String("url", requestUrl))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s returned %s", name, requestUrl, resp.Status)
+	}
 
-	var build Build
-	err = json.Unmarshal(body, &build)
+	err = json.Unmarshal(body, v)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	slog.Debug(fmt.Sprintf("%+v", v))
+	return nil
+}
 
-	slog.Debug(fmt.Sprintf("%+v", build))
-	return build
+/*
+Gets a the latest build. These are host toplevel derivations in this
+use case.
+*/
+func (client HydraClient) GetLatestBuild(ctx context.Context) (Build, error) {
+	var build Build
+	err := client.get(ctx, "GetLatestBuild", &build, "job", client.Project, client.JobSet, client.Job, "latest")
+	return build, err
 }
 
 /*
 Gets a specific evaluation. This includes the flake that includes the
 job / build.
 */
-func (client HydraClient) GetEval(build Build) Eval {
-	httpClient := http.Client{}
-
-	requestUrl, err := url.JoinPath(client.Instance, "eval", strconv.Itoa(build.JobSetEvals[0]))
-	if err != nil {
-		panic(err)
+func (client HydraClient) GetEval(ctx context.Context, build Build) (Eval, error) {
+	var eval Eval
+	if len(build.JobSetEvals) == 0 {
+		return eval, fmt.Errorf("build %d has no evaluations", build.ID)
 	}
-	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
-	if err != nil {
-		panic(err)
+	err := client.get(ctx, "GetEval", &eval, "eval", strconv.Itoa(build.JobSetEvals[0]))
+	return eval, err
+}
+
+// Gets the configured jobset, including the flake it evaluates.
+func (client HydraClient) GetJobset(ctx context.Context) (Jobset, error) {
+	var jobset Jobset
+	err := client.get(ctx, "GetJobset", &jobset, "jobset", client.Project, client.JobSet)
+	return jobset, err
+}
+
+// Gets page `page` of the configured jobset's evaluations, starting at 1.
+func (client HydraClient) GetEvals(ctx context.Context, page int) (Evals, error) {
+	var evals Evals
+	query := url.Values{"page": {strconv.Itoa(page)}}
+	err := client.getQuery(ctx, "GetEvals", &evals, query, "jobset", client.Project, client.JobSet, "evals")
+	return evals, err
+}
+
+// Gets every build of an evaluation.
+func (client HydraClient) GetEvalBuilds(ctx context.Context, id int) ([]Build, error) {
+	var builds []Build
+	err := client.get(ctx, "GetEvalBuilds", &builds, "eval", strconv.Itoa(id), "builds")
+	return builds, err
+}
+
+// No successful build of the job was found, see LatestSuccess.
+var ErrNoSuccess = errors.New("no successful build")
+
+/*
+Finds the latest successful build of the configured job, paging through the
+jobset's evaluations newest first. Evaluations are searched until one that
+finished before `since` has been checked, failing with ErrNoSuccess when
+none of them built the job successfully. Unchanged jobs keep their build
+across evaluations, so the build found may have finished before `since`.
+*/
+func (client HydraClient) LatestSuccess(ctx context.Context, since time.Time) (Build, error) {
+	for page := 1; ; page++ {
+		evals, err := client.GetEvals(ctx, page)
+		if err != nil {
+			return Build{}, err
+		}
+		for _, eval := range evals.Evals {
+			builds, err := client.GetEvalBuilds(ctx, eval.ID)
+			if err != nil {
+				return Build{}, err
+			}
+			for _, build := range builds {
+				if build.Job == client.Job && build.Finished == 1 && build.BuildStatus == 0 {
+					return build, nil
+				}
+			}
+			if time.Unix(eval.Timestamp, 0).Before(since) {
+				return Build{}, ErrNoSuccess
+			}
+		}
+		if evals.Next == "" || len(evals.Evals) == 0 {
+			return Build{}, ErrNoSuccess
+		}
 	}
+}
 
-	req.Header.Add("Accept", "application/json")
-	resp, err := httpClient.Do(req)
+// Gets a specific build.
+func (client HydraClient) GetBuild(ctx context.Context, id int) (Build, error) {
+	var build Build
+	err := client.get(ctx, "GetBuild", &build, "build", strconv.Itoa(id))
+	return build, err
+}
+
+/*
+Downloads build product `number` of `build` to `w`, failing when its
+sha256 doesn't match the product's.
+*/
+func (client HydraClient) DownloadProduct(ctx context.Context, build Build, number string, w io.Writer) error {
+	product, ok := build.BuildProducts[number]
+	if !ok {
+		return fmt.Errorf("build %d has no product %s", build.ID, number)
+	}
+	resp, err := client.request(ctx, "*/*", nil, "build", strconv.Itoa(build.ID), "download", number, product.Name)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DownloadProduct: %s returned %s", resp.Request.URL, resp.Status)
 	}
-	slog.Debug("GetEval",
-		slog.String("body", string(body)),
-		slog.String("url", requestUrl))
 
-	var eval Eval
-	err = json.Unmarshal(body, &eval)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, hash), resp.Body)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
-	slog.Debug(fmt.Sprintf("%+v", eval))
-	return eval
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if product.SHA256 != "" && sum != product.SHA256 {
+		return fmt.Errorf("product %s of build %d has sha256 %s, expected %s", product.Name, build.ID, sum, product.SHA256)
+	}
+	return nil
 }
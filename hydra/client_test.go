@@ -0,0 +1,120 @@
+package hydra_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hydra"
+)
+
+func TestLatestSuccess(t *testing.T) {
+	pages := map[string]string{
+		"1": `{"evals": [{"id": 3, "timestamp": 3000}, {"id": 2, "timestamp": 2000}], "next": "?page=2"}`,
+		"2": `{"evals": [{"id": 1, "timestamp": 1000}], "next": ""}`,
+	}
+	builds := map[string]string{}
+	var requested []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobset/project/jobset/evals", func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, "page "+r.URL.Query().Get("page"))
+		w.Write([]byte(pages[r.URL.Query().Get("page")]))
+	})
+	mux.HandleFunc("/eval/{id}/builds", func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, "eval "+r.PathValue("id"))
+		w.Write([]byte(builds[r.PathValue("id")]))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := hydra.HydraClient{Instance: server.URL, Project: "project", JobSet: "jobset", Job: "host"}
+	reset := func() {
+		requested = nil
+		builds = map[string]string{
+			"3": `[{"id": 30, "job": "host", "finished": 0}]`,
+			"2": `[{"id": 21, "job": "other", "finished": 1, "buildstatus": 0}, {"id": 20, "job": "host", "finished": 1, "buildstatus": 1}]`,
+			"1": `[{"id": 10, "job": "host", "finished": 1, "buildstatus": 0}]`,
+		}
+	}
+
+	t.Run("pages through evaluations", func(t *testing.T) {
+		reset()
+		build, err := client.LatestSuccess(context.Background(), time.Unix(0, 0))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, build.ID, 10)
+		assert.ArrayEqual(t, requested, []string{"page 1", "eval 3", "eval 2", "page 2", "eval 1"})
+	})
+
+	t.Run("stops after evaluations older than since", func(t *testing.T) {
+		reset()
+		_, err := client.LatestSuccess(context.Background(), time.Unix(2500, 0))
+		assert.Equal(t, errors.Is(err, hydra.ErrNoSuccess), true)
+		assert.ArrayEqual(t, requested, []string{"page 1", "eval 3", "eval 2"})
+	})
+
+	t.Run("stops on the last page", func(t *testing.T) {
+		reset()
+		builds["1"] = `[]`
+		_, err := client.LatestSuccess(context.Background(), time.Unix(0, 0))
+		assert.Equal(t, errors.Is(err, hydra.ErrNoSuccess), true)
+		assert.ArrayEqual(t, requested, []string{"page 1", "eval 3", "eval 2", "page 2", "eval 1"})
+	})
+
+	t.Run("fails on failed requests", func(t *testing.T) {
+		reset()
+		failing := hydra.HydraClient{Instance: server.URL, Project: "project", JobSet: "missing", Job: "host"}
+		_, err := failing.LatestSuccess(context.Background(), time.Unix(0, 0))
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, errors.Is(err, hydra.ErrNoSuccess), false)
+	})
+}
+
+func TestDownloadProduct(t *testing.T) {
+	content := []byte("iso contents")
+	sum := sha256.Sum256(content)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/build/7/download/1/nixos.iso", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := hydra.HydraClient{Instance: server.URL}
+	build := func(hash string) hydra.Build {
+		return hydra.Build{ID: 7, BuildProducts: map[string]hydra.BuildProduct{
+			"1": {Name: "nixos.iso", Type: "file", SubType: "iso", SHA256: hash},
+		}}
+	}
+
+	t.Run("downloads products with matching checksums", func(t *testing.T) {
+		var out bytes.Buffer
+		err := client.DownloadProduct(context.Background(), build(hex.EncodeToString(sum[:])), "1", &out)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, out.String(), "iso contents")
+	})
+
+	t.Run("fails on checksum mismatches", func(t *testing.T) {
+		var out bytes.Buffer
+		err := client.DownloadProduct(context.Background(), build("0000"), "1", &out)
+		assert.Equal(t, err != nil, true)
+	})
+
+	t.Run("fails on missing products", func(t *testing.T) {
+		var out bytes.Buffer
+		err := client.DownloadProduct(context.Background(), build(""), "2", &out)
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, out.Len(), 0)
+	})
+
+	t.Run("fails on failed downloads", func(t *testing.T) {
+		var out bytes.Buffer
+		missing := hydra.Build{ID: 8, BuildProducts: build("").BuildProducts}
+		err := client.DownloadProduct(context.Background(), missing, "1", &out)
+		assert.Equal(t, err != nil, true)
+	})
+}
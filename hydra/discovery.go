@@ -0,0 +1,95 @@
+package hydra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long discovered instances are reused before discovering them again.
+const discoveryTTL = 5 * time.Minute
+
+// Instances discovered per domain, see Discover.
+var discovered = struct {
+	sync.Mutex
+	instances map[string]discovery
+}{instances: map[string]discovery{}}
+
+type discovery struct {
+	instance string
+	at       time.Time
+}
+
+// The well-known document on a discovery domain.
+type wellKnown struct {
+	Instance string `json:"instance"`
+}
+
+/*
+Discovers the hydra instance of client.Domain, from its _hydra._tcp SRV
+record when there is one, or else the instance of the well-known document
+https://<domain>/.well-known/nixos-hydra-upgrade.json, like
+{"instance": "https://hydra.example.com"}. Results are reused for a few
+minutes.
+*/
+func (client HydraClient) Discover(ctx context.Context) (string, error) {
+	domain := client.Domain
+	discovered.Lock()
+	cached, ok := discovered.instances[domain]
+	discovered.Unlock()
+	if ok && time.Since(cached.at) < discoveryTTL {
+		return cached.instance, nil
+	}
+
+	instance, err := discoverSRV(ctx, domain)
+	if err != nil {
+		slog.Debug("No hydra SRV record.", slog.String("domain", domain), slog.String("error", err.Error()))
+		instance, err = client.discoverWellKnown(ctx)
+	}
+	if err != nil {
+		return "", fmt.Errorf("discovering hydra instance of %s: %w", domain, err)
+	}
+	slog.Info("Discovered hydra instance.", slog.String("domain", domain), slog.String("instance", instance))
+
+	discovered.Lock()
+	discovered.instances[domain] = discovery{instance: instance, at: time.Now()}
+	discovered.Unlock()
+	return instance, nil
+}
+
+func discoverSRV(ctx context.Context, domain string) (string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "hydra", "tcp", domain)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no SRV records for %s", domain)
+	}
+	// sorted by priority and randomized by weight
+	record := records[0]
+	host := strings.TrimSuffix(record.Target, ".")
+	if record.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(int(record.Port)))
+	}
+	return "https://" + host, nil
+}
+
+func (client HydraClient) discoverWellKnown(ctx context.Context) (string, error) {
+	client = HydraClient{Instance: "https://" + client.Domain, HTTP: client.HTTP}
+	var document wellKnown
+	err := client.get(ctx, "Discover", &document, ".well-known", "nixos-hydra-upgrade.json")
+	if err != nil {
+		return "", err
+	}
+	parsed, err := url.Parse(document.Instance)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return "", fmt.Errorf("invalid instance %q", document.Instance)
+	}
+	return document.Instance, nil
+}
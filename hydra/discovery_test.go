@@ -0,0 +1,60 @@
+package hydra_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hydra"
+)
+
+func TestDiscover(t *testing.T) {
+	documents := 0
+	instance := ""
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/nixos-hydra-upgrade.json", func(w http.ResponseWriter, r *http.Request) {
+		documents++
+		w.Write([]byte(`{"instance": "` + instance + `"}`))
+	})
+	mux.HandleFunc("/jobset/project/jobset", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"flake": "github:owner/repo"}`))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	// ports aren't valid in SRV names, so discovery falls back to the well-known document
+	domain := strings.TrimPrefix(server.URL, "https://")
+	instance = server.URL
+
+	t.Run("uses the well-known instance", func(t *testing.T) {
+		client := hydra.HydraClient{Domain: domain, Project: "project", JobSet: "jobset", HTTP: server.Client()}
+		jobset, err := client.GetJobset(context.Background())
+		assert.Equal(t, err, nil)
+		assert.Equal(t, jobset.Flake, "github:owner/repo")
+
+		discovered, err := client.Discover(context.Background())
+		assert.Equal(t, err, nil)
+		assert.Equal(t, discovered, server.URL)
+		assert.Equal(t, documents, 1)
+	})
+
+	t.Run("fails on invalid instances", func(t *testing.T) {
+		invalid := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"instance": "hydra.example.com"}`))
+		}))
+		defer invalid.Close()
+		client := hydra.HydraClient{Domain: strings.TrimPrefix(invalid.URL, "https://"), HTTP: invalid.Client()}
+		_, err := client.Discover(context.Background())
+		assert.Equal(t, err != nil, true)
+	})
+
+	t.Run("fails without a well-known document", func(t *testing.T) {
+		missing := httptest.NewTLSServer(http.NotFoundHandler())
+		defer missing.Close()
+		client := hydra.HydraClient{Domain: strings.TrimPrefix(missing.URL, "https://"), HTTP: missing.Client()}
+		_, err := client.Discover(context.Background())
+		assert.Equal(t, err != nil, true)
+	})
+}
@@ -0,0 +1,71 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Annotation marking nodes drained by nixos-hydra-upgrade. Nodes cordoned
+// by anything else are never uncordoned.
+const drainedAnnotation = "nixos-hydra-upgrade/drained"
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+// A kubernetes node, managed with kubectl.
+type Node struct {
+	Name string
+	// optional, kubectl falls back to $KUBECONFIG or in-cluster config
+	Kubeconfig string
+}
+
+func (node Node) kubectl(args ...string) runner.Cmd {
+	if node.Kubeconfig != "" {
+		args = append([]string{"--kubeconfig", node.Kubeconfig}, args...)
+	}
+	return runner.Command("kubectl", args...)
+}
+
+func (node Node) run(ctx context.Context, args ...string) error {
+	return Runner.Run(ctx, node.kubectl(args...))
+}
+
+/*
+Cordons and drains the node, evicting workloads. The node is annotated so
+Uncordon only reverts drains performed here. `args` are passed through to
+`kubectl drain`.
+*/
+func (node Node) Drain(ctx context.Context, args []string) error {
+	err := node.run(ctx, "annotate", "--overwrite", "node", node.Name, drainedAnnotation+"=true")
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Draining kubernetes node.", slog.String("node", node.Name))
+	drainArgs := append([]string{"drain", node.Name, "--ignore-daemonsets", "--delete-emptydir-data"}, args...)
+	return node.run(ctx, drainArgs...)
+}
+
+// Uncordons the node if it was drained by Drain, otherwise does nothing.
+func (node Node) Uncordon(ctx context.Context) error {
+	output, err := Runner.Output(ctx, node.kubectl("get", "node", node.Name,
+		"-o", fmt.Sprintf("jsonpath={.metadata.annotations.%s}", drainedAnnotation)))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(output)) != "true" {
+		slog.Debug("Kubernetes node not drained by nixos-hydra-upgrade.", slog.String("node", node.Name))
+		return nil
+	}
+
+	slog.Info("Uncordoning kubernetes node.", slog.String("node", node.Name))
+	err = node.run(ctx, "uncordon", node.Name)
+	if err != nil {
+		return err
+	}
+	return node.run(ctx, "annotate", "node", node.Name, drainedAnnotation+"-")
+}
@@ -0,0 +1,59 @@
+package kubernetes_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/kubernetes"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestNode(t *testing.T) {
+	original := kubernetes.Runner
+	t.Cleanup(func() { kubernetes.Runner = original })
+	ctx := context.Background()
+	annotation := "kubectl get node host -o jsonpath={.metadata.annotations.nixos-hydra-upgrade/drained}"
+
+	t.Run("annotates nodes before draining them", func(t *testing.T) {
+		fake := &runner.Fake{}
+		kubernetes.Runner = fake
+		err := kubernetes.Node{Name: "host", Kubeconfig: "/etc/kubeconfig"}.Drain(ctx, []string{"--timeout=5m"})
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{
+			"kubectl --kubeconfig /etc/kubeconfig annotate --overwrite node host nixos-hydra-upgrade/drained=true",
+			"kubectl --kubeconfig /etc/kubeconfig drain host --ignore-daemonsets --delete-emptydir-data --timeout=5m",
+		})
+	})
+
+	t.Run("doesn't drain when annotating fails", func(t *testing.T) {
+		fake := &runner.Fake{Errors: map[string]error{
+			"kubectl annotate --overwrite node host nixos-hydra-upgrade/drained=true": errors.New("exit status 1"),
+		}}
+		kubernetes.Runner = fake
+		err := kubernetes.Node{Name: "host"}.Drain(ctx, nil)
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, len(fake.Ran), 1)
+	})
+
+	t.Run("uncordons nodes it drained", func(t *testing.T) {
+		fake := &runner.Fake{Outputs: map[string]string{annotation: "true\n"}}
+		kubernetes.Runner = fake
+		err := kubernetes.Node{Name: "host"}.Uncordon(ctx)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{
+			annotation,
+			"kubectl uncordon host",
+			"kubectl annotate node host nixos-hydra-upgrade/drained-",
+		})
+	})
+
+	t.Run("leaves nodes cordoned by others", func(t *testing.T) {
+		fake := &runner.Fake{}
+		kubernetes.Runner = fake
+		err := kubernetes.Node{Name: "host"}.Uncordon(ctx)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{annotation})
+	})
+}
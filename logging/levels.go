@@ -0,0 +1,88 @@
+/*
+Package logging filters slog records by the package that logged them, so one
+subsystem can log at debug while the rest stay at info.
+*/
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+)
+
+/*
+Parses module levels like hydra=debug or nix=warn, keyed by package name,
+e.g. hydra, nix, healthcheck, or upgrade.
+*/
+func ParseLevels(specs []string) (map[string]slog.Level, error) {
+	levels := map[string]slog.Level{}
+	for _, spec := range specs {
+		module, name, ok := strings.Cut(spec, "=")
+		if !ok || module == "" {
+			return nil, fmt.Errorf("log level %q: expected module=level", spec)
+		}
+		var level slog.Level
+		err := level.UnmarshalText([]byte(name))
+		if err != nil {
+			return nil, fmt.Errorf("log level %q: %w", spec, err)
+		}
+		levels[module] = level
+	}
+	return levels, nil
+}
+
+/*
+Wraps a handler, dropping records below the level of the package that logged
+them, or below Level for packages without one. Records need a PC, which slog
+sets by default.
+*/
+type ModuleHandler struct {
+	Handler slog.Handler
+	Level   slog.Level
+	// levels by package name, see ParseLevels
+	Levels map[string]slog.Level
+}
+
+func (h ModuleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	minimum := h.Level
+	for _, moduleLevel := range h.Levels {
+		minimum = min(minimum, moduleLevel)
+	}
+	return level >= minimum && h.Handler.Enabled(ctx, level)
+}
+
+func (h ModuleHandler) Handle(ctx context.Context, record slog.Record) error {
+	level, ok := h.Levels[Module(record.PC)]
+	if !ok {
+		level = h.Level
+	}
+	if record.Level < level {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h ModuleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.Handler = h.Handler.WithAttrs(attrs)
+	return h
+}
+
+func (h ModuleHandler) WithGroup(name string) slog.Handler {
+	h.Handler = h.Handler.WithGroup(name)
+	return h
+}
+
+// Name of the package of the function at `pc`, e.g. hydra. Empty if unknown.
+func Module(pc uintptr) string {
+	if pc == 0 {
+		return ""
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	// e.g. github.com/hyperparabolic/nixos-hydra-upgrade/hydra.HydraClient.get
+	name := frame.Function
+	name = name[strings.LastIndex(name, "/")+1:]
+	module, _, _ := strings.Cut(name, ".")
+	return module
+}
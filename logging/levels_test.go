@@ -0,0 +1,43 @@
+package logging_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/logging"
+)
+
+func TestParseLevels(t *testing.T) {
+	levels, err := logging.ParseLevels([]string{"hydra=debug", "nix=WARN"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, levels["hydra"], slog.LevelDebug)
+	assert.Equal(t, levels["nix"], slog.LevelWarn)
+
+	_, err = logging.ParseLevels([]string{"hydra"})
+	assert.Equal(t, err != nil, true)
+	_, err = logging.ParseLevels([]string{"hydra=loud"})
+	assert.Equal(t, err != nil, true)
+}
+
+func TestModuleHandler(t *testing.T) {
+	var out bytes.Buffer
+	handler := logging.ModuleHandler{
+		Handler: slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		Level:   slog.LevelInfo,
+		Levels:  map[string]slog.Level{"logging_test": slog.LevelDebug, "other": slog.LevelError},
+	}
+	logger := slog.New(handler)
+
+	logger.Debug("debug from this module")
+	assert.Equal(t, strings.Contains(out.String(), "debug from this module"), true)
+
+	handler.Levels["logging_test"] = slog.LevelWarn
+	out.Reset()
+	logger.Info("info from this module")
+	assert.Equal(t, out.String(), "")
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"os"
+
 	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd"
 )
 
@@ -8,5 +11,32 @@ func main() {
 	rootCmd := cmd.NewRootCmd()
 	docsCmd := cmd.NewDocsCommand(rootCmd)
 	rootCmd.AddCommand(docsCmd)
-	rootCmd.Execute()
+	rootCmd.AddCommand(cmd.NewActivateCommand())
+	rootCmd.AddCommand(cmd.NewApproveCommand())
+	rootCmd.AddCommand(cmd.NewCheckCommand())
+	rootCmd.AddCommand(cmd.NewConfirmCommand())
+	rootCmd.AddCommand(cmd.NewDaemonCommand())
+	rootCmd.AddCommand(cmd.NewHoldCommand())
+	rootCmd.AddCommand(cmd.NewInstallCommand())
+	rootCmd.AddCommand(cmd.NewPreflightCommand())
+	rootCmd.AddCommand(cmd.NewPrepareCommand())
+	rootCmd.AddCommand(cmd.NewStatusCommand())
+	rootCmd.AddCommand(cmd.NewUnholdCommand())
+	rootCmd.AddCommand(cmd.NewWhyBlockedCommand())
+	os.Exit(exitCode(rootCmd.Execute()))
+}
+
+/*
+Exit code for a command result. Upgrades that are deferred or have nothing
+to do yet exit successfully, failed upgrades and other errors exit 1.
+*/
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var outcomeErr *cmd.OutcomeError
+	if errors.As(err, &outcomeErr) && !outcomeErr.Outcome.Failed() {
+		return 0
+	}
+	return 1
 }
@@ -0,0 +1,112 @@
+/*
+Package metrics renders upgrade status in the prometheus text format, for
+the node_exporter textfile collector.
+*/
+package metrics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What the textfile reports about the system and the last upgrade run.
+type Status struct {
+	// latest hydra build, 0 when unknown
+	LatestBuildID int
+	// flake revisions of the system profile and the latest build, empty when unknown
+	CurrentRevision string
+	LatestRevision  string
+	// when the flakes of the system profile and the latest build were last modified, zero when unknown
+	Current time.Time
+	Latest  time.Time
+	// the system profile isn't the booted system
+	RebootPending bool
+	// outcome of the last run and when it finished
+	Outcome  string
+	Finished time.Time
+}
+
+const prefix = "nixos_hydra_upgrade_"
+
+/*
+Renders the status, omitting metrics that are unknown. Hydra build ids are
+global to the instance rather than counting builds of the job, so lag is
+measured in time between the flakes' last modification instead.
+*/
+func Render(status Status) string {
+	var b strings.Builder
+	metric := func(name, help, labels string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s%s %s\n", prefix, name, help)
+		fmt.Fprintf(&b, "# TYPE %s%s gauge\n", prefix, name)
+		fmt.Fprintf(&b, "%s%s%s %s\n", prefix, name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	metric("info", "Flake revisions of the system profile and the latest hydra build.",
+		fmt.Sprintf("{current_revision=%q,latest_revision=%q}", status.CurrentRevision, status.LatestRevision), 1)
+	if status.LatestBuildID > 0 {
+		metric("latest_build_id", "Latest hydra build of the job.", "", float64(status.LatestBuildID))
+	}
+	if !status.Current.IsZero() {
+		metric("current_timestamp_seconds", "When the system profile's flake was last modified.", "", float64(status.Current.Unix()))
+	}
+	if !status.Latest.IsZero() {
+		metric("latest_timestamp_seconds", "When the latest hydra build's flake was last modified.", "", float64(status.Latest.Unix()))
+	}
+	if !status.Current.IsZero() && !status.Latest.IsZero() {
+		metric("lag_seconds", "How far the system profile's flake is behind the latest hydra build's.", "",
+			max(status.Latest.Sub(status.Current).Seconds(), 0))
+	}
+	if status.CurrentRevision != "" && status.LatestRevision != "" {
+		metric("up_to_date", "Whether the system profile is the latest hydra build.", "", boolValue(status.CurrentRevision == status.LatestRevision))
+	}
+	metric("reboot_pending", "Whether the system profile isn't the booted system.", "", boolValue(status.RebootPending))
+	if !status.Finished.IsZero() {
+		metric("last_run_timestamp_seconds", "When the last upgrade run finished.", "", float64(status.Finished.Unix()))
+	}
+	if status.Outcome != "" {
+		metric("last_run", "Outcome of the last upgrade run.", fmt.Sprintf("{outcome=%q}", status.Outcome), 1)
+	}
+	return b.String()
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/*
+Atomically writes the rendered status to `path`, readable by everyone. The
+collector reads every *.prom file in its directory, so the temporary file is
+named without the extension until it's renamed into place.
+*/
+func Write(path string, status Status) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(Render(status))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
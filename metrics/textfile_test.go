@@ -0,0 +1,56 @@
+package metrics_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/metrics"
+)
+
+func TestRender(t *testing.T) {
+	rendered := metrics.Render(metrics.Status{
+		LatestBuildID:   1235,
+		CurrentRevision: "abc",
+		LatestRevision:  "def",
+		Current:         time.Unix(1714500000, 0),
+		Latest:          time.Unix(1714586400, 0),
+		RebootPending:   true,
+		Outcome:         "available",
+		Finished:        time.Unix(1714600000, 0),
+	})
+	var samples []string
+	for _, line := range strings.Split(strings.TrimSpace(rendered), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			samples = append(samples, line)
+		}
+	}
+	assert.ArrayEqual(t, samples, []string{
+		`nixos_hydra_upgrade_info{current_revision="abc",latest_revision="def"} 1`,
+		"nixos_hydra_upgrade_latest_build_id 1235",
+		"nixos_hydra_upgrade_current_timestamp_seconds 1714500000",
+		"nixos_hydra_upgrade_latest_timestamp_seconds 1714586400",
+		"nixos_hydra_upgrade_lag_seconds 86400",
+		"nixos_hydra_upgrade_up_to_date 0",
+		"nixos_hydra_upgrade_reboot_pending 1",
+		"nixos_hydra_upgrade_last_run_timestamp_seconds 1714600000",
+		`nixos_hydra_upgrade_last_run{outcome="available"} 1`,
+	})
+}
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "textfiles", "nixos-hydra-upgrade.prom")
+	err := metrics.Write(path, metrics.Status{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, strings.Contains(string(contents), "nixos_hydra_upgrade_reboot_pending 0\n"), true)
+	assert.Equal(t, strings.Contains(string(contents), "lag_seconds"), false)
+}
@@ -26,6 +26,17 @@ in {
         '';
       };
 
+      netrcFile = lib.mkOption {
+        type = lib.types.nullOr lib.types.path;
+        default = null;
+        example = "/run/secrets/nix-netrc";
+        description = ''
+          netrc file with credentials for authenticated binary caches. Passed
+          to the service with systemd `LoadCredential=` so it stays out of the
+          nix store, and used for `nix.netrc-file`.
+        '';
+      };
+
       dates = lib.mkOption {
         type = lib.types.str;
         default = "04:40";
@@ -144,41 +155,67 @@ in {
   };
 
   config = lib.mkIf cfg.enable {
+    # upgrades re-exec the new generation's executable from sw/bin after switching
+    environment.systemPackages = [nixosHydraUpgradePackages.default];
     environment.etc."nixos-hydra-upgrade" = {
       mode = "0440";
       source = settingsFormat.generate "nixos-hydra-upgrade.yaml" cfg.settings;
       target = "nixos-hydra-upgrade/config.yaml";
     };
-    systemd.services.nixos-hydra-upgrade =
-      {
-        description = "NixOS Upgrade with hydra build validation and health check support.";
-
-        restartIfChanged = false;
-        unitConfig.X-StopOnRemoval = false;
-        serviceConfig.Type = "oneshot";
-
-        environment =
-          config.nix.envVars
-          // {
-            inherit (config.environment.sessionVariables) NIX_PATH;
-            HOME = "/root";
-          }
-          // config.networking.proxy.envVars;
-
-        path = [
+    systemd.services.nixos-hydra-upgrade = {
+      description = "NixOS Upgrade with hydra build validation and health check support.";
+
+      restartIfChanged = false;
+      unitConfig.X-StopOnRemoval = false;
+      serviceConfig.Type = "oneshot";
+      serviceConfig.StateDirectory = "nixos-hydra-upgrade";
+      serviceConfig.CacheDirectory = "nixos-hydra-upgrade";
+      serviceConfig.LoadCredential = lib.optional (cfg.netrcFile != null) "netrc:${cfg.netrcFile}";
+      serviceConfig.EnvironmentFile = lib.mkIf (cfg.environmentFile != null) cfg.environmentFile;
+
+      environment =
+        config.nix.envVars
+        // {
+          inherit (config.environment.sessionVariables) NIX_PATH;
+          HOME = "/root";
+        }
+        // lib.optionalAttrs (cfg.netrcFile != null) {
+          # %d is the systemd credentials directory
+          NHU_NIX_NETRC_FILE = "%d/netrc";
+        }
+        // config.networking.proxy.envVars;
+
+      path =
+        [
           config.nix.package
           config.system.build.nixos-rebuild
-        ];
+        ]
+        ++ lib.optional (cfg.settings.secure-boot.verify or false) pkgs.sbctl;
 
-        script = "${lib.getExe nixosHydraUpgradePackages.default} -c /etc/nixos-hydra-upgrade/config.yaml";
+      script = "${lib.getExe nixosHydraUpgradePackages.default} -c /etc/nixos-hydra-upgrade/config.yaml";
 
-        startAt = cfg.dates;
+      startAt = cfg.dates;
 
-        after = ["network-online.target"];
-        wants = ["network-online.target"];
-      }
-      // lib.optionalAttrs (cfg.environmentFile != null) {
-        EnvironmentFile = cfg.environmentFile;
-      };
+      after = ["network-online.target"];
+      wants = ["network-online.target"];
+    };
+    systemd.services.nixos-hydra-upgrade-confirm = lib.mkIf ((cfg.settings.reboot or false) || (cfg.settings.bootcounting.enable or false) || (cfg.settings.verify.system-running or false) || (cfg.settings.verify.journal-window or "0") != "0" || (cfg.settings.healthcheck.units or []) != []) {
+      description = "Confirm boot following a nixos-hydra-upgrade boot upgrade.";
+
+      restartIfChanged = false;
+      # not oneshot, boot has to finish while verify.system-running waits for it
+      serviceConfig.Type = "exec";
+      serviceConfig.EnvironmentFile = lib.mkIf (cfg.environmentFile != null) cfg.environmentFile;
+
+      path = [
+        config.nix.package
+      ];
+
+      script = "${lib.getExe nixosHydraUpgradePackages.default} confirm -c /etc/nixos-hydra-upgrade/config.yaml";
+
+      wantedBy = ["multi-user.target"];
+      after = ["network-online.target"];
+      wants = ["network-online.target"];
+    };
   };
 }
@@ -0,0 +1,90 @@
+/*
+Package motd renders upgrade status for login banners, e.g. a file in
+/etc/motd.d or /run/motd.dynamic shown by pam_motd.
+*/
+package motd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What the banner reports about the system and the last upgrade run.
+type Status struct {
+	// hydra build and flake revision of the system, 0 and empty when unknown
+	BuildID  int
+	Revision string
+	// system profile generation, shown when the build is unknown
+	Generation int
+	// when the system profile last changed, zero when unknown
+	Upgraded time.Time
+	// the system profile isn't the booted system
+	RebootPending bool
+	// newer build found by a check-only run, 0 when none
+	Available int
+	// outcome of the last run when it failed, empty otherwise
+	Failed   string
+	Finished time.Time
+}
+
+/*
+Renders the status, e.g.
+
+	System on build #1234 (rev abc1234), upgraded 2024-05-01; reboot pending
+*/
+func Render(status Status) string {
+	var b strings.Builder
+	if status.BuildID > 0 {
+		fmt.Fprintf(&b, "System on build #%d", status.BuildID)
+		if status.Revision != "" {
+			fmt.Fprintf(&b, " (rev %.7s)", status.Revision)
+		}
+	} else {
+		fmt.Fprintf(&b, "System on generation %d", status.Generation)
+	}
+	if !status.Upgraded.IsZero() {
+		fmt.Fprintf(&b, ", upgraded %s", status.Upgraded.Format(time.DateOnly))
+	}
+	if status.RebootPending {
+		b.WriteString("; reboot pending")
+	}
+	b.WriteString("\n")
+	if status.Available > 0 {
+		fmt.Fprintf(&b, "Build #%d is available.\n", status.Available)
+	}
+	if status.Failed != "" {
+		fmt.Fprintf(&b, "Last upgrade failed with %s at %s.\n", status.Failed, status.Finished.Format("2006-01-02 15:04"))
+	}
+	return b.String()
+}
+
+// Atomically writes the rendered status to `path`, readable by everyone.
+func Write(path string, status Status) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".motd-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(Render(status))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
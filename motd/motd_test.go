@@ -0,0 +1,42 @@
+package motd_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/motd"
+)
+
+func TestRender(t *testing.T) {
+	upgraded := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	assert.Equal(t, motd.Render(motd.Status{
+		BuildID:       1234,
+		Revision:      "abc1234def5678",
+		Upgraded:      upgraded,
+		RebootPending: true,
+	}), "System on build #1234 (rev abc1234), upgraded 2024-05-01; reboot pending\n")
+
+	assert.Equal(t, motd.Render(motd.Status{
+		Generation: 57,
+		Upgraded:   upgraded,
+		Available:  1235,
+		Failed:     "build-failed",
+		Finished:   time.Date(2024, 5, 2, 4, 30, 0, 0, time.UTC),
+	}), "System on generation 57, upgraded 2024-05-01\nBuild #1235 is available.\nLast upgrade failed with build-failed at 2024-05-02 04:30.\n")
+}
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd.d", "nixos-hydra-upgrade")
+	err := motd.Write(path, motd.Status{BuildID: 1, Revision: "abc"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, string(contents), "System on build #1 (rev abc)\n")
+}
@@ -0,0 +1,52 @@
+package network
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+The net package network of address family `family`, any, ipv4, or ipv6,
+for `network` tcp, udp, or ip. e.g. tcp6 for ipv6 tcp.
+*/
+func Network(family string, network string) string {
+	switch family {
+	case "ipv4":
+		return network + "4"
+	case "ipv6":
+		return network + "6"
+	}
+	return network
+}
+
+/*
+Strips the brackets of a literal ipv6 address, so [2001:db8::1] can be
+configured like it would be in a url. Other hosts are returned unchanged.
+*/
+func HostLiteral(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+/*
+An http client restricted to address family `family`. With any, both
+families are dialed happy eyeballs style, falling back to ipv4 when ipv6
+doesn't connect quickly.
+*/
+func HTTPClient(family string) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: 300 * time.Millisecond,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, Network(family, network), addr)
+	}
+	return &http.Client{Transport: transport}
+}
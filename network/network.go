@@ -0,0 +1,110 @@
+/*
+Package network inspects network interfaces and the tailscale and wireguard
+overlay networks remote machines are often only reachable over.
+*/
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+var ErrOffline = errors.New("offline")
+
+// Resolver for Online, replaced by tests.
+var Resolver interface {
+	LookupIP(ctx context.Context, network string, host string) ([]net.IP, error)
+} = net.DefaultResolver
+
+func hasDefaultRoute(family string) (bool, error) {
+	output, err := Runner.Output(context.Background(), runner.Command("ip", "-json", family, "route", "show", "default"))
+	if err != nil {
+		return false, err
+	}
+	routes := []json.RawMessage{}
+	err = json.Unmarshal(output, &routes)
+	return len(routes) > 0, err
+}
+
+/*
+Checks for a default route and that `host` resolves, in address family
+`family` (any, ipv4, or ipv6), returning an error wrapping ErrOffline if not.
+ipv6 only accepts AAAA records. Fails in seconds, rather than waiting on the
+timeouts of requests that can't succeed.
+*/
+func Online(host string, family string) error {
+	ipv4, err := hasDefaultRoute("-4")
+	if err != nil {
+		return err
+	}
+	ipv6, err := hasDefaultRoute("-6")
+	if err != nil {
+		return err
+	}
+	switch {
+	case family == "ipv4" && !ipv4:
+		return fmt.Errorf("%w: no ipv4 default route", ErrOffline)
+	case family == "ipv6" && !ipv6:
+		return fmt.Errorf("%w: no ipv6 default route", ErrOffline)
+	case !ipv4 && !ipv6:
+		return fmt.Errorf("%w: no default route", ErrOffline)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = Resolver.LookupIP(ctx, Network(family, "ip"), HostLiteral(host))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrOffline, err)
+	}
+	return nil
+}
+
+type link struct {
+	Flags []string `json:"flags"`
+}
+
+// Whether network interface `name` is up. Errors if it doesn't exist.
+func InterfaceUp(name string) (bool, error) {
+	output, err := Runner.Output(context.Background(), runner.Command("ip", "-json", "link", "show", "dev", name))
+	if err != nil {
+		return false, err
+	}
+	links := []link{}
+	err = json.Unmarshal(output, &links)
+	if err != nil {
+		return false, err
+	}
+	return len(links) > 0 && slices.Contains(links[0].Flags, "UP"), nil
+}
+
+type tailscaleStatus struct {
+	BackendState string
+}
+
+// State of the tailscale daemon, Running once connected to the tailnet.
+func TailscaleState() (string, error) {
+	output, err := Runner.Output(context.Background(), runner.Command("tailscale", "status", "--json"))
+	if err != nil {
+		return "", err
+	}
+	var status tailscaleStatus
+	err = json.Unmarshal(output, &status)
+	return status.BackendState, err
+}
+
+// Pings tailnet `peer` over tailscale, erroring if it doesn't respond.
+func TailscalePing(peer string) error {
+	_, err := Runner.CombinedOutput(context.Background(),
+		runner.Command("tailscale", "ping", "--c", "1", "--timeout", "5s", peer))
+	return err
+}
@@ -0,0 +1,101 @@
+package network_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/network"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+type fakeResolver map[string][]string
+
+func (resolver fakeResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	ips := []net.IP{}
+	for _, addr := range resolver[host] {
+		ip := net.ParseIP(addr)
+		if network == "ip" || (network == "ip4") == (ip.To4() != nil) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no such host")
+	}
+	return ips, nil
+}
+
+func TestOnline(t *testing.T) {
+	fake := &runner.Fake{Outputs: map[string]string{}}
+	originalRunner, originalResolver := network.Runner, network.Resolver
+	network.Runner = fake
+	network.Resolver = fakeResolver{
+		"hydra.example.com": {"192.0.2.1"},
+		"v6.example.com":    {"2001:db8::1"},
+		"2001:db8::1":       {"2001:db8::1"},
+	}
+	t.Cleanup(func() {
+		network.Runner = originalRunner
+		network.Resolver = originalResolver
+	})
+
+	t.Run("offline without a default route", func(t *testing.T) {
+		fake.Outputs["ip -json -4 route show default"] = "[]"
+		fake.Outputs["ip -json -6 route show default"] = "[]"
+		err := network.Online("hydra.example.com", "any")
+		assert.Equal(t, errors.Is(err, network.ErrOffline), true)
+	})
+
+	fake.Outputs["ip -json -6 route show default"] = `[{"dst": "default", "gateway": "fe80::1", "dev": "wlan0"}]`
+
+	t.Run("online with a route and dns", func(t *testing.T) {
+		err := network.Online("hydra.example.com", "any")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("offline when dns fails", func(t *testing.T) {
+		err := network.Online("unknown.example.com", "any")
+		assert.Equal(t, errors.Is(err, network.ErrOffline), true)
+	})
+
+	t.Run("ipv6 needs an ipv6 route", func(t *testing.T) {
+		fake.Outputs["ip -json -4 route show default"] = `[{"dst": "default", "gateway": "192.0.2.254", "dev": "eth0"}]`
+		fake.Outputs["ip -json -6 route show default"] = "[]"
+		err := network.Online("hydra.example.com", "ipv6")
+		assert.Equal(t, errors.Is(err, network.ErrOffline), true)
+	})
+
+	fake.Outputs["ip -json -6 route show default"] = `[{"dst": "default", "gateway": "fe80::1", "dev": "wlan0"}]`
+
+	t.Run("ipv6 needs AAAA records", func(t *testing.T) {
+		err := network.Online("hydra.example.com", "ipv6")
+		assert.Equal(t, errors.Is(err, network.ErrOffline), true)
+		err = network.Online("v6.example.com", "ipv6")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("literal ipv6 addresses", func(t *testing.T) {
+		err := network.Online("[2001:db8::1]", "ipv6")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestNetwork(t *testing.T) {
+	assert.Equal(t, network.Network("any", "tcp"), "tcp")
+	assert.Equal(t, network.Network("ipv4", "tcp"), "tcp4")
+	assert.Equal(t, network.Network("ipv6", "ip"), "ip6")
+}
+
+func TestHostLiteral(t *testing.T) {
+	assert.Equal(t, network.HostLiteral("[2001:db8::1]"), "2001:db8::1")
+	assert.Equal(t, network.HostLiteral("fe80::1%eth0"), "fe80::1%eth0")
+	assert.Equal(t, network.HostLiteral("canary.example.com"), "canary.example.com")
+}
@@ -0,0 +1,98 @@
+package nix
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// What a binary cache advertises about itself.
+type CacheInfo struct {
+	Url string
+	// from nix-cache-info, lower is preferred, 0 when unset
+	Priority      int
+	WantMassQuery bool
+	/*
+		the cache serves chunked, deduplicated downloads, so transfers are
+		smaller than the nar sizes nix estimates. Detected for attic caches
+	*/
+	Chunked bool
+}
+
+/*
+Gets the nix-cache-info of the http(s) binary cache at `cacheUrl`, and
+whether it is an attic cache. attic serves its API next to its caches, e.g.
+https://attic.example.com/_api/v1/cache-config/main for
+https://attic.example.com/main, and answers private caches with a JSON error.
+*/
+func GetCacheInfo(ctx context.Context, client *http.Client, cacheUrl string) (CacheInfo, error) {
+	info := CacheInfo{Url: cacheUrl}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	get := func(u string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		return client.Do(req)
+	}
+
+	base, _, _ := strings.Cut(cacheUrl, "?")
+	base = strings.TrimSuffix(base, "/")
+	resp, err := get(base + "/nix-cache-info")
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, &CacheInfoError{Url: cacheUrl, Status: resp.Status}
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Priority":
+			info.Priority, _ = strconv.Atoi(value)
+		case "WantMassQuery":
+			info.WantMassQuery = value == "1"
+		}
+	}
+
+	parsed, err := url.Parse(base)
+	if err != nil {
+		return info, err
+	}
+	cache := path.Base(parsed.Path)
+	if cache == "/" || cache == "." {
+		return info, nil
+	}
+	parsed.Path = path.Join(path.Dir(parsed.Path), "_api/v1/cache-config", cache)
+	resp, err = get(parsed.String())
+	if err != nil {
+		return info, nil
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	if json.NewDecoder(resp.Body).Decode(&body) != nil {
+		return info, nil
+	}
+	_, isError := body["error"]
+	info.Chunked = resp.StatusCode == http.StatusOK || isError
+	return info, nil
+}
+
+type CacheInfoError struct {
+	Url    string
+	Status string
+}
+
+func (err *CacheInfoError) Error() string {
+	return "nix-cache-info of " + err.Url + ": " + err.Status
+}
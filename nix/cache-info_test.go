@@ -0,0 +1,52 @@
+package nix_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestGetCacheInfo(t *testing.T) {
+	mux := http.NewServeMux()
+	cacheInfo := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("StoreDir: /nix/store\nWantMassQuery: 1\nPriority: 41\n"))
+	}
+	mux.HandleFunc("/main/nix-cache-info", cacheInfo)
+	mux.HandleFunc("/private/nix-cache-info", cacheInfo)
+	mux.HandleFunc("/plain/nix-cache-info", cacheInfo)
+	mux.HandleFunc("/_api/v1/cache-config/main", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"is_public":true}`))
+	})
+	mux.HandleFunc("/_api/v1/cache-config/private", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"code":401,"error":"Unauthorized"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	t.Run("detects attic caches", func(t *testing.T) {
+		info, err := nix.GetCacheInfo(context.Background(), nil, server.URL+"/main")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, info, nix.CacheInfo{Url: server.URL + "/main", Priority: 41, WantMassQuery: true, Chunked: true})
+
+		info, err = nix.GetCacheInfo(context.Background(), nil, server.URL+"/private/")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, info.Chunked, true)
+	})
+
+	t.Run("plain binary caches aren't chunked", func(t *testing.T) {
+		info, err := nix.GetCacheInfo(context.Background(), nil, server.URL+"/plain?trusted=1")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, info.Priority, 41)
+		assert.Equal(t, info.Chunked, false)
+	})
+
+	t.Run("missing caches fail", func(t *testing.T) {
+		_, err := nix.GetCacheInfo(context.Background(), nil, server.URL+"/missing")
+		assert.Equal(t, err != nil, true)
+	})
+}
@@ -0,0 +1,168 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Store paths missing for a build, from `nix build --dry-run`.
+type Missing struct {
+	// derivations that must be built locally
+	Build []string
+	// paths that will be fetched from substituters
+	Fetch []string
+	// bytes to download for Fetch
+	DownloadSize int64
+}
+
+// Parses the missing store paths from `nix build --dry-run` output.
+func ParseMissing(output string) (Missing, error) {
+	var missing Missing
+	var section *[]string
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.Contains(line, "will be built"):
+			section = &missing.Build
+		case strings.Contains(line, "will be fetched"):
+			section = &missing.Fetch
+		case strings.HasPrefix(line, "  /nix/store/") && section != nil:
+			*section = append(*section, strings.TrimSpace(line))
+		default:
+			section = nil
+		}
+	}
+	var err error
+	missing.DownloadSize, err = ParseDownloadSize(output)
+	return missing, err
+}
+
+// Lists the store paths missing to build the system toplevel of `host` from `flake`.
+func MissingPaths(ctx context.Context, flake string, host string) (Missing, error) {
+	cmd := command("nix", "build", "--dry-run", "--no-link", toplevelInstallable(flake, host))
+	output, err := Runner.CombinedOutput(ctx, cmd)
+	if err != nil {
+		return Missing{}, fmt.Errorf("%w: %s", err, output)
+	}
+	return ParseMissing(string(output))
+}
+
+// The configured substituter urls, in priority order.
+func Substituters(ctx context.Context) ([]string, error) {
+	output, err := Runner.Output(ctx, command("nix", "config", "show", "substituters"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(output)), nil
+}
+
+/*
+Which of `paths` the substituter at `url` has. Paths it doesn't have are
+reported as invalid by `nix path-info`, as null (newer nix) or with
+"valid": false (older nix).
+*/
+func SubstituterHas(ctx context.Context, url string, paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	args := append([]string{"path-info", "--json", "--store", url}, paths...)
+	// exits non-zero when any path is missing, the json still describes every path
+	output, err := Runner.Output(ctx, command("nix", args...))
+	if len(output) == 0 && err != nil {
+		return nil, err
+	}
+
+	has := []string{}
+	var byPath map[string]json.RawMessage
+	if json.Unmarshal(output, &byPath) == nil {
+		for path, info := range byPath {
+			if string(info) != "null" {
+				has = append(has, path)
+			}
+		}
+		slices.Sort(has)
+		return has, nil
+	}
+	var infos []struct {
+		Path  string `json:"path"`
+		Valid *bool  `json:"valid"`
+	}
+	err = json.Unmarshal(output, &infos)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Valid == nil || *info.Valid {
+			has = append(has, info.Path)
+		}
+	}
+	return has, nil
+}
+
+// A store path of a closure, from `nix path-info --json`.
+type PathInfo struct {
+	Path string `json:"path"`
+	// nix32 sha256 of the path's nar serialization, e.g. sha256:1b2c...
+	NarHash string `json:"narHash"`
+	NarSize int64  `json:"narSize"`
+}
+
+// Lists the store paths in the closure of `path`, sorted by path.
+func ClosureInfo(ctx context.Context, path string) ([]PathInfo, error) {
+	output, err := Runner.Output(ctx, command("nix", "path-info", "--json", "--recursive", path))
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []PathInfo
+	// newer nix returns an object keyed by path, older nix an array
+	var byPath map[string]PathInfo
+	if json.Unmarshal(output, &byPath) == nil {
+		for path, info := range byPath {
+			info.Path = path
+			infos = append(infos, info)
+		}
+	} else {
+		err = json.Unmarshal(output, &infos)
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(infos, func(a, b PathInfo) int { return strings.Compare(a.Path, b.Path) })
+	return infos, nil
+}
+
+// spdx ids of each package's meta.license, LicenseRef-<shortName> for licenses without one
+const licensesApply = `pkgs: builtins.listToAttrs (map (p: {
+  name = p.outPath;
+  value = map (l: if builtins.isString l then l else l.spdxId or ("LicenseRef-" + (l.shortName or "unknown")))
+    (let l = p.meta.license or [ ]; in if builtins.isList l then l else [ l ]);
+}) pkgs)`
+
+/*
+Evaluates the licenses of the system packages of `host` in `flake`, by the
+store path of each package's out output. Packages only in the closure as
+dependencies of others aren't evaluated.
+*/
+func PackageLicenses(ctx context.Context, flake string, host string) (map[string][]string, error) {
+	installable := fmt.Sprintf("%s#nixosConfigurations.%s.config.environment.systemPackages", flake, host)
+	cmd := command("nix", "eval", "--json", installable, "--apply", licensesApply)
+
+	var output []byte
+	err := Retry.do(ctx, "eval", func() error {
+		var err error
+		output, err = Runner.Output(ctx, cmd)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	licenses := map[string][]string{}
+	err = json.Unmarshal(output, &licenses)
+	if err != nil {
+		return nil, fmt.Errorf("parsing licenses of %s: %w", host, err)
+	}
+	return licenses, nil
+}
@@ -0,0 +1,78 @@
+package nix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestParseMissing(t *testing.T) {
+	missing, err := nix.ParseMissing(`these 2 derivations will be built:
+  /nix/store/aaaa-etc.drv
+  /nix/store/bbbb-nixos-system-host.drv
+these 3 paths will be fetched (1.50 MiB download, 6.00 MiB unpacked):
+  /nix/store/cccc-linux-6.6
+  /nix/store/dddd-systemd-255
+  /nix/store/eeee-glibc-2.39
+`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.ArrayEqual(t, missing.Build, []string{"/nix/store/aaaa-etc.drv", "/nix/store/bbbb-nixos-system-host.drv"})
+	assert.ArrayEqual(t, missing.Fetch, []string{"/nix/store/cccc-linux-6.6", "/nix/store/dddd-systemd-255", "/nix/store/eeee-glibc-2.39"})
+	assert.Equal(t, missing.DownloadSize, int64(1.5*(1<<20)))
+}
+
+func TestSubstituterHas(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix path-info --json --store https://cache.example.org /nix/store/cccc-linux-6.6 /nix/store/dddd-systemd-255"] = `{
+  "/nix/store/cccc-linux-6.6": {"narSize": 1024},
+  "/nix/store/dddd-systemd-255": null
+}`
+	has, err := nix.SubstituterHas(context.Background(), "https://cache.example.org", []string{"/nix/store/cccc-linux-6.6", "/nix/store/dddd-systemd-255"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.ArrayEqual(t, has, []string{"/nix/store/cccc-linux-6.6"})
+
+	t.Run("reads older path-info output", func(t *testing.T) {
+		fake.Outputs["nix path-info --json --store https://cache.nixos.org /nix/store/dddd-systemd-255 /nix/store/eeee-glibc-2.39"] = `[
+  {"path": "/nix/store/dddd-systemd-255", "valid": false},
+  {"path": "/nix/store/eeee-glibc-2.39", "narSize": 2048}
+]`
+		has, err := nix.SubstituterHas(context.Background(), "https://cache.nixos.org", []string{"/nix/store/dddd-systemd-255", "/nix/store/eeee-glibc-2.39"})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, has, []string{"/nix/store/eeee-glibc-2.39"})
+	})
+}
+
+func TestClosureInfo(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix path-info --json --recursive /nix/store/aaaa-nixos-system"] = `{
+  "/nix/store/bbbb-bash-5.2": {"narHash": "sha256:0b", "narSize": 10},
+  "/nix/store/aaaa-nixos-system": {"narHash": "sha256:0a", "narSize": 20}
+}`
+	infos, err := nix.ClosureInfo(context.Background(), "/nix/store/aaaa-nixos-system")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.ArrayEqual(t, infos, []nix.PathInfo{
+		{Path: "/nix/store/aaaa-nixos-system", NarHash: "sha256:0a", NarSize: 20},
+		{Path: "/nix/store/bbbb-bash-5.2", NarHash: "sha256:0b", NarSize: 10},
+	})
+
+	t.Run("parses older nix arrays", func(t *testing.T) {
+		fake.Outputs["nix path-info --json --recursive /nix/store/cccc-nixos-system"] = `[
+  {"path": "/nix/store/cccc-nixos-system", "narHash": "sha256:0c", "narSize": 30}
+]`
+		infos, err := nix.ClosureInfo(context.Background(), "/nix/store/cccc-nixos-system")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, infos, []nix.PathInfo{{Path: "/nix/store/cccc-nixos-system", NarHash: "sha256:0c", NarSize: 30}})
+	})
+}
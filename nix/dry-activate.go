@@ -0,0 +1,69 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Unit changes switch-to-configuration would make, from dry-activate output.
+type Activation struct {
+	Stop    []string
+	Restart []string
+	Start   []string
+	Reload  []string
+}
+
+// Units that would be stopped or restarted, interrupting them.
+func (activation Activation) Disrupted() []string {
+	units := slices.Clone(activation.Restart)
+	for _, unit := range activation.Stop {
+		if !slices.Contains(units, unit) {
+			units = append(units, unit)
+		}
+	}
+	return units
+}
+
+// Parses `switch-to-configuration dry-activate` output.
+func ParseDryActivate(output string) Activation {
+	activation := Activation{}
+	lists := map[string]*[]string{
+		"stop":    &activation.Stop,
+		"restart": &activation.Restart,
+		"start":   &activation.Start,
+		"reload":  &activation.Reload,
+	}
+	for _, line := range strings.Split(output, "\n") {
+		// would restart the following units: a.service, b.service
+		action, units, ok := strings.Cut(strings.TrimPrefix(line, "would "), " the following units: ")
+		if !ok || !strings.HasPrefix(line, "would ") {
+			continue
+		}
+		list, ok := lists[action]
+		if !ok {
+			continue
+		}
+		for _, unit := range strings.Split(units, ",") {
+			unit = strings.TrimSpace(unit)
+			if unit != "" {
+				*list = append(*list, unit)
+			}
+		}
+	}
+	return activation
+}
+
+// Reports the unit changes switching to a system toplevel would make, without making them.
+func DryActivate(ctx context.Context, toplevel string) (Activation, error) {
+	cmd := runner.Command(filepath.Join(toplevel, "bin", "switch-to-configuration"), "dry-activate")
+	output, err := Runner.CombinedOutput(ctx, cmd)
+	if err != nil {
+		return Activation{}, fmt.Errorf("%w: %s", err, output)
+	}
+	return ParseDryActivate(string(output)), nil
+}
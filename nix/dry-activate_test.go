@@ -0,0 +1,25 @@
+package nix_test
+
+import (
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestParseDryActivate(t *testing.T) {
+	activation := nix.ParseDryActivate(`would stop the following units: old.service, sshd.service
+would NOT stop the following changed units: systemd-journald.service
+would activate the configuration...
+would restart systemd
+would reload the following units: dbus.service
+would restart the following units: sshd.service, NetworkManager.service
+would start the following units: new.service, sshd.service
+`)
+
+	assert.ArrayEqual(t, activation.Stop, []string{"old.service", "sshd.service"})
+	assert.ArrayEqual(t, activation.Restart, []string{"sshd.service", "NetworkManager.service"})
+	assert.ArrayEqual(t, activation.Start, []string{"new.service", "sshd.service"})
+	assert.ArrayEqual(t, activation.Reload, []string{"dbus.service"})
+	assert.ArrayEqual(t, activation.Disrupted(), []string{"sshd.service", "NetworkManager.service", "old.service"})
+}
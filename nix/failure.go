@@ -0,0 +1,89 @@
+package nix
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Kind of failure of a nix or nixos-rebuild command.
+type Failure string
+
+const (
+	// rebuilding a derivation with --check produced a different output
+	FailureNondeterministic Failure = "nondeterministic"
+	// the system failed to evaluate, retrying won't help
+	FailureEval Failure = "eval"
+	// fetching flake inputs or substituting store paths failed
+	FailureFetch Failure = "fetch"
+	// a derivation failed to build locally
+	FailureBuild Failure = "build"
+	// switch-to-configuration or the bootloader install failed
+	FailureActivation Failure = "activation"
+	FailureUnknown    Failure = "unknown"
+)
+
+// lowercase fragments of nix and nixos-rebuild output by failure, checked in order
+var failureFragments = []struct {
+	failure   Failure
+	fragments []string
+}{
+	{FailureNondeterministic, []string{
+		"may not be deterministic",
+	}},
+	{FailureActivation, []string{
+		"error(s) occurred while switching to the new configuration",
+		"failed to install bootloader",
+		"failed to install boot loader",
+	}},
+	{FailureFetch, []string{
+		"unable to download",
+		"cannot download",
+		"some substitutes for the outputs of derivation",
+		"but there is no substituter that can build it",
+	}},
+	{FailureEval, []string{
+		"while evaluating",
+		"does not provide attribute",
+		"undefined variable",
+		"infinite recursion",
+		"syntax error",
+		"failed assertions",
+		"evaluation aborted",
+	}},
+	{FailureBuild, []string{
+		"builder for",
+		"cannot build",
+		"dependencies couldn't be built",
+	}},
+}
+
+/*
+Classifies a failed nix or nixos-rebuild command from its error message, the
+stderr of failed commands, and nix's exit codes for build failures.
+*/
+func Classify(err error) Failure {
+	if err == nil {
+		return ""
+	}
+	message := err.Error() + "\n" + runner.Stderr(err)
+	message = strings.ToLower(message)
+	for _, kind := range failureFragments {
+		for _, fragment := range kind.fragments {
+			if strings.Contains(message, fragment) {
+				return kind.failure
+			}
+		}
+	}
+	if IsTransient(err) {
+		return FailureFetch
+	}
+	// nix exits 100-104 for failed, timed out, and nondeterministic builds
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 100 && exitErr.ExitCode() <= 104 {
+		return FailureBuild
+	}
+	return FailureUnknown
+}
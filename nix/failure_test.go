@@ -0,0 +1,34 @@
+package nix_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestClassify(t *testing.T) {
+	failed := func(stderr string) error {
+		return &runner.Error{Err: errors.New("exit status 1"), Stderr: stderr}
+	}
+	tests := []struct {
+		name    string
+		err     error
+		failure nix.Failure
+	}{
+		{"eval", failed("error:\n       … while evaluating the attribute 'config.system.build.toplevel'\n       error: undefined variable 'pkgs'"), nix.FailureEval},
+		{"substitution", failed("error: unable to download 'https://cache.example.org/abc.narinfo': HTTP error 403"), nix.FailureFetch},
+		{"transient", failed("error: connection reset by peer"), nix.FailureFetch},
+		{"build", failed("error: builder for '/nix/store/abc-foo.drv' failed with exit code 2"), nix.FailureBuild},
+		{"nondeterministic", failed("error: derivation '/nix/store/abc-nixos-system.drv' may not be deterministic: output '/nix/store/def-nixos-system' differs"), nix.FailureNondeterministic},
+		{"activation", failed("warning: error(s) occurred while switching to the new configuration"), nix.FailureActivation},
+		{"unknown", failed("error: out of memory"), nix.FailureUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, nix.Classify(test.err), test.failure)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+Runs `nix flake check` on `flake`. When `checks` is non-empty only those
+checks.<system> attributes are built instead, skipping the evaluation of
+every other output.
+*/
+func FlakeCheck(ctx context.Context, flake string, checks []string) error {
+	if len(checks) == 0 {
+		return Runner.Run(ctx, command("nix", "flake", "check", flake))
+	}
+	args := []string{"build", "--no-link"}
+	for _, check := range checks {
+		args = append(args, fmt.Sprintf("%s#checks.%s.%s", flake, System(), check))
+	}
+	return Runner.Run(ctx, command("nix", args...))
+}
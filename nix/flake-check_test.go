@@ -0,0 +1,30 @@
+package nix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestFlakeCheck(t *testing.T) {
+	t.Run("checks the whole flake", func(t *testing.T) {
+		fake := fakeRunner(t)
+		err := nix.FlakeCheck(context.Background(), "github:example/nixos/abc", []string{})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, fake.Ran, []string{"nix flake check github:example/nixos/abc"})
+	})
+
+	t.Run("builds selected checks", func(t *testing.T) {
+		fake := fakeRunner(t)
+		err := nix.FlakeCheck(context.Background(), "github:example/nixos/abc", []string{"vm", "lint"})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		system := nix.System()
+		assert.ArrayEqual(t, fake.Ran, []string{"nix build --no-link github:example/nixos/abc#checks." + system + ".vm github:example/nixos/abc#checks." + system + ".lint"})
+	})
+}
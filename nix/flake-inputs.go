@@ -0,0 +1,87 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// flake.lock as included in `nix flake metadata --json`
+type flakeLocks struct {
+	Root  string              `json:"root"`
+	Nodes map[string]lockNode `json:"nodes"`
+}
+
+type lockNode struct {
+	/*
+		input name -> node name, or a path of input names from the root when
+		the input follows another
+	*/
+	Inputs map[string]json.RawMessage `json:"inputs"`
+	Locked struct {
+		Rev string `json:"rev"`
+	} `json:"locked"`
+}
+
+// Returns the node `path` names, following inputs from the root node.
+func (locks flakeLocks) node(path []string) (string, bool) {
+	name := locks.Root
+	for _, input := range path {
+		raw, ok := locks.Nodes[name].Inputs[input]
+		if !ok {
+			return "", false
+		}
+		var follows []string
+		if json.Unmarshal(raw, &name) != nil {
+			if json.Unmarshal(raw, &follows) != nil {
+				return "", false
+			}
+			name, ok = locks.node(follows)
+			if !ok {
+				return "", false
+			}
+		}
+	}
+	return name, true
+}
+
+/*
+Returns the git revisions the flake's lock file pins its direct inputs to,
+by input name. Inputs that aren't locked to a git revision are left out.
+*/
+func LockedInputs(ctx context.Context, flake string) (map[string]string, error) {
+	cmd := command("nix", "flake", "metadata", flake, "--json")
+
+	var output []byte
+	err := Retry.do(ctx, "flake metadata", func() error {
+		var err error
+		output, err = Runner.Output(ctx, cmd)
+		return err
+	})
+	if err != nil {
+		slog.Debug(fmt.Sprintf("%s", output))
+		return nil, err
+	}
+
+	var metadata struct {
+		Locks flakeLocks `json:"locks"`
+	}
+	err = json.Unmarshal(output, &metadata)
+	if err != nil {
+		return nil, err
+	}
+	locks := metadata.Locks
+	if locks.Root == "" {
+		locks.Root = "root"
+	}
+
+	inputs := map[string]string{}
+	for input := range locks.Nodes[locks.Root].Inputs {
+		name, ok := locks.node([]string{input})
+		if ok && locks.Nodes[name].Locked.Rev != "" {
+			inputs[input] = locks.Nodes[name].Locked.Rev
+		}
+	}
+	return inputs, nil
+}
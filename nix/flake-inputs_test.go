@@ -0,0 +1,36 @@
+package nix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestLockedInputs(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix flake metadata github:example/nixos --json"] = `{
+  "originalUrl": "github:example/nixos",
+  "locks": {
+    "root": "root",
+    "version": 7,
+    "nodes": {
+      "root": {"inputs": {"overlay": "overlay", "nixpkgs": "nixpkgs", "lib": ["overlay", "lib"], "local": "local"}},
+      "overlay": {"inputs": {"lib": "lib_2"}, "locked": {"rev": "1111111111111111111111111111111111111111"}},
+      "lib_2": {"locked": {"rev": "2222222222222222222222222222222222222222"}},
+      "nixpkgs": {"locked": {"rev": "3333333333333333333333333333333333333333"}},
+      "local": {"locked": {"path": "/etc/nixos"}}
+    }
+  }
+}`
+
+	inputs, err := nix.LockedInputs(context.Background(), "github:example/nixos")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, len(inputs), 3)
+	assert.Equal(t, inputs["overlay"], "1111111111111111111111111111111111111111")
+	assert.Equal(t, inputs["lib"], "2222222222222222222222222222222222222222")
+	assert.Equal(t, inputs["nixpkgs"], "3333333333333333333333333333333333333333")
+}
@@ -1,34 +1,66 @@
 package nix
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"os/exec"
 )
 
 type FlakeMetadata struct {
 	// unix timestamp
 	LastModified int64 `json:"lastModified"`
-	// flake url
+	// flake url, resolved through the flake registry if it was indirect
 	OriginalUrl string `json:"originalUrl"`
+	// flake url after registry resolution
+	ResolvedUrl string `json:"resolvedUrl"`
+	// locked git revision, empty for dirty or non-git flakes
+	Revision string    `json:"revision"`
+	Locked   FlakeLock `json:"locked"`
 }
 
-func GetFlakeMetadata(flake string) FlakeMetadata {
-	cmd := exec.Command("nix", "flake", "metadata", flake, "--json")
+// Locked flake attributes.
+type FlakeLock struct {
+	// hash of the flake's source tree, the same for identical sources
+	NarHash string `json:"narHash"`
+}
+
+/*
+Whether both flakes are known to have the same source tree, by narHash. Unlike
+lastModified and revisions, narHashes survive mirrors and rewritten history.
+*/
+func (metadata FlakeMetadata) SameSource(other FlakeMetadata) bool {
+	return metadata.Locked.NarHash != "" && metadata.Locked.NarHash == other.Locked.NarHash
+}
+
+func GetFlakeMetadata(ctx context.Context, flake string) (FlakeMetadata, error) {
+	cmd := command("nix", "flake", "metadata", flake, "--json")
 
-	output, err := cmd.Output()
+	var metadata FlakeMetadata
+	var output []byte
+	err := Retry.do(ctx, "flake metadata", func() error {
+		var err error
+		output, err = Runner.Output(ctx, cmd)
+		return err
+	})
 	if err != nil {
 		slog.Debug(fmt.Sprintf("%s", output))
-		panic(err)
+		return metadata, err
 	}
 
-	var metadata FlakeMetadata
 	err = json.Unmarshal(output, &metadata)
 	if err != nil {
-		panic(err)
+		return metadata, err
+	}
+
+	if IsIndirect(metadata.OriginalUrl) && metadata.ResolvedUrl != "" {
+		// registry entries may change, compare and rebuild the flake they pointed at now
+		slog.Info("Resolved indirect flake.",
+			slog.String("flake", metadata.OriginalUrl),
+			slog.String("resolved", metadata.ResolvedUrl))
+		metadata.OriginalUrl = metadata.ResolvedUrl
 	}
 
 	slog.Debug(fmt.Sprintf("%+v", metadata))
-	return metadata
+	return metadata, nil
 }
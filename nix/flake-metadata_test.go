@@ -0,0 +1,53 @@
+package nix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestGetFlakeMetadata(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix flake metadata github:example/nixos --json"] = `{
+  "lastModified": 1700000000,
+  "originalUrl": "github:example/nixos",
+  "revision": "0123456789abcdef0123456789abcdef01234567",
+  "locked": {
+    "narHash": "sha256-abc"
+  }
+}`
+
+	metadata, err := nix.GetFlakeMetadata(context.Background(), "github:example/nixos")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, metadata, nix.FlakeMetadata{
+		LastModified: 1700000000,
+		OriginalUrl:  "github:example/nixos",
+		Revision:     "0123456789abcdef0123456789abcdef01234567",
+		Locked:       nix.FlakeLock{NarHash: "sha256-abc"},
+	})
+
+	t.Run("resolves indirect flakes", func(t *testing.T) {
+		fake.Outputs["nix flake metadata flake:nix-config --json"] = `{
+  "lastModified": 1700000000,
+  "originalUrl": "flake:nix-config",
+  "resolvedUrl": "github:example/nixos"
+}`
+		metadata, err := nix.GetFlakeMetadata(context.Background(), "flake:nix-config")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, metadata.OriginalUrl, "github:example/nixos")
+	})
+}
+
+func TestSameSource(t *testing.T) {
+	a := nix.FlakeMetadata{LastModified: 1, Locked: nix.FlakeLock{NarHash: "sha256-abc"}}
+	mirrored := nix.FlakeMetadata{LastModified: 2, Locked: nix.FlakeLock{NarHash: "sha256-abc"}}
+	assert.Equal(t, a.SameSource(mirrored), true)
+	assert.Equal(t, a.SameSource(nix.FlakeMetadata{LastModified: 1, Locked: nix.FlakeLock{NarHash: "sha256-def"}}), false)
+	assert.Equal(t, nix.FlakeMetadata{}.SameSource(nix.FlakeMetadata{}), false)
+}
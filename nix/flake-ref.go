@@ -0,0 +1,133 @@
+package nix
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var revPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// flake registry id, optionally followed by a ref and rev
+var indirectPattern = regexp.MustCompile(`^(flake:)?[a-zA-Z][a-zA-Z0-9_-]*(/[^/]+){0,2}$`)
+
+// Whether `ref` is a full git commit hash rather than a branch or tag.
+func IsRev(ref string) bool {
+	return revPattern.MatchString(ref)
+}
+
+/*
+Whether `flake` is an indirect reference resolved through the flake
+registry, e.g. flake:nixpkgs or nixpkgs/nixos-unstable.
+*/
+func IsIndirect(flake string) bool {
+	flake, _, _ = strings.Cut(flake, "#")
+	flake, _, _ = strings.Cut(flake, "?")
+	return indirectPattern.MatchString(flake)
+}
+
+/*
+Returns the git ref or revision a flake url points at, from the `ref` query
+parameter or the ref/rev path segment of github:, gitlab:, sourcehut:, and
+indirect urls. Empty when the url doesn't specify one (the default branch).
+*/
+func FlakeRef(flake string) string {
+	flake, _, _ = strings.Cut(flake, "#")
+	flake, query, _ := strings.Cut(flake, "?")
+	values, err := url.ParseQuery(query)
+	if err == nil && values.Get("ref") != "" {
+		return values.Get("ref")
+	}
+
+	for _, scheme := range []string{"github:", "gitlab:", "sourcehut:"} {
+		path, ok := strings.CutPrefix(flake, scheme)
+		if !ok {
+			continue
+		}
+		// owner/repo/ref-or-rev
+		segments := strings.SplitN(path, "/", 3)
+		if len(segments) == 3 {
+			return segments[2]
+		}
+	}
+	if IsIndirect(flake) {
+		// id/ref-or-rev/rev
+		segments := strings.Split(strings.TrimPrefix(flake, "flake:"), "/")
+		if len(segments) > 1 {
+			return segments[1]
+		}
+	}
+	return ""
+}
+
+/*
+Returns the git revision a flake url is locked to, from the `rev` query
+parameter or a revision in place of the ref. Empty when it isn't locked.
+*/
+func FlakeRev(flake string) string {
+	_, query, _ := strings.Cut(strings.SplitN(flake, "#", 2)[0], "?")
+	values, err := url.ParseQuery(query)
+	if err == nil && IsRev(values.Get("rev")) {
+		return values.Get("rev")
+	}
+	if ref := FlakeRef(flake); IsRev(ref) {
+		return ref
+	}
+	return ""
+}
+
+// Whether `ref` matches any of `allowed`, ignoring refs/heads/ and refs/tags/ prefixes.
+func RefAllowed(ref string, allowed []string) bool {
+	short := func(ref string) string {
+		ref = strings.TrimPrefix(ref, "refs/heads/")
+		return strings.TrimPrefix(ref, "refs/tags/")
+	}
+	for _, a := range allowed {
+		if short(a) == short(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// query parameters pinning a flake url to a revision, see FlakeOrigin
+var pinParams = []string{"ref", "rev", "narHash", "lastModified", "revCount"}
+
+/*
+Returns the repository `flake` comes from, without the ref, rev, or lock
+attributes pinning a revision and without a fragment, e.g.
+github:example/nixos for github:example/nixos/<rev>#host.
+*/
+func FlakeOrigin(flake string) string {
+	flake, _, _ = strings.Cut(flake, "#")
+	flake, query, _ := strings.Cut(flake, "?")
+
+	for _, scheme := range []string{"github:", "gitlab:", "sourcehut:"} {
+		path, ok := strings.CutPrefix(flake, scheme)
+		if !ok {
+			continue
+		}
+		// owner/repo/ref-or-rev
+		segments := strings.SplitN(path, "/", 3)
+		if len(segments) == 3 {
+			flake = scheme + segments[0] + "/" + segments[1]
+		}
+	}
+	if IsIndirect(flake) {
+		// id/ref-or-rev/rev
+		flake, _, _ = strings.Cut(strings.TrimPrefix(flake, "flake:"), "/")
+	}
+	flake = strings.TrimSuffix(flake, "/")
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return flake
+	}
+	for _, param := range pinParams {
+		values.Del(param)
+	}
+	if len(values) > 0 {
+		flake += "?" + values.Encode()
+	}
+	return flake
+}
@@ -0,0 +1,61 @@
+package nix_test
+
+import (
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestFlakeRef(t *testing.T) {
+	rev := "0123456789abcdef0123456789abcdef01234567"
+	assert.Equal(t, nix.FlakeRef("github:example/nix-config"), "")
+	assert.Equal(t, nix.FlakeRef("github:example/nix-config/main"), "main")
+	assert.Equal(t, nix.FlakeRef("github:example/nix-config/"+rev+"#host"), rev)
+	assert.Equal(t, nix.FlakeRef("github:example/nix-config?ref=refs/heads/release"), "refs/heads/release")
+	assert.Equal(t, nix.FlakeRef("git+https://git.example.com/nix-config?ref=refs/heads/main&rev="+rev), "refs/heads/main")
+	assert.Equal(t, nix.FlakeRef("git+https://git.example.com/nix-config?rev="+rev), "")
+	assert.Equal(t, nix.FlakeRef("path:/etc/nixos"), "")
+	assert.Equal(t, nix.FlakeRef("flake:nix-config/release"), "release")
+	assert.Equal(t, nix.FlakeRef("nix-config"), "")
+}
+
+func TestFlakeOrigin(t *testing.T) {
+	rev := "0123456789abcdef0123456789abcdef01234567"
+	assert.Equal(t, nix.FlakeOrigin("github:example/nix-config"), "github:example/nix-config")
+	assert.Equal(t, nix.FlakeOrigin("github:example/nix-config/"+rev+"#host"), "github:example/nix-config")
+	assert.Equal(t, nix.FlakeOrigin("github:example/nix-config?narHash=sha256-abc"), "github:example/nix-config")
+	assert.Equal(t, nix.FlakeOrigin("git+https://git.example.com/nix-config?ref=refs/heads/main&rev="+rev), "git+https://git.example.com/nix-config")
+	assert.Equal(t, nix.FlakeOrigin("git+https://git.example.com/nix-config?dir=hosts&rev="+rev), "git+https://git.example.com/nix-config?dir=hosts")
+	assert.Equal(t, nix.FlakeOrigin("flake:nix-config/release/"+rev), "nix-config")
+}
+
+func TestIsIndirect(t *testing.T) {
+	assert.Equal(t, nix.IsIndirect("flake:nix-config"), true)
+	assert.Equal(t, nix.IsIndirect("nix-config/main#host"), true)
+	assert.Equal(t, nix.IsIndirect("github:example/nix-config"), false)
+	assert.Equal(t, nix.IsIndirect("/etc/nixos"), false)
+	assert.Equal(t, nix.IsIndirect("./nixos"), false)
+}
+
+func TestIsRev(t *testing.T) {
+	assert.Equal(t, nix.IsRev("0123456789abcdef0123456789abcdef01234567"), true)
+	assert.Equal(t, nix.IsRev("main"), false)
+}
+
+func TestFlakeRev(t *testing.T) {
+	rev := "0123456789abcdef0123456789abcdef01234567"
+	assert.Equal(t, nix.FlakeRev("github:example/overlay/"+rev), rev)
+	assert.Equal(t, nix.FlakeRev("git+https://git.example.com/overlay?ref=main&rev="+rev+"#checks"), rev)
+	assert.Equal(t, nix.FlakeRev("github:example/overlay/main"), "")
+	assert.Equal(t, nix.FlakeRev("github:example/overlay"), "")
+}
+
+func TestRefAllowed(t *testing.T) {
+	allowed := []string{"refs/heads/main", "release"}
+	assert.Equal(t, nix.RefAllowed("main", allowed), true)
+	assert.Equal(t, nix.RefAllowed("refs/heads/main", allowed), true)
+	assert.Equal(t, nix.RefAllowed("refs/heads/release", allowed), true)
+	assert.Equal(t, nix.RefAllowed("experimental", allowed), false)
+	assert.Equal(t, nix.RefAllowed("", allowed), false)
+}
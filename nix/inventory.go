@@ -0,0 +1,87 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Deployment tools whose inventories are read by Inventory.
+const (
+	InventoryColmena  = "colmena"
+	InventoryDeployRS = "deploy-rs"
+)
+
+// Flake output holding the nodes of each inventory.
+var inventoryOutputs = map[string]string{
+	InventoryColmena:  "colmena",
+	InventoryDeployRS: "deploy.nodes",
+}
+
+/*
+Maps the nodes of each inventory to the hostnames they deploy to, without
+evaluating their configurations. Colmena nodes default to deploying to
+their name, and hive-wide settings aren't nodes.
+*/
+var inventoryApply = map[string]string{
+	InventoryColmena:  `hive: builtins.mapAttrs (name: node: name) (removeAttrs hive [ "meta" "defaults" ])`,
+	InventoryDeployRS: `nodes: builtins.mapAttrs (name: node: node.hostname or name) nodes`,
+}
+
+/*
+Evaluates the nodes of a colmena hive or deploy-rs deploy.nodes in `flake`,
+by node name -> hostname deployed to.
+*/
+func Inventory(ctx context.Context, kind string, flake string) (map[string]string, error) {
+	output, ok := inventoryOutputs[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown inventory %q", kind)
+	}
+	cmd := command("nix", "eval", "--json", flake+"#"+output, "--apply", inventoryApply[kind])
+
+	var out []byte
+	err := Retry.do(ctx, "eval", func() error {
+		var err error
+		out, err = Runner.Output(ctx, cmd)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodes := map[string]string{}
+	err = json.Unmarshal(out, &nodes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s inventory: %w", kind, err)
+	}
+	return nodes, nil
+}
+
+/*
+The inventory node deploying to `hostname`, matched against node names and
+hostnames case insensitively. Fully qualified node hostnames also match
+their short name.
+*/
+func InventoryNode(nodes map[string]string, hostname string) (string, bool) {
+	hostname = strings.ToLower(hostname)
+	// nodes are checked in order so duplicates resolve the same way every run
+	names := []string{}
+	for name := range nodes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if strings.ToLower(name) == hostname {
+			return name, true
+		}
+	}
+	for _, name := range names {
+		target := strings.ToLower(nodes[name])
+		short, _, _ := strings.Cut(target, ".")
+		if target == hostname || short == hostname {
+			return name, true
+		}
+	}
+	return "", false
+}
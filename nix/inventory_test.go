@@ -0,0 +1,77 @@
+package nix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestInventory(t *testing.T) {
+	t.Run("evaluates colmena hives", func(t *testing.T) {
+		fake := fakeRunner(t)
+		fake.Outputs[`nix eval --json github:example/nixos#colmena --apply hive: builtins.mapAttrs (name: node: name) (removeAttrs hive [ "meta" "defaults" ])`] = `{"oak":"oak","birch":"birch"}`
+
+		nodes, err := nix.Inventory(context.Background(), nix.InventoryColmena, "github:example/nixos")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(nodes), 2)
+		assert.Equal(t, nodes["oak"], "oak")
+	})
+
+	t.Run("evaluates deploy-rs nodes", func(t *testing.T) {
+		fake := fakeRunner(t)
+		fake.Outputs[`nix eval --json github:example/nixos#deploy.nodes --apply nodes: builtins.mapAttrs (name: node: node.hostname or name) nodes`] = `{"web":"web1.example.org"}`
+
+		nodes, err := nix.Inventory(context.Background(), nix.InventoryDeployRS, "github:example/nixos")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, nodes["web"], "web1.example.org")
+	})
+
+	t.Run("fails on unknown inventories", func(t *testing.T) {
+		fake := fakeRunner(t)
+		_, err := nix.Inventory(context.Background(), "ansible", "github:example/nixos")
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, len(fake.Ran), 0)
+	})
+
+	t.Run("fails on malformed output", func(t *testing.T) {
+		fake := fakeRunner(t)
+		fake.Outputs[`nix eval --json github:example/nixos#deploy.nodes --apply nodes: builtins.mapAttrs (name: node: node.hostname or name) nodes`] = `["web"]`
+
+		_, err := nix.Inventory(context.Background(), nix.InventoryDeployRS, "github:example/nixos")
+		assert.Equal(t, err != nil, true)
+	})
+}
+
+func TestInventoryNode(t *testing.T) {
+	nodes := map[string]string{
+		"oak":   "oak",
+		"web":   "web1.example.org",
+		"db":    "10.0.0.5",
+		"Birch": "birch.lan",
+	}
+	tests := []struct {
+		name     string
+		hostname string
+		node     string
+		found    bool
+	}{
+		{"node name", "oak", "oak", true},
+		{"case insensitive", "birch", "Birch", true},
+		{"fully qualified hostname", "web1.example.org", "web", true},
+		{"short hostname", "web1", "web", true},
+		{"unknown host", "maple", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node, found := nix.InventoryNode(nodes, test.hostname)
+			assert.Equal(t, node, test.node)
+			assert.Equal(t, found, test.found)
+		})
+	}
+}
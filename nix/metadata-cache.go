@@ -0,0 +1,82 @@
+package nix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+Caches flake metadata on disk, so daemon mode and repeated runs don't query
+slow or rate-limited git remotes for every lookup.
+*/
+type MetadataCache struct {
+	Dir string
+	// how long results are reused, 0 disables caching
+	TTL time.Duration
+}
+
+type cachedMetadata struct {
+	Flake    string        `json:"flake"`
+	Metadata FlakeMetadata `json:"metadata"`
+}
+
+func (cache MetadataCache) path(flake string) string {
+	sum := sha256.Sum256([]byte(flake))
+	return filepath.Join(cache.Dir, "flake-metadata", hex.EncodeToString(sum[:])+".json")
+}
+
+/*
+Gets flake metadata like GetFlakeMetadata, reusing results younger than TTL.
+Indirect flakes are never cached, their registry entries may change at any
+time and resolving them is local.
+*/
+func (cache MetadataCache) Get(ctx context.Context, flake string) (FlakeMetadata, error) {
+	if cache.TTL <= 0 || cache.Dir == "" || IsIndirect(flake) {
+		return GetFlakeMetadata(ctx, flake)
+	}
+
+	path := cache.path(flake)
+	info, err := os.Stat(path)
+	if err == nil && time.Since(info.ModTime()) < cache.TTL {
+		var cached cachedMetadata
+		data, err := os.ReadFile(path)
+		if err == nil && json.Unmarshal(data, &cached) == nil && cached.Flake == flake {
+			slog.Debug("Using cached flake metadata.", slog.String("flake", flake))
+			return cached.Metadata, nil
+		}
+	}
+
+	metadata, err := GetFlakeMetadata(ctx, flake)
+	if err != nil {
+		return metadata, err
+	}
+	err = cache.write(path, cachedMetadata{Flake: flake, Metadata: metadata})
+	if err != nil {
+		slog.Warn("Unable to cache flake metadata.", slog.String("error", err.Error()))
+	}
+	return metadata, nil
+}
+
+func (cache MetadataCache) write(path string, cached cachedMetadata) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// written to a temporary file and renamed, so readers never see partial entries
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,36 @@
+package nix_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestMetadataCache(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix flake metadata github:example/nixos --json"] = `{"lastModified": 1700000000, "originalUrl": "github:example/nixos"}`
+	fake.Outputs["nix flake metadata flake:nixos --json"] = `{"lastModified": 1700000000, "originalUrl": "flake:nixos"}`
+
+	t.Run("reuses fresh results", func(t *testing.T) {
+		cache := nix.MetadataCache{Dir: t.TempDir(), TTL: time.Minute}
+		for range 2 {
+			metadata, err := cache.Get(context.Background(), "github:example/nixos")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			assert.Equal(t, metadata.LastModified, 1700000000)
+		}
+		assert.Equal(t, len(fake.Ran), 1)
+	})
+
+	t.Run("doesn't cache indirect flakes", func(t *testing.T) {
+		fake.Ran = nil
+		cache := nix.MetadataCache{Dir: t.TempDir(), TTL: time.Minute}
+		cache.Get(context.Background(), "flake:nixos")
+		cache.Get(context.Background(), "flake:nixos")
+		assert.Equal(t, len(fake.Ran), 2)
+	})
+}
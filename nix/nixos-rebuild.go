@@ -1,29 +1,33 @@
 package nix
 
 import (
-	"os"
-	"os/exec"
+	"context"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
 )
 
-func NixosRebuild(operation string, flake string, args []string) {
-	fullArgs := append([]string{operation, "--flake", flake}, args...)
-	cmd := exec.Command("nixos-rebuild", fullArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
 
-	err := cmd.Run()
-	if err != nil {
-		panic(err)
-	}
+func NixosRebuild(ctx context.Context, operation string, flake string, args []string) error {
+	fullArgs := append([]string{operation, "--flake", flake}, args...)
+	return Runner.Run(ctx, command("nixos-rebuild", fullArgs...))
 }
 
-func Reboot() {
-	cmd := exec.Command("systemctl", "reboot")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func Reboot(ctx context.Context) error {
+	return Runner.Run(ctx, runner.Command("systemctl", "reboot"))
+}
 
-	err := cmd.Run()
-	if err != nil {
-		panic(err)
+// Returns the --target-host nixos-rebuild deploys to, empty for the local system.
+func TargetHost(args []string) string {
+	for i, arg := range args {
+		if host, ok := strings.CutPrefix(arg, "--target-host="); ok {
+			return host
+		}
+		if arg == "--target-host" && i+1 < len(args) {
+			return args[i+1]
+		}
 	}
+	return ""
 }
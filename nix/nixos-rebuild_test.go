@@ -0,0 +1,68 @@
+package nix_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Replaces nix.Runner with a fake for the duration of the test.
+func fakeRunner(t *testing.T) *runner.Fake {
+	fake := &runner.Fake{Outputs: map[string]string{}, Errors: map[string]error{}}
+	original := nix.Runner
+	nix.Runner = fake
+	t.Cleanup(func() { nix.Runner = original })
+	return fake
+}
+
+func TestNixosRebuild(t *testing.T) {
+	t.Run("rebuilds the flake", func(t *testing.T) {
+		fake := fakeRunner(t)
+		err := nix.NixosRebuild(context.Background(), "boot", "github:example/nixos#host", []string{"--use-remote-sudo"})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, fake.Ran, []string{"nixos-rebuild boot --flake github:example/nixos#host --use-remote-sudo"})
+	})
+
+	t.Run("passes nix options", func(t *testing.T) {
+		fake := fakeRunner(t)
+		nix.Options = map[string]string{"max-jobs": "4", "cores": "2"}
+		t.Cleanup(func() { nix.Options = map[string]string{} })
+		err := nix.NixosRebuild(context.Background(), "boot", "github:example/nixos#host", []string{})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, fake.Ran, []string{"nixos-rebuild --option cores 2 --option max-jobs 4 boot --flake github:example/nixos#host"})
+	})
+
+	t.Run("returns rebuild failures", func(t *testing.T) {
+		fake := fakeRunner(t)
+		fake.Errors["nixos-rebuild switch --flake github:example/nixos#host"] = errors.New("exit status 1")
+		err := nix.NixosRebuild(context.Background(), "switch", "github:example/nixos#host", []string{})
+		if err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+func TestReboot(t *testing.T) {
+	fake := fakeRunner(t)
+	err := nix.Reboot(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.ArrayEqual(t, fake.Ran, []string{"systemctl reboot"})
+}
+
+func TestTargetHost(t *testing.T) {
+	assert.Equal(t, nix.TargetHost([]string{}), "")
+	assert.Equal(t, nix.TargetHost([]string{"--use-remote-sudo"}), "")
+	assert.Equal(t, nix.TargetHost([]string{"--target-host", "root@example.com", "--use-remote-sudo"}), "root@example.com")
+	assert.Equal(t, nix.TargetHost([]string{"--target-host=root@example.com"}), "root@example.com")
+	assert.Equal(t, nix.TargetHost([]string{"--target-host"}), "")
+}
@@ -0,0 +1,23 @@
+package nix
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// nix.conf settings passed with --option to every nix and nixos-rebuild invocation, set from config.
+var Options = map[string]string{}
+
+/*
+Returns the command running `name` with Options prepended to `args`. nix,
+nix-store, and nixos-rebuild all accept --option before other arguments.
+*/
+func command(name string, args ...string) runner.Cmd {
+	options := []string{}
+	for _, key := range slices.Sorted(maps.Keys(Options)) {
+		options = append(options, "--option", key, Options[key])
+	}
+	return runner.Command(name, slices.Concat(options, args)...)
+}
@@ -0,0 +1,37 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	SystemProfile = "/nix/var/nix/profiles/system"
+	BootedSystem  = "/run/booted-system"
+	CurrentSystem = "/run/current-system"
+)
+
+// Resolves a system link (profile, booted-system, current-system) to its store path.
+func SystemPath(link string) (string, error) {
+	return filepath.EvalSymlinks(link)
+}
+
+// Returns the generation number the system profile currently points to.
+func SystemGeneration() (int, error) {
+	target, err := os.Readlink(SystemProfile)
+	if err != nil {
+		return 0, err
+	}
+	// system-123-link
+	generation, ok := strings.CutPrefix(filepath.Base(target), "system-")
+	if ok {
+		generation, ok = strings.CutSuffix(generation, "-link")
+	}
+	if !ok {
+		return 0, fmt.Errorf("unexpected system profile link %q", target)
+	}
+	return strconv.Atoi(generation)
+}
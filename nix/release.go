@@ -0,0 +1,56 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A NixOS release, e.g. 24.05.
+type Release struct {
+	Year  int
+	Month int
+}
+
+func (release Release) String() string {
+	return fmt.Sprintf("%02d.%02d", release.Year, release.Month)
+}
+
+// Sequential index of the release, NixOS releases twice a year.
+func (release Release) index() int {
+	half := 0
+	if release.Month > 6 {
+		half = 1
+	}
+	return release.Year*2 + half
+}
+
+// Number of releases from `release` to `target`, negative for downgrades.
+func (release Release) Steps(target Release) int {
+	return target.index() - release.index()
+}
+
+var releasePattern = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+// Parses the release from a NixOS version, e.g. "24.05.20240601.abcdef0 (Uakari)".
+func ParseRelease(version string) (Release, error) {
+	match := releasePattern.FindStringSubmatch(strings.TrimSpace(version))
+	if match == nil {
+		return Release{}, fmt.Errorf("unexpected nixos version %q", version)
+	}
+	year, _ := strconv.Atoi(match[1])
+	month, _ := strconv.Atoi(match[2])
+	return Release{Year: year, Month: month}, nil
+}
+
+// Reads the NixOS release of a system toplevel or system link.
+func SystemRelease(system string) (Release, error) {
+	version, err := os.ReadFile(filepath.Join(system, "nixos-version"))
+	if err != nil {
+		return Release{}, err
+	}
+	return ParseRelease(string(version))
+}
@@ -0,0 +1,40 @@
+package nix_test
+
+import (
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestParseRelease(t *testing.T) {
+	release, err := nix.ParseRelease("24.05.20240601.abcdef0 (Uakari)\n")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, release, nix.Release{Year: 24, Month: 5})
+
+	release, err = nix.ParseRelease("24.11pre-git")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, release, nix.Release{Year: 24, Month: 11})
+
+	_, err = nix.ParseRelease("unstable")
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestReleaseSteps(t *testing.T) {
+	r2305 := nix.Release{Year: 23, Month: 5}
+	r2311 := nix.Release{Year: 23, Month: 11}
+	r2405 := nix.Release{Year: 24, Month: 5}
+
+	assert.Equal(t, r2305.Steps(r2305), 0)
+	assert.Equal(t, r2305.Steps(r2311), 1)
+	assert.Equal(t, r2311.Steps(r2405), 1)
+	assert.Equal(t, r2305.Steps(r2405), 2)
+	assert.Equal(t, r2405.Steps(r2311), -1)
+	assert.Equal(t, nix.Release{Year: 20, Month: 9}.Steps(nix.Release{Year: 21, Month: 5}), 1)
+}
@@ -0,0 +1,81 @@
+package nix
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Retries of nix fetches failing with transient errors.
+type RetryPolicy struct {
+	// retries after the first attempt, 0 disables retries
+	Retries int
+	// delay before the first retry, doubling for each further retry
+	Delay time.Duration
+}
+
+// Retries flake metadata lookups and system builds, set from config.
+var Retry = RetryPolicy{Retries: 2, Delay: 5 * time.Second}
+
+// lowercase fragments of nix, curl, and git errors worth retrying
+var transientErrors = []string{
+	"connection reset",
+	"connection refused",
+	"connection timed out",
+	"timeout was reached",
+	"could not resolve host",
+	"couldn't connect to server",
+	"failed to connect",
+	"http error 500",
+	"http error 502",
+	"http error 503",
+	"http error 504",
+	"http error 429",
+	"unable to access",
+	"the remote end hung up",
+	"early eof",
+	"ssl connect error",
+}
+
+/*
+Whether `err` looks like a network or remote hiccup that may succeed on
+retry, from its message and the stderr of failed commands.
+*/
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error() + "\n" + runner.Stderr(err)
+	message = strings.ToLower(message)
+	for _, fragment := range transientErrors {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs `fetch`, retrying transient errors with backoff.
+func (policy RetryPolicy) do(ctx context.Context, name string, fetch func() error) error {
+	delay := policy.Delay
+	for attempt := 0; ; attempt++ {
+		err := fetch()
+		if err == nil || attempt >= policy.Retries || !IsTransient(err) {
+			return err
+		}
+		slog.Warn("Transient nix failure, retrying.",
+			slog.String("operation", name),
+			slog.Int("attempt", attempt+1),
+			slog.Duration("delay", delay),
+			slog.String("error", err.Error()))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,42 @@
+package nix_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestIsTransient(t *testing.T) {
+	stderr := &runner.Error{
+		Err:    errors.New("exit status 1"),
+		Stderr: "error: unable to download 'https://cache.nixos.org/abc.narinfo': HTTP error 503\n",
+	}
+	assert.Equal(t, nix.IsTransient(stderr), true)
+	assert.Equal(t, nix.IsTransient(errors.New("fatal: the remote end hung up unexpectedly")), true)
+	assert.Equal(t, nix.IsTransient(errors.New("error: attribute 'host' missing")), false)
+}
+
+func TestRetry(t *testing.T) {
+	original := nix.Retry
+	nix.Retry = nix.RetryPolicy{Retries: 2}
+	t.Cleanup(func() { nix.Retry = original })
+
+	t.Run("retries transient failures", func(t *testing.T) {
+		fake := fakeRunner(t)
+		fake.Errors["nix flake metadata github:example/nixos --json"] = errors.New("Connection reset by peer")
+		_, err := nix.GetFlakeMetadata(context.Background(), "github:example/nixos")
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, len(fake.Ran), 3)
+	})
+
+	t.Run("fails fast otherwise", func(t *testing.T) {
+		fake := fakeRunner(t)
+		fake.Errors["nix flake metadata github:example/nixos --json"] = errors.New("error: flake has no outputs")
+		nix.GetFlakeMetadata(context.Background(), "github:example/nixos")
+		assert.Equal(t, len(fake.Ran), 1)
+	})
+}
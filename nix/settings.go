@@ -0,0 +1,57 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+/*
+Evaluates the nixos-hydra-upgrade module settings of `host` in `flake`,
+system.autoUpgradeHydra.settings, without building anything.
+*/
+func SystemSettings(ctx context.Context, flake string, host string) (map[string]any, error) {
+	installable := fmt.Sprintf("%s#nixosConfigurations.%s.config.system.autoUpgradeHydra.settings", flake, host)
+	cmd := command("nix", "eval", "--json", installable)
+
+	var output []byte
+	err := Retry.do(ctx, "eval", func() error {
+		var err error
+		output, err = Runner.Output(ctx, cmd)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]any{}
+	err = json.Unmarshal(output, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("parsing settings of %s: %w", host, err)
+	}
+	return settings, nil
+}
+
+/*
+Evaluates NixOS option `option` of `host` in `flake`, e.g. system.stateVersion,
+decoded from JSON.
+*/
+func SystemOption(ctx context.Context, flake string, host string, option string) (any, error) {
+	installable := fmt.Sprintf("%s#nixosConfigurations.%s.config.%s", flake, host, option)
+	cmd := command("nix", "eval", "--json", installable)
+
+	var output []byte
+	err := Retry.do(ctx, "eval", func() error {
+		var err error
+		output, err = Runner.Output(ctx, cmd)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	err = json.Unmarshal(output, &value)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s of %s: %w", option, host, err)
+	}
+	return value, nil
+}
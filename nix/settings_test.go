@@ -0,0 +1,32 @@
+package nix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestSystemSettings(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix eval --json github:example/nixos/abc#nixosConfigurations.host.config.system.autoUpgradeHydra.settings"] = `{"reboot":true,"gates":{"min-uptime":"1h"}}`
+
+	settings, err := nix.SystemSettings(context.Background(), "github:example/nixos/abc", "host")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, settings["reboot"], true)
+	assert.Equal(t, settings["gates"].(map[string]any)["min-uptime"], "1h")
+}
+
+func TestSystemOption(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix eval --json self#nixosConfigurations.host.config.system.stateVersion"] = `"24.05"`
+
+	value, err := nix.SystemOption(context.Background(), "self", "host", "system.stateVersion")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, value, any("24.05"))
+}
@@ -0,0 +1,42 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// "path '/nix/store/abc-foo' is untrusted"
+var untrustedPattern = regexp.MustCompile(`path '(/nix/store/[^']+)' is untrusted`)
+
+// Parses the paths `nix store verify` reports as untrusted.
+func ParseUntrusted(output string) []string {
+	untrusted := []string{}
+	for _, match := range untrustedPattern.FindAllStringSubmatch(output, -1) {
+		untrusted = append(untrusted, match[1])
+	}
+	return untrusted
+}
+
+/*
+Returns the paths in the closure of `path` that aren't signed by any of
+`keys`. Only `keys` are trusted, regardless of trusted-public-keys in
+nix.conf or Options. Paths built locally are trusted without signatures.
+*/
+func UntrustedPaths(ctx context.Context, path string, keys []string) ([]string, error) {
+	// not command(), Options may set trusted-public-keys too
+	cmd := runner.Command("nix", "store", "verify", "--recursive", "--no-contents",
+		"--option", "trusted-public-keys", strings.Join(keys, " "), path)
+	output, err := Runner.CombinedOutput(ctx, cmd)
+	untrusted := ParseUntrusted(string(output))
+	if len(untrusted) > 0 {
+		return untrusted, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, output)
+	}
+	return untrusted, nil
+}
@@ -0,0 +1,30 @@
+package nix_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestUntrustedPaths(t *testing.T) {
+	command := "nix store verify --recursive --no-contents --option trusted-public-keys hydra.example.org-1:abc /nix/store/aaa-nixos-system-host"
+
+	t.Run("reports untrusted paths", func(t *testing.T) {
+		fake := fakeRunner(t)
+		fake.Outputs[command] = "path '/nix/store/bbb-openssl-3.0' is untrusted\npath '/nix/store/ccc-glibc-2.39' is untrusted\n2 paths are untrusted\n"
+		fake.Errors[command] = errors.New("exit status 2")
+		untrusted, err := nix.UntrustedPaths(context.Background(), "/nix/store/aaa-nixos-system-host", []string{"hydra.example.org-1:abc"})
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, untrusted, []string{"/nix/store/bbb-openssl-3.0", "/nix/store/ccc-glibc-2.39"})
+	})
+
+	t.Run("trusts signed closures", func(t *testing.T) {
+		fakeRunner(t)
+		untrusted, err := nix.UntrustedPaths(context.Background(), "/nix/store/aaa-nixos-system-host", []string{"hydra.example.org-1:abc"})
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, untrusted, []string{})
+	})
+}
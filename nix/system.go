@@ -0,0 +1,34 @@
+package nix
+
+import (
+	"runtime"
+	"strings"
+)
+
+// Go architectures by nix system architecture, where the names differ.
+var architectures = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"386":     "i686",
+	"arm":     "armv7l",
+	"ppc64le": "powerpc64le",
+}
+
+// Returns the nix system double of a Go `goos` and `goarch`, e.g. x86_64-linux.
+func SystemDouble(goos string, goarch string) string {
+	arch, ok := architectures[goarch]
+	if !ok {
+		arch = goarch
+	}
+	return arch + "-" + goos
+}
+
+// Returns the nix system double of this machine, e.g. x86_64-linux.
+func System() string {
+	return SystemDouble(runtime.GOOS, runtime.GOARCH)
+}
+
+// Replaces {system} in a hydra job or jobset name with this machine's System.
+func ExpandSystem(name string) string {
+	return strings.ReplaceAll(name, "{system}", System())
+}
@@ -0,0 +1,15 @@
+package nix_test
+
+import (
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestSystemDouble(t *testing.T) {
+	assert.Equal(t, nix.SystemDouble("linux", "amd64"), "x86_64-linux")
+	assert.Equal(t, nix.SystemDouble("linux", "arm64"), "aarch64-linux")
+	assert.Equal(t, nix.SystemDouble("linux", "riscv64"), "riscv64-linux")
+	assert.Equal(t, nix.SystemDouble("darwin", "arm64"), "aarch64-darwin")
+}
@@ -0,0 +1,145 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func toplevelInstallable(flake string, host string) string {
+	return fmt.Sprintf("%s#nixosConfigurations.%s.config.system.build.toplevel", flake, host)
+}
+
+/*
+Builds (or substitutes) the system toplevel of `host` from `flake` without
+activating it, returning its store path.
+*/
+func BuildToplevel(ctx context.Context, flake string, host string) (string, error) {
+	return build(ctx, toplevelInstallable(flake, host))
+}
+
+// Substitutes the store path `path`, without evaluating anything.
+func RealiseStorePath(ctx context.Context, path string) (string, error) {
+	return build(ctx, path)
+}
+
+// Builds `installable` without a result link, returning its output path.
+func build(ctx context.Context, installable string) (string, error) {
+	cmd := command("nix", "build", "--no-link", "--print-out-paths", installable)
+
+	var output []byte
+	err := Retry.do(ctx, "build", func() error {
+		var err error
+		output, err = Runner.Output(ctx, cmd)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+/*
+Rebuilds the system toplevel of `host` from `flake` locally with --check,
+failing if the result differs from the store path already present.
+*/
+func CheckToplevel(ctx context.Context, flake string, host string) error {
+	cmd := command("nix", "build", "--check", "--no-link", toplevelInstallable(flake, host))
+
+	return Runner.Run(ctx, cmd)
+}
+
+/*
+Registers `root` as a garbage collector root for the store path `path`,
+replacing any path it previously rooted.
+*/
+func AddGCRoot(ctx context.Context, path string, root string) error {
+	cmd := command("nix-store", "--add-root", root, "--realise", path)
+
+	return Runner.Run(ctx, cmd)
+}
+
+/*
+Copies the closure of `path` to the ssh destination `host`, so deploying it
+there doesn't have to.
+*/
+func CopyClosure(ctx context.Context, host string, path string) error {
+	cmd := command("nix", "copy", "--to", "ssh://"+host, path)
+
+	return Retry.do(ctx, "copy", func() error {
+		return Runner.Run(ctx, cmd)
+	})
+}
+
+// Points the system profile at `toplevel`, creating a new generation.
+func SetSystemProfile(ctx context.Context, toplevel string) error {
+	cmd := command("nix-env", "--profile", SystemProfile, "--set", toplevel)
+
+	return Runner.Run(ctx, cmd)
+}
+
+/*
+Activates a system toplevel already set as the system profile, as the final
+step of `nixos-rebuild boot|switch`.
+*/
+func SwitchToConfiguration(ctx context.Context, toplevel string, operation string) error {
+	cmd := runner.Command(filepath.Join(toplevel, "bin", "switch-to-configuration"), operation)
+
+	return Runner.Run(ctx, cmd)
+}
+
+// "these 12 paths will be fetched (345.67 MiB download, 1.2 GiB unpacked):"
+var downloadPattern = regexp.MustCompile(`will be fetched \(([0-9.]+) ([KMGT]?i?B) download`)
+
+var sizeUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// Parses the download size in bytes from `nix build --dry-run` output.
+func ParseDownloadSize(output string) (int64, error) {
+	match := downloadPattern.FindStringSubmatch(output)
+	if match == nil {
+		// nothing to fetch
+		return 0, nil
+	}
+	size, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit, ok := sizeUnits[match[2]]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q", match[2])
+	}
+	return int64(size * unit), nil
+}
+
+/*
+Returns the number of bytes that must be downloaded from substituters to
+build the system toplevel of `host` from `flake`.
+*/
+func DownloadSize(ctx context.Context, flake string, host string) (int64, error) {
+	return downloadSize(ctx, toplevelInstallable(flake, host))
+}
+
+// Returns the number of bytes that must be downloaded to substitute the store path `path`.
+func StorePathDownloadSize(ctx context.Context, path string) (int64, error) {
+	return downloadSize(ctx, path)
+}
+
+func downloadSize(ctx context.Context, installable string) (int64, error) {
+	cmd := command("nix", "build", "--dry-run", "--no-link", installable)
+	output, err := Runner.CombinedOutput(ctx, cmd)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", err, output)
+	}
+	return ParseDownloadSize(string(output))
+}
@@ -0,0 +1,88 @@
+package nix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestParseDownloadSize(t *testing.T) {
+	t.Run("parses download sizes", func(t *testing.T) {
+		size, err := nix.ParseDownloadSize(`these 2 derivations will be built:
+  /nix/store/aaa-etc.drv
+  /nix/store/bbb-nixos-system-host.drv
+these 12 paths will be fetched (1.50 GiB download, 6.20 GiB unpacked):
+  /nix/store/ccc-linux-6.6
+`)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, size, int64(1.5*(1<<30)))
+	})
+
+	t.Run("nothing to fetch", func(t *testing.T) {
+		size, err := nix.ParseDownloadSize("")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, size, 0)
+	})
+}
+
+func TestBuildToplevel(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix build --no-link --print-out-paths github:example/nixos#nixosConfigurations.host.config.system.build.toplevel"] = "/nix/store/aaa-nixos-system-host\n"
+
+	toplevel, err := nix.BuildToplevel(context.Background(), "github:example/nixos", "host")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, toplevel, "/nix/store/aaa-nixos-system-host")
+}
+
+func TestCopyClosure(t *testing.T) {
+	fake := fakeRunner(t)
+	err := nix.CopyClosure(context.Background(), "root@target", "/nix/store/aaa-nixos-system-host")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.ArrayEqual(t, fake.Ran, []string{"nix copy --to ssh://root@target /nix/store/aaa-nixos-system-host"})
+}
+
+func TestSetSystemProfile(t *testing.T) {
+	fake := fakeRunner(t)
+	_, err := nix.RealiseStorePath(context.Background(), "/nix/store/aaa-nixos-system-host")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = nix.SetSystemProfile(context.Background(), "/nix/store/aaa-nixos-system-host")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.ArrayEqual(t, fake.Ran, []string{
+		"nix build --no-link --print-out-paths /nix/store/aaa-nixos-system-host",
+		"nix-env --profile /nix/var/nix/profiles/system --set /nix/store/aaa-nixos-system-host",
+	})
+}
+
+func TestAddGCRoot(t *testing.T) {
+	fake := fakeRunner(t)
+	err := nix.AddGCRoot(context.Background(), "/nix/store/aaa-nixos-system-host", "/nix/var/nix/gcroots/nixos-hydra-upgrade")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.ArrayEqual(t, fake.Ran, []string{"nix-store --add-root /nix/var/nix/gcroots/nixos-hydra-upgrade --realise /nix/store/aaa-nixos-system-host"})
+}
+
+func TestDownloadSize(t *testing.T) {
+	fake := fakeRunner(t)
+	fake.Outputs["nix build --dry-run --no-link github:example/nixos#nixosConfigurations.host.config.system.build.toplevel"] = "these 3 paths will be fetched (12.00 MiB download, 40.00 MiB unpacked):\n"
+
+	size, err := nix.DownloadSize(context.Background(), "github:example/nixos", "host")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, size, 12<<20)
+}
@@ -0,0 +1,62 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// A nix version, e.g. 2.24.10.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (version Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Patch)
+}
+
+// Whether `version` is `other` or newer.
+func (version Version) AtLeast(other Version) bool {
+	if version.Major != other.Major {
+		return version.Major > other.Major
+	}
+	if version.Minor != other.Minor {
+		return version.Minor > other.Minor
+	}
+	return version.Patch >= other.Patch
+}
+
+// Oldest nix supported, the first with `nix config show`.
+var MinVersion = Version{Major: 2, Minor: 20}
+
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?\S*\s*$`)
+
+/*
+Parses the output of `nix --version`, e.g. "nix (Nix) 2.24.10". Forks
+reporting their own name, like "nix (Lix, like Nix) 2.91.1", parse the same.
+*/
+func ParseVersion(output string) (Version, error) {
+	match := versionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return Version{}, fmt.Errorf("unexpected nix version %q", output)
+	}
+	version := Version{}
+	version.Major, _ = strconv.Atoi(match[1])
+	version.Minor, _ = strconv.Atoi(match[2])
+	version.Patch, _ = strconv.Atoi(match[3])
+	return version, nil
+}
+
+// Runs `nix --version`, without nix.Options an older nix might not know.
+func NixVersion(ctx context.Context) (Version, error) {
+	output, err := Runner.Output(ctx, runner.Command("nix", "--version"))
+	if err != nil {
+		return Version{}, err
+	}
+	return ParseVersion(string(output))
+}
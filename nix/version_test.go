@@ -0,0 +1,33 @@
+package nix_test
+
+import (
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+func TestParseVersion(t *testing.T) {
+	version, err := nix.ParseVersion("nix (Nix) 2.24.10\n")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, version, nix.Version{Major: 2, Minor: 24, Patch: 10})
+	assert.Equal(t, version.AtLeast(nix.MinVersion), true)
+
+	version, err = nix.ParseVersion("nix (Lix, like Nix) 2.91.1")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, version, nix.Version{Major: 2, Minor: 91, Patch: 1})
+
+	version, err = nix.ParseVersion("nix (Nix) 2.18.0pre20230919_6b38d2d")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, version, nix.Version{Major: 2, Minor: 18})
+	assert.Equal(t, version.AtLeast(nix.MinVersion), false)
+
+	_, err = nix.ParseVersion("command not found")
+	assert.Equal(t, err != nil, true)
+}
@@ -0,0 +1,164 @@
+/*
+Package plugins runs site-specific executables at extension points of the
+upgrade, so behavior can be extended without forking.
+
+Each executable in the plugin directory is run with the extension point as
+its only argument and a Request as JSON on stdin. It may write a Response as
+JSON to stdout, empty output is an empty response. Exiting non-zero is an
+error. Plugins ignore extension points they don't implement by exiting 0
+without output.
+*/
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+// Where in the upgrade plugins are run.
+type Point string
+
+const (
+	// upgrade gate once the latest build is known, blocking defers the upgrade
+	PointGate Point = "gate"
+	// health check before starting an upgrade, blocking fails the upgrade
+	PointCheck Point = "check"
+	// after every run with its outcome, the response is ignored
+	PointNotify Point = "notify"
+	// when an automatic rollback is triggered, before notify, the response is ignored
+	PointRollback Point = "rollback"
+	// when the latest build's flake isn't from hydra.expected-origin, the response is ignored
+	PointDrift Point = "drift"
+	// when no successful build landed within hydra.freshness, the response is ignored
+	PointStale Point = "stale"
+	// when the process running a previous upgrade crashed mid-run, the response is ignored
+	PointCrashed Point = "crashed"
+)
+
+// Run context provided on stdin.
+type Request struct {
+	Point     Point  `json:"point"`
+	Operation string `json:"operation"`
+	// hydra build id of the target system, 0 if not known yet
+	BuildID int    `json:"buildId,omitempty"`
+	Flake   string `json:"flake,omitempty"`
+	// flake revision of the target system, empty if not resolved yet
+	FlakeRev string `json:"flakeRev,omitempty"`
+	// notify only
+	Outcome string `json:"outcome,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// notify only, the end of the stderr of the command that failed
+	Stderr string `json:"stderr,omitempty"`
+	// notify only, units that failed after switching
+	FailedUnits []string `json:"failedUnits,omitempty"`
+	// notify only, failures of advisory checks that didn't stop the run
+	Warnings []string `json:"warnings,omitempty"`
+	// notify only, runs failing with this outcome in a row
+	Failures int `json:"failures,omitempty"`
+	// notify only, wall-clock time of each phase run, in order
+	Phases []events.PhaseTiming `json:"phases,omitempty"`
+	// notify only, path of the target system's bill of materials, see upgrade.SBOM
+	SBOM string `json:"sbom,omitempty"`
+	// notify only, sent by confirm once the system booted into the upgrade
+	Rebooted bool `json:"rebooted,omitempty"`
+	// "high" for rollbacks, repeated failures, drift, stale jobsets, and crashes, so notifiers can page someone
+	Priority string `json:"priority,omitempty"`
+	// rollback only, the system rolled back from and to
+	RollbackFrom string `json:"rollbackFrom,omitempty"`
+	RollbackTo   string `json:"rollbackTo,omitempty"`
+	// crashed only, the last phase the crashed upgrade completed, see state.Phase
+	Phase string `json:"phase,omitempty"`
+	// drift only, the origin the flake was expected from
+	ExpectedOrigin string `json:"expectedOrigin,omitempty"`
+	// stale only, when the latest successful build finished, omitted if none was found
+	LastSuccess time.Time `json:"lastSuccess,omitzero"`
+	// operator note on why the run was triggered, e.g. a change ticket
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// Result read from stdout.
+type Response struct {
+	// blocks gates and fails checks
+	Block  bool   `json:"block"`
+	Reason string `json:"reason"`
+}
+
+// An executable plugin.
+type Plugin struct {
+	Path string
+}
+
+func (plugin Plugin) Name() string {
+	return filepath.Base(plugin.Path)
+}
+
+/*
+Finds the executables in `dir`, in lexical order. Subdirectories and files
+without an executable bit are skipped.
+*/
+func Discover(dir string) ([]Plugin, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	plugins := []Plugin{}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		// follows symlinks, e.g. into the nix store
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		plugins = append(plugins, Plugin{Path: path})
+	}
+	return plugins, nil
+}
+
+// Runs every plugin at `request.Point`, ignoring responses. Failures are only logged.
+func Notify(ctx context.Context, plugins []Plugin, request Request) {
+	for _, plugin := range plugins {
+		_, err := plugin.Call(ctx, request)
+		if err != nil {
+			slog.Error("Notifying plugin failed.", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// Runs the plugin at `request.Point`.
+func (plugin Plugin) Call(ctx context.Context, request Request) (Response, error) {
+	var response Response
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+	cmd := runner.Command(plugin.Path, string(request.Point))
+	cmd.Stdin = payload
+
+	out, err := Runner.Output(ctx, cmd)
+	if err != nil {
+		return response, fmt.Errorf("plugin %s %s: %w", plugin.Name(), request.Point, err)
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return response, nil
+	}
+	err = json.Unmarshal(out, &response)
+	if err != nil {
+		return response, fmt.Errorf("plugin %s %s: invalid response: %w", plugin.Name(), request.Point, err)
+	}
+	return response, nil
+}
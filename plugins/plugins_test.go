@@ -0,0 +1,59 @@
+package plugins_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/plugins"
+)
+
+func writePlugin(t *testing.T, dir string, name string, script string, mode os.FileMode) {
+	err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	dir := t.TempDir()
+	// blocks gates for build 7 only
+	writePlugin(t, dir, "10-freeze", `
+if [ "$1" = gate ] && grep -q '"buildId":7'; then
+  echo '{"block": true, "reason": "build 7 is frozen"}'
+fi
+`, 0755)
+	writePlugin(t, dir, "20-broken", "exit 1\n", 0755)
+	writePlugin(t, dir, "README", "not a plugin\n", 0644)
+
+	found, err := plugins.Discover(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, len(found), 2)
+	assert.Equal(t, found[0].Name(), "10-freeze")
+
+	t.Run("reads responses", func(t *testing.T) {
+		response, err := found[0].Call(context.Background(), plugins.Request{Point: plugins.PointGate, BuildID: 7})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, response.Block, true)
+		assert.Equal(t, response.Reason, "build 7 is frozen")
+	})
+
+	t.Run("empty output is an empty response", func(t *testing.T) {
+		response, err := found[0].Call(context.Background(), plugins.Request{Point: plugins.PointGate, BuildID: 8})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, response.Block, false)
+	})
+
+	t.Run("fails on non-zero exit", func(t *testing.T) {
+		_, err := found[1].Call(context.Background(), plugins.Request{Point: plugins.PointCheck})
+		assert.Equal(t, err != nil, true)
+	})
+}
@@ -0,0 +1,143 @@
+package rollback
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Transient systemd unit name of the rollback timer and service.
+const unit = "nixos-hydra-upgrade-rollback"
+
+const systemProfile = "/nix/var/nix/profiles/system"
+
+// Environment variable of the rollback service naming the generation it rolls back to.
+const previousEnv = "NIXOS_HYDRA_UPGRADE_ROLLBACK_TO"
+
+/*
+A systemd timer on the target system that rolls the system profile back to
+the generation active when it was armed, unless disarmed first. Guards
+protect against switches that break connectivity or otherwise can't be
+confirmed.
+*/
+type Guard struct {
+	// ssh destination of the target system, empty for the local system
+	Host string
+	// system profile generation rolled back to, set by Arm
+	Previous string
+}
+
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+func (guard Guard) command(args ...string) runner.Cmd {
+	if guard.Host == "" {
+		return runner.Command(args[0], args[1:]...)
+	}
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	sshArgs := append([]string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10", guard.Host, "--"}, quoted...)
+	return runner.Command("ssh", sshArgs...)
+}
+
+func (guard Guard) run(ctx context.Context, args ...string) error {
+	return Runner.Run(ctx, guard.command(args...))
+}
+
+/*
+Arms the rollback timer to fire after `timeout`, rolling back to the
+currently active system profile generation.
+*/
+func (guard *Guard) Arm(ctx context.Context, timeout time.Duration) error {
+	output, err := Runner.Output(ctx, guard.command("readlink", "-f", systemProfile))
+	if err != nil {
+		return err
+	}
+	previous := strings.TrimSpace(string(output))
+	if !strings.HasPrefix(previous, "/nix/store/") {
+		return fmt.Errorf("unexpected system profile target %q", previous)
+	}
+
+	// clear any guard left behind by an earlier run
+	Runner.CombinedOutput(ctx, guard.command("systemctl", "stop", unit+".timer", unit+".service"))
+	Runner.CombinedOutput(ctx, guard.command("systemctl", "reset-failed", unit+".service"))
+
+	slog.Info("Arming rollback.", slog.String("host", guard.Host), slog.String("previous", previous), slog.Duration("timeout", timeout))
+	rollback := fmt.Sprintf("%s/sw/bin/nix-env -p %s --set %s && %s/bin/switch-to-configuration switch",
+		previous, systemProfile, previous, previous)
+	err = guard.run(ctx, "systemd-run",
+		"--unit", unit,
+		"--description", "nixos-hydra-upgrade automatic rollback",
+		fmt.Sprintf("--on-active=%ds", int(timeout.Seconds())),
+		"--timer-property=AccuracySec=1s",
+		"--setenv="+previousEnv+"="+previous,
+		"--", "/bin/sh", "-c", rollback)
+	if err != nil {
+		return err
+	}
+	guard.Previous = previous
+	return nil
+}
+
+// Returns the generation an armed rollback timer rolls back to.
+func (guard Guard) Target(ctx context.Context) (string, error) {
+	output, err := Runner.Output(ctx, guard.command("systemctl", "show", "--property", "Environment", "--value", unit+".service"))
+	if err != nil {
+		return "", err
+	}
+	for _, variable := range strings.Fields(string(output)) {
+		previous, ok := strings.CutPrefix(variable, previousEnv+"=")
+		if ok {
+			return previous, nil
+		}
+	}
+	return "", fmt.Errorf("rollback service has no %s", previousEnv)
+}
+
+// Whether the rollback timer is armed.
+func (guard Guard) Armed(ctx context.Context) bool {
+	return guard.run(ctx, "systemctl", "is-active", "--quiet", unit+".timer") == nil
+}
+
+// Restarts the armed rollback timer, firing a whole timeout from now.
+func (guard Guard) Restart(ctx context.Context) error {
+	return guard.run(ctx, "systemctl", "restart", unit+".timer")
+}
+
+// Disarms the rollback timer, keeping the current generation.
+func (guard Guard) Disarm(ctx context.Context) error {
+	return guard.run(ctx, "systemctl", "stop", unit+".timer")
+}
+
+/*
+Disarms the rollback timer, retrying until `deadline` for targets that are
+briefly unreachable while their network configuration changes. Stops
+retrying when `ctx` is done, leaving the target to roll back.
+*/
+func (guard Guard) Confirm(ctx context.Context, deadline time.Time) error {
+	for {
+		err := guard.Disarm(ctx)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(5 * time.Second).After(deadline) {
+			return err
+		}
+		slog.Warn("Unable to confirm switch, retrying.", slog.String("host", guard.Host), slog.String("error", err.Error()))
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package rollback_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/rollback"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestGuard(t *testing.T) {
+	original := rollback.Runner
+	t.Cleanup(func() { rollback.Runner = original })
+	ctx := context.Background()
+	ssh := "ssh -o BatchMode=yes -o ConnectTimeout=10 root@target -- "
+	previous := "/nix/store/abc-nixos-system"
+
+	t.Run("arms remote rollbacks to the active generation", func(t *testing.T) {
+		fake := &runner.Fake{Outputs: map[string]string{
+			ssh + "'readlink' '-f' '/nix/var/nix/profiles/system'": previous + "\n",
+		}}
+		rollback.Runner = fake
+		guard := &rollback.Guard{Host: "root@target"}
+		err := guard.Arm(ctx, 90*time.Second)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, guard.Previous, previous)
+		assert.ArrayEqual(t, fake.Ran, []string{
+			ssh + "'readlink' '-f' '/nix/var/nix/profiles/system'",
+			ssh + "'systemctl' 'stop' 'nixos-hydra-upgrade-rollback.timer' 'nixos-hydra-upgrade-rollback.service'",
+			ssh + "'systemctl' 'reset-failed' 'nixos-hydra-upgrade-rollback.service'",
+			ssh + "'systemd-run' '--unit' 'nixos-hydra-upgrade-rollback' '--description' 'nixos-hydra-upgrade automatic rollback' " +
+				"'--on-active=90s' '--timer-property=AccuracySec=1s' '--setenv=NIXOS_HYDRA_UPGRADE_ROLLBACK_TO=" + previous + "' " +
+				"'--' '/bin/sh' '-c' '" + previous + "/sw/bin/nix-env -p /nix/var/nix/profiles/system --set " + previous +
+				" && " + previous + "/bin/switch-to-configuration switch'",
+		})
+	})
+
+	t.Run("doesn't arm for unexpected profiles", func(t *testing.T) {
+		fake := &runner.Fake{Outputs: map[string]string{
+			"readlink -f /nix/var/nix/profiles/system": "/nix/var/nix/profiles/system\n",
+		}}
+		rollback.Runner = fake
+		guard := &rollback.Guard{}
+		err := guard.Arm(ctx, time.Minute)
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, guard.Previous, "")
+		assert.Equal(t, len(fake.Ran), 1)
+	})
+
+	t.Run("reads the armed target", func(t *testing.T) {
+		rollback.Runner = &runner.Fake{Outputs: map[string]string{
+			"systemctl show --property Environment --value nixos-hydra-upgrade-rollback.service": "LANG=C NIXOS_HYDRA_UPGRADE_ROLLBACK_TO=" + previous + "\n",
+		}}
+		target, err := rollback.Guard{}.Target(ctx)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, target, previous)
+	})
+
+	t.Run("fails without an armed target", func(t *testing.T) {
+		rollback.Runner = &runner.Fake{}
+		_, err := rollback.Guard{}.Target(ctx)
+		assert.Equal(t, err != nil, true)
+	})
+
+	t.Run("checks whether the timer is armed", func(t *testing.T) {
+		rollback.Runner = &runner.Fake{Errors: map[string]error{
+			ssh + "'systemctl' 'is-active' '--quiet' 'nixos-hydra-upgrade-rollback.timer'": errors.New("exit status 3"),
+		}}
+		assert.Equal(t, rollback.Guard{Host: "root@target"}.Armed(ctx), false)
+		assert.Equal(t, rollback.Guard{}.Armed(ctx), true)
+	})
+
+	t.Run("restarts the timer", func(t *testing.T) {
+		fake := &runner.Fake{}
+		rollback.Runner = fake
+		err := rollback.Guard{Host: "root@target"}.Restart(ctx)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{ssh + "'systemctl' 'restart' 'nixos-hydra-upgrade-rollback.timer'"})
+	})
+
+	t.Run("confirms by disarming", func(t *testing.T) {
+		fake := &runner.Fake{}
+		rollback.Runner = fake
+		err := rollback.Guard{Host: "root@target"}.Confirm(ctx, time.Now().Add(time.Minute))
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{ssh + "'systemctl' 'stop' 'nixos-hydra-upgrade-rollback.timer'"})
+	})
+
+	t.Run("stops confirming at the deadline", func(t *testing.T) {
+		fake := &runner.Fake{Errors: map[string]error{
+			ssh + "'systemctl' 'stop' 'nixos-hydra-upgrade-rollback.timer'": errors.New("exit status 255"),
+		}}
+		rollback.Runner = fake
+		err := rollback.Guard{Host: "root@target"}.Confirm(ctx, time.Now())
+		assert.Equal(t, err != nil, true)
+		assert.Equal(t, len(fake.Ran), 1)
+	})
+	t.Run("stops confirming when cancelled", func(t *testing.T) {
+		fake := &runner.Fake{Errors: map[string]error{
+			ssh + "'systemctl' 'stop' 'nixos-hydra-upgrade-rollback.timer'": errors.New("exit status 255"),
+		}}
+		rollback.Runner = fake
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		err := rollback.Guard{Host: "root@target"}.Confirm(cancelled, time.Now().Add(time.Minute))
+		assert.Equal(t, err, context.Canceled)
+		assert.Equal(t, len(fake.Ran), 1)
+	})
+}
@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+/*
+Resource limits of commands, applied by running them in a transient systemd
+scope with systemd-run. Zero values leave a limit unset.
+*/
+type Limits struct {
+	// nice level, 1-19
+	Nice int
+	// cgroup CPUWeight= and IOWeight=, 1-10000, 100 is the default of other units
+	CPUWeight int
+	IOWeight  int
+	// cgroup MemoryMax=, e.g. 4G or 50%
+	MemoryMax string
+}
+
+func (limits Limits) IsZero() bool {
+	return limits == Limits{}
+}
+
+type limitsKey struct{}
+
+// Returns a context limiting the commands run with it, see Limits.
+func WithLimits(ctx context.Context, limits Limits) context.Context {
+	return context.WithValue(ctx, limitsKey{}, limits)
+}
+
+/*
+Returns `cmd` wrapped in systemd-run with the limits of `ctx`, or `cmd` when
+it has none. `name` is the executable `cmd` runs, resolved by the caller.
+*/
+func limit(ctx context.Context, cmd Cmd, name string) Cmd {
+	limits, _ := ctx.Value(limitsKey{}).(Limits)
+	if limits.IsZero() {
+		cmd.Name = name
+		return cmd
+	}
+	args := []string{"--scope", "--quiet", "--collect"}
+	if limits.Nice != 0 {
+		args = append(args, fmt.Sprintf("--nice=%d", limits.Nice))
+	}
+	if limits.CPUWeight != 0 {
+		args = append(args, "-p", fmt.Sprintf("CPUWeight=%d", limits.CPUWeight))
+	}
+	if limits.IOWeight != 0 {
+		args = append(args, "-p", fmt.Sprintf("IOWeight=%d", limits.IOWeight))
+	}
+	if limits.MemoryMax != "" {
+		args = append(args, "-p", "MemoryMax="+limits.MemoryMax)
+	}
+	cmd.Name = "systemd-run"
+	if path, ok := Paths[cmd.Name]; ok {
+		cmd.Name = path
+	}
+	cmd.Args = slices.Concat(args, []string{"--", name}, cmd.Args)
+	return cmd
+}
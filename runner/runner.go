@@ -0,0 +1,364 @@
+/*
+Package runner runs external commands behind an interface, so code shelling
+out to nix, systemctl, and friends can be tested without them installed.
+*/
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A command produced no output for Exec.StallTimeout and was killed.
+var ErrStalled = errors.New("stalled")
+
+// An external command.
+type Cmd struct {
+	Name string
+	Args []string
+	// additional environment variables, added to ours
+	Env []string
+	// written to stdin, nil leaves stdin empty
+	Stdin []byte
+}
+
+func Command(name string, args ...string) Cmd {
+	return Cmd{Name: name, Args: args}
+}
+
+// The command line, name and args separated by spaces.
+func (cmd Cmd) String() string {
+	return strings.Join(append([]string{cmd.Name}, cmd.Args...), " ")
+}
+
+// Runs external commands.
+type Runner interface {
+	// Runs `cmd`, streaming its stdout and stderr to ours. Errors keep the end of stderr, see Error.
+	Run(ctx context.Context, cmd Cmd) error
+	// Runs `cmd`, returning its stdout. stderr is streamed to ours.
+	Output(ctx context.Context, cmd Cmd) ([]byte, error)
+	// Runs `cmd`, returning its stdout and stderr interleaved.
+	CombinedOutput(ctx context.Context, cmd Cmd) ([]byte, error)
+	/*
+		Starts `cmd` in the background reading a pipe on stdin, until the
+		returned stop closes the pipe and waits for it to exit. stdout and
+		stderr are streamed to ours.
+	*/
+	Start(ctx context.Context, cmd Cmd) (stop func() error, err error)
+}
+
+// Bytes of stderr kept by Error, unless Exec.StderrBytes is set.
+const stderrTail = 4096
+
+// Keeps the last `size` bytes written, in a fixed size buffer.
+type ringBuffer struct {
+	buf []byte
+	// next write position, once full
+	start   int
+	dropped bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	if size <= 0 {
+		size = stderrTail
+	}
+	return &ringBuffer{buf: make([]byte, 0, size)}
+}
+
+func (ring *ringBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	size := cap(ring.buf)
+	if len(p) > size {
+		p = p[len(p)-size:]
+		ring.dropped = true
+	}
+	// fill before wrapping around
+	if free := size - len(ring.buf); free > 0 {
+		fill := min(free, len(p))
+		ring.buf = append(ring.buf, p[:fill]...)
+		p = p[fill:]
+	}
+	for len(p) > 0 {
+		ring.dropped = true
+		written := copy(ring.buf[ring.start:], p)
+		ring.start = (ring.start + written) % size
+		p = p[written:]
+	}
+	return n, nil
+}
+
+// The bytes kept, oldest first.
+func (ring *ringBuffer) String() string {
+	return string(ring.buf[ring.start:]) + string(ring.buf[:ring.start])
+}
+
+// Error of a failed command, with the end of its stderr.
+type Error struct {
+	Err error
+	// the last Exec.StderrBytes of stderr, or of combined output for CombinedOutput
+	Stderr string
+	// earlier stderr was dropped to bound Stderr
+	Truncated bool
+}
+
+func (ring *ringBuffer) error(err error) error {
+	return &Error{Err: err, Stderr: ring.String(), Truncated: ring.dropped}
+}
+
+// The end of the stderr of the first failed command in `err`'s chain, if any.
+func Stderr(err error) string {
+	var runErr *Error
+	if errors.As(err, &runErr) {
+		return runErr.Stderr
+	}
+	return ""
+}
+
+func (err *Error) Error() string {
+	return err.Err.Error()
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+/*
+Absolute paths of executables by name, run by Exec instead of looking them up
+in PATH, set from config. Static builds can run without a PATH providing nix
+and friends, e.g. as systemd portable services.
+*/
+var Paths = map[string]string{}
+
+// Resolves the executable Exec runs for `name`, from Paths or PATH.
+func LookPath(name string) (string, error) {
+	if path, ok := Paths[name]; ok {
+		name = path
+	}
+	return exec.LookPath(name)
+}
+
+// Runs commands with os/exec.
+type Exec struct {
+	/*
+		Kills commands, and any processes they started, after producing no
+		output on stdout or stderr for this long. 0 disables the watchdog.
+	*/
+	StallTimeout time.Duration
+	/*
+		Kills commands along with any processes they started when their
+		context is done, rather than only the command. Implied by StallTimeout.
+	*/
+	KillGroup bool
+	// bytes of stderr kept for Error, 0 keeps 4 KiB
+	StderrBytes int
+}
+
+func (Exec) command(ctx context.Context, cmd Cmd) *exec.Cmd {
+	name := cmd.Name
+	if path, ok := Paths[name]; ok {
+		name = path
+	}
+	cmd = limit(ctx, cmd, name)
+	c := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	if len(cmd.Env) > 0 {
+		c.Env = append(os.Environ(), cmd.Env...)
+	}
+	if cmd.Stdin != nil {
+		c.Stdin = bytes.NewReader(cmd.Stdin)
+	}
+	return c
+}
+
+// Runs `cmd` to completion, writing its output to `stdout` and `stderr`.
+func (e Exec) run(ctx context.Context, cmd Cmd, stdout io.Writer, stderr io.Writer) error {
+	if e.StallTimeout <= 0 {
+		c := e.command(ctx, cmd)
+		c.Stdout = stdout
+		c.Stderr = stderr
+		if e.KillGroup {
+			killGroup(c)
+		}
+		return c.Run()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := e.command(ctx, cmd)
+	dog := &watchdog{last: time.Now()}
+	c.Stdout = dog.wrap(stdout)
+	c.Stderr = dog.wrap(stderr)
+	killGroup(c)
+
+	go dog.watch(ctx, e.StallTimeout, cancel)
+	err := c.Run()
+	if dog.stalled() {
+		return fmt.Errorf("%s: no output for %s: %w", cmd.Name, e.StallTimeout, ErrStalled)
+	}
+	return err
+}
+
+func (e Exec) Run(ctx context.Context, cmd Cmd) error {
+	stderr := newRingBuffer(e.StderrBytes)
+	err := e.run(ctx, cmd, os.Stdout, io.MultiWriter(os.Stderr, stderr))
+	if err != nil {
+		err = stderr.error(err)
+	}
+	return err
+}
+
+func (e Exec) Output(ctx context.Context, cmd Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	stderr := newRingBuffer(e.StderrBytes)
+	err := e.run(ctx, cmd, &stdout, io.MultiWriter(os.Stderr, stderr))
+	if err != nil {
+		err = stderr.error(err)
+	}
+	return stdout.Bytes(), err
+}
+
+func (e Exec) CombinedOutput(ctx context.Context, cmd Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	tail := newRingBuffer(e.StderrBytes)
+	// one writer, so os/exec shares a pipe for stdout and stderr
+	combined := io.MultiWriter(&output, tail)
+	err := e.run(ctx, cmd, combined, combined)
+	if err != nil {
+		err = tail.error(err)
+	}
+	return output.Bytes(), err
+}
+
+func (e Exec) Start(ctx context.Context, cmd Cmd) (func() error, error) {
+	cmd.Stdin = nil
+	c := e.command(ctx, cmd)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = c.Start()
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		stdin.Close()
+		return c.Wait()
+	}, nil
+}
+
+// Kills the whole process group of `c` when its context is done, nixos-rebuild does its work in children.
+func killGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	// don't wait on output pipes held open by orphaned children
+	c.WaitDelay = 10 * time.Second
+}
+
+// Tracks when a command last produced output.
+type watchdog struct {
+	mu      sync.Mutex
+	last    time.Time
+	expired bool
+}
+
+/*
+Records writes through `w` as activity. Wrapping the same writer twice
+yields equal writers, so os/exec still shares one pipe for both.
+*/
+func (dog *watchdog) wrap(w io.Writer) io.Writer {
+	return activityWriter{dog: dog, w: w}
+}
+
+// Calls `kill` once there's been no output for `timeout`, until `ctx` is done.
+func (dog *watchdog) watch(ctx context.Context, timeout time.Duration, kill func()) {
+	ticker := time.NewTicker(min(timeout/10+time.Millisecond, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dog.mu.Lock()
+			expired := time.Since(dog.last) > timeout
+			dog.expired = expired
+			dog.mu.Unlock()
+			if expired {
+				kill()
+				return
+			}
+		}
+	}
+}
+
+func (dog *watchdog) stalled() bool {
+	dog.mu.Lock()
+	defer dog.mu.Unlock()
+	return dog.expired
+}
+
+type activityWriter struct {
+	dog *watchdog
+	w   io.Writer
+}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	w.dog.mu.Lock()
+	w.dog.last = time.Now()
+	w.dog.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// Records commands instead of running them, for tests.
+type Fake struct {
+	// command lines run, see Cmd.String, wrapped in systemd-run when limited
+	Ran []string
+	// output by command line, other commands output nothing
+	Outputs map[string]string
+	// errors by command line, other commands succeed
+	Errors map[string]error
+	// command lines started and then stopped, see Runner.Start
+	Stopped []string
+}
+
+func (fake *Fake) run(ctx context.Context, cmd Cmd) ([]byte, error) {
+	line := limit(ctx, cmd, cmd.Name).String()
+	fake.Ran = append(fake.Ran, line)
+	return []byte(fake.Outputs[line]), fake.Errors[line]
+}
+
+func (fake *Fake) Run(ctx context.Context, cmd Cmd) error {
+	_, err := fake.run(ctx, cmd)
+	return err
+}
+
+func (fake *Fake) Output(ctx context.Context, cmd Cmd) ([]byte, error) {
+	return fake.run(ctx, cmd)
+}
+
+func (fake *Fake) CombinedOutput(ctx context.Context, cmd Cmd) ([]byte, error) {
+	return fake.run(ctx, cmd)
+}
+
+func (fake *Fake) Start(ctx context.Context, cmd Cmd) (func() error, error) {
+	_, err := fake.run(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	line := fake.Ran[len(fake.Ran)-1]
+	return func() error {
+		fake.Stopped = append(fake.Stopped, line)
+		return nil
+	}, nil
+}
@@ -0,0 +1,142 @@
+package runner_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+func TestExec(t *testing.T) {
+	output, err := runner.Exec{}.Output(context.Background(), runner.Cmd{
+		Name: "sh",
+		Args: []string{"-c", "echo $GREETING"},
+		Env:  []string{"GREETING=hello"},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, string(output), "hello\n")
+}
+
+func TestExecPaths(t *testing.T) {
+	t.Cleanup(func() { runner.Paths = map[string]string{} })
+	runner.Paths = map[string]string{"shell": "/bin/sh"}
+	output, err := runner.Exec{}.Output(context.Background(), runner.Command("shell", "-c", "echo hello"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, string(output), "hello\n")
+
+	path, err := runner.LookPath("shell")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assert.Equal(t, path, "/bin/sh")
+	_, err = runner.LookPath("nixos-hydra-upgrade-missing")
+	assert.Equal(t, err != nil, true)
+}
+
+func TestExecStderr(t *testing.T) {
+	t.Run("keeps the end of stderr", func(t *testing.T) {
+		_, err := runner.Exec{StderrBytes: 8}.Output(context.Background(),
+			runner.Command("sh", "-c", "printf 'early\\n' >&2; printf 'failed\\n' >&2; exit 1"))
+		var runErr *runner.Error
+		if !errors.As(err, &runErr) {
+			t.Fatalf("expected runner error, got: %v", err)
+		}
+		assert.Equal(t, runErr.Stderr, "\nfailed\n")
+		assert.Equal(t, runErr.Truncated, true)
+		assert.Equal(t, runner.Stderr(fmt.Errorf("wrapped: %w", err)), "\nfailed\n")
+	})
+
+	t.Run("keeps combined output", func(t *testing.T) {
+		_, err := runner.Exec{}.CombinedOutput(context.Background(),
+			runner.Command("sh", "-c", "echo out; echo err >&2; exit 1"))
+		assert.Equal(t, runner.Stderr(err), "out\nerr\n")
+	})
+}
+
+func TestExecStallTimeout(t *testing.T) {
+	t.Run("kills stalled commands", func(t *testing.T) {
+		started := time.Now()
+		_, err := runner.Exec{StallTimeout: 100 * time.Millisecond}.Output(context.Background(),
+			runner.Command("sh", "-c", "echo started; sleep 10; echo done"))
+		if !errors.Is(err, runner.ErrStalled) {
+			t.Errorf("expected stalled error, got: %v", err)
+		}
+		if time.Since(started) > 5*time.Second {
+			t.Errorf("stalled command ran for %s", time.Since(started))
+		}
+	})
+
+	t.Run("keeps commands producing output", func(t *testing.T) {
+		output, err := runner.Exec{StallTimeout: 500 * time.Millisecond}.CombinedOutput(context.Background(),
+			runner.Command("sh", "-c", "for i in 1 2 3; do echo $i; sleep 0.2; done"))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, string(output), "1\n2\n3\n")
+	})
+}
+
+func TestExecKillGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	// sh's child holds the output pipe open after sh is killed
+	_, err := runner.Exec{KillGroup: true}.CombinedOutput(ctx, runner.Command("sh", "-c", "sleep 5; true"))
+	assert.Equal(t, err != nil, true)
+	if time.Since(started) > 2*time.Second {
+		t.Errorf("timed out command ran for %s", time.Since(started))
+	}
+}
+
+func TestExecStart(t *testing.T) {
+	started := time.Now()
+	stop, err := runner.Exec{}.Start(context.Background(), runner.Command("cat"))
+	assert.Equal(t, err, nil)
+	// cat exits once stdin closes
+	assert.Equal(t, stop(), nil)
+	if time.Since(started) > 2*time.Second {
+		t.Errorf("stopped command ran for %s", time.Since(started))
+	}
+
+	_, err = runner.Exec{}.Start(context.Background(), runner.Command("/nonexistent"))
+	assert.Equal(t, err != nil, true)
+}
+
+func TestFake(t *testing.T) {
+	failed := errors.New("exit status 1")
+	fake := &runner.Fake{
+		Outputs: map[string]string{"echo hello": "hello\n"},
+		Errors:  map[string]error{"false": failed},
+	}
+
+	output, err := fake.Output(context.Background(), runner.Command("echo", "hello"))
+	assert.Equal(t, string(output), "hello\n")
+	assert.Equal(t, err, nil)
+	err = fake.Run(context.Background(), runner.Command("false"))
+	assert.Equal(t, err, failed)
+	assert.ArrayEqual(t, fake.Ran, []string{"echo hello", "false"})
+}
+
+func TestLimits(t *testing.T) {
+	fake := &runner.Fake{}
+
+	t.Run("runs limited commands in a systemd scope", func(t *testing.T) {
+		ctx := runner.WithLimits(context.Background(), runner.Limits{Nice: 10, IOWeight: 20, MemoryMax: "4G"})
+		fake.Run(ctx, runner.Command("nix", "build", "--no-link"))
+		assert.Equal(t, fake.Ran[len(fake.Ran)-1], "systemd-run --scope --quiet --collect --nice=10 -p IOWeight=20 -p MemoryMax=4G -- nix build --no-link")
+	})
+
+	t.Run("leaves unlimited commands alone", func(t *testing.T) {
+		ctx := runner.WithLimits(context.Background(), runner.Limits{})
+		fake.Run(ctx, runner.Command("nix", "build"))
+		assert.Equal(t, fake.Ran[len(fake.Ran)-1], "nix build")
+	})
+}
@@ -0,0 +1,279 @@
+/*
+Package sbom renders software bills of materials of NixOS system closures,
+as SPDX or CycloneDX JSON.
+*/
+package sbom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Supported document formats.
+const (
+	FormatSPDX      = "spdx"
+	FormatCycloneDX = "cyclonedx"
+)
+
+// A store path of the closure.
+type Component struct {
+	Name    string
+	Version string
+	Path    string
+	// spdx license ids or LicenseRef-<name>, empty when unknown
+	Licenses []string
+}
+
+// A system closure, described by its toplevel.
+type Document struct {
+	// e.g. the hydra build and host
+	Name       string
+	Toplevel   string
+	Components []Component
+	Created    time.Time
+}
+
+/*
+Splits a store path's name into the package name and version, like
+builtins.parseDrvName: the version starts at the first dash followed by a
+digit, e.g. /nix/store/<hash>-openssl-3.0.13 is openssl and 3.0.13.
+*/
+func ParseName(path string) (string, string) {
+	name := filepath.Base(path)
+	// strip the 32 character hash
+	if len(name) > 33 && name[32] == '-' {
+		name = name[33:]
+	}
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '-' && name[i+1] >= '0' && name[i+1] <= '9' {
+			return name[:i], name[i+1:]
+		}
+	}
+	return name, ""
+}
+
+// Extension of files in `format`, e.g. spdx.json.
+func Extension(format string) string {
+	if format == FormatCycloneDX {
+		return "cdx.json"
+	}
+	return "spdx.json"
+}
+
+// Renders `doc` in `format`, spdx or cyclonedx.
+func Render(format string, doc Document) ([]byte, error) {
+	switch format {
+	case FormatSPDX:
+		return json.MarshalIndent(spdx(doc), "", "  ")
+	case FormatCycloneDX:
+		return json.MarshalIndent(cycloneDX(doc), "", "  ")
+	default:
+		return nil, fmt.Errorf("unknown sbom format %q", format)
+	}
+}
+
+// Atomically writes `doc` rendered in `format` to `path`, readable by everyone.
+func Write(path string, format string, doc Document) error {
+	data, err := Render(format, doc)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sbom-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var idUnsafe = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// An SPDX identifier for the store path, unique by its hash.
+func spdxID(path string) string {
+	return "SPDXRef-" + idUnsafe.ReplaceAllString(filepath.Base(path), "-")
+}
+
+// Joins licenses into an SPDX expression, NOASSERTION when unknown.
+func licenseExpression(licenses []string) string {
+	if len(licenses) == 0 {
+		return "NOASSERTION"
+	}
+	ids := make([]string, len(licenses))
+	for i, license := range licenses {
+		ref, isRef := strings.CutPrefix(license, "LicenseRef-")
+		if isRef {
+			license = "LicenseRef-" + idUnsafe.ReplaceAllString(ref, "-")
+		}
+		ids[i] = license
+	}
+	return strings.Join(ids, " AND ")
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string `json:"SPDXID"`
+	Name             string `json:"name"`
+	VersionInfo      string `json:"versionInfo,omitempty"`
+	PackageFileName  string `json:"packageFileName"`
+	DownloadLocation string `json:"downloadLocation"`
+	FilesAnalyzed    bool   `json:"filesAnalyzed"`
+	LicenseConcluded string `json:"licenseConcluded"`
+	LicenseDeclared  string `json:"licenseDeclared"`
+	CopyrightText    string `json:"copyrightText"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+// SPDX 2.3, the document describes the toplevel, which contains the closure.
+func spdx(doc Document) spdxDocument {
+	sum := sha256.Sum256([]byte(doc.Toplevel))
+	out := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              doc.Name,
+		DocumentNamespace: "https://github.com/hyperparabolic/nixos-hydra-upgrade/spdx/" + hex.EncodeToString(sum[:]),
+		CreationInfo: spdxCreationInfo{
+			Created:  doc.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: nixos-hydra-upgrade"},
+		},
+		Packages:      []spdxPackage{},
+		Relationships: []spdxRelationship{},
+	}
+	for _, component := range doc.Components {
+		out.Packages = append(out.Packages, spdxPackage{
+			SPDXID:           spdxID(component.Path),
+			Name:             component.Name,
+			VersionInfo:      component.Version,
+			PackageFileName:  component.Path,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  licenseExpression(component.Licenses),
+			CopyrightText:    "NOASSERTION",
+		})
+		relationship := spdxRelationship{Element: spdxID(doc.Toplevel), Type: "CONTAINS", Related: spdxID(component.Path)}
+		if component.Path == doc.Toplevel {
+			relationship = spdxRelationship{Element: "SPDXRef-DOCUMENT", Type: "DESCRIBES", Related: spdxID(component.Path)}
+		}
+		out.Relationships = append(out.Relationships, relationship)
+	}
+	return out
+}
+
+type cdxDocument struct {
+	BOMFormat   string         `json:"bomFormat"`
+	SpecVersion string         `json:"specVersion"`
+	Version     int            `json:"version"`
+	Metadata    cdxMetadata    `json:"metadata"`
+	Components  []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type     string       `json:"type"`
+	BOMRef   string       `json:"bom-ref,omitempty"`
+	Name     string       `json:"name"`
+	Version  string       `json:"version,omitempty"`
+	Licenses []cdxLicense `json:"licenses,omitempty"`
+}
+
+type cdxLicense struct {
+	License cdxLicenseID `json:"license"`
+}
+
+type cdxLicenseID struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// CycloneDX 1.5, the metadata component is the toplevel.
+func cycloneDX(doc Document) cdxDocument {
+	out := cdxDocument{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: cdxMetadata{
+			Timestamp: doc.Created.UTC().Format(time.RFC3339),
+			Tools: cdxTools{Components: []cdxComponent{
+				{Type: "application", Name: "nixos-hydra-upgrade"},
+			}},
+			Component: cdxComponent{Type: "operating-system", BOMRef: doc.Toplevel, Name: doc.Name},
+		},
+		Components: []cdxComponent{},
+	}
+	for _, component := range doc.Components {
+		if component.Path == doc.Toplevel {
+			continue
+		}
+		licenses := []cdxLicense{}
+		for _, license := range component.Licenses {
+			name, isRef := strings.CutPrefix(license, "LicenseRef-")
+			if isRef {
+				licenses = append(licenses, cdxLicense{License: cdxLicenseID{Name: name}})
+			} else {
+				licenses = append(licenses, cdxLicense{License: cdxLicenseID{ID: license}})
+			}
+		}
+		out.Components = append(out.Components, cdxComponent{
+			Type:     "library",
+			BOMRef:   component.Path,
+			Name:     component.Name,
+			Version:  component.Version,
+			Licenses: licenses,
+		})
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package sbom_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/sbom"
+)
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		path, name, version string
+	}{
+		{"/nix/store/0123456789abcdfghijklmnpqrsvwxyz-openssl-3.0.13", "openssl", "3.0.13"},
+		{"/nix/store/0123456789abcdfghijklmnpqrsvwxyz-python3.11-requests-2.31.0", "python3.11-requests", "2.31.0"},
+		{"/nix/store/0123456789abcdfghijklmnpqrsvwxyz-etc", "etc", ""},
+	}
+	for _, test := range tests {
+		name, version := sbom.ParseName(test.path)
+		assert.Equal(t, name, test.name)
+		assert.Equal(t, version, test.version)
+	}
+}
+
+func TestRender(t *testing.T) {
+	doc := sbom.Document{
+		Name:     "build 1234",
+		Toplevel: "/nix/store/aaaa-nixos-system-oak-24.05",
+		Components: []sbom.Component{
+			{Name: "nixos-system-oak", Version: "24.05", Path: "/nix/store/aaaa-nixos-system-oak-24.05"},
+			{Name: "openssl", Version: "3.0.13", Path: "/nix/store/bbbb-openssl-3.0.13", Licenses: []string{"Apache-2.0", "LicenseRef-unfree redist"}},
+		},
+		Created: time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+	}
+
+	t.Run("spdx", func(t *testing.T) {
+		data, err := sbom.Render(sbom.FormatSPDX, doc)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		var out struct {
+			Packages []struct {
+				SPDXID          string
+				LicenseDeclared string
+			}
+			Relationships []struct {
+				RelationshipType string
+			}
+		}
+		json.Unmarshal(data, &out)
+		assert.Equal(t, out.Packages[1].SPDXID, "SPDXRef-bbbb-openssl-3.0.13")
+		assert.Equal(t, out.Packages[1].LicenseDeclared, "Apache-2.0 AND LicenseRef-unfree-redist")
+		assert.Equal(t, out.Packages[0].LicenseDeclared, "NOASSERTION")
+		assert.Equal(t, out.Relationships[0].RelationshipType, "DESCRIBES")
+		assert.Equal(t, out.Relationships[1].RelationshipType, "CONTAINS")
+	})
+
+	t.Run("cyclonedx", func(t *testing.T) {
+		data, err := sbom.Render(sbom.FormatCycloneDX, doc)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		var out struct {
+			Components []struct {
+				Name     string
+				Licenses []struct {
+					License struct{ ID, Name string }
+				}
+			}
+		}
+		json.Unmarshal(data, &out)
+		assert.Equal(t, len(out.Components), 1)
+		assert.Equal(t, out.Components[0].Name, "openssl")
+		assert.Equal(t, out.Components[0].Licenses[0].License.ID, "Apache-2.0")
+		assert.Equal(t, out.Components[0].Licenses[1].License.Name, "unfree redist")
+	})
+}
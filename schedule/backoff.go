@@ -0,0 +1,61 @@
+package schedule
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+)
+
+// Failed runs in a row with the same outcome, backing off scheduled runs.
+type Backoff struct {
+	// time between runs, doubled for each failure in a row past the first
+	Interval time.Duration
+	// longest delay, 0 disables backing off
+	Max time.Duration
+
+	mu       sync.Mutex
+	outcome  upgrade.Outcome
+	failures int
+}
+
+// Records the outcome of a finished run.
+func (b *Backoff) Record(outcome upgrade.Outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !outcome.Failed():
+		b.outcome, b.failures = "", 0
+	case outcome == b.outcome:
+		b.failures++
+	default:
+		b.outcome, b.failures = outcome, 1
+	}
+}
+
+// The outcome of the failed runs in a row, and how many failed.
+func (b *Backoff) Previous() (upgrade.Outcome, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.outcome, b.failures
+}
+
+/*
+How long the next run waits after the last one, doubling Interval for each
+failure in a row past the first, up to Max. 0 unless runs are failing the
+same way repeatedly.
+*/
+func (b *Backoff) Delay() time.Duration {
+	_, failures := b.Previous()
+	if failures < 2 || b.Max == 0 {
+		return 0
+	}
+	delay := b.Interval
+	for range failures - 1 {
+		delay *= 2
+		if delay >= b.Max {
+			return b.Max
+		}
+	}
+	return delay
+}
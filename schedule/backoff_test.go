@@ -0,0 +1,54 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/schedule"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      time.Duration
+		outcomes []upgrade.Outcome
+		outcome  upgrade.Outcome
+		failures int
+		delay    time.Duration
+	}{
+		{"no runs", 4 * time.Hour, nil, "", 0, 0},
+		{"first failure", 4 * time.Hour, []upgrade.Outcome{upgrade.OutcomeFetchFailed}, upgrade.OutcomeFetchFailed, 1, 0},
+		{"doubles for each failure in a row", 4 * time.Hour, []upgrade.Outcome{
+			upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed,
+		}, upgrade.OutcomeFetchFailed, 3, 4 * time.Hour},
+		{"second failure doubles once", 4 * time.Hour, []upgrade.Outcome{
+			upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed,
+		}, upgrade.OutcomeFetchFailed, 2, 2 * time.Hour},
+		{"capped at the maximum", 3 * time.Hour, []upgrade.Outcome{
+			upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed,
+		}, upgrade.OutcomeFetchFailed, 4, 3 * time.Hour},
+		{"disabled without a maximum", 0, []upgrade.Outcome{
+			upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed,
+		}, upgrade.OutcomeFetchFailed, 3, 0},
+		{"reset on success", 4 * time.Hour, []upgrade.Outcome{
+			upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed, upgrade.OutcomeSuccess,
+		}, "", 0, 0},
+		{"reset on a different outcome", 4 * time.Hour, []upgrade.Outcome{
+			upgrade.OutcomeFetchFailed, upgrade.OutcomeFetchFailed, upgrade.OutcomeRebuildFailed,
+		}, upgrade.OutcomeRebuildFailed, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backoff := &schedule.Backoff{Interval: time.Hour, Max: test.max}
+			for _, outcome := range test.outcomes {
+				backoff.Record(outcome)
+			}
+			outcome, failures := backoff.Previous()
+			assert.Equal(t, outcome, test.outcome)
+			assert.Equal(t, failures, test.failures)
+			assert.Equal(t, backoff.Delay(), test.delay)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Package schedule parses cron expressions for daemon mode, spreads the runs
+of a fleet, and backs off runs that keep failing.
+
+Expressions have the usual five fields, minute hour day-of-month month
+day-of-week, each a `*`, a value, a range `a-b`, or a comma separated list
+of them, optionally with a step like `0-59/15` or `1-5/2`. Months and weekdays
+may be given by their three letter English names, and Sunday is 0 or 7.
+When both day fields are restricted, either matching is enough, as in
+Vixie cron. @hourly, @daily, @weekly, @monthly, and @yearly are shorthands.
+*/
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A parsed cron expression, evaluated in a time zone.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	// whether the day fields are restricted, for Vixie cron day matching
+	domAny, dowAny bool
+	location       *time.Location
+}
+
+type field struct {
+	min, max int
+	names    []string
+}
+
+var (
+	minutes = field{min: 0, max: 59}
+	hours   = field{min: 0, max: 23}
+	doms    = field{min: 1, max: 31}
+	months  = field{min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	// 7 is folded into 0, both are sunday
+	dows = field{min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parses a cron expression evaluated in `location`, nil for local time.
+func Parse(expr string, location *time.Location) (Cron, error) {
+	if location == nil {
+		location = time.Local
+	}
+	spec := strings.TrimSpace(expr)
+	if shorthand, ok := shorthands[strings.ToLower(spec)]; ok {
+		spec = shorthand
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return Cron{}, fmt.Errorf("invalid cron expression %q, expected 5 fields", expr)
+	}
+
+	cron := Cron{location: location}
+	var err error
+	for i, parse := range []struct {
+		bits  *uint64
+		field field
+	}{
+		{&cron.minute, minutes},
+		{&cron.hour, hours},
+		{&cron.dom, doms},
+		{&cron.month, months},
+		{&cron.dow, dows},
+	} {
+		*parse.bits, err = parseField(fields[i], parse.field)
+		if err != nil {
+			return Cron{}, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+	}
+	if cron.dow&(1<<7) != 0 {
+		cron.dow |= 1
+	}
+	cron.domAny = fields[2] == "*"
+	cron.dowAny = fields[4] == "*"
+	return cron, nil
+}
+
+// Parses a comma separated field into a bit set of its values.
+func parseField(spec string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(spec, ",") {
+		rangeSpec, stepSpec, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			var err error
+			step, err = strconv.Atoi(stepSpec)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+		}
+
+		low, high := f.min, f.max
+		if rangeSpec != "*" {
+			lowSpec, highSpec, ranged := strings.Cut(rangeSpec, "-")
+			var err error
+			low, err = f.value(lowSpec)
+			if err != nil {
+				return 0, err
+			}
+			high = low
+			if ranged {
+				high, err = f.value(highSpec)
+				if err != nil {
+					return 0, err
+				}
+			} else if stepped {
+				// `a/n` starts at a and runs to the end of the field
+				high = f.max
+			}
+		}
+		if low > high {
+			return 0, fmt.Errorf("invalid range %q", part)
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// Parses a number or name within the field's bounds.
+func (f field) value(spec string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(spec, name) {
+			return i + f.min, nil
+		}
+	}
+	value, err := strconv.Atoi(spec)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("invalid value %q, expected %d-%d", spec, f.min, f.max)
+	}
+	return value, nil
+}
+
+func (cron Cron) dayMatches(t time.Time) bool {
+	dom := cron.dom&(1<<t.Day()) != 0
+	dow := cron.dow&(1<<int(t.Weekday())) != 0
+	if cron.domAny || cron.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+/*
+The first time after `after` matching the expression, in the expression's
+time zone. Returns the zero time if nothing matches within five years, e.g.
+for February 30th.
+*/
+func (cron Cron) Next(after time.Time) time.Time {
+	t := after.In(cron.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if cron.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, cron.location)
+			continue
+		}
+		if !cron.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, cron.location)
+			continue
+		}
+		if cron.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, cron.location)
+			continue
+		}
+		if cron.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
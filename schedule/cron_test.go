@@ -0,0 +1,53 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/schedule"
+)
+
+func TestNext(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	// a monday
+	now := time.Date(2024, 5, 6, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		expr     string
+		location *time.Location
+		next     time.Time
+	}{
+		{"*/15 * * * *", time.UTC, time.Date(2024, 5, 6, 10, 15, 0, 0, time.UTC)},
+		{"0 3 * * *", time.UTC, time.Date(2024, 5, 7, 3, 0, 0, 0, time.UTC)},
+		{"@hourly", time.UTC, time.Date(2024, 5, 6, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * sat,sun", time.UTC, time.Date(2024, 5, 11, 2, 30, 0, 0, time.UTC)},
+		{"0 4 * * 7", time.UTC, time.Date(2024, 5, 12, 4, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan-mar *", time.UTC, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 12 15 * fri", time.UTC, time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", helsinki, time.Date(2024, 5, 7, 3, 0, 0, 0, helsinki)},
+		{"0 0 30 2 *", time.UTC, time.Time{}},
+	}
+	for _, test := range tests {
+		cron, err := schedule.Parse(test.expr, test.location)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.expr, err)
+			continue
+		}
+		next := cron.Next(now)
+		if !next.Equal(test.next) {
+			t.Errorf("%q: expected %v, got %v", test.expr, test.next, next)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		_, err := schedule.Parse(expr, time.UTC)
+		assert.Equal(t, err != nil, true)
+	}
+}
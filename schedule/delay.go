@@ -0,0 +1,31 @@
+package schedule
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand/v2"
+	"time"
+)
+
+/*
+Returns a delay in [0, window) that's stable for `host`, so a fleet of hosts
+with identical timers spreads its runs evenly over `window`.
+*/
+func HostDelay(host string, window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	sum := sha256.Sum256([]byte(host))
+	return time.Duration(binary.BigEndian.Uint64(sum[:8]) % uint64(window))
+}
+
+/*
+Returns a random delay in [0, window), drawn again every call, so runs on an
+interval don't line up with other hosts or with periodic load upstream.
+*/
+func Jitter(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	return rand.N(window)
+}
@@ -0,0 +1,38 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/schedule"
+)
+
+func TestHostDelay(t *testing.T) {
+	t.Run("is stable per host", func(t *testing.T) {
+		delay := schedule.HostDelay("host-a", time.Hour)
+		assert.Equal(t, schedule.HostDelay("host-a", time.Hour), delay)
+		assert.Equal(t, delay >= 0 && delay < time.Hour, true)
+	})
+
+	t.Run("spreads hosts", func(t *testing.T) {
+		assert.Equal(t, schedule.HostDelay("host-a", time.Hour) != schedule.HostDelay("host-b", time.Hour), true)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Equal(t, schedule.HostDelay("host-a", 0), 0)
+	})
+}
+
+func TestJitter(t *testing.T) {
+	t.Run("stays in the window", func(t *testing.T) {
+		for range 100 {
+			jitter := schedule.Jitter(time.Minute)
+			assert.Equal(t, jitter >= 0 && jitter < time.Minute, true)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Equal(t, schedule.Jitter(0), 0)
+	})
+}
@@ -0,0 +1,65 @@
+package snapshots
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+/*
+Directory within each subvolume holding its upgrade snapshots, apart from
+snapper's .snapshots.
+*/
+const btrfsSnapshotDir = ".nixos-hydra-upgrade"
+
+// Btrfs subvolumes snapshotted before upgrades.
+type Btrfs struct {
+	Subvolumes []string
+}
+
+func btrfs(ctx context.Context, args ...string) error {
+	return Runner.Run(ctx, runner.Command("btrfs", args...))
+}
+
+// Takes a read-only snapshot of every subvolume as `<subvolume>/.nixos-hydra-upgrade/<name>`.
+func (b Btrfs) Snapshot(ctx context.Context, name string) error {
+	for _, subvolume := range b.Subvolumes {
+		dir := filepath.Join(subvolume, btrfsSnapshotDir)
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+		err = btrfs(ctx, "subvolume", "snapshot", "-r", subvolume, filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes upgrade snapshots of every subvolume beyond the `keep` most recent.
+func (b Btrfs) Prune(ctx context.Context, keep int) error {
+	for _, subvolume := range b.Subvolumes {
+		dir := filepath.Join(subvolume, btrfsSnapshotDir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		for _, name := range Expired(names, keep) {
+			path := filepath.Join(dir, name)
+			slog.Info("Deleting expired snapshot.", slog.String("snapshot", path))
+			err = btrfs(ctx, "subvolume", "delete", path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package snapshots_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/snapshots"
+)
+
+func TestBtrfs(t *testing.T) {
+	original := snapshots.Runner
+	t.Cleanup(func() { snapshots.Runner = original })
+	ctx := context.Background()
+	name := snapshots.Name(1234, time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC))
+
+	t.Run("snapshots every subvolume", func(t *testing.T) {
+		home, srv := t.TempDir(), t.TempDir()
+		fake := &runner.Fake{}
+		snapshots.Runner = fake
+		err := snapshots.Btrfs{Subvolumes: []string{home, srv}}.Snapshot(ctx, name)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{
+			"btrfs subvolume snapshot -r " + home + " " + filepath.Join(home, ".nixos-hydra-upgrade", name),
+			"btrfs subvolume snapshot -r " + srv + " " + filepath.Join(srv, ".nixos-hydra-upgrade", name),
+		})
+		_, err = os.Stat(filepath.Join(home, ".nixos-hydra-upgrade"))
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("stops when a snapshot fails", func(t *testing.T) {
+		home, srv := t.TempDir(), t.TempDir()
+		failed := "btrfs subvolume snapshot -r " + home + " " + filepath.Join(home, ".nixos-hydra-upgrade", name)
+		fake := &runner.Fake{Errors: map[string]error{failed: errors.New("exit status 1")}}
+		snapshots.Runner = fake
+		err := snapshots.Btrfs{Subvolumes: []string{home, srv}}.Snapshot(ctx, name)
+		assert.Equal(t, err != nil, true)
+		assert.ArrayEqual(t, fake.Ran, []string{failed})
+	})
+
+	t.Run("prunes expired upgrade snapshots", func(t *testing.T) {
+		home := t.TempDir()
+		dir := filepath.Join(home, ".nixos-hydra-upgrade")
+		day := func(d int) string {
+			return snapshots.Name(100+d, time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC))
+		}
+		for _, entry := range []string{day(1), day(2), day(3), "manual"} {
+			err := os.MkdirAll(filepath.Join(dir, entry), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		fake := &runner.Fake{}
+		snapshots.Runner = fake
+		err := snapshots.Btrfs{Subvolumes: []string{home}}.Prune(ctx, 2)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{"btrfs subvolume delete " + filepath.Join(dir, day(1))})
+	})
+
+	t.Run("fails to prune without snapshots", func(t *testing.T) {
+		fake := &runner.Fake{}
+		snapshots.Runner = fake
+		err := snapshots.Btrfs{Subvolumes: []string{t.TempDir()}}.Prune(ctx, 2)
+		assert.Equal(t, errors.Is(err, os.ErrNotExist), true)
+		assert.Equal(t, len(fake.Ran), 0)
+	})
+}
@@ -0,0 +1,73 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Prefix of snapshots created by nixos-hydra-upgrade. Only snapshots with
+// this prefix are ever pruned.
+const Prefix = "nixos-hydra-upgrade-"
+
+const timestampFormat = "20060102T150405Z"
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+// Storage snapshotted before upgrades, ZFS datasets or btrfs subvolumes.
+type Snapshotter interface {
+	// snapshots all configured storage as `name`
+	Snapshot(ctx context.Context, name string) error
+	// removes upgrade snapshots beyond the `keep` most recent
+	Prune(ctx context.Context, keep int) error
+}
+
+// Snapshot name for an upgrade to hydra build `buildID` taken at `now`.
+func Name(buildID int, now time.Time) string {
+	return fmt.Sprintf("%s%d-%s", Prefix, buildID, now.UTC().Format(timestampFormat))
+}
+
+func timestamp(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, Prefix) {
+		return time.Time{}, false
+	}
+	i := strings.LastIndex(name, "-")
+	t, err := time.Parse(timestampFormat, name[i+1:])
+	return t, err == nil
+}
+
+/*
+Returns the upgrade snapshots in `names` that fall outside the `keep` most
+recent. Names not created by nixos-hydra-upgrade are never returned, and
+`keep` <= 0 keeps every snapshot.
+*/
+func Expired(names []string, keep int) []string {
+	if keep <= 0 {
+		return []string{}
+	}
+	type snapshot struct {
+		name string
+		time time.Time
+	}
+	upgrades := []snapshot{}
+	for _, name := range names {
+		t, ok := timestamp(name)
+		if ok {
+			upgrades = append(upgrades, snapshot{name, t})
+		}
+	}
+	sort.Slice(upgrades, func(i, j int) bool {
+		return upgrades[i].time.After(upgrades[j].time)
+	})
+
+	expired := []string{}
+	for i := keep; i < len(upgrades); i++ {
+		expired = append(expired, upgrades[i].name)
+	}
+	return expired
+}
@@ -0,0 +1,33 @@
+package snapshots_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/snapshots"
+)
+
+func TestName(t *testing.T) {
+	name := snapshots.Name(1234, time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC))
+	assert.Equal(t, name, "nixos-hydra-upgrade-1234-20240506T070809Z")
+}
+
+func TestExpired(t *testing.T) {
+	day := func(d int) string {
+		return snapshots.Name(100+d, time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC))
+	}
+	names := []string{day(3), "manual", day(1), day(4), "zfs-auto-snap_daily-2024-05-01-00h00", day(2)}
+
+	t.Run("keeps the most recent upgrade snapshots", func(t *testing.T) {
+		assert.ArrayEqual(t, snapshots.Expired(names, 2), []string{day(2), day(1)})
+	})
+
+	t.Run("keeps everything when keep is unset", func(t *testing.T) {
+		assert.ArrayEqual(t, snapshots.Expired(names, 0), []string{})
+	})
+
+	t.Run("keeps everything within the limit", func(t *testing.T) {
+		assert.ArrayEqual(t, snapshots.Expired(names, 10), []string{})
+	})
+}
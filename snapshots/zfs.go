@@ -0,0 +1,48 @@
+package snapshots
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// ZFS datasets snapshotted before upgrades.
+type ZFS struct {
+	Datasets []string
+}
+
+// Atomically snapshots every dataset as `name`.
+func (zfs ZFS) Snapshot(ctx context.Context, name string) error {
+	args := []string{"snapshot"}
+	for _, dataset := range zfs.Datasets {
+		args = append(args, dataset+"@"+name)
+	}
+	return Runner.Run(ctx, runner.Command("zfs", args...))
+}
+
+// Destroys upgrade snapshots of every dataset beyond the `keep` most recent.
+func (zfs ZFS) Prune(ctx context.Context, keep int) error {
+	for _, dataset := range zfs.Datasets {
+		output, err := Runner.Output(ctx, runner.Command("zfs", "list", "-H", "-t", "snapshot", "-o", "name", "-d", "1", dataset))
+		if err != nil {
+			return err
+		}
+		names := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			_, name, ok := strings.Cut(line, "@")
+			if ok {
+				names = append(names, name)
+			}
+		}
+		for _, name := range Expired(names, keep) {
+			slog.Info("Destroying expired snapshot.", slog.String("snapshot", dataset+"@"+name))
+			err = Runner.Run(ctx, runner.Command("zfs", "destroy", dataset+"@"+name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
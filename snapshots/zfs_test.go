@@ -0,0 +1,67 @@
+package snapshots_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/snapshots"
+)
+
+func TestZFS(t *testing.T) {
+	original := snapshots.Runner
+	t.Cleanup(func() { snapshots.Runner = original })
+	ctx := context.Background()
+	name := snapshots.Name(1234, time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC))
+	zfs := snapshots.ZFS{Datasets: []string{"rpool/home", "rpool/srv"}}
+
+	t.Run("snapshots every dataset atomically", func(t *testing.T) {
+		fake := &runner.Fake{}
+		snapshots.Runner = fake
+		err := zfs.Snapshot(ctx, name)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{"zfs snapshot rpool/home@" + name + " rpool/srv@" + name})
+	})
+
+	t.Run("fails when the snapshot fails", func(t *testing.T) {
+		snapshots.Runner = &runner.Fake{Errors: map[string]error{
+			"zfs snapshot rpool/home@" + name + " rpool/srv@" + name: errors.New("exit status 1"),
+		}}
+		assert.Equal(t, zfs.Snapshot(ctx, name) != nil, true)
+	})
+
+	day := func(d int) string {
+		return snapshots.Name(100+d, time.Date(2024, 5, d, 0, 0, 0, 0, time.UTC))
+	}
+	listHome := "zfs list -H -t snapshot -o name -d 1 rpool/home"
+	listSrv := "zfs list -H -t snapshot -o name -d 1 rpool/srv"
+
+	t.Run("prunes expired upgrade snapshots", func(t *testing.T) {
+		fake := &runner.Fake{Outputs: map[string]string{
+			listHome: "rpool/home@" + day(1) + "\nrpool/home@zfs-auto-snap_daily-2024-05-01-00h00\nrpool/home@" + day(3) + "\nrpool/home@" + day(2) + "\n",
+			listSrv:  "rpool/srv@" + day(3) + "\n",
+		}}
+		snapshots.Runner = fake
+		err := zfs.Prune(ctx, 2)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{listHome, "zfs destroy rpool/home@" + day(1), listSrv})
+	})
+
+	t.Run("prunes nothing without snapshots", func(t *testing.T) {
+		fake := &runner.Fake{}
+		snapshots.Runner = fake
+		err := zfs.Prune(ctx, 2)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{listHome, listSrv})
+	})
+
+	t.Run("fails when listing snapshots fails", func(t *testing.T) {
+		fake := &runner.Fake{Errors: map[string]error{listHome: errors.New("dataset does not exist")}}
+		snapshots.Runner = fake
+		assert.Equal(t, zfs.Prune(ctx, 2) != nil, true)
+		assert.ArrayEqual(t, fake.Ran, []string{listHome})
+	})
+}
@@ -0,0 +1,75 @@
+package state
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Another process holds the lock of the state file, see Acquire.
+var ErrLocked = errors.New("state file locked by another run")
+
+/*
+An exclusive lock on a state file, held by the process running an upgrade
+so CLI and daemon runs can't interleave their saves. The kernel releases it
+however the holder exits.
+*/
+type Lock struct {
+	file *os.File
+	// pid left in the lock file by a holder that exited without unlocking, 0 if none
+	Stale int
+}
+
+/*
+Takes the lock of the state file at `path`, the file `path`.lock, failing
+with ErrLocked right away when another process holds it. The lock file is
+never removed, a process removing it could race one locking it.
+*/
+func Acquire(path string) (*Lock, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		file.Close()
+		return nil, ErrLocked
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	lock := &Lock{file: file}
+	contents, err := io.ReadAll(file)
+	if err == nil {
+		stale, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+		// re-exec keeps the pid, and releases the lock without crashing
+		if err == nil && stale != os.Getpid() {
+			lock.Stale = stale
+		}
+	}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Releases the lock, clearing the pid recorded in the lock file.
+func (lock *Lock) Unlock() error {
+	err := lock.file.Truncate(0)
+	return errors.Join(err, lock.file.Close())
+}
@@ -0,0 +1,274 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Upgrade phases, in order of completion.
+type Phase string
+
+const (
+	PhaseGated      Phase = "gated"
+	PhasePrefetched Phase = "prefetched"
+	PhaseProfileSet Phase = "profile-set"
+	PhaseActivated  Phase = "activated"
+	PhaseRebooted   Phase = "rebooted"
+)
+
+var phases = []Phase{PhaseGated, PhasePrefetched, PhaseProfileSet, PhaseActivated, PhaseRebooted}
+
+// Whether `phase` has completed `other`.
+func (phase Phase) Reached(other Phase) bool {
+	return slices.Index(phases, phase) >= slices.Index(phases, other)
+}
+
+// Progress of an upgrade, persisted so interrupted runs can resume.
+type Run struct {
+	BuildID   int    `json:"buildId"`
+	Flake     string `json:"flake"`
+	Operation string `json:"operation"`
+	// store path of the target system, set once prefetched
+	Toplevel string `json:"toplevel,omitempty"`
+	// bill of materials of the target system, set once prefetched
+	SBOM string `json:"sbom,omitempty"`
+	// system running before activation when it may be returned to, set once activated
+	Previous string    `json:"previous,omitempty"`
+	Phase    Phase     `json:"phase"`
+	Updated  time.Time `json:"updated"`
+	/*
+		process running the upgrade, 0 once it stopped to await a reboot,
+		approval, or a later run. See Crashed
+	*/
+	PID int `json:"pid,omitempty"`
+	// boot the process ran in, see Crashed
+	Boot string `json:"boot,omitempty"`
+	// start time of the process in clock ticks since boot, telling it from reused pids
+	Started int64 `json:"started,omitempty"`
+	// operator note on why the upgrade was triggered, see upgrade.Options.Annotation
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// Identifies the running boot, empty if unknown.
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+func bootID() string {
+	contents, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+// Start time of process `pid` in clock ticks since boot, 0 if it doesn't exist.
+func startTime(pid int) int64 {
+	contents, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// the command name in parentheses may contain spaces
+	end := strings.LastIndexByte(string(contents), ')')
+	if end < 0 {
+		return 0
+	}
+	// fields after the name start at the state, field 3, starttime is field 22
+	fields := strings.Fields(string(contents[end+1:]))
+	if len(fields) < 20 {
+		return 0
+	}
+	started, _ := strconv.ParseInt(fields[19], 10, 64)
+	return started
+}
+
+// Records this process as the one running the upgrade, see Crashed.
+func (run *Run) Own() {
+	run.PID = os.Getpid()
+	run.Boot = bootID()
+	run.Started = startTime(run.PID)
+}
+
+/*
+Whether the process running the upgrade exited without stopping it, e.g.
+it crashed, was killed mid-phase, or the system lost power. After a reboot,
+or once the pid is reused, the recorded pid may belong to an unrelated
+process, so the boot and process start time must match too.
+*/
+func (run Run) Crashed() bool {
+	if run.PID == 0 {
+		return false
+	}
+	if run.Boot != "" && run.Boot != bootID() {
+		return true
+	}
+	if run.Started != 0 {
+		return startTime(run.PID) != run.Started
+	}
+	if run.PID == os.Getpid() {
+		return false
+	}
+	err := syscall.Kill(run.PID, 0)
+	return errors.Is(err, syscall.ESRCH)
+}
+
+// An operator hold pausing upgrades.
+type Hold struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+/*
+Loads the hold from the hold file at `path`, nil when not held. The reason
+is the file's contents and the hold dates from when it was written. Holds
+are only kept in the hold file, so they never race runs saving state.
+*/
+func LoadHold(path string) (*Hold, error) {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Hold{Reason: strings.TrimSpace(string(contents)), Since: info.ModTime()}, nil
+}
+
+// An upgrade completed by rebooting into its system.
+type Completion struct {
+	BuildID   int       `json:"buildId"`
+	Flake     string    `json:"flake"`
+	Operation string    `json:"operation"`
+	Toplevel  string    `json:"toplevel"`
+	Completed time.Time `json:"completed"`
+	// see Run.Annotation
+	Annotation string `json:"annotation,omitempty"`
+}
+
+/*
+A build needing no upgrade, found up to date with the running system or
+applied to it. Runs finding the same build latest again can stop early.
+*/
+type Settled struct {
+	BuildID   int    `json:"buildId"`
+	Operation string `json:"operation"`
+	// system running when the build settled, any other means it changed since
+	System  string    `json:"system"`
+	Settled time.Time `json:"settled"`
+}
+
+// Completions kept in State.Completed.
+const CompletedLimit = 10
+
+type State struct {
+	// upgrade in progress, nil when no upgrade is in progress
+	Run *Run `json:"run,omitempty"`
+	// upgrades completed after rebooting, oldest first, at most CompletedLimit
+	Completed []Completion `json:"completed,omitempty"`
+	// latest build found needing no upgrade, nil when unknown
+	Settled *Settled `json:"settled,omitempty"`
+}
+
+// Records the run in progress as completed at `completed`, ending it.
+func (state *State) Complete(completed time.Time) {
+	if state.Run == nil {
+		return
+	}
+	state.Completed = append(state.Completed, Completion{
+		BuildID:    state.Run.BuildID,
+		Flake:      state.Run.Flake,
+		Operation:  state.Run.Operation,
+		Toplevel:   state.Run.Toplevel,
+		Completed:  completed,
+		Annotation: state.Run.Annotation,
+	})
+	state.Completed = state.Completed[max(len(state.Completed)-CompletedLimit, 0):]
+	state.Run = nil
+}
+
+// Loads state from `path`. A missing state file is an empty state.
+func Load(path string) (State, error) {
+	var state State
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(contents, &state)
+	return state, err
+}
+
+// Temporary files written by Save before renaming them into place.
+const tempPattern = ".state-*.json"
+
+/*
+Removes temporary files of saves to `path` last modified before `before`,
+left behind by processes that crashed while saving. Returns the removed
+files.
+*/
+func RemoveStaleTemp(path string, before time.Time) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(path), tempPattern))
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		err = os.Remove(match)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, match)
+	}
+	return removed, nil
+}
+
+// Atomically writes state to `path`.
+func (state State) Save(path string) error {
+	contents, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(contents)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,149 @@
+package state_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+)
+
+func TestPhaseReached(t *testing.T) {
+	assert.Equal(t, state.PhasePrefetched.Reached(state.PhaseGated), true)
+	assert.Equal(t, state.PhasePrefetched.Reached(state.PhasePrefetched), true)
+	assert.Equal(t, state.PhasePrefetched.Reached(state.PhaseActivated), false)
+	assert.Equal(t, state.Phase("").Reached(state.PhaseGated), false)
+}
+
+func TestLoadSave(t *testing.T) {
+	t.Run("missing state file is empty", func(t *testing.T) {
+		s, err := state.Load(filepath.Join(t.TempDir(), "state.json"))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if s.Run != nil {
+			t.Errorf("unexpected run: %+v", s.Run)
+		}
+	})
+
+	t.Run("round trips runs", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "nested", "state.json")
+		run := state.Run{
+			BuildID:   1234,
+			Flake:     "github:example/nix-config/abc123#host",
+			Operation: "switch",
+			Toplevel:  "/nix/store/abc-nixos-system-host",
+			Phase:     state.PhasePrefetched,
+			Updated:   time.Unix(1700000000, 0).UTC(),
+		}
+		err := state.State{Run: &run}.Save(path)
+		if err != nil {
+			panic(err)
+		}
+
+		s, err := state.Load(path)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, *s.Run, run)
+	})
+}
+
+func TestComplete(t *testing.T) {
+	s := state.State{}
+	for buildID := 1; buildID <= state.CompletedLimit+2; buildID++ {
+		s.Run = &state.Run{BuildID: buildID, Operation: "boot", Phase: state.PhaseRebooted}
+		s.Complete(time.Unix(1700000000, 0))
+	}
+	if s.Run != nil {
+		t.Errorf("unexpected run: %+v", s.Run)
+	}
+	assert.Equal(t, len(s.Completed), state.CompletedLimit)
+	assert.Equal(t, s.Completed[0].BuildID, 3)
+	assert.Equal(t, s.Completed[state.CompletedLimit-1].BuildID, state.CompletedLimit+2)
+}
+
+func TestCrashed(t *testing.T) {
+	assert.Equal(t, state.Run{}.Crashed(), false)
+	assert.Equal(t, state.Run{PID: os.Getpid()}.Crashed(), false)
+	// beyond the kernel's pid_max, never a running process
+	assert.Equal(t, state.Run{PID: 1 << 30}.Crashed(), true)
+
+	t.Run("checks the boot and start time of the process", func(t *testing.T) {
+		run := state.Run{}
+		run.Own()
+		assert.Equal(t, run.Crashed(), false)
+
+		rebooted := run
+		rebooted.Boot = "00000000-0000-0000-0000-000000000000"
+		assert.Equal(t, rebooted.Crashed(), true)
+
+		// an unrelated process reusing the pid
+		reused := run
+		reused.Started--
+		assert.Equal(t, reused.Crashed(), true)
+	})
+}
+
+func TestLoadHold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hold")
+	hold, err := state.LoadHold(path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hold == nil, true)
+
+	err = os.WriteFile(path, []byte("kernel regression\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	since := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, since, since)
+	hold, err = state.LoadHold(path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hold.Reason, "kernel regression")
+	assert.Equal(t, hold.Since.Equal(since), true)
+}
+
+func TestAcquire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	lock, err := state.Acquire(path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, lock.Stale, 0)
+	_, err = state.Acquire(path)
+	assert.Equal(t, err, state.ErrLocked)
+	assert.Equal(t, lock.Unlock(), nil)
+
+	t.Run("clears locks of crashed runs", func(t *testing.T) {
+		err := os.WriteFile(path+".lock", []byte("12345\n"), 0600)
+		if err != nil {
+			panic(err)
+		}
+		lock, err := state.Acquire(path)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, lock.Stale, 12345)
+		contents, _ := os.ReadFile(path + ".lock")
+		assert.Equal(t, string(contents), fmt.Sprintf("%d\n", os.Getpid()))
+		lock.Unlock()
+	})
+}
+
+func TestRemoveStaleTemp(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, ".state-1.json")
+	fresh := filepath.Join(dir, ".state-2.json")
+	for _, path := range []string{stale, fresh, filepath.Join(dir, "state.json")} {
+		err := os.WriteFile(path, []byte("{}"), 0600)
+		if err != nil {
+			panic(err)
+		}
+	}
+	os.Chtimes(stale, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+
+	removed, err := state.RemoveStaleTemp(filepath.Join(dir, "state.json"), time.Now().Add(-time.Minute))
+	assert.Equal(t, err, nil)
+	assert.ArrayEqual(t, removed, []string{stale})
+	entries, _ := os.ReadDir(dir)
+	assert.Equal(t, len(entries), 2)
+}
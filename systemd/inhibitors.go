@@ -0,0 +1,101 @@
+package systemd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// A systemd-logind inhibitor lock, see systemd-inhibit(1).
+type Inhibitor struct {
+	// shutdown, sleep, idle, handle-*
+	What []string
+	Who  string
+	Why  string
+	// block, delay
+	Mode string
+	UID  uint32
+	PID  uint32
+}
+
+// Holds the given inhibitor type.
+func (inhibitor Inhibitor) Inhibits(what string) bool {
+	for _, w := range inhibitor.What {
+		if w == what {
+			return true
+		}
+	}
+	return false
+}
+
+// Who of the inhibitor locks taken by Inhibit.
+const InhibitorWho = "nixos-hydra-upgrade"
+
+/*
+Takes a blocking inhibitor lock of the `what` types, e.g. sleep and
+shutdown, until the returned release is called or `ctx` is done. The lock
+is held by a systemd-inhibit child reading our stdin pipe, so it's also
+released when this process exits or execs.
+*/
+func Inhibit(ctx context.Context, what []string, why string) (func(), error) {
+	stop, err := Runner.Start(ctx, runner.Command("systemd-inhibit",
+		"--what="+strings.Join(what, ":"),
+		"--who="+InhibitorWho,
+		"--why="+why,
+		"--mode=block",
+		"cat"))
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		stop()
+	}, nil
+}
+
+// busctl --json output for the a(ssssuu) ListInhibitors reply
+type listInhibitorsReply struct {
+	Data [][][]json.RawMessage `json:"data"`
+}
+
+// Lists currently held inhibitor locks.
+func ListInhibitors() ([]Inhibitor, error) {
+	cmd := runner.Command("busctl", "--system", "--json=short", "call",
+		"org.freedesktop.login1",
+		"/org/freedesktop/login1",
+		"org.freedesktop.login1.Manager",
+		"ListInhibitors")
+	output, err := Runner.Output(context.Background(), cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply listInhibitorsReply
+	err = json.Unmarshal(output, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Data) != 1 {
+		return nil, fmt.Errorf("unexpected ListInhibitors reply: %s", output)
+	}
+
+	inhibitors := []Inhibitor{}
+	for _, fields := range reply.Data[0] {
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("unexpected ListInhibitors reply: %s", output)
+		}
+		var what string
+		inhibitor := Inhibitor{}
+		for i, target := range []any{&what, &inhibitor.Who, &inhibitor.Why, &inhibitor.Mode, &inhibitor.UID, &inhibitor.PID} {
+			err = json.Unmarshal(fields[i], target)
+			if err != nil {
+				return nil, err
+			}
+		}
+		inhibitor.What = strings.Split(what, ":")
+		inhibitors = append(inhibitors, inhibitor)
+	}
+	return inhibitors, nil
+}
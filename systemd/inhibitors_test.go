@@ -0,0 +1,86 @@
+package systemd_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+const listInhibitors = "busctl --system --json=short call org.freedesktop.login1 /org/freedesktop/login1 org.freedesktop.login1.Manager ListInhibitors"
+
+// busctl --json=short reply on a desktop with a backup running
+const inhibitorsReply = `{"type":"a(ssssuu)","data":[[["handle-power-key:handle-suspend-key:handle-hibernate-key","GNOME Settings Daemon","GNOME handling keypresses","block",1000,2301],["sleep","NetworkManager","NetworkManager needs to turn off networks","delay",0,1187],["sleep:shutdown","restic","Backup in progress","block",0,40213]]]}
+`
+
+func TestInhibit(t *testing.T) {
+	original := systemd.Runner
+	t.Cleanup(func() { systemd.Runner = original })
+	inhibit := "systemd-inhibit --what=sleep:shutdown --who=nixos-hydra-upgrade --why=Upgrading NixOS --mode=block cat"
+
+	t.Run("holds the lock until released", func(t *testing.T) {
+		fake := &runner.Fake{}
+		systemd.Runner = fake
+		release, err := systemd.Inhibit(context.Background(), []string{"sleep", "shutdown"}, "Upgrading NixOS")
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{inhibit})
+		assert.ArrayEqual(t, fake.Stopped, []string{})
+		release()
+		assert.ArrayEqual(t, fake.Stopped, []string{inhibit})
+	})
+
+	t.Run("fails when systemd-inhibit can't start", func(t *testing.T) {
+		systemd.Runner = &runner.Fake{Errors: map[string]error{inhibit: errors.New("executable file not found in $PATH")}}
+		_, err := systemd.Inhibit(context.Background(), []string{"sleep", "shutdown"}, "Upgrading NixOS")
+		assert.Equal(t, err != nil, true)
+	})
+}
+
+func TestListInhibitors(t *testing.T) {
+	original := systemd.Runner
+	t.Cleanup(func() { systemd.Runner = original })
+
+	t.Run("parses inhibitor locks", func(t *testing.T) {
+		systemd.Runner = &runner.Fake{Outputs: map[string]string{listInhibitors: inhibitorsReply}}
+		inhibitors, err := systemd.ListInhibitors()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(inhibitors), 3)
+		assert.ArrayEqual(t, inhibitors[0].What, []string{"handle-power-key", "handle-suspend-key", "handle-hibernate-key"})
+		assert.Equal(t, inhibitors[1].Mode, "delay")
+		restic := inhibitors[2]
+		assert.Equal(t, restic.Who, "restic")
+		assert.Equal(t, restic.Why, "Backup in progress")
+		assert.Equal(t, restic.Mode, "block")
+		assert.Equal(t, restic.UID, uint32(0))
+		assert.Equal(t, restic.PID, uint32(40213))
+		assert.Equal(t, restic.Inhibits("shutdown"), true)
+		assert.Equal(t, restic.Inhibits("idle"), false)
+	})
+
+	t.Run("parses empty replies", func(t *testing.T) {
+		systemd.Runner = &runner.Fake{Outputs: map[string]string{listInhibitors: `{"type":"a(ssssuu)","data":[[]]}`}}
+		inhibitors, err := systemd.ListInhibitors()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(inhibitors), 0)
+	})
+
+	malformed := []struct {
+		name  string
+		reply string
+	}{
+		{"not json", "Failed to connect to bus"},
+		{"missing data", `{"type":"a(ssssuu)"}`},
+		{"short locks", `{"type":"a(ssssuu)","data":[[["sleep","restic","Backup in progress","block",0]]]}`},
+		{"mistyped fields", `{"type":"a(ssssuu)","data":[[["sleep","restic","Backup in progress","block","root",40213]]]}`},
+	}
+	for _, test := range malformed {
+		t.Run("fails on "+test.name, func(t *testing.T) {
+			systemd.Runner = &runner.Fake{Outputs: map[string]string{listInhibitors: test.reply}}
+			_, err := systemd.ListInhibitors()
+			assert.Equal(t, err != nil, true)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Options of the generated service and timer units, see ServiceUnit and TimerUnit.
+type InstallOptions struct {
+	// absolute path of the nixos-hydra-upgrade executable
+	Executable string
+	// passed with -c, empty passes no config file
+	ConfigFile string
+	// directories under /var/lib and /var/cache created for the service, empty omits them
+	StateDirectory string
+	CacheDirectory string
+	// loaded as a systemd credential and passed as NHU_NIX_NETRC_FILE, empty omits it
+	NetrcFile string
+	// timer schedule, see systemd.time(7)
+	OnCalendar      string
+	RandomizedDelay time.Duration
+	// run on the next boot when a scheduled run was missed
+	Persistent bool
+}
+
+// Quotes a command line argument for ExecStart when needed.
+func quote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\%$") {
+		return arg
+	}
+	arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(arg)
+	return `"` + arg + `"`
+}
+
+/*
+A oneshot service running an upgrade. Switching writes to /nix, /etc, and
+/boot, and restarts arbitrary units, so the filesystem can't be protected,
+only the process's privileges and kernel access.
+*/
+func ServiceUnit(opts InstallOptions) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=NixOS Upgrade with hydra build validation and health check support.\n")
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("X-StopOnRemoval=false\n")
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=oneshot\n")
+	exec := []string{quote(opts.Executable)}
+	if opts.ConfigFile != "" {
+		exec = append(exec, "-c", quote(opts.ConfigFile))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(exec, " "))
+	b.WriteString("Environment=HOME=/root\n")
+	if opts.StateDirectory != "" {
+		fmt.Fprintf(&b, "StateDirectory=%s\n", opts.StateDirectory)
+	}
+	if opts.CacheDirectory != "" {
+		fmt.Fprintf(&b, "CacheDirectory=%s\n", opts.CacheDirectory)
+	}
+	if opts.NetrcFile != "" {
+		fmt.Fprintf(&b, "LoadCredential=netrc:%s\n", opts.NetrcFile)
+		b.WriteString("Environment=NHU_NIX_NETRC_FILE=%d/netrc\n")
+	}
+	for _, directive := range []string{
+		"NoNewPrivileges=true",
+		"PrivateTmp=true",
+		"ProtectClock=true",
+		"ProtectKernelLogs=true",
+		"LockPersonality=true",
+		"RestrictRealtime=true",
+		"SystemCallArchitectures=native",
+		"KeyringMode=private",
+		"UMask=0022",
+	} {
+		b.WriteString(directive + "\n")
+	}
+	return b.String()
+}
+
+// A timer starting the service on `opts.OnCalendar`.
+func TimerUnit(opts InstallOptions) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=Scheduled nixos-hydra-upgrade runs.\n")
+	b.WriteString("\n[Timer]\n")
+	fmt.Fprintf(&b, "OnCalendar=%s\n", opts.OnCalendar)
+	if opts.RandomizedDelay > 0 {
+		fmt.Fprintf(&b, "RandomizedDelaySec=%d\n", int(opts.RandomizedDelay.Seconds()))
+	}
+	fmt.Fprintf(&b, "Persistent=%t\n", opts.Persistent)
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=timers.target\n")
+	return b.String()
+}
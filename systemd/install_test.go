@@ -0,0 +1,36 @@
+package systemd_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+func TestInstallUnits(t *testing.T) {
+	opts := systemd.InstallOptions{
+		Executable:      "/usr/local/bin/nixos-hydra-upgrade",
+		ConfigFile:      "/etc/nixos hydra/config.yaml",
+		StateDirectory:  "nixos-hydra-upgrade",
+		NetrcFile:       "/etc/nix/netrc",
+		OnCalendar:      "04:40",
+		RandomizedDelay: 45 * time.Minute,
+		Persistent:      true,
+	}
+
+	service := systemd.ServiceUnit(opts)
+	for _, directive := range []string{
+		`ExecStart=/usr/local/bin/nixos-hydra-upgrade -c "/etc/nixos hydra/config.yaml"`,
+		"StateDirectory=nixos-hydra-upgrade",
+		"LoadCredential=netrc:/etc/nix/netrc",
+		"Environment=NHU_NIX_NETRC_FILE=%d/netrc",
+	} {
+		assert.Equal(t, strings.Contains(service, directive+"\n"), true)
+	}
+	assert.Equal(t, strings.Contains(service, "CacheDirectory="), false)
+
+	timer := systemd.TimerUnit(opts)
+	assert.Equal(t, strings.Contains(timer, "OnCalendar=04:40\nRandomizedDelaySec=2700\nPersistent=true\n"), true)
+}
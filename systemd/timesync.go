@@ -0,0 +1,40 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Neither timedatectl nor chronyc could tell whether the clock is synchronized.
+var ErrTimeSyncUnknown = errors.New("unable to determine time synchronization")
+
+/*
+Whether the system clock is synchronized, as reported by
+`timedatectl show`. Falls back to chrony's leap status on systems without
+timedated.
+*/
+func TimeSynchronized(ctx context.Context) (bool, error) {
+	output, err := Runner.Output(ctx, runner.Command("timedatectl", "show", "--property=NTPSynchronized", "--value"))
+	if err == nil {
+		switch strings.TrimSpace(string(output)) {
+		case "yes":
+			return true, nil
+		case "no":
+			return false, nil
+		}
+	}
+	output, err = Runner.Output(ctx, runner.Command("chronyc", "-n", "tracking"))
+	if err != nil {
+		return false, ErrTimeSyncUnknown
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && strings.TrimSpace(key) == "Leap status" {
+			return strings.TrimSpace(value) != "Not synchronised", nil
+		}
+	}
+	return false, ErrTimeSyncUnknown
+}
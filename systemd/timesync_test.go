@@ -0,0 +1,46 @@
+package systemd_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+func TestTimeSynchronized(t *testing.T) {
+	original := systemd.Runner
+	t.Cleanup(func() { systemd.Runner = original })
+	timedatectl := "timedatectl show --property=NTPSynchronized --value"
+	chronyc := "chronyc -n tracking"
+	missing := errors.New("executable file not found in $PATH")
+
+	tests := []struct {
+		name         string
+		fake         *runner.Fake
+		synchronized bool
+		err          error
+	}{
+		{"timedated synchronized", &runner.Fake{Outputs: map[string]string{timedatectl: "yes\n"}}, true, nil},
+		{"timedated unsynchronized", &runner.Fake{Outputs: map[string]string{timedatectl: "no\n"}}, false, nil},
+		{"chrony synchronized", &runner.Fake{
+			Outputs: map[string]string{chronyc: "Reference ID    : C0A80001 (192.168.0.1)\nLeap status     : Normal\n"},
+			Errors:  map[string]error{timedatectl: missing},
+		}, true, nil},
+		{"chrony unsynchronized", &runner.Fake{
+			Outputs: map[string]string{chronyc: "Reference ID    : 00000000 ()\nLeap status     : Not synchronised\n"},
+			Errors:  map[string]error{timedatectl: missing},
+		}, false, nil},
+		{"unknown", &runner.Fake{Errors: map[string]error{timedatectl: missing, chronyc: missing}}, false, systemd.ErrTimeSyncUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			systemd.Runner = test.fake
+			synchronized, err := systemd.TimeSynchronized(context.Background())
+			assert.Equal(t, synchronized, test.synchronized)
+			assert.Equal(t, err, test.err)
+		})
+	}
+}
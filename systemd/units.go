@@ -0,0 +1,80 @@
+package systemd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+// A loaded systemd unit, as listed by `systemctl list-units`.
+type Unit struct {
+	Name string
+	// active, activating, deactivating, inactive, failed, ...
+	Active string
+	// unit type specific state: running, start, exited, ...
+	Sub string
+}
+
+/*
+Whether the unit is doing work. Oneshot services stay "activating" while
+their command runs, and may remain "active (exited)" after finishing.
+*/
+func (unit Unit) Running() bool {
+	return unit.Active == "activating" || unit.Active == "deactivating" || unit.Sub == "running"
+}
+
+// Lists loaded units matching any of the glob `patterns`.
+func ListUnits(patterns []string) ([]Unit, error) {
+	args := append([]string{"list-units", "--all", "--full", "--plain", "--no-legend", "--no-pager"}, patterns...)
+	output, err := Runner.Output(context.Background(), runner.Command("systemctl", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	units := []Unit{}
+	for _, line := range strings.Split(string(output), "\n") {
+		// UNIT LOAD ACTIVE SUB DESCRIPTION
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		units = append(units, Unit{Name: fields[0], Active: fields[2], Sub: fields[3]})
+	}
+	return units, nil
+}
+
+// Names of units in the failed state.
+func FailedUnits(ctx context.Context) ([]string, error) {
+	cmd := runner.Command("systemctl", "list-units", "--failed", "--all", "--full", "--plain", "--no-legend", "--no-pager")
+	output, err := Runner.Output(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	units := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			units = append(units, fields[0])
+		}
+	}
+	return units, nil
+}
+
+/*
+The overall system state reported by `systemctl is-system-running`:
+initializing, starting, running, degraded, maintenance, stopping, ...
+*/
+func SystemState(ctx context.Context) (string, error) {
+	// exits non-zero for any state other than running
+	output, err := Runner.Output(ctx, runner.Command("systemctl", "is-system-running"))
+	state := strings.TrimSpace(string(output))
+	if state == "" && err != nil {
+		return "", err
+	}
+	return state, nil
+}
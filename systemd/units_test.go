@@ -0,0 +1,58 @@
+package systemd_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+func TestListUnits(t *testing.T) {
+	original := systemd.Runner
+	t.Cleanup(func() { systemd.Runner = original })
+	listUnits := "systemctl list-units --all --full --plain --no-legend --no-pager restic-backups-*.service borgbackup-job-home.service"
+
+	t.Run("lists units matching the patterns", func(t *testing.T) {
+		fake := &runner.Fake{Outputs: map[string]string{listUnits: "" +
+			"restic-backups-remote.service loaded activating start restic backup remote\n" +
+			"restic-backups-local.service  loaded inactive   dead  restic backup local\n" +
+			"borgbackup-job-home.service   loaded active     exited BorgBackup job home\n"}}
+		systemd.Runner = fake
+		units, err := systemd.ListUnits([]string{"restic-backups-*.service", "borgbackup-job-home.service"})
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, fake.Ran, []string{listUnits})
+		assert.ArrayEqual(t, units, []systemd.Unit{
+			{Name: "restic-backups-remote.service", Active: "activating", Sub: "start"},
+			{Name: "restic-backups-local.service", Active: "inactive", Sub: "dead"},
+			{Name: "borgbackup-job-home.service", Active: "active", Sub: "exited"},
+		})
+	})
+
+	t.Run("fails when listing fails", func(t *testing.T) {
+		systemd.Runner = &runner.Fake{Errors: map[string]error{listUnits: errors.New("exit status 1")}}
+		_, err := systemd.ListUnits([]string{"restic-backups-*.service", "borgbackup-job-home.service"})
+		assert.Equal(t, err != nil, true)
+	})
+}
+
+func TestUnitRunning(t *testing.T) {
+	tests := []struct {
+		name    string
+		unit    systemd.Unit
+		running bool
+	}{
+		{"running service", systemd.Unit{Active: "active", Sub: "running"}, true},
+		{"activating oneshot", systemd.Unit{Active: "activating", Sub: "start"}, true},
+		{"deactivating service", systemd.Unit{Active: "deactivating", Sub: "stop-sigterm"}, true},
+		{"exited oneshot", systemd.Unit{Active: "active", Sub: "exited"}, false},
+		{"inactive service", systemd.Unit{Active: "inactive", Sub: "dead"}, false},
+		{"failed service", systemd.Unit{Active: "failed", Sub: "failed"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.unit.Running(), test.running)
+		})
+	}
+}
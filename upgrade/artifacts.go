@@ -0,0 +1,96 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hydra"
+)
+
+// Archives out-of-band artifacts of target builds, e.g. disk images or SBOMs.
+type Archiver interface {
+	Archive(ctx context.Context, target Target) error
+}
+
+/*
+Downloads hydra build products of the target build to Dir/<build id>/,
+e.g. a disk image or closure tarball. Only file products are downloaded,
+products already archived are kept.
+*/
+type HydraProducts struct {
+	Client hydra.HydraClient
+	// product name globs, see path.Match
+	Names []string
+	Dir   string
+}
+
+func (archiver HydraProducts) Archive(ctx context.Context, target Target) error {
+	build, err := archiver.Client.GetBuild(ctx, target.BuildID)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(archiver.Dir, strconv.Itoa(build.ID))
+	for number, product := range build.BuildProducts {
+		if product.SHA256 == "" || !archiver.selected(product.Name) {
+			continue
+		}
+		dest := filepath.Join(dir, filepath.Base(product.Name))
+		_, err := os.Stat(dest)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		slog.Info("Downloading build product.", slog.String("product", product.Name), slog.Int("buildid", build.ID))
+		err = archiver.download(ctx, build, number, dest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (archiver HydraProducts) selected(name string) bool {
+	for _, glob := range archiver.Names {
+		matched, _ := path.Match(glob, name)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Downloads a product to a temporary file, renamed to `dest` once verified.
+func (archiver HydraProducts) download(ctx context.Context, build hydra.Build, number string, dest string) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".product-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = archiver.Client.DownloadProduct(ctx, build, number, tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
@@ -0,0 +1,259 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hydra"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+/*
+A precondition for upgrading. Gates return a *gates.BlockedError to defer
+the upgrade to a later run, any other error fails the upgrade.
+*/
+type Checker interface {
+	Check(ctx context.Context, target Target) error
+}
+
+// Adapts a function to a Checker.
+type CheckerFunc func(ctx context.Context, target Target) error
+
+func (f CheckerFunc) Check(ctx context.Context, target Target) error {
+	return f(ctx, target)
+}
+
+/*
+Marks a gate or health check advisory. Its failures are logged and reported
+with the run as warnings, but don't stop the upgrade, so new checks can be
+introduced across a fleet gradually.
+*/
+type Advisory struct {
+	Name    string
+	Checker Checker
+}
+
+func (checker Advisory) Check(ctx context.Context, target Target) error {
+	err := checker.Checker.Check(ctx, target)
+	if err != nil {
+		return &AdvisoryError{Name: checker.Name, Err: err}
+	}
+	return nil
+}
+
+/*
+An advisory check failed. Deliberately doesn't unwrap, so a blocked advisory
+gate isn't mistaken for one deferring the upgrade.
+*/
+type AdvisoryError struct {
+	Name string
+	Err  error
+}
+
+func (err *AdvisoryError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Name, err.Err.Error())
+}
+
+// Health check requiring a canary to be healthy, see healthcheck.Check.
+type CanaryChecker struct {
+	Canary healthcheck.Check
+}
+
+func (checker CanaryChecker) Check(ctx context.Context, target Target) error {
+	return checker.Canary.Check(ctx)
+}
+
+/*
+Health check on the local system's state. A degraded system, with failed
+units, is logged with "warn" and fails the check with "refuse".
+*/
+type SystemStateChecker struct {
+	Policy string
+}
+
+func (checker SystemStateChecker) Check(ctx context.Context, target Target) error {
+	state, err := systemd.SystemState(ctx)
+	if err != nil {
+		return err
+	}
+	if state != "degraded" {
+		return nil
+	}
+	units, err := systemd.FailedUnits(ctx)
+	if err != nil {
+		return err
+	}
+	if checker.Policy == "warn" {
+		slog.Warn("System is degraded.", slog.String("units", strings.Join(units, ", ")))
+		return nil
+	}
+	return fmt.Errorf("system is degraded, failed units: %s", strings.Join(units, ", "))
+}
+
+// Post-switch check requiring deployed secrets to exist with the expected ownership.
+type SecretsChecker struct {
+	Secrets []healthcheck.Secret
+}
+
+func (checker SecretsChecker) Check(ctx context.Context, target Target) error {
+	for _, secret := range checker.Secrets {
+		err := healthcheck.CheckSecret(secret)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Health check requiring local systemd units to be active.
+type UnitsChecker struct {
+	Units []string
+	// how long to wait for units still starting, 0 doesn't wait
+	Timeout time.Duration
+}
+
+func (checker UnitsChecker) Check(ctx context.Context, target Target) error {
+	return healthcheck.UnitsActive(ctx, checker.Units, checker.Timeout)
+}
+
+// Post-switch check requiring the system to finish starting and reach the running state.
+type RunningChecker struct {
+	// how long to wait for units still starting
+	Timeout time.Duration
+}
+
+func (checker RunningChecker) Check(ctx context.Context, target Target) error {
+	return healthcheck.SystemRunning(ctx, checker.Timeout)
+}
+
+// Post-switch check watching the journal for Window, failing when more than MaxErrors errors are logged.
+type JournalChecker struct {
+	Window    time.Duration
+	MaxErrors int
+}
+
+func (checker JournalChecker) Check(ctx context.Context, target Target) error {
+	since := time.Now()
+	slog.Info("Watching journal for errors.", slog.Duration("window", checker.Window))
+	select {
+	case <-time.After(checker.Window):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	count, err := healthcheck.JournalErrors(ctx, since)
+	if err != nil {
+		return err
+	}
+	if count > checker.MaxErrors {
+		return fmt.Errorf("%d errors logged to the journal in %s, more than %d", count, checker.Window, checker.MaxErrors)
+	}
+	return nil
+}
+
+// Gates checked before each disruptive step.
+type Gates struct {
+	// before the provider is queried, the target is empty
+	Start []Checker
+	// once the latest build is known, before its flake is resolved
+	Upgrade []Checker
+	// before switching
+	Switch []Checker
+	// before rebooting
+	Reboot []Checker
+	/*
+		Checked last before rebooting. When blocked, evacuate hooks run to
+		shut down or migrate workloads, and it is checked again.
+	*/
+	Workloads Checker
+}
+
+/*
+Detects stale jobsets, which haven't had a successful build of Client's job
+land within Window, e.g. when evaluations have been failing for days. The
+job's latest build alone can't tell how long that has been.
+*/
+type Freshness struct {
+	Client hydra.HydraClient
+	Window time.Duration
+}
+
+/*
+Upgrade gate requiring the latest build of another hydra job to have
+succeeded, e.g. a private overlay flake the system flake consumes, built in
+its own project. With Input set, the build must also be of the revision the
+target's flake locks that input to. Unfinished, failed, or mismatched builds
+defer the upgrade.
+*/
+type DependencyChecker struct {
+	Client hydra.HydraClient
+	// input of the target's flake built by Client's job, empty skips the revision check
+	Input string
+}
+
+func (checker DependencyChecker) Check(ctx context.Context, target Target) error {
+	client := checker.Client
+	job := fmt.Sprintf("%s/%s/%s", client.Project, client.JobSet, client.Job)
+	blocked := func(format string, a ...any) error {
+		return &gates.BlockedError{Gate: "dependency " + job, Reason: fmt.Sprintf(format, a...)}
+	}
+	build, err := client.GetLatestBuild(ctx)
+	if err != nil {
+		return err
+	}
+	if build.Finished != 1 {
+		return blocked("latest build %d is unfinished", build.ID)
+	}
+	if build.BuildStatus != 0 {
+		return blocked("latest build %d failed with buildstatus %d", build.ID, build.BuildStatus)
+	}
+	if checker.Input == "" {
+		return nil
+	}
+
+	eval, err := client.GetEval(ctx, build)
+	if err != nil {
+		return err
+	}
+	inputs, err := nix.LockedInputs(ctx, target.Flake)
+	if err != nil {
+		return err
+	}
+	locked, ok := inputs[checker.Input]
+	if !ok {
+		return fmt.Errorf("%s has no input %s locked to a git revision", target.Flake, checker.Input)
+	}
+	if nix.FlakeRev(eval.Flake) != locked {
+		return blocked("latest build %d is of %s, the target locks %s to %s", build.ID, eval.Flake, checker.Input, locked)
+	}
+	slog.Info("Dependency is built.", slog.String("job", job), slog.Int("buildid", build.ID))
+	return nil
+}
+
+/*
+Upgrade gate blocking upgrades across Constraint, comparing its option in
+the running system's flake, the self registry entry like Rebuilder.Current,
+with the target's. Both are only evaluated, never built.
+*/
+type ConstraintChecker struct {
+	// flake nixosConfigurations.<name>
+	Host       string
+	Constraint gates.Constraint
+}
+
+func (checker ConstraintChecker) Check(ctx context.Context, target Target) error {
+	running, err := nix.SystemOption(ctx, "self", checker.Host, checker.Constraint.Option)
+	if err != nil {
+		return fmt.Errorf("evaluating the running %s: %w", checker.Constraint.Option, err)
+	}
+	upgraded, err := nix.SystemOption(ctx, target.Flake, checker.Host, checker.Constraint.Option)
+	if err != nil {
+		return fmt.Errorf("evaluating the target's %s: %w", checker.Constraint.Option, err)
+	}
+	return checker.Constraint.Check(running, upgraded)
+}
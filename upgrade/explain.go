@@ -0,0 +1,131 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+)
+
+// A condition currently preventing an upgrade, see Explain.
+type Blocker struct {
+	// what was checked, e.g. start gate or health check
+	Check string `json:"check"`
+	// why it prevents the upgrade
+	Reason string `json:"reason"`
+	// the condition couldn't be evaluated, or fails the upgrade rather than deferring it
+	Failed bool `json:"failed,omitempty"`
+	// an advisory check failing, reported without preventing the upgrade, see Advisory
+	Advisory bool `json:"advisory,omitempty"`
+}
+
+/*
+Checks the conditions an upgrade run checks, without stopping at the first
+one that blocks, and explains every one that would prevent an upgrade now.
+Nothing is fetched, activated, or written, and hooks and plugins don't run.
+Gates that depend on the target are skipped when the latest build can't be
+resolved.
+*/
+func Explain(ctx context.Context, opts Options) []Blocker {
+	var blockers []Blocker
+	add := func(check string, err error) {
+		var advisory *AdvisoryError
+		if errors.As(err, &advisory) {
+			blockers = append(blockers, Blocker{Check: check, Reason: advisory.Error(), Advisory: true})
+			return
+		}
+		var blocked *gates.BlockedError
+		if errors.As(err, &blocked) {
+			blockers = append(blockers, Blocker{Check: check, Reason: blocked.Error()})
+			return
+		}
+		blockers = append(blockers, Blocker{Check: check, Reason: err.Error(), Failed: true})
+	}
+	checkAll := func(check string, checkers []Checker, target Target) {
+		for _, checker := range checkers {
+			err := checker.Check(ctx, target)
+			if err != nil {
+				add(check, err)
+			}
+		}
+	}
+
+	if opts.Connectivity != nil {
+		err := opts.Connectivity.Check(ctx, Target{})
+		if err != nil {
+			blockers = append(blockers, Blocker{Check: "connectivity", Reason: "offline: " + err.Error()})
+		}
+	}
+	checkAll("start gate", opts.Gates.Start, Target{})
+	if opts.PendingBoot == "skip" {
+		booted, bootedErr := nix.SystemPath(nix.BootedSystem)
+		staged, stagedErr := nix.SystemPath(nix.SystemProfile)
+		if bootedErr == nil && stagedErr == nil && booted != staged {
+			blockers = append(blockers, Blocker{Check: "pending boot", Reason: fmt.Sprintf("%s is staged and waiting for a reboot", staged)})
+		}
+	}
+	checkAll("health check", opts.HealthChecks, Target{})
+
+	target, err := opts.Provider.Latest(ctx)
+	switch {
+	case errors.Is(err, ErrUnfinished):
+		blockers = append(blockers, Blocker{Check: "build", Reason: fmt.Sprintf("latest build %d hasn't finished", target.BuildID)})
+	case err != nil:
+		add("build", err)
+	}
+	if err == nil {
+		err = opts.Provider.Resolve(ctx, &target)
+		if err != nil {
+			add("build", err)
+		}
+	}
+	if err != nil {
+		return blockers
+	}
+
+	current, err := opts.Rebuilder.Current(ctx)
+	if err != nil {
+		add("build", err)
+	} else if current.SameSource(target.Metadata) || current.LastModified >= target.Metadata.LastModified {
+		blockers = append(blockers, Blocker{Check: "build", Reason: fmt.Sprintf("the system is up to date with build %d", target.BuildID)})
+	}
+	if len(opts.AllowedRefs) > 0 {
+		ref, err := opts.Provider.Ref(ctx, target)
+		if err != nil {
+			add("allowed refs", err)
+		} else if !nix.RefAllowed(ref, opts.AllowedRefs) {
+			blockers = append(blockers, Blocker{Check: "allowed refs", Reason: fmt.Sprintf("flake ref %s not allowed", ref), Failed: true})
+		}
+	}
+	if opts.Policy != nil {
+		err := opts.Policy(ctx, target, &opts)
+		if err != nil {
+			add("policy", err)
+		}
+	}
+	checkAll("upgrade gate", opts.Gates.Upgrade, target)
+	if opts.Approval != nil {
+		approved, err := opts.Approval.Load(ctx)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			blockers = append(blockers, Blocker{Check: "approval", Reason: fmt.Sprintf("build %d isn't approved, %s doesn't exist", target.BuildID, opts.Approval.Path)})
+		case err != nil:
+			add("approval", err)
+		case approved.BuildID != target.BuildID:
+			blockers = append(blockers, Blocker{Check: "approval", Reason: fmt.Sprintf("build %d is approved rather than %d", approved.BuildID, target.BuildID)})
+		}
+	}
+	if opts.Operation == "switch" || opts.Operation == OperationTestThenBoot {
+		checkAll("switch gate", opts.Gates.Switch, target)
+	}
+	if opts.Reboot {
+		checkAll("reboot gate", opts.Gates.Reboot, target)
+		if opts.Gates.Workloads != nil {
+			checkAll("workloads", []Checker{opts.Gates.Workloads}, target)
+		}
+	}
+	return blockers
+}
@@ -0,0 +1,529 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hooks"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+)
+
+// Phases of the upgrade pipeline, run in order.
+type Phase string
+
+const (
+	// connectivity, plugins, operator holds, start gates, and staged generations pending reboot
+	PhaseGate Phase = "gate"
+	// the latest build, upgrade gates, and whether it is an update
+	PhaseResolve Phase = "resolve"
+	// health checks and download size
+	PhasePreflight Phase = "preflight"
+	// builds or substitutes the target system
+	PhasePrefetch Phase = "prefetch"
+	// switches to or stages the target system
+	PhaseActivate Phase = "activate"
+	// confirms the switch and runs post-switch hooks
+	PhaseVerify Phase = "verify"
+	// reboots into the staged system if enabled
+	PhaseReboot Phase = "reboot"
+)
+
+var Phases = []Phase{PhaseGate, PhaseResolve, PhasePreflight, PhasePrefetch, PhaseActivate, PhaseVerify, PhaseReboot}
+
+type step struct {
+	phase Phase
+	run   func(ctx context.Context) (Outcome, error)
+	// whether an interrupted run already completed the phase
+	done func() bool
+}
+
+func (u *upgrader) steps() []step {
+	reached := func(phase state.Phase) func() bool {
+		return func() bool {
+			return u.run != nil && u.run.Phase.Reached(phase)
+		}
+	}
+	return []step{
+		{phase: PhaseGate, run: u.gatePhase},
+		{phase: PhaseResolve, run: u.resolvePhase},
+		{phase: PhasePreflight, run: u.preflightPhase, done: reached(state.PhasePrefetched)},
+		{phase: PhasePrefetch, run: u.prefetchPhase, done: reached(state.PhasePrefetched)},
+		{phase: PhaseActivate, run: u.activatePhase, done: reached(state.PhaseActivated)},
+		{phase: PhaseVerify, run: u.verifyPhase},
+		{phase: PhaseReboot, run: u.rebootPhase},
+	}
+}
+
+/*
+Runs the phases in order until one ends the run with an outcome. Phases
+completed by an interrupted run are skipped.
+*/
+func (u *upgrader) runPhases(ctx context.Context) (Outcome, error) {
+	defer u.uninhibit()
+	for _, step := range u.steps() {
+		if u.Prefetch && step.phase == PhaseActivate && !step.done() {
+			slog.Info("System fetched, leaving it for a later run to activate.", slog.String("flake", u.target.Flake))
+			return OutcomePrefetched, nil
+		}
+		if step.phase == PhaseActivate && !step.done() {
+			outcome, err := u.checkApproval(ctx)
+			if outcome != "" {
+				return outcome, err
+			}
+		}
+		if step.phase == PhaseVerify {
+			u.uninhibit()
+			u.reexec()
+		}
+		if step.done != nil && step.done() {
+			slog.Debug("Skipping completed phase.", slog.String("phase", string(step.phase)))
+			continue
+		}
+		if step.phase == PhasePrefetch || step.phase == PhaseActivate {
+			u.inhibit(ctx)
+		}
+		outcome, err := u.runPhase(ctx, step)
+		if outcome != "" {
+			return outcome, err
+		}
+	}
+	return OutcomeSuccess, nil
+}
+
+// Runs a phase, retrying failures, and publishes its result.
+func (u *upgrader) runPhase(ctx context.Context, step step) (Outcome, error) {
+	u.publish(ctx, events.Event{Type: events.PhaseStarted, Phase: string(step.phase)})
+	// hooks and sinks publishing the phase's events run unlimited
+	limited := runner.WithLimits(ctx, u.Limits[step.phase])
+	started := time.Now()
+	attempts := 0
+	var outcome Outcome
+	var err error
+	for {
+		attempts++
+		outcome, err = step.run(limited)
+		if outcome.Failed() && errors.Is(err, runner.ErrStalled) {
+			outcome = OutcomeStalled
+		}
+		if !outcome.Retryable() || attempts > u.Retries[step.phase] || ctx.Err() != nil {
+			break
+		}
+		slog.Warn("Phase failed, retrying.",
+			slog.String("phase", string(step.phase)),
+			slog.Int("attempt", attempts),
+			slog.Duration("delay", u.RetryDelay))
+		select {
+		case <-time.After(u.RetryDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	event := finished(events.PhaseFinished, started, outcome, err)
+	event.Phase = string(step.phase)
+	event.Attempts = attempts
+	u.phases = append(u.phases, events.PhaseTiming{Phase: event.Phase, Duration: event.Duration})
+	u.publish(ctx, event)
+	return outcome, err
+}
+
+// Runs phase hooks for finished phases.
+func (u *upgrader) runPhaseHooks(ctx context.Context, event events.Event) {
+	if event.Type != events.PhaseFinished {
+		return
+	}
+	env := u.env
+	env.Phase = event.Phase
+	env.Duration = event.Duration
+	env.Outcome = event.Outcome
+	err := hooks.Run(ctx, "phase", u.Hooks.Phase, env)
+	if err != nil {
+		slog.Error("Phase hook failed.", slog.String("error", err.Error()))
+	}
+}
+
+func (u *upgrader) gatePhase(ctx context.Context) (Outcome, error) {
+	if u.Connectivity != nil {
+		err := u.Connectivity.Check(ctx, Target{})
+		if err != nil {
+			slog.Info("Network is offline, skipping upgrade.", slog.String("reason", err.Error()))
+			return OutcomeOffline, nil
+		}
+	}
+
+	// a previous run may have drained this node before rebooting
+	if !u.Check {
+		u.uncordon(ctx)
+	}
+
+	outcome, err := u.loadPlugins()
+	if outcome != "" {
+		return outcome, err
+	}
+	u.recoverCrash(ctx)
+	outcome, err = u.check(ctx, u.Gates.Start, Target{})
+	if outcome != "" || u.Check {
+		return outcome, err
+	}
+	u.restage, outcome, err = u.pendingBoot(ctx)
+	return outcome, err
+}
+
+/*
+Runs `query` in the background, returning a function that waits for its
+result. Results that are never awaited are dropped.
+*/
+func async[T any](query func() (T, error)) func() (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := query()
+		done <- result{value, err}
+	}()
+	return func() (T, error) {
+		r := <-done
+		return r.value, r.err
+	}
+}
+
+/*
+Returns the latest build, waiting up to Options.Wait for it to finish when
+it's unfinished.
+*/
+func (u *upgrader) latest(ctx context.Context) (Target, error) {
+	deadline := time.Now().Add(u.Wait)
+	for {
+		target, err := u.Provider.Latest(ctx)
+		if !errors.Is(err, ErrUnfinished) || u.Wait <= 0 {
+			return target, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			slog.Info("Stopped waiting for the latest build.", slog.Int("buildid", target.BuildID), slog.Duration("wait", u.Wait))
+			return target, err
+		}
+		slog.Info("Latest build unfinished, waiting for it.", slog.Int("buildid", target.BuildID), slog.Duration("interval", u.WaitInterval))
+		select {
+		case <-ctx.Done():
+			// still unfinished, being stopped isn't a provider failure
+			slog.Info("Stopped waiting for the latest build, run cancelled.", slog.Int("buildid", target.BuildID))
+			return target, err
+		case <-time.After(min(u.WaitInterval, remaining)):
+		}
+	}
+}
+
+/*
+Finds the latest build and whether it is an update. Queries are made
+concurrently where they don't depend on each other, to cut network latency
+from every run.
+*/
+func (u *upgrader) resolvePhase(ctx context.Context) (Outcome, error) {
+	currentMetadata := func() (nix.FlakeMetadata, error) {
+		return u.Rebuilder.Current(ctx)
+	}
+	settled := u.settled(ctx)
+	var current func() (nix.FlakeMetadata, error)
+	if settled == nil {
+		current = async(currentMetadata)
+	}
+	target, err := u.latest(ctx)
+	u.env.BuildID = target.BuildID
+	u.checkOrigin(ctx, target)
+	u.checkFreshness(ctx)
+	switch {
+	case errors.Is(err, ErrUnfinished):
+		slog.Info("Latest build unfinished.")
+		return OutcomeUnfinished, nil
+	case errors.Is(err, ErrNothingStaged):
+		slog.Info("No prepared upgrade to activate.")
+		return OutcomeNothingStaged, nil
+	case errors.Is(err, ErrBuildFailed):
+		slog.Info("Latest build unsuccessful.", slog.String("error", err.Error()))
+		return OutcomeBuildFailed, err
+	case err != nil:
+		slog.Error("Unable to get latest build.", slog.String("error", err.Error()))
+		return OutcomeProviderFailed, err
+	}
+	if settled != nil && settled.BuildID == target.BuildID {
+		slog.Info("System is already up to date.", slog.Int("buildid", target.BuildID), slog.Time("settled", settled.Settled))
+		return OutcomeUpToDate, nil
+	}
+	if current == nil {
+		current = async(currentMetadata)
+	}
+	outcome, err := u.applyPolicy(ctx, target)
+	if outcome != "" {
+		return outcome, err
+	}
+	outcome, err = u.check(ctx, u.Gates.Upgrade, target)
+	if outcome != "" {
+		return outcome, err
+	}
+
+	slog.Debug("hydraMetadata", slog.String("flake", target.Flake))
+	resolving := target
+	resolved := async(func() (Target, error) {
+		err := u.Provider.Resolve(ctx, &resolving)
+		return resolving, err
+	})
+	outcome, err = u.checkRef(ctx, target)
+	if outcome != "" {
+		return outcome, err
+	}
+	target, err = resolved()
+	if err != nil {
+		slog.Error("Unable to resolve flake.", slog.String("error", err.Error()))
+		return OutcomeProviderFailed, err
+	}
+	u.target = target
+	u.env.FlakeRev = target.Metadata.Revision
+	if u.Check {
+		return u.checkAvailable(target, current)
+	}
+
+	u.run = u.resume(target)
+	if u.run != nil {
+		u.sbom = u.run.SBOM
+		// resumed runs keep the annotation they were started with, unless given a new one
+		if u.env.Annotation == "" {
+			u.env.Annotation = u.run.Annotation
+		} else {
+			u.run.Annotation = u.env.Annotation
+		}
+	}
+	if u.run != nil || u.restage {
+		return "", nil
+	}
+	outcome, err = u.checkAvailable(target, current)
+	if outcome == OutcomeAvailable {
+		return "", nil
+	}
+	if outcome == OutcomeUpToDate {
+		u.settle(ctx)
+	}
+	return outcome, err
+}
+
+func (u *upgrader) preflightPhase(ctx context.Context) (Outcome, error) {
+	if u.run == nil {
+		for _, checker := range u.HealthChecks {
+			err := checker.Check(ctx, u.target)
+			if err != nil && !u.advisory(err) {
+				slog.Info("Health check failed.", slog.String("error", err.Error()))
+				return OutcomeHealthCheckFailed, err
+			}
+		}
+
+		u.run = &state.Run{
+			BuildID:    u.target.BuildID,
+			Flake:      u.target.Flake,
+			Operation:  u.Operation,
+			Annotation: u.env.Annotation,
+		}
+		u.savePhase(u.run, state.PhaseGated)
+	}
+	return u.checkDownloadSize(ctx, u.target)
+}
+
+func (u *upgrader) prefetchPhase(ctx context.Context) (Outcome, error) {
+	slog.Info("Fetching system.", slog.String("flake", u.target.Flake))
+	toplevel, err := u.Rebuilder.Prefetch(ctx, u.target)
+	if err != nil {
+		slog.Error("Fetching system failed.", slog.String("error", err.Error()))
+		return rebuildFailed(err), err
+	}
+	u.run.Toplevel = toplevel
+	outcome, err := u.checkSignatures(ctx, toplevel)
+	if outcome != "" {
+		return outcome, err
+	}
+	outcome, err = u.checkReproducible(ctx, toplevel)
+	if outcome != "" {
+		return outcome, err
+	}
+	u.addGCRoot(ctx, toplevel)
+	u.archive(ctx)
+	u.writeSBOM(ctx, toplevel)
+	u.savePhase(u.run, state.PhasePrefetched)
+	return "", nil
+}
+
+// Switches to or stages the prefetched system.
+func (u *upgrader) activatePhase(ctx context.Context) (Outcome, error) {
+	run, target := u.run, u.target
+	outcome, err := u.checkRelease(run.Toplevel)
+	if outcome != "" {
+		return outcome, err
+	}
+	outcome, err = u.checkRestarts(ctx, run)
+	if outcome != "" {
+		return outcome, err
+	}
+	err = hooks.Run(ctx, "pre-switch", u.Hooks.PreSwitch, u.env)
+	if err != nil {
+		slog.Error("Pre-switch hook failed.", slog.String("error", err.Error()))
+		return OutcomeHookFailed, err
+	}
+	if u.activatesLive() {
+		outcome, err = u.check(ctx, u.Gates.Switch, target)
+		if outcome != "" {
+			return outcome, err
+		}
+		outcome, err = u.drain(ctx)
+		if outcome != "" {
+			return outcome, err
+		}
+	}
+	outcome, err = u.takeSnapshots(ctx)
+	if outcome != "" {
+		return outcome, err
+	}
+	slog.Info("Performing system upgrade.", slog.String("flake", target.Flake))
+
+	u.failedBefore = u.listFailedUnits(ctx)
+	previous := u.recoverable(ctx)
+	if u.Operation == OperationTestThenBoot || u.revertsChecks() {
+		run.Previous, err = u.Rebuilder.Running(ctx)
+		if err != nil {
+			slog.Warn("Unable to determine the running system, systems failing post-switch checks won't be re-activated.", slog.String("error", err.Error()))
+		}
+	}
+	if run.Phase == state.PhaseProfileSet {
+		// interrupted after the profile was set, only activation remains
+		outcome, err = u.armRollback(ctx)
+		if outcome != "" {
+			return outcome, err
+		}
+		err = u.Rebuilder.Activate(ctx, run.Toplevel, u.activation())
+		if err != nil {
+			slog.Error("System activation failed.", slog.String("error", err.Error()))
+			return OutcomeActivationFailed, u.recoverActivation(ctx, previous, err)
+		}
+	} else {
+		outcome, err = u.rebuild(ctx, target)
+		if err != nil {
+			slog.Error("System upgrade failed.", slog.String("error", err.Error()))
+			if outcome == OutcomeActivationFailed {
+				err = u.recoverActivation(ctx, previous, err)
+			}
+			return outcome, err
+		}
+	}
+	slog.Info("System upgrade complete.", slog.String("flake", target.Flake))
+	u.restartRollback(ctx)
+
+	if u.Operation == "boot" && u.BootCounting != nil {
+		err = u.enableBootCounting()
+		if err != nil {
+			slog.Error("Enabling boot counting failed.", slog.String("error", err.Error()))
+			return OutcomeBootCountingFailed, err
+		}
+	}
+	u.savePhase(run, state.PhaseActivated)
+	// the system profile roots it now
+	u.removeGCRoot()
+	return "", nil
+}
+
+/*
+Rebuilds `target`, retrying failures to fetch it. Only nixos-rebuild is
+retried, the gates, hooks, and snapshots preceding it aren't repeated. The
+rollback is armed for each attempt, and disarmed again when an attempt
+fails before activating anything.
+*/
+func (u *upgrader) rebuild(ctx context.Context, target Target) (Outcome, error) {
+	for attempt := 1; ; attempt++ {
+		// armed last, the timer must not fire before the switch is done
+		outcome, err := u.armRollback(ctx)
+		if outcome != "" {
+			return outcome, err
+		}
+		started := time.Now()
+		err = u.Rebuilder.Rebuild(ctx, u.activation(), target)
+		if err != nil {
+			outcome = rebuildFailed(err)
+		}
+		event := finished(events.SwitchAttempted, started, outcome, err)
+		event.Attempts = attempt
+		u.publish(ctx, event)
+		if err != nil && !activated(err) {
+			u.disarmRollback(ctx)
+		}
+		if err == nil || outcome != OutcomeFetchFailed || attempt > u.SwitchRetries || ctx.Err() != nil {
+			return outcome, err
+		}
+		slog.Warn("Switch failed to fetch the system, retrying.",
+			slog.Int("attempt", attempt),
+			slog.Duration("delay", u.SwitchRetryDelay),
+			slog.String("error", err.Error()))
+		select {
+		case <-time.After(u.SwitchRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (u *upgrader) verifyPhase(ctx context.Context) (Outcome, error) {
+	u.reportFailedUnits(ctx)
+	if u.guard != nil && u.guard.Host == "" {
+		slog.Warn("Switch must be confirmed with nixos-hydra-upgrade confirm or it will be rolled back.", slog.Time("deadline", u.deadline))
+	} else if u.guard != nil {
+		err := u.guard.Confirm(ctx, u.deadline)
+		if err != nil {
+			slog.Error("Unable to confirm remote switch, target host will roll back.", slog.String("error", err.Error()))
+			u.rollingBack(ctx, OutcomeRolledBack, err, u.guard.Previous)
+			return OutcomeRolledBack, err
+		}
+		slog.Info("Remote switch confirmed.", slog.String("host", u.guard.Host))
+	}
+	if u.activatesLive() && u.TargetHost == "" {
+		for _, checker := range u.PostChecks {
+			err := checker.Check(ctx, u.target)
+			if err != nil && !u.advisory(err) {
+				slog.Error("Post-switch check failed.", slog.String("error", err.Error()))
+				switch {
+				case u.Operation == OperationTestThenBoot:
+					u.revertTest(ctx, err)
+				case u.revertsChecks() && u.run.Previous != "":
+					slog.Warn("Post-switch checks failed, re-activating the previous system.", slog.String("previous", u.run.Previous))
+					err = u.restore(ctx, OutcomeVerifyFailed, u.run.Previous, err)
+				case u.guard != nil:
+					u.rollingBack(ctx, OutcomeVerifyFailed, err, u.guard.Previous)
+				}
+				return OutcomeVerifyFailed, err
+			}
+		}
+	}
+	if u.Operation == OperationTestThenBoot {
+		outcome, err := u.installBoot(ctx)
+		if outcome != "" {
+			return outcome, err
+		}
+	}
+
+	u.env.Outcome = string(OutcomeSuccess)
+	err := hooks.Run(ctx, "post-switch", u.Hooks.PostSwitch, u.env)
+	if err != nil {
+		slog.Error("Post-switch hook failed.", slog.String("error", err.Error()))
+	}
+	return "", nil
+}
+
+func (u *upgrader) rebootPhase(ctx context.Context) (Outcome, error) {
+	if !u.Reboot {
+		u.uncordon(ctx)
+		u.clearRun()
+		u.settle(ctx)
+		return OutcomeSuccess, nil
+	}
+	u.savePhase(u.run, state.PhaseRebooted)
+	return u.reboot(ctx)
+}
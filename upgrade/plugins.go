@@ -0,0 +1,111 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/plugins"
+)
+
+// Runs a plugin as a gate or health check, see package plugins.
+type PluginChecker struct {
+	Plugin plugins.Plugin
+	// PointGate or PointCheck
+	Point     plugins.Point
+	Operation string
+}
+
+func (checker PluginChecker) Check(ctx context.Context, target Target) error {
+	response, err := checker.Plugin.Call(ctx, plugins.Request{
+		Point:     checker.Point,
+		Operation: checker.Operation,
+		BuildID:   target.BuildID,
+		Flake:     target.Flake,
+		FlakeRev:  target.Metadata.Revision,
+	})
+	if err != nil || !response.Block {
+		return err
+	}
+	if checker.Point == plugins.PointGate {
+		return &gates.BlockedError{Gate: "plugin " + checker.Plugin.Name(), Reason: response.Reason}
+	}
+	return fmt.Errorf("plugin %s: %s", checker.Plugin.Name(), response.Reason)
+}
+
+// Adds the plugins in Options.PluginDir to upgrade gates and health checks.
+func (u *upgrader) loadPlugins() (Outcome, error) {
+	if u.PluginDir == "" {
+		return "", nil
+	}
+	found, err := plugins.Discover(u.PluginDir)
+	if err != nil {
+		slog.Error("Unable to load plugins.", slog.String("dir", u.PluginDir), slog.String("error", err.Error()))
+		return OutcomeGateFailed, err
+	}
+	u.plugins = found
+	for _, plugin := range found {
+		slog.Debug("Loaded plugin.", slog.String("plugin", plugin.Name()))
+		u.Gates.Upgrade = slices.Concat(u.Gates.Upgrade, []Checker{
+			PluginChecker{Plugin: plugin, Point: plugins.PointGate, Operation: u.Operation},
+		})
+		u.HealthChecks = slices.Concat(u.HealthChecks, []Checker{
+			PluginChecker{Plugin: plugin, Point: plugins.PointCheck, Operation: u.Operation},
+		})
+	}
+	return "", nil
+}
+
+/*
+Notifies plugins of the outcome of finished runs, of triggered rollbacks,
+and of other events needing attention. Failures are only logged.
+*/
+func (u *upgrader) notifyPlugins(ctx context.Context, event events.Event) {
+	request := plugins.Request{
+		Operation:   event.Operation,
+		BuildID:     event.BuildID,
+		Flake:       u.target.Flake,
+		FlakeRev:    event.FlakeRev,
+		Outcome:     event.Outcome,
+		Error:       event.Error,
+		Stderr:      event.Stderr,
+		FailedUnits: event.FailedUnits,
+		Annotation:  event.Annotation,
+	}
+	switch event.Type {
+	case events.RunFinished:
+		request.Point = plugins.PointNotify
+		request.Failures = event.Failures
+		request.Phases = event.Phases
+		request.SBOM = event.SBOM
+		request.Warnings = event.Warnings
+		if event.Failures > 1 {
+			request.Priority = "high"
+		}
+	case events.RollbackTriggered:
+		request.Point = plugins.PointRollback
+		request.Priority = "high"
+		request.RollbackFrom = event.RollbackFrom
+		request.RollbackTo = event.RollbackTo
+	case events.OriginDrift:
+		request.Point = plugins.PointDrift
+		request.Priority = "high"
+		request.Flake = event.Flake
+		request.ExpectedOrigin = event.ExpectedOrigin
+	case events.JobsetStale:
+		request.Point = plugins.PointStale
+		request.Priority = "high"
+		request.Error = event.Error
+		request.LastSuccess = event.LastSuccess
+	case events.RunCrashed:
+		request.Point = plugins.PointCrashed
+		request.Priority = "high"
+		request.Phase = event.Phase
+	default:
+		return
+	}
+	plugins.Notify(ctx, u.plugins, request)
+}
@@ -0,0 +1,182 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hydra"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+)
+
+var (
+	// the latest build has not finished yet
+	ErrUnfinished = errors.New("latest build unfinished")
+	// the latest build finished unsuccessfully
+	ErrBuildFailed = errors.New("latest build unsuccessful")
+)
+
+// A system build to upgrade to.
+type Target struct {
+	BuildID int
+	// when the build finished
+	Finished time.Time
+	// locked flake url the build was evaluated from
+	Flake string
+	// store path of the system hydra built, empty if unknown
+	OutPath string
+	// metadata of Flake, set by Resolve
+	Metadata nix.FlakeMetadata
+}
+
+// Provides the latest successful system build.
+type Provider interface {
+	/*
+		Returns the latest build. Returns ErrUnfinished or ErrBuildFailed
+		(possibly wrapped) along with the target if it isn't usable.
+	*/
+	Latest(ctx context.Context) (Target, error)
+	// Resolves the metadata of the flake a target was built from.
+	Resolve(ctx context.Context, target *Target) error
+	// Returns the git ref the target's flake tracks, "HEAD" for the default branch.
+	Ref(ctx context.Context, target Target) (string, error)
+}
+
+// Provides builds of a hydra job.
+type HydraProvider struct {
+	Client hydra.HydraClient
+	// flake metadata cache, the zero value disables caching
+	Cache nix.MetadataCache
+}
+
+func (provider HydraProvider) Latest(ctx context.Context) (Target, error) {
+	build, err := provider.Client.GetLatestBuild(ctx)
+	if err != nil {
+		return Target{}, err
+	}
+	target := Target{
+		BuildID:  build.ID,
+		Finished: time.Unix(build.StopTime, 0),
+		OutPath:  build.BuildOutputs["out"].Path,
+	}
+	if build.Finished != 1 {
+		return target, ErrUnfinished
+	}
+	if build.BuildStatus != 0 {
+		return target, fmt.Errorf("%w: buildstatus %d", ErrBuildFailed, build.BuildStatus)
+	}
+
+	eval, err := provider.Client.GetEval(ctx, build)
+	if err != nil {
+		return target, err
+	}
+	target.Flake = eval.Flake
+	return target, nil
+}
+
+func (provider HydraProvider) Resolve(ctx context.Context, target *Target) error {
+	var err error
+	target.Metadata, err = provider.Cache.Get(ctx, target.Flake)
+	return err
+}
+
+// Evals are usually locked to a revision, the ref then comes from the jobset's flake.
+func (provider HydraProvider) Ref(ctx context.Context, target Target) (string, error) {
+	ref := nix.FlakeRef(target.Flake)
+	if ref == "" || nix.IsRev(ref) {
+		jobset, err := provider.Client.GetJobset(ctx)
+		if err != nil {
+			return "", err
+		}
+		ref = nix.FlakeRef(jobset.Flake)
+	}
+	if ref == "" || nix.IsRev(ref) {
+		ref = "HEAD"
+	}
+	return ref, nil
+}
+
+/*
+Provides builds from the first of Providers with a recent successful build,
+for stable jobsets backed by fallback jobsets. Providers that fail, or whose
+latest build finished more than MaxAge ago, fall back to the next. When none
+qualify, the primary's result is used.
+*/
+type FailoverProvider struct {
+	// in order of preference
+	Providers []Provider
+	// builds older than this are stale, 0 only falls back on failures
+	MaxAge time.Duration
+	// index of the provider the last target came from
+	selected int
+}
+
+func (provider *FailoverProvider) Latest(ctx context.Context) (Target, error) {
+	var primary Target
+	var primaryErr error
+	for i, candidate := range provider.Providers {
+		target, err := candidate.Latest(ctx)
+		if i == 0 {
+			primary, primaryErr = target, err
+		}
+		stale := provider.MaxAge > 0 && time.Since(target.Finished) > provider.MaxAge
+		if err == nil && !stale {
+			provider.selected = i
+			if i > 0 {
+				slog.Info("Using fallback jobset.", slog.Int("fallback", i), slog.Int("buildid", target.BuildID))
+			}
+			return target, nil
+		}
+		reason := "stale"
+		if err != nil {
+			reason = err.Error()
+		}
+		slog.Info("No recent successful build, trying the next jobset.", slog.Int("provider", i), slog.String("reason", reason))
+	}
+	provider.selected = 0
+	return primary, primaryErr
+}
+
+func (provider *FailoverProvider) Resolve(ctx context.Context, target *Target) error {
+	return provider.Providers[provider.selected].Resolve(ctx, target)
+}
+
+func (provider *FailoverProvider) Ref(ctx context.Context, target Target) (string, error) {
+	return provider.Providers[provider.selected].Ref(ctx, target)
+}
+
+// Nothing was prepared for StagedProvider to provide.
+var ErrNothingStaged = errors.New("no prepared upgrade")
+
+/*
+Provides the build a previous run prefetched and recorded in StateFile,
+ignoring newer builds, so a prepared upgrade is activated as it was
+prepared. Provider resolves its flake.
+*/
+type StagedProvider struct {
+	Provider  Provider
+	StateFile string
+}
+
+func (provider StagedProvider) Latest(ctx context.Context) (Target, error) {
+	upgradeState, err := state.Load(provider.StateFile)
+	if err != nil {
+		return Target{}, err
+	}
+	run := upgradeState.Run
+	if run == nil || !run.Phase.Reached(state.PhasePrefetched) {
+		return Target{}, ErrNothingStaged
+	}
+	return Target{BuildID: run.BuildID, Flake: run.Flake, OutPath: run.Toplevel}, nil
+}
+
+func (provider StagedProvider) Resolve(ctx context.Context, target *Target) error {
+	return provider.Provider.Resolve(ctx, target)
+}
+
+func (provider StagedProvider) Ref(ctx context.Context, target Target) (string, error) {
+	return provider.Provider.Ref(ctx, target)
+}
@@ -0,0 +1,217 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+)
+
+// Builds and activates systems.
+type Rebuilder interface {
+	// Returns the flake metadata of the running system.
+	Current(ctx context.Context) (nix.FlakeMetadata, error)
+	// Returns the bytes that must be downloaded to build the target.
+	DownloadSize(ctx context.Context, target Target) (int64, error)
+	// Builds or substitutes the target without activating it, returning its store path.
+	Prefetch(ctx context.Context, target Target) (string, error)
+	// Rebuilds the prefetched target locally, failing if the result differs from it.
+	CheckBuild(ctx context.Context, target Target) error
+	// Reports the unit changes activating a system toplevel would make.
+	DryActivate(ctx context.Context, toplevel string) (nix.Activation, error)
+	// Lists the failed systemd units of the running system.
+	FailedUnits(ctx context.Context) ([]string, error)
+	/*
+		Sets the system profile to the target and activates it with operation
+		boot or switch, or only activates it with test
+	*/
+	Rebuild(ctx context.Context, operation string, target Target) error
+	// Activates a toplevel already set as the system profile.
+	Activate(ctx context.Context, toplevel string, operation string) error
+	// Returns the toplevel of the running system.
+	Running(ctx context.Context) (string, error)
+	// Sets the system profile back to a previous toplevel and switches to it.
+	Recover(ctx context.Context, toplevel string) error
+	Reboot(ctx context.Context) error
+}
+
+// Rebuilds a nixosConfigurations host with nixos-rebuild.
+type NixRebuilder struct {
+	// flake nixosConfigurations.<name>
+	Host string
+	// additional nixos-rebuild args, expanded with ExpandArgs
+	Args []string
+	// expanded for {hostname}, defaults to the system hostname
+	Hostname string
+}
+
+func (rebuilder NixRebuilder) Current(ctx context.Context) (nix.FlakeMetadata, error) {
+	return nix.GetFlakeMetadata(ctx, "self")
+}
+
+func (rebuilder NixRebuilder) DownloadSize(ctx context.Context, target Target) (int64, error) {
+	return nix.DownloadSize(ctx, target.Metadata.OriginalUrl, rebuilder.Host)
+}
+
+/*
+Builds the target, copying it to the --target-host as well when deploying
+elsewhere, leaving nixos-rebuild little to do once a rollback is armed.
+*/
+func (rebuilder NixRebuilder) Prefetch(ctx context.Context, target Target) (string, error) {
+	toplevel, err := nix.BuildToplevel(ctx, target.Metadata.OriginalUrl, rebuilder.Host)
+	if err != nil {
+		return "", err
+	}
+	host := nix.TargetHost(ExpandArgs(rebuilder.Args, target, rebuilder.Hostname))
+	if host == "" {
+		return toplevel, nil
+	}
+	return toplevel, nix.CopyClosure(ctx, host, toplevel)
+}
+
+func (rebuilder NixRebuilder) CheckBuild(ctx context.Context, target Target) error {
+	return nix.CheckToplevel(ctx, target.Metadata.OriginalUrl, rebuilder.Host)
+}
+
+func (rebuilder NixRebuilder) DryActivate(ctx context.Context, toplevel string) (nix.Activation, error) {
+	return nix.DryActivate(ctx, toplevel)
+}
+
+func (rebuilder NixRebuilder) FailedUnits(ctx context.Context) ([]string, error) {
+	return systemd.FailedUnits(ctx)
+}
+
+func (rebuilder NixRebuilder) Rebuild(ctx context.Context, operation string, target Target) error {
+	return nix.NixosRebuild(ctx, operation, rebuilder.FlakeSpec(target), ExpandArgs(rebuilder.Args, target, rebuilder.Hostname))
+}
+
+func (rebuilder NixRebuilder) Activate(ctx context.Context, toplevel string, operation string) error {
+	return nix.SwitchToConfiguration(ctx, toplevel, operation)
+}
+
+func (rebuilder NixRebuilder) Running(ctx context.Context) (string, error) {
+	return nix.SystemPath(nix.CurrentSystem)
+}
+
+func (rebuilder NixRebuilder) Recover(ctx context.Context, toplevel string) error {
+	return recoverSystem(ctx, toplevel)
+}
+
+func (rebuilder NixRebuilder) Reboot(ctx context.Context) error {
+	return nix.Reboot(ctx)
+}
+
+/*
+Expands run context in nixos-rebuild args: {buildid} and {rev}, the hydra
+build and flake revision of the target, and {hostname}, this machine's,
+defaulting to the system hostname. Unknown values expand to nothing.
+*/
+func ExpandArgs(args []string, target Target, hostname string) []string {
+	buildID := ""
+	if target.BuildID != 0 {
+		buildID = strconv.Itoa(target.BuildID)
+	}
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	replacer := strings.NewReplacer(
+		"{buildid}", buildID,
+		"{rev}", target.Metadata.Revision,
+		"{hostname}", hostname,
+	)
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = replacer.Replace(arg)
+	}
+	return expanded
+}
+
+// The nixos-rebuild --flake argument for the target.
+func (rebuilder NixRebuilder) FlakeSpec(target Target) string {
+	return fmt.Sprintf("%s#%s", target.Metadata.OriginalUrl, rebuilder.Host)
+}
+
+// Hydra reported no output path for the target, see Target.OutPath.
+var ErrNoOutPath = errors.New("hydra reported no output path")
+
+/*
+Deploys the store path hydra built for the target, substituting it, setting
+the system profile, and activating it without ever evaluating the flake
+locally. For machines that can't afford to evaluate their own system.
+*/
+type StorePathRebuilder struct{}
+
+func (rebuilder StorePathRebuilder) Current(ctx context.Context) (nix.FlakeMetadata, error) {
+	return nix.GetFlakeMetadata(ctx, "self")
+}
+
+func (rebuilder StorePathRebuilder) DownloadSize(ctx context.Context, target Target) (int64, error) {
+	if target.OutPath == "" {
+		return 0, ErrNoOutPath
+	}
+	return nix.StorePathDownloadSize(ctx, target.OutPath)
+}
+
+func (rebuilder StorePathRebuilder) Prefetch(ctx context.Context, target Target) (string, error) {
+	if target.OutPath == "" {
+		return "", ErrNoOutPath
+	}
+	return nix.RealiseStorePath(ctx, target.OutPath)
+}
+
+func (rebuilder StorePathRebuilder) CheckBuild(ctx context.Context, target Target) error {
+	return errors.New("eval-free upgrades can't rebuild the system locally")
+}
+
+func (rebuilder StorePathRebuilder) DryActivate(ctx context.Context, toplevel string) (nix.Activation, error) {
+	return nix.DryActivate(ctx, toplevel)
+}
+
+func (rebuilder StorePathRebuilder) FailedUnits(ctx context.Context) ([]string, error) {
+	return systemd.FailedUnits(ctx)
+}
+
+func (rebuilder StorePathRebuilder) Rebuild(ctx context.Context, operation string, target Target) error {
+	toplevel, err := rebuilder.Prefetch(ctx, target)
+	if err != nil {
+		return err
+	}
+	// test leaves the boot default alone, like nixos-rebuild test
+	if operation != "test" {
+		err = nix.SetSystemProfile(ctx, toplevel)
+		if err != nil {
+			return err
+		}
+	}
+	return nix.SwitchToConfiguration(ctx, toplevel, operation)
+}
+
+func (rebuilder StorePathRebuilder) Activate(ctx context.Context, toplevel string, operation string) error {
+	return nix.SwitchToConfiguration(ctx, toplevel, operation)
+}
+
+func (rebuilder StorePathRebuilder) Running(ctx context.Context) (string, error) {
+	return nix.SystemPath(nix.CurrentSystem)
+}
+
+func (rebuilder StorePathRebuilder) Recover(ctx context.Context, toplevel string) error {
+	return recoverSystem(ctx, toplevel)
+}
+
+func (rebuilder StorePathRebuilder) Reboot(ctx context.Context) error {
+	return nix.Reboot(ctx)
+}
+
+// Sets the system profile to `toplevel` and switches to it.
+func recoverSystem(ctx context.Context, toplevel string) error {
+	err := nix.SetSystemProfile(ctx, toplevel)
+	if err != nil {
+		return err
+	}
+	return nix.SwitchToConfiguration(ctx, toplevel, "switch")
+}
@@ -0,0 +1,1114 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hooks"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hydra"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/rollback"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/sbom"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/snapshots"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+)
+
+/*
+Checks gates in order. Blocked gates defer the upgrade to a later run, gates
+that could not be evaluated fail the upgrade. Returns an empty outcome if
+all gates pass.
+*/
+func (u *upgrader) check(ctx context.Context, checkers []Checker, target Target) (Outcome, error) {
+	for _, checker := range checkers {
+		err := checker.Check(ctx, target)
+		if err != nil && !u.advisory(err) {
+			return gateOutcome(err)
+		}
+	}
+	return "", nil
+}
+
+/*
+Whether `err` is an advisory check failing, see Advisory. Failures are logged
+and kept as warnings of the run rather than stopping it.
+*/
+func (u *upgrader) advisory(err error) bool {
+	var advisory *AdvisoryError
+	if !errors.As(err, &advisory) {
+		return false
+	}
+	slog.Warn("Advisory check failed.", slog.String("check", advisory.Name), slog.String("error", advisory.Err.Error()))
+	u.warnings = append(u.warnings, advisory.Error())
+	return true
+}
+
+func gateOutcome(err error) (Outcome, error) {
+	var blocked *gates.BlockedError
+	if errors.As(err, &blocked) {
+		slog.Info("Upgrade deferred.", slog.String("gate", blocked.Gate), slog.String("reason", blocked.Reason))
+		return OutcomeDeferred, err
+	}
+	slog.Error("Gate check failed.", slog.String("error", err.Error()))
+	return OutcomeGateFailed, err
+}
+
+/*
+Defers reboots while workloads are running. Evacuate hooks get a chance to
+shut down or migrate blocking workloads before deferring.
+*/
+func (u *upgrader) checkWorkloads(ctx context.Context) (Outcome, error) {
+	if u.Gates.Workloads == nil {
+		return "", nil
+	}
+	target := Target{BuildID: u.env.BuildID}
+	err := u.Gates.Workloads.Check(ctx, target)
+	if err != nil && u.advisory(err) {
+		return "", nil
+	}
+	var blocked *gates.BlockedError
+	if errors.As(err, &blocked) && len(u.Hooks.Evacuate) > 0 {
+		slog.Info("Evacuating workloads.", slog.String("reason", blocked.Reason))
+		err = hooks.Run(ctx, "evacuate", u.Hooks.Evacuate, u.env)
+		if err != nil {
+			slog.Error("Evacuate hook failed, skipping reboot.", slog.String("error", err.Error()))
+			return OutcomeHookFailed, err
+		}
+		err = u.Gates.Workloads.Check(ctx, target)
+	}
+	if err != nil {
+		return gateOutcome(err)
+	}
+	return "", nil
+}
+
+/*
+Detects a generation staged by a previous `boot` run that has not been
+booted yet, and applies the pending boot policy. Returns true if the
+upgrade should be staged again even if the system is up to date, or a
+non-empty outcome if the run ends here.
+*/
+func (u *upgrader) pendingBoot(ctx context.Context) (bool, Outcome, error) {
+	booted, err := nix.SystemPath(nix.BootedSystem)
+	if err != nil {
+		slog.Warn("Unable to resolve booted system, skipping pending boot detection.", slog.String("error", err.Error()))
+		return false, "", nil
+	}
+	staged, err := nix.SystemPath(nix.SystemProfile)
+	if err != nil {
+		slog.Warn("Unable to resolve system profile, skipping pending boot detection.", slog.String("error", err.Error()))
+		return false, "", nil
+	}
+	if booted == staged {
+		return false, "", nil
+	}
+
+	pending := []any{slog.String("booted", booted), slog.String("staged", staged), slog.String("policy", u.PendingBoot)}
+	switch u.PendingBoot {
+	case "skip":
+		slog.Info("Staged generation pending reboot.", pending...)
+		return false, OutcomePendingBoot, nil
+	case "warn":
+		slog.Warn("Staged generation pending reboot.", pending...)
+	case "restage":
+		slog.Info("Staged generation pending reboot, staging latest build.", pending...)
+		return true, "", nil
+	case "reboot":
+		slog.Info("Staged generation pending reboot, rebooting.", pending...)
+		u.env.Operation = "boot"
+		u.env.Outcome = string(OutcomeSuccess)
+		outcome, err := u.reboot(ctx)
+		return false, outcome, err
+	}
+	return false, "", nil
+}
+
+/*
+Loads progress left by an interrupted run. Returns the run to resume for
+`target`, or nil to start a new upgrade.
+*/
+func (u *upgrader) resume(target Target) *state.Run {
+	if u.StateFile == "" {
+		return nil
+	}
+	var err error
+	u.state, err = state.Load(u.StateFile)
+	if err != nil {
+		slog.Warn("Unable to load upgrade state, starting a new upgrade.", slog.String("error", err.Error()))
+		return nil
+	}
+	run := u.state.Run
+	if run == nil {
+		return nil
+	}
+	if run.BuildID != target.BuildID || run.Operation != u.Operation {
+		slog.Info("Discarding progress of a superseded upgrade.", slog.Int("buildid", run.BuildID), slog.String("phase", string(run.Phase)))
+		u.clearRun()
+		return nil
+	}
+
+	if run.Phase == state.PhaseRebooted {
+		booted, err := nix.SystemPath(nix.BootedSystem)
+		if err == nil && booted == run.Toplevel {
+			slog.Info("Upgrade complete after reboot.", slog.Int("buildid", run.BuildID))
+			u.completeRun()
+			return nil
+		}
+		// the reboot never happened, retry it
+		run.Phase = state.PhaseActivated
+	}
+	if run.Phase == state.PhasePrefetched {
+		profile, err := nix.SystemPath(nix.SystemProfile)
+		if err == nil && profile == run.Toplevel {
+			u.savePhase(run, state.PhaseProfileSet)
+		}
+	}
+	slog.Info("Resuming interrupted upgrade.", slog.Int("buildid", run.BuildID), slog.String("phase", string(run.Phase)))
+	return run
+}
+
+/*
+Locks the state file for the run, so single runs and the daemon can't
+upgrade at once. Ends the run with OutcomeBusy while another run holds it.
+Runs without a state file, or unable to create its lock, aren't locked.
+*/
+func (u *upgrader) lockState() (*state.Lock, Outcome, error) {
+	if u.StateFile == "" {
+		return nil, "", nil
+	}
+	lock, err := state.Acquire(u.StateFile)
+	if errors.Is(err, state.ErrLocked) {
+		slog.Warn("Another run is in progress.", slog.String("state", u.StateFile))
+		return nil, OutcomeBusy, err
+	}
+	if err != nil {
+		slog.Warn("Unable to lock upgrade state.", slog.String("error", err.Error()))
+		return nil, "", nil
+	}
+	if lock.Stale != 0 {
+		slog.Info("Cleared the state lock left by a crashed run.", slog.Int("pid", lock.Stale))
+	}
+	return lock, "", nil
+}
+
+/*
+Reports an upgrade left in progress by a process that crashed or was killed,
+and releases it to resume like any interrupted upgrade. Temporary state files
+the crash left behind are removed. Failures are only logged.
+*/
+func (u *upgrader) recoverCrash(ctx context.Context) {
+	if u.StateFile == "" {
+		return
+	}
+	crashed, err := state.Load(u.StateFile)
+	if err != nil || crashed.Run == nil || !crashed.Run.Crashed() {
+		return
+	}
+	run := crashed.Run
+	u.events.Publish(ctx, events.Event{
+		Type:      events.RunCrashed,
+		Operation: run.Operation,
+		Phase:     string(run.Phase),
+		BuildID:   run.BuildID,
+		Outcome:   string(OutcomeCrashed),
+		Failed:    true,
+		Error:     fmt.Sprintf("previous run (pid %d) crashed after the %s phase", run.PID, run.Phase),
+	})
+	// saves in progress are renamed into place within moments
+	removed, err := state.RemoveStaleTemp(u.StateFile, time.Now().Add(-time.Minute))
+	if err != nil {
+		slog.Warn("Unable to remove temporary state files.", slog.String("error", err.Error()))
+	}
+	for _, path := range removed {
+		slog.Info("Removed temporary state file left by the crashed run.", slog.String("path", path))
+	}
+	run.PID = 0
+	err = crashed.Save(u.StateFile)
+	if err != nil {
+		slog.Warn("Unable to save upgrade state.", slog.String("error", err.Error()))
+	}
+}
+
+// Marks the upgrade left in progress for a later run as stopped, see state.Run.PID.
+func (u *upgrader) parkRun() {
+	if u.state.Run == nil || u.state.Run.PID != os.Getpid() {
+		return
+	}
+	u.state.Run.PID = 0
+	if u.StateFile == "" {
+		return
+	}
+	err := u.state.Save(u.StateFile)
+	if err != nil {
+		slog.Warn("Unable to save upgrade state.", slog.String("error", err.Error()))
+	}
+}
+
+/*
+The settled build recorded by an earlier run, see Options.SkipSettled. nil
+unless it settled with the system still running and operation, and no
+upgrade is in progress.
+*/
+func (u *upgrader) settled(ctx context.Context) *state.Settled {
+	if !u.SkipSettled || u.StateFile == "" || u.TargetHost != "" {
+		return nil
+	}
+	saved, err := state.Load(u.StateFile)
+	if err != nil || saved.Run != nil || saved.Settled == nil || saved.Settled.Operation != u.Operation {
+		return nil
+	}
+	running, err := u.Rebuilder.Running(ctx)
+	if err != nil || running != saved.Settled.System {
+		return nil
+	}
+	return saved.Settled
+}
+
+// Records the target as settled, see Options.SkipSettled.
+func (u *upgrader) settle(ctx context.Context) {
+	if !u.SkipSettled || u.StateFile == "" || u.TargetHost != "" || u.Check {
+		return
+	}
+	running, err := u.Rebuilder.Running(ctx)
+	if err != nil {
+		slog.Warn("Unable to find the running system.", slog.String("error", err.Error()))
+		return
+	}
+	u.state.Settled = &state.Settled{
+		BuildID:   u.target.BuildID,
+		Operation: u.Operation,
+		System:    running,
+		Settled:   time.Now(),
+	}
+	err = u.state.Save(u.StateFile)
+	if err != nil {
+		slog.Warn("Unable to save upgrade state.", slog.String("error", err.Error()))
+	}
+}
+
+// Records that `run` completed `phase`.
+func (u *upgrader) savePhase(run *state.Run, phase state.Phase) {
+	run.Phase = phase
+	run.Updated = time.Now()
+	run.Own()
+	if phase == state.PhaseRebooted {
+		// rebooting ends this process without crashing it
+		run.PID = 0
+	}
+	u.state.Run = run
+	if u.StateFile == "" {
+		return
+	}
+	err := u.state.Save(u.StateFile)
+	if err != nil {
+		slog.Warn("Unable to save upgrade state.", slog.String("error", err.Error()))
+	}
+}
+
+/*
+Roots the prefetched `toplevel`, so garbage collection before a deferred
+activation or reboot doesn't delete it. Failures are only logged, the
+closure is refetched if it's collected.
+*/
+func (u *upgrader) addGCRoot(ctx context.Context, toplevel string) {
+	if u.GCRoot == "" {
+		return
+	}
+	err := nix.AddGCRoot(ctx, toplevel, u.GCRoot)
+	if err != nil {
+		slog.Warn("Unable to add gc root for prefetched system.", slog.String("root", u.GCRoot), slog.String("error", err.Error()))
+	}
+}
+
+/*
+Archives the prefetched target's artifacts. Failures are only logged, the
+archive isn't needed to upgrade.
+*/
+func (u *upgrader) archive(ctx context.Context) {
+	if u.Artifacts == nil {
+		return
+	}
+	err := u.Artifacts.Archive(ctx, u.target)
+	if err != nil {
+		slog.Warn("Unable to archive build artifacts.", slog.Int("buildid", u.target.BuildID), slog.String("error", err.Error()))
+	}
+}
+
+/*
+Writes the bill of materials of the prefetched `toplevel`. Failures are only
+logged, and licenses are left out when they can't be evaluated.
+*/
+func (u *upgrader) writeSBOM(ctx context.Context, toplevel string) {
+	if u.SBOM == nil {
+		return
+	}
+	infos, err := nix.ClosureInfo(ctx, toplevel)
+	if err != nil {
+		slog.Warn("Unable to list the system closure for its sbom.", slog.String("error", err.Error()))
+		return
+	}
+	licenses := map[string][]string{}
+	if u.SBOM.Host != "" {
+		licenses, err = nix.PackageLicenses(ctx, u.target.Metadata.OriginalUrl, u.SBOM.Host)
+		if err != nil {
+			slog.Warn("Unable to evaluate package licenses for the sbom.", slog.String("error", err.Error()))
+		}
+	}
+	doc := sbom.Document{
+		Name:     fmt.Sprintf("build %d", u.target.BuildID),
+		Toplevel: toplevel,
+		Created:  time.Now(),
+	}
+	for _, info := range infos {
+		name, version := sbom.ParseName(info.Path)
+		doc.Components = append(doc.Components, sbom.Component{
+			Name:     name,
+			Version:  version,
+			Path:     info.Path,
+			Licenses: licenses[info.Path],
+		})
+	}
+	path := filepath.Join(u.SBOM.Dir, fmt.Sprintf("%d.%s", u.target.BuildID, sbom.Extension(u.SBOM.Format)))
+	err = sbom.Write(path, u.SBOM.Format, doc)
+	if err != nil {
+		slog.Warn("Unable to write sbom.", slog.String("path", path), slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("Wrote sbom.", slog.String("path", path), slog.Int("components", len(doc.Components)))
+	u.sbom = path
+	u.run.SBOM = path
+}
+
+// Removes the gc root of an activated or abandoned prefetched system.
+func (u *upgrader) removeGCRoot() {
+	if u.GCRoot == "" {
+		return
+	}
+	err := os.Remove(u.GCRoot)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Unable to remove gc root.", slog.String("root", u.GCRoot), slog.String("error", err.Error()))
+	}
+}
+
+// Records the upgrade in progress as completed after rebooting into it.
+func (u *upgrader) completeRun() {
+	u.removeGCRoot()
+	u.state.Complete(time.Now())
+	if u.StateFile == "" {
+		return
+	}
+	err := u.state.Save(u.StateFile)
+	if err != nil {
+		slog.Warn("Unable to save upgrade state.", slog.String("error", err.Error()))
+	}
+}
+
+// Clears upgrade progress once an upgrade completes or fails.
+func (u *upgrader) clearRun() {
+	u.removeGCRoot()
+	if u.state.Run == nil {
+		return
+	}
+	u.state.Run = nil
+	if u.StateFile == "" {
+		return
+	}
+	err := u.state.Save(u.StateFile)
+	if err != nil {
+		slog.Warn("Unable to save upgrade state.", slog.String("error", err.Error()))
+	}
+}
+
+/*
+Re-execs the executable of the switched system when it differs from ours, so
+fixes to the tool itself take effect for the post-switch phases of the run
+that installed them. The new process resumes from the state file at the
+verify phase. Failures are logged and the run continues in this process.
+*/
+func (u *upgrader) reexec() {
+	if u.Reexec == nil || !u.activatesLive() || u.TargetHost != "" || u.StateFile == "" || u.run == nil {
+		return
+	}
+	binary, err := filepath.EvalSymlinks(path.Join(u.run.Toplevel, u.Reexec.Binary))
+	if err != nil {
+		slog.Debug("Switched system has no executable to re-exec.", slog.String("error", err.Error()))
+		return
+	}
+	running, err := os.Executable()
+	if err == nil {
+		running, err = filepath.EvalSymlinks(running)
+	}
+	if err != nil {
+		slog.Warn("Unable to find running executable, not re-executing.", slog.String("error", err.Error()))
+		return
+	}
+	if binary == running {
+		return
+	}
+	slog.Info("Re-executing upgraded nixos-hydra-upgrade.", slog.String("binary", binary))
+	err = u.Reexec.Exec(binary)
+	slog.Warn("Re-exec failed, continuing with the running executable.", slog.String("error", err.Error()))
+}
+
+/*
+Lists failed units when switching the local system, so units failing after
+the switch can be reported. Returns nil when unknown.
+*/
+func (u *upgrader) listFailedUnits(ctx context.Context) []string {
+	if !u.activatesLive() || u.TargetHost != "" {
+		return nil
+	}
+	units, err := u.Rebuilder.FailedUnits(ctx)
+	if err != nil {
+		slog.Warn("Unable to list failed units.", slog.String("error", err.Error()))
+		return nil
+	}
+	return units
+}
+
+/*
+Reports units that failed since switching, even when switch-to-configuration
+succeeded. They're passed to later hooks, events, and plugins, the upgrade
+itself still succeeds.
+*/
+func (u *upgrader) reportFailedUnits(ctx context.Context) {
+	if u.failedBefore == nil {
+		return
+	}
+	after := u.listFailedUnits(ctx)
+	failed := []string{}
+	for _, unit := range after {
+		if !slices.Contains(u.failedBefore, unit) {
+			failed = append(failed, unit)
+		}
+	}
+	if len(failed) > 0 {
+		slog.Warn("Units failed after switching.", slog.String("units", strings.Join(failed, ", ")))
+	}
+	u.env.FailedUnits = failed
+}
+
+// The outcome of a failed nix or nixos-rebuild command, see nix.Classify.
+/*
+Whether a rebuild failing with `err` may have activated anything.
+Unclassified failures may have.
+*/
+func activated(err error) bool {
+	switch nix.Classify(err) {
+	case nix.FailureActivation, nix.FailureUnknown:
+		return true
+	}
+	return false
+}
+
+func rebuildFailed(err error) Outcome {
+	switch nix.Classify(err) {
+	case nix.FailureEval:
+		return OutcomeEvalFailed
+	case nix.FailureFetch:
+		return OutcomeFetchFailed
+	case nix.FailureActivation:
+		return OutcomeActivationFailed
+	case nix.FailureNondeterministic:
+		return OutcomeBuildMismatch
+	}
+	return OutcomeRebuildFailed
+}
+
+// Keeps the system from sleeping or shutting down until uninhibit, see Options.Inhibit.
+func (u *upgrader) inhibit(ctx context.Context) {
+	if u.Inhibit == nil || u.release != nil {
+		return
+	}
+	release, err := u.Inhibit(ctx)
+	if err != nil {
+		slog.Warn("Unable to inhibit sleep and shutdown.", slog.String("error", err.Error()))
+		return
+	}
+	u.release = release
+}
+
+// Releases the lock taken by inhibit, if any.
+func (u *upgrader) uninhibit() {
+	if u.release != nil {
+		u.release()
+		u.release = nil
+	}
+}
+
+// Applies Options.Policy for `target`, failing the run when it can't be read.
+func (u *upgrader) applyPolicy(ctx context.Context, target Target) (Outcome, error) {
+	if u.Policy == nil {
+		return "", nil
+	}
+	err := u.Policy(ctx, target, &u.Options)
+	if err == nil {
+		return "", nil
+	}
+	slog.Error("Unable to apply upgrade policy from the target.", slog.String("error", err.Error()))
+	switch outcome := rebuildFailed(err); outcome {
+	case OutcomeEvalFailed, OutcomeFetchFailed:
+		return outcome, err
+	}
+	return OutcomeGateFailed, err
+}
+
+/*
+Verifies every substituted path in the closure of the prefetched `toplevel`
+is signed by one of Options.PinnedKeys, catching substituter or
+trusted-public-keys misconfiguration before activating.
+*/
+func (u *upgrader) checkSignatures(ctx context.Context, toplevel string) (Outcome, error) {
+	if len(u.PinnedKeys) == 0 {
+		return "", nil
+	}
+	untrusted, err := nix.UntrustedPaths(ctx, toplevel, u.PinnedKeys)
+	if err != nil {
+		slog.Error("Unable to verify signatures.", slog.String("error", err.Error()))
+		return rebuildFailed(err), err
+	}
+	if len(untrusted) > 0 {
+		err = fmt.Errorf("%d paths not signed by a pinned key, e.g. %s", len(untrusted), untrusted[0])
+		slog.Error("System closure has untrusted paths.", slog.String("paths", strings.Join(untrusted, ", ")))
+		return OutcomeUntrusted, err
+	}
+	return "", nil
+}
+
+/*
+Compares the prefetched `toplevel` to hydra's build of the target, and
+rebuilds it locally when Options.Reproducibility asks for it, so systems
+that don't match what hydra built are never activated.
+*/
+func (u *upgrader) checkReproducible(ctx context.Context, toplevel string) (Outcome, error) {
+	if u.Reproducibility == "" {
+		return "", nil
+	}
+	if u.target.OutPath == "" {
+		slog.Warn("Hydra reported no output path, unable to compare the system to its build.")
+	} else if toplevel != u.target.OutPath {
+		err := fmt.Errorf("system %s differs from hydra's build %s", toplevel, u.target.OutPath)
+		slog.Error("System doesn't match hydra's build.", slog.String("error", err.Error()))
+		return OutcomeBuildMismatch, err
+	}
+	if u.Reproducibility != "rebuild" {
+		return "", nil
+	}
+	slog.Info("Rebuilding system to verify it's reproducible.", slog.String("toplevel", toplevel))
+	err := u.Rebuilder.CheckBuild(ctx, u.target)
+	if err != nil {
+		slog.Error("Reproducibility check failed.", slog.String("error", err.Error()))
+		return rebuildFailed(err), err
+	}
+	return "", nil
+}
+
+// Reports whether `target` is newer than the running system, awaiting its `current` metadata.
+func (u *upgrader) checkAvailable(target Target, current func() (nix.FlakeMetadata, error)) (Outcome, error) {
+	metadata, err := current()
+	if err != nil {
+		slog.Error("Unable to get current system flake metadata.", slog.String("error", err.Error()))
+		return OutcomeRebuildFailed, err
+	}
+	u.current = metadata
+	// narHash identifies sources even when timestamps are rewritten
+	if metadata.SameSource(target.Metadata) {
+		slog.Info("System is already up to date.", slog.String("narHash", metadata.Locked.NarHash))
+		return OutcomeUpToDate, nil
+	}
+	// older builds are never upgrades
+	if metadata.LastModified >= target.Metadata.LastModified {
+		slog.Info("System is already up to date.")
+		return OutcomeUpToDate, nil
+	}
+	slog.Info("Upgrade available.", slog.Int("buildid", target.BuildID), slog.String("flake", target.Flake))
+	return OutcomeAvailable, nil
+}
+
+/*
+Warns when the latest build's flake isn't from Options.ExpectedOrigin, even
+when there's nothing to upgrade, catching silently reconfigured jobsets.
+*/
+func (u *upgrader) checkOrigin(ctx context.Context, target Target) {
+	if u.ExpectedOrigin == "" || target.Flake == "" {
+		return
+	}
+	if nix.FlakeOrigin(target.Flake) == nix.FlakeOrigin(u.ExpectedOrigin) {
+		return
+	}
+	u.publish(ctx, events.Event{
+		Type:           events.OriginDrift,
+		Flake:          target.Flake,
+		ExpectedOrigin: u.ExpectedOrigin,
+	})
+}
+
+/*
+Warns when the jobset is stale, see Freshness, even when there's nothing to
+upgrade. Failures to page through hydra's evaluations are only logged.
+*/
+func (u *upgrader) checkFreshness(ctx context.Context) {
+	if u.Freshness == nil {
+		return
+	}
+	since := time.Now().Add(-u.Freshness.Window)
+	build, err := u.Freshness.Client.LatestSuccess(ctx, since)
+	event := events.Event{Type: events.JobsetStale}
+	switch {
+	case errors.Is(err, hydra.ErrNoSuccess):
+		event.Error = fmt.Sprintf("no successful build within %s", u.Freshness.Window)
+	case err != nil:
+		slog.Warn("Unable to find the latest successful build.", slog.String("error", err.Error()))
+		return
+	case time.Unix(build.StopTime, 0).Before(since):
+		event.LastSuccess = time.Unix(build.StopTime, 0)
+		event.Error = fmt.Sprintf("latest successful build %d finished %s ago", build.ID, time.Since(event.LastSuccess).Round(time.Minute))
+	default:
+		return
+	}
+	u.publish(ctx, event)
+}
+
+/*
+Rejects targets tracking flake refs other than the allowed refs, so a
+misconfigured or hijacked jobset can't move systems onto another branch.
+*/
+func (u *upgrader) checkRef(ctx context.Context, target Target) (Outcome, error) {
+	if len(u.AllowedRefs) == 0 {
+		return "", nil
+	}
+	ref, err := u.Provider.Ref(ctx, target)
+	if err != nil {
+		slog.Error("Unable to determine flake ref.", slog.String("error", err.Error()))
+		return OutcomeProviderFailed, err
+	}
+	if !nix.RefAllowed(ref, u.AllowedRefs) {
+		slog.Error("Flake ref not allowed.", slog.String("ref", ref), slog.String("flake", target.Flake))
+		return OutcomeRefRejected, fmt.Errorf("flake ref %s not allowed", ref)
+	}
+	return "", nil
+}
+
+/*
+Aborts upgrades that would download more than the configured cap, protecting
+metered connections from unexpectedly large updates. Without a cap the
+estimate is only logged when EstimateDownload is set.
+*/
+func (u *upgrader) checkDownloadSize(ctx context.Context, target Target) (Outcome, error) {
+	if u.MaxDownloadMiB == 0 && !u.EstimateDownload {
+		return "", nil
+	}
+	size, err := u.Rebuilder.DownloadSize(ctx, target)
+	if err != nil {
+		slog.Error("Unable to determine download size.", slog.String("error", err.Error()))
+		return rebuildFailed(err), err
+	}
+	sizeMiB := size >> 20
+	if u.MaxDownloadMiB == 0 {
+		slog.Info("Estimated download size.", slog.Int64("mib", sizeMiB))
+		return "", nil
+	}
+	slog.Info("Download size.", slog.Int64("mib", sizeMiB), slog.Int("max", u.MaxDownloadMiB))
+	if sizeMiB > int64(u.MaxDownloadMiB) {
+		slog.Error("Download size exceeds maximum.", slog.Int64("mib", sizeMiB), slog.Int("max", u.MaxDownloadMiB))
+		return OutcomeDownloadTooLarge, fmt.Errorf("download of %d MiB exceeds maximum of %d MiB", sizeMiB, u.MaxDownloadMiB)
+	}
+	return "", nil
+}
+
+/*
+Rejects upgrades to an older NixOS release or skipping more than one
+release, catching jobset mix-ups, unless explicitly allowed.
+*/
+func (u *upgrader) checkRelease(toplevel string) (Outcome, error) {
+	if u.AllowReleaseChange || u.TargetHost != "" {
+		return "", nil
+	}
+	current, err := nix.SystemRelease(nix.CurrentSystem)
+	if err != nil {
+		slog.Warn("Unable to determine current NixOS release, skipping release check.", slog.String("error", err.Error()))
+		return "", nil
+	}
+	target, err := nix.SystemRelease(toplevel)
+	if err != nil {
+		slog.Warn("Unable to determine target NixOS release, skipping release check.", slog.String("error", err.Error()))
+		return "", nil
+	}
+	steps := current.Steps(target)
+	if steps < 0 || steps > 1 {
+		slog.Error("NixOS release change not allowed.",
+			slog.String("current", current.String()),
+			slog.String("target", target.String()))
+		return OutcomeReleaseRejected, fmt.Errorf("NixOS release change from %s to %s not allowed", current, target)
+	}
+	return "", nil
+}
+
+/*
+Finds critical units a switch would stop or restart, dropping sessions or
+connectivity, and applies the critical restart policy.
+*/
+func (u *upgrader) checkRestarts(ctx context.Context, run *state.Run) (Outcome, error) {
+	if !u.activatesLive() || u.TargetHost != "" {
+		return "", nil
+	}
+	activation, err := u.Rebuilder.DryActivate(ctx, run.Toplevel)
+	if err != nil {
+		slog.Warn("Unable to determine unit restarts, skipping critical restart check.", slog.String("error", err.Error()))
+		return "", nil
+	}
+	critical := u.critical(activation.Disrupted())
+	if len(critical) == 0 {
+		return "", nil
+	}
+
+	units := slog.String("units", strings.Join(critical, ", "))
+	rejected := fmt.Errorf("switch restarts critical units: %s", strings.Join(critical, ", "))
+	switch u.Restarts.Policy {
+	case "warn":
+		slog.Warn("Switch restarts critical units.", units)
+	case "boot":
+		slog.Warn("Switch restarts critical units, staging for boot instead.", units)
+		u.Operation = "boot"
+		u.env.Operation = "boot"
+		run.Operation = "boot"
+	case "prompt":
+		if u.Prompt == nil || !u.Prompt(fmt.Sprintf("Switch restarts critical units: %s. Continue? [y/N] ", strings.Join(critical, ", "))) {
+			slog.Info("Switch not confirmed.", units)
+			return OutcomeRestartRejected, rejected
+		}
+	case "abort":
+		slog.Error("Switch restarts critical units.", units)
+		return OutcomeRestartRejected, rejected
+	}
+	return "", nil
+}
+
+// The units of `units` matching Restarts.CriticalUnits.
+func (u *upgrader) critical(units []string) []string {
+	critical := []string{}
+	for _, unit := range units {
+		for _, pattern := range u.Restarts.CriticalUnits {
+			matched, _ := path.Match(pattern, unit)
+			if matched {
+				critical = append(critical, unit)
+				break
+			}
+		}
+	}
+	return critical
+}
+
+/*
+Snapshots stateful storage before upgrading, so data can be rewound if the
+new generation misbehaves. Old upgrade snapshots are pruned after.
+*/
+func (u *upgrader) takeSnapshots(ctx context.Context) (Outcome, error) {
+	name := snapshots.Name(u.env.BuildID, time.Now())
+	for _, snapshotter := range u.Snapshotters {
+		slog.Info("Taking snapshots.", slog.String("snapshot", name), slog.String("storage", fmt.Sprintf("%+v", snapshotter)))
+		err := snapshotter.Snapshot(ctx, name)
+		if err != nil {
+			slog.Error("Snapshot failed.", slog.String("error", err.Error()))
+			return OutcomeSnapshotFailed, err
+		}
+		err = snapshotter.Prune(ctx, u.SnapshotKeep)
+		if err != nil {
+			slog.Warn("Pruning snapshots failed.", slog.String("error", err.Error()))
+		}
+	}
+	return "", nil
+}
+
+// Stops before activating the prefetched system until it's approved, see Options.Approval.
+func (u *upgrader) checkApproval(ctx context.Context) (Outcome, error) {
+	if u.Approval == nil {
+		return "", nil
+	}
+	approved, err := u.Approval.Load(ctx)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("System fetched, waiting for approval to activate it.", slog.Int("buildid", u.run.BuildID), slog.String("toplevel", u.run.Toplevel))
+		return OutcomeAwaitingApproval, nil
+	}
+	if err != nil {
+		slog.Error("Approval rejected.", slog.String("file", u.Approval.Path), slog.String("error", err.Error()))
+		return OutcomeApprovalRejected, err
+	}
+	if !approved.Approves(u.run.BuildID, u.run.Toplevel) {
+		slog.Info("System fetched, waiting for approval to activate it, the approval is for another build.",
+			slog.Int("buildid", u.run.BuildID),
+			slog.Int("approved", approved.BuildID),
+			slog.String("toplevel", u.run.Toplevel))
+		return OutcomeAwaitingApproval, nil
+	}
+	slog.Info("Activation approved.", slog.Int("buildid", approved.BuildID), slog.String("by", approved.By))
+	return "", nil
+}
+
+/*
+Arms automatic rollback for switches. Remote switches to a target host use
+deploy-rs style magic rollback, confirmed by reconnecting to the target.
+Local switches must be confirmed with the confirm command. Either way the
+system rolls back on its own unless confirmed before u.deadline. Leaves
+u.guard nil if not enabled.
+*/
+func (u *upgrader) armRollback(ctx context.Context) (Outcome, error) {
+	timeout := u.rollbackTimeout()
+	if timeout == 0 {
+		return "", nil
+	}
+
+	guard := &rollback.Guard{Host: u.TargetHost}
+	deadline := time.Now().Add(timeout)
+	err := guard.Arm(ctx, timeout)
+	if err != nil {
+		slog.Error("Arming rollback failed.", slog.String("error", err.Error()))
+		return OutcomeRollbackFailed, err
+	}
+	u.guard, u.deadline = guard, deadline
+	return "", nil
+}
+
+/*
+Disarms the rollback armed for a switch that failed before activating
+anything, the timer would only re-activate the running system. Disarmed
+even when the run was interrupted.
+*/
+func (u *upgrader) disarmRollback(ctx context.Context) {
+	if u.guard == nil {
+		return
+	}
+	err := u.guard.Disarm(context.WithoutCancel(ctx))
+	if err != nil {
+		slog.Warn("Unable to disarm rollback, the running system will be re-activated once it fires.", slog.String("host", u.guard.Host), slog.String("error", err.Error()))
+	}
+	u.guard = nil
+}
+
+// The rollback timeout of the operation, 0 when switches aren't guarded.
+func (u *upgrader) rollbackTimeout() time.Duration {
+	if u.Operation != "switch" {
+		return 0
+	}
+	if u.TargetHost != "" {
+		return u.Rollback.MagicTimeout
+	}
+	return u.Rollback.ConfirmTimeout
+}
+
+/*
+Restarts the armed rollback timer once the switch is done, so the timeout
+counts from the new system rather than from arming. When the target can't
+be reached the timer keeps running, and so does the original deadline.
+*/
+func (u *upgrader) restartRollback(ctx context.Context) {
+	if u.guard == nil {
+		return
+	}
+	deadline := time.Now().Add(u.rollbackTimeout())
+	err := u.guard.Restart(ctx)
+	if err != nil {
+		slog.Warn("Unable to restart rollback timer, confirming within the original timeout.", slog.String("host", u.guard.Host), slog.String("error", err.Error()))
+		return
+	}
+	u.deadline = deadline
+}
+
+/*
+Notifies on-rollback hooks and plugins that the switched system is rolling
+back to the generation `to`, either the one the guard was armed with or the
+one recovered after a failed activation. This is separate from, and
+precedes, the notification of the failed run.
+*/
+func (u *upgrader) rollingBack(ctx context.Context, outcome Outcome, err error, to string) {
+	event := events.Event{
+		Type:         events.RollbackTriggered,
+		Outcome:      string(outcome),
+		Failed:       true,
+		Error:        err.Error(),
+		RollbackFrom: u.run.Toplevel,
+		RollbackTo:   to,
+	}
+	u.publish(ctx, event)
+
+	env := u.env
+	env.Outcome = string(outcome)
+	env.RollbackFrom = event.RollbackFrom
+	env.RollbackTo = event.RollbackTo
+	env.Error = event.Error
+	hookErr := hooks.Run(ctx, "on-rollback", u.Hooks.OnRollback, env)
+	if hookErr != nil {
+		slog.Error("On-rollback hook failed.", slog.String("error", hookErr.Error()))
+	}
+}
+
+/*
+Returns the running system when a failed activation should be recovered
+from, see recoverActivation. Empty when not.
+*/
+func (u *upgrader) recoverable(ctx context.Context) string {
+	if !u.Rollback.RecoverActivation || u.Operation != "switch" || u.TargetHost != "" {
+		return ""
+	}
+	running, err := u.Rebuilder.Running(ctx)
+	if err != nil {
+		slog.Warn("Unable to determine the running system, failed activations won't be recovered.", slog.String("error", err.Error()))
+		return ""
+	}
+	return running
+}
+
+/*
+Re-activates `previous` after switching to the new system failed partway, so
+the system isn't left running a mix of both generations until someone
+intervenes.
+*/
+func (u *upgrader) recoverActivation(ctx context.Context, previous string, err error) error {
+	if previous == "" {
+		return err
+	}
+	slog.Warn("Switch failed partway, re-activating the previous system.", slog.String("previous", previous))
+	return u.restore(ctx, OutcomeActivationFailed, previous, err)
+}
+
+// Whether local switches failing post-switch checks re-activate the previous system.
+func (u *upgrader) revertsChecks() bool {
+	return u.Rollback.VerifyFailure && u.Operation == "switch" && u.TargetHost == ""
+}
+
+/*
+Rolls back to `previous` after a switch failed with `outcome`, setting it as
+the system profile and switching to it. Critical units failing afterwards
+are added to the returned error, along with rollback failures.
+*/
+func (u *upgrader) restore(ctx context.Context, outcome Outcome, previous string, err error) error {
+	u.rollingBack(ctx, outcome, err, previous)
+	recoverErr := u.Rebuilder.Recover(ctx, previous)
+	if recoverErr != nil {
+		slog.Error("Re-activating the previous system failed.", slog.String("error", recoverErr.Error()))
+		return errors.Join(err, fmt.Errorf("recovering %s: %w", previous, recoverErr))
+	}
+	if u.run.Phase == state.PhaseProfileSet {
+		// the profile is the previous system again
+		u.savePhase(u.run, state.PhasePrefetched)
+	}
+	if u.guard != nil && u.guard.Host == "" {
+		disarmErr := u.guard.Disarm(context.WithoutCancel(ctx))
+		if disarmErr != nil {
+			slog.Warn("Unable to disarm rollback after recovering.", slog.String("error", disarmErr.Error()))
+		}
+	}
+
+	failed, listErr := u.Rebuilder.FailedUnits(ctx)
+	if listErr != nil {
+		slog.Warn("Unable to verify critical units after recovering.", slog.String("error", listErr.Error()))
+		return err
+	}
+	critical := u.critical(failed)
+	if len(critical) > 0 {
+		slog.Error("Critical units failed after recovering.", slog.String("units", strings.Join(critical, ", ")))
+		return errors.Join(err, fmt.Errorf("critical units failed after recovering: %s", strings.Join(critical, ", ")))
+	}
+	slog.Info("Previous system re-activated.", slog.String("previous", previous))
+	return err
+}
+
+// Enables boot counting for the newly staged generation.
+func (u *upgrader) enableBootCounting() error {
+	generation, err := nix.SystemGeneration()
+	if err != nil {
+		return err
+	}
+	slog.Info("Enabling boot counting.", slog.Int("generation", generation), slog.Int("tries", u.BootCounting.Tries))
+	return u.BootCounting.Loader.EnableBootCounting(generation, u.BootCounting.Tries)
+}
+
+// Drains the kubernetes node if enabled.
+func (u *upgrader) drain(ctx context.Context) (Outcome, error) {
+	if u.Kubernetes == nil || u.drained {
+		return "", nil
+	}
+	// a partial drain still needs to be reverted
+	u.drained = true
+	err := u.Kubernetes.Node.Drain(ctx, u.Kubernetes.DrainArgs)
+	if err != nil {
+		slog.Error("Kubernetes node drain failed.", slog.String("error", err.Error()))
+		return OutcomeDrainFailed, err
+	}
+	return "", nil
+}
+
+/*
+Uncordons the kubernetes node if enabled. Only nodes drained by
+nixos-hydra-upgrade are uncordoned, including drains from previous runs
+that rebooted the system. Drains are reverted even when the run was
+interrupted.
+*/
+func (u *upgrader) uncordon(ctx context.Context) {
+	if u.Kubernetes == nil {
+		return
+	}
+	err := u.Kubernetes.Node.Uncordon(context.WithoutCancel(ctx))
+	if err != nil {
+		slog.Error("Kubernetes node uncordon failed.", slog.String("error", err.Error()))
+		return
+	}
+	u.drained = false
+}
+
+/*
+Whether the operation activates the new system on the running machine, so
+switch gates, restart checks, and post-checks apply.
+*/
+func (u *upgrader) activatesLive() bool {
+	return u.Operation == "switch" || u.Operation == OperationTestThenBoot
+}
+
+// The operation the new system is first activated with.
+func (u *upgrader) activation() string {
+	if u.Operation == OperationTestThenBoot {
+		return "test"
+	}
+	return u.Operation
+}
+
+/*
+Installs the tested system as the boot default once it passed post-checks,
+completing OperationTestThenBoot.
+*/
+func (u *upgrader) installBoot(ctx context.Context) (Outcome, error) {
+	slog.Info("Tested system passed checks, installing it for boot.", slog.String("flake", u.target.Flake))
+	err := u.Rebuilder.Rebuild(ctx, "boot", u.target)
+	if err != nil {
+		slog.Error("Installing the tested system for boot failed, it will be rolled back on reboot.", slog.String("error", err.Error()))
+		return rebuildFailed(err), err
+	}
+	return "", nil
+}
+
+/*
+Re-activates the system running before a test activation that failed its
+post-checks. The boot default was never changed, so rebooting rolls back
+when this fails or the previous system is unknown.
+*/
+func (u *upgrader) revertTest(ctx context.Context, err error) {
+	if u.run.Previous == "" {
+		slog.Warn("Previous system unknown, reboot to roll back the tested system.")
+		return
+	}
+	u.rollingBack(ctx, OutcomeVerifyFailed, err, u.run.Previous)
+	revertErr := u.Rebuilder.Activate(ctx, u.run.Previous, "test")
+	if revertErr != nil {
+		slog.Error("Re-activating the previous system failed, reboot to roll back.", slog.String("error", revertErr.Error()))
+	}
+}
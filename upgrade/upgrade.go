@@ -0,0 +1,495 @@
+/*
+Package upgrade implements the gated NixOS upgrade flow behind the
+nixos-hydra-upgrade CLI, for embedding in other Go tools and orchestrators.
+
+An upgrade resolves the latest build from a Provider, checks gates and
+health checks, and upgrades the system with a Rebuilder:
+
+	outcome, err := upgrade.Run(ctx, upgrade.Options{
+		Operation: "switch",
+		Provider:  upgrade.HydraProvider{Client: client},
+		Rebuilder: upgrade.NixRebuilder{Host: "myhost"},
+	})
+*/
+package upgrade
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/approval"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/bootloader"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hooks"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/kubernetes"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/plugins"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/rollback"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/snapshots"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+)
+
+// Result of an upgrade, provided to hooks as OUTCOME.
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	// the system already runs the latest build
+	OutcomeUpToDate Outcome = "up-to-date"
+	// the latest build has not finished yet
+	OutcomeUnfinished Outcome = "unfinished"
+	// a previously staged generation is waiting for a reboot
+	OutcomePendingBoot Outcome = "pending-boot"
+	// a gate blocked the upgrade, a later run will try again
+	OutcomeDeferred Outcome = "deferred"
+	// a newer build is available, see Options.Check
+	OutcomeAvailable Outcome = "available"
+	// the network is down, see Options.Connectivity
+	OutcomeOffline Outcome = "offline"
+	// the newer build was fetched and awaits activation, see Options.Prefetch
+	OutcomePrefetched Outcome = "prefetched"
+	// the newer build was fetched and awaits approval, see Options.Approval
+	OutcomeAwaitingApproval Outcome = "awaiting-approval"
+	// there's no prefetched build to activate, see StagedProvider
+	OutcomeNothingStaged Outcome = "nothing-staged"
+	// another run holds the state file, see state.Acquire
+	OutcomeBusy Outcome = "busy"
+
+	OutcomeProviderFailed    Outcome = "provider-failed"
+	OutcomeBuildFailed       Outcome = "build-failed"
+	OutcomeDownloadTooLarge  Outcome = "download-too-large"
+	OutcomeGateFailed        Outcome = "gate-failed"
+	OutcomeRefRejected       Outcome = "ref-rejected"
+	OutcomeReleaseRejected   Outcome = "release-rejected"
+	OutcomeRestartRejected   Outcome = "restart-rejected"
+	OutcomeHealthCheckFailed Outcome = "healthcheck-failed"
+	// the approval file isn't signed by an allowed signer or can't be read
+	OutcomeApprovalRejected Outcome = "approval-rejected"
+	// the prefetched closure has paths not signed by Options.PinnedKeys
+	OutcomeUntrusted Outcome = "untrusted"
+	// the prefetched system differs from hydra's build or isn't reproducible, see Options.Reproducibility
+	OutcomeBuildMismatch Outcome = "build-mismatch"
+	// a post-switch check failed, see Options.PostChecks
+	OutcomeVerifyFailed   Outcome = "verify-failed"
+	OutcomeHookFailed     Outcome = "hook-failed"
+	OutcomeDrainFailed    Outcome = "drain-failed"
+	OutcomeSnapshotFailed Outcome = "snapshot-failed"
+	OutcomeRebuildFailed  Outcome = "rebuild-failed"
+	// the target system failed to evaluate
+	OutcomeEvalFailed Outcome = "eval-failed"
+	// fetching flake inputs or substituting the target system failed
+	OutcomeFetchFailed Outcome = "fetch-failed"
+	// switch-to-configuration or the bootloader install failed
+	OutcomeActivationFailed Outcome = "activation-failed"
+	// a nix or nixos-rebuild process produced no output for too long and was killed
+	OutcomeStalled            Outcome = "stalled"
+	OutcomeRebootFailed       Outcome = "reboot-failed"
+	OutcomeBootCountingFailed Outcome = "bootcounting-failed"
+	OutcomeBootFallback       Outcome = "boot-fallback"
+	OutcomeRollbackFailed     Outcome = "rollback-failed"
+	OutcomeRolledBack         Outcome = "rolled-back"
+	// the process running a previous upgrade crashed mid-run, see events.RunCrashed
+	OutcomeCrashed Outcome = "crashed"
+)
+
+var successes = []Outcome{OutcomeSuccess, OutcomeUpToDate, OutcomeUnfinished, OutcomePendingBoot, OutcomeDeferred, OutcomeAvailable, OutcomeOffline, OutcomePrefetched, OutcomeAwaitingApproval, OutcomeNothingStaged, OutcomeBusy}
+
+// Whether the outcome is a failure, as opposed to success or nothing to do yet.
+func (outcome Outcome) Failed() bool {
+	return !slices.Contains(successes, outcome)
+}
+
+// failures retrying won't fix, or that need an operator to look at the system first
+var permanent = []Outcome{OutcomeEvalFailed, OutcomeActivationFailed, OutcomeBuildMismatch, OutcomeUntrusted, OutcomeApprovalRejected}
+
+// Whether a failed phase may succeed when retried, see Options.Retries.
+func (outcome Outcome) Retryable() bool {
+	return outcome.Failed() && !slices.Contains(permanent, outcome)
+}
+
+// Hook commands run with `sh -c` around the upgrade, see hooks.Run.
+type Hooks struct {
+	// before switching, failures abort the upgrade
+	PreSwitch []string
+	// after a successful switch
+	PostSwitch []string
+	// before rebooting, failures cancel the reboot
+	PreReboot []string
+	// while workloads block a reboot, to shut down or migrate them
+	Evacuate []string
+	// when the upgrade fails
+	OnFailure []string
+	// when an automatic rollback is triggered, before on-failure hooks
+	OnRollback []string
+	// after each phase, with PHASE and PHASE_SECONDS
+	Phase []string
+}
+
+// Policy for switches that would stop or restart critical units.
+type RestartPolicy struct {
+	// unit name globs
+	CriticalUnits []string
+	// warn, boot, prompt, or abort
+	Policy string
+}
+
+// Automatic rollback of switches that aren't confirmed in time, 0 disables.
+type RollbackPolicy struct {
+	// local switches, confirmed with the confirm command
+	ConfirmTimeout time.Duration
+	// switches to a remote target host, confirmed by reconnecting
+	MagicTimeout time.Duration
+	/*
+		Re-activates the previous system when a local switch fails partway,
+		see upgrader.recoverActivation.
+	*/
+	RecoverActivation bool
+	/*
+		Re-activates the previous system right away when post-switch checks
+		fail after a local switch, rather than leaving it to ConfirmTimeout.
+	*/
+	VerifyFailure bool
+}
+
+// systemd-boot boot counting for boot upgrades.
+type BootCounting struct {
+	Loader bootloader.SystemdBoot
+	Tries  int
+}
+
+/*
+Software bill of materials written for prefetched systems, to
+Dir/<build id>.spdx.json or .cdx.json.
+*/
+type SBOM struct {
+	// spdx or cyclonedx
+	Format string
+	Dir    string
+	/*
+		flake nixosConfigurations.<name> system package licenses are
+		evaluated from, empty leaves licenses out
+	*/
+	Host string
+}
+
+// Re-execs the nixos-hydra-upgrade of newly switched systems.
+type Reexec struct {
+	// executable path within a system toplevel
+	Binary string
+	// replaces the running process with `binary`, only returning on failure
+	Exec func(binary string) error
+}
+
+// Kubernetes node drained before switching or rebooting.
+type Kubernetes struct {
+	Node      kubernetes.Node
+	DrainArgs []string
+}
+
+/*
+Operation activating the new system with `test`, leaving the boot default
+alone, and only installing it for boot once post-checks pass. A reboot
+rolls back until then.
+*/
+const OperationTestThenBoot = "test-then-boot"
+
+type Options struct {
+	// boot, switch, or OperationTestThenBoot
+	Operation string
+	// reboot after a successful upgrade
+	Reboot bool
+	// only check whether a newer build is available, without fetching or activating it
+	Check bool
+	/*
+		stop once the newer build is fetched, before activating it. A later
+		run resumes from the prefetched system, see StateFile
+	*/
+	Prefetch  bool
+	Provider  Provider
+	Rebuilder Rebuilder
+	// checked first, failing ends the run quietly with OutcomeOffline. nil skips the check
+	Connectivity Checker
+	Gates        Gates
+	// checked before starting a new upgrade
+	HealthChecks []Checker
+	// checked after switching locally, failing ends the run with OutcomeVerifyFailed
+	PostChecks []Checker
+	/*
+		updates these options with upgrade policy read from the target, once
+		the latest build is known and before upgrade gates are checked. nil
+		keeps the options as they are
+	*/
+	Policy func(ctx context.Context, target Target, opts *Options) error
+	Hooks  Hooks
+	// records upgrade progress so interrupted upgrades resume, empty disables
+	StateFile string
+	/*
+		remember the latest build found up to date or applied in StateFile,
+		ending runs finding the same build latest with OutcomeUpToDate before
+		resolving its flake or checking upgrade gates, until hydra reports a
+		newer build or the running system changes
+	*/
+	SkipSettled bool
+	// gc root protecting prefetched systems until they're activated, empty disables
+	GCRoot string
+	// archives artifacts of prefetched builds, nil disables
+	Artifacts Archiver
+	// nil disables
+	SBOM *SBOM
+	// policy for staged generations pending a reboot: skip, warn, restage, or reboot
+	PendingBoot string
+	/*
+		flake url builds are expected to come from, compared with
+		nix.FlakeOrigin on every run. Builds from elsewhere publish an
+		events.OriginDrift warning. Empty disables
+	*/
+	ExpectedOrigin string
+	// publishes events.JobsetStale when no successful build is recent enough, nil disables
+	Freshness *Freshness
+	// only upgrade to flakes tracking these git refs, empty allows any
+	AllowedRefs []string
+	/*
+		verifies prefetched systems against hydra's build before activating
+		them: eval compares the locally evaluated output path to hydra's,
+		rebuild also rebuilds the toplevel with nix build --check. Empty
+		disables
+	*/
+	Reproducibility string
+	/*
+		signing keys every substituted path of the prefetched closure must
+		be signed with, verified before activating regardless of nix.conf.
+		Empty disables
+	*/
+	PinnedKeys []string
+	// abort upgrades downloading more than this, 0 disables
+	MaxDownloadMiB int
+	// log the estimated download of every upgrade, even without a cap
+	EstimateDownload bool
+	// allow upgrades to older NixOS releases or skipping releases
+	AllowReleaseChange bool
+	// ssh destination when the Rebuilder deploys to another machine
+	TargetHost string
+	Restarts   RestartPolicy
+	/*
+		takes a lock keeping the system from sleeping or shutting down while
+		the target is prefetched and activated, returning its release. nil
+		takes no lock
+	*/
+	Inhibit func(ctx context.Context) (func(), error)
+	// asks the operator a yes/no question, nil always answers no
+	Prompt func(question string) bool
+	// storage snapshotted before switching
+	Snapshotters []snapshots.Snapshotter
+	// upgrade snapshots to keep, 0 keeps all
+	SnapshotKeep int
+	Rollback     RollbackPolicy
+	// nil disables boot counting
+	BootCounting *BootCounting
+	// nil disables draining
+	Kubernetes *Kubernetes
+	/*
+		stop once the newer build is prefetched until it's approved, a later
+		run activates it. nil activates without approval
+	*/
+	Approval *approval.File
+	/*
+		after switching locally, resume the run in the new system's
+		executable when it differs from ours. Requires StateFile, nil disables
+	*/
+	Reexec *Reexec
+	// receive lifecycle events in addition to logging, hooks, and plugins
+	Sinks []events.Sink
+	// executables run as gates, health checks, and notification sinks, see package plugins. Empty disables
+	PluginDir string
+	// times failed phases are retried, none by default, see Outcome.Retryable
+	Retries    map[Phase]int
+	RetryDelay time.Duration
+	// resource limits of the commands phases run, none by default
+	Limits map[Phase]runner.Limits
+	/*
+		longest time an unfinished latest build is waited for, polling every
+		WaitInterval, before the run ends as OutcomeUnfinished. 0 doesn't wait
+	*/
+	Wait         time.Duration
+	WaitInterval time.Duration
+	/*
+		times nixos-rebuild is retried when switching fails to fetch the
+		system, other failures are never retried
+	*/
+	SwitchRetries    int
+	SwitchRetryDelay time.Duration
+	/*
+		outcome and number of the failed runs in a row preceding this one,
+		e.g. tracked by the daemon. A run failing the same way again reports
+		how many failed in a row, and notifies plugins with high priority
+	*/
+	PreviousFailure  Outcome
+	PreviousFailures int
+	/*
+		operator note on why the run was triggered, e.g. a change ticket.
+		Recorded with the run's state, events, and hooks
+	*/
+	Annotation string
+}
+
+// Performs upgrades.
+type Upgrader interface {
+	/*
+		Runs an upgrade to the latest build. Returns a non-nil error
+		describing why the upgrade did not complete, for failed outcomes and
+		OutcomeDeferred.
+	*/
+	Run(ctx context.Context) (Outcome, error)
+}
+
+type upgrader struct {
+	Options
+	env   hooks.Env
+	state state.State
+	// set once this upgrade drains the kubernetes node
+	drained bool
+	plugins []plugins.Plugin
+	events  events.Bus
+
+	// carried between phases
+	target   Target
+	restage  bool
+	run      *state.Run
+	guard    *rollback.Guard
+	deadline time.Time
+	// timing of the phases run so far
+	phases []events.PhaseTiming
+	// releases the lock taken with Options.Inhibit, nil while not held
+	release func()
+	// failed units before switching, nil if unknown
+	failedBefore []string
+	// failures of advisory checks, see Advisory
+	warnings []string
+	// flake of the running system, once compared to the target
+	current nix.FlakeMetadata
+	// bill of materials of the target system, once written
+	sbom string
+}
+
+func New(opts Options) Upgrader {
+	u := &upgrader{Options: opts}
+	u.events.Subscribe(events.LogSink{}, events.SinkFunc(u.runPhaseHooks), events.SinkFunc(u.notifyPlugins))
+	u.events.Subscribe(opts.Sinks...)
+	return u
+}
+
+// Runs an upgrade with `opts`, see Upgrader.
+func Run(ctx context.Context, opts Options) (Outcome, error) {
+	return New(opts).Run(ctx)
+}
+
+func (u *upgrader) Run(ctx context.Context) (Outcome, error) {
+	u.env = hooks.Env{Operation: u.Operation, Annotation: u.Annotation}
+	u.phases = nil
+	u.current = nix.FlakeMetadata{}
+	u.sbom = ""
+	u.warnings = nil
+	u.publish(ctx, events.Event{Type: events.RunStarted})
+	started := time.Now()
+	lock, outcome, err := u.lockState()
+	if lock != nil {
+		defer lock.Unlock()
+	}
+	if outcome == "" {
+		outcome, err = u.runPhases(ctx)
+		u.parkRun()
+	}
+	if outcome.Failed() {
+		u.env.Failures = 1
+		if outcome == u.PreviousFailure {
+			u.env.Failures = u.PreviousFailures + 1
+		}
+		u.fail(ctx, outcome)
+	} else if outcome == OutcomeDeferred && u.drained {
+		u.uncordon(ctx)
+	}
+	event := finished(events.RunFinished, started, outcome, err)
+	event.Failures = u.env.Failures
+	event.Phases = u.phases
+	event.CurrentRev = u.current.Revision
+	event.SBOM = u.sbom
+	event.Warnings = u.warnings
+	if u.current.LastModified > 0 {
+		event.CurrentModified = time.Unix(u.current.LastModified, 0)
+	}
+	if u.target.Metadata.LastModified > 0 {
+		event.LatestModified = time.Unix(u.target.Metadata.LastModified, 0)
+	}
+	u.publish(ctx, event)
+	return outcome, err
+}
+
+// Publishes `event`, describing the run so far.
+func (u *upgrader) publish(ctx context.Context, event events.Event) {
+	event.Operation = u.Operation
+	event.Check = u.Check
+	event.BuildID = u.env.BuildID
+	event.FlakeRev = u.env.FlakeRev
+	event.FailedUnits = u.env.FailedUnits
+	event.Annotation = u.env.Annotation
+	u.events.Publish(ctx, event)
+}
+
+func finished(kind events.Type, started time.Time, outcome Outcome, err error) events.Event {
+	event := events.Event{
+		Type:     kind,
+		Outcome:  string(outcome),
+		Failed:   outcome != "" && outcome.Failed(),
+		Duration: time.Since(started),
+	}
+	if err != nil {
+		event.Error = err.Error()
+		event.Stderr = runner.Stderr(err)
+	}
+	return event
+}
+
+// Reboots into the staged generation, after reboot gates and pre-reboot hooks.
+func (u *upgrader) reboot(ctx context.Context) (Outcome, error) {
+	outcome, err := u.check(ctx, u.Gates.Reboot, Target{BuildID: u.env.BuildID})
+	if outcome != "" {
+		return outcome, err
+	}
+	outcome, err = u.checkWorkloads(ctx)
+	if outcome != "" {
+		return outcome, err
+	}
+	err = hooks.Run(ctx, "pre-reboot", u.Hooks.PreReboot, u.env)
+	if err != nil {
+		slog.Error("Pre-reboot hook failed, skipping reboot.", slog.String("error", err.Error()))
+		return OutcomeHookFailed, err
+	}
+	outcome, err = u.drain(ctx)
+	if outcome != "" {
+		return outcome, err
+	}
+	slog.Info("Initiating reboot")
+	err = u.Rebuilder.Reboot(ctx)
+	if err != nil {
+		slog.Error("Reboot failed.", slog.String("error", err.Error()))
+		return OutcomeRebootFailed, err
+	}
+	return OutcomeSuccess, nil
+}
+
+// Runs on-failure hooks for `outcome`, reverting drains and discarding progress.
+func (u *upgrader) fail(ctx context.Context, outcome Outcome) {
+	if u.drained {
+		u.uncordon(ctx)
+	}
+	// failed upgrades start over instead of resuming
+	u.clearRun()
+	u.env.Outcome = string(outcome)
+	err := hooks.Run(ctx, "on-failure", u.Hooks.OnFailure, u.env)
+	if err != nil {
+		slog.Error("On-failure hook failed.", slog.String("error", err.Error()))
+	}
+}
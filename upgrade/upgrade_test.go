@@ -0,0 +1,1063 @@
+package upgrade_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/approval"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/events"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/gates"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/hydra"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/rollback"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/state"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/systemd"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/upgrade"
+)
+
+type fakeProvider struct {
+	target upgrade.Target
+	err    error
+}
+
+func (provider fakeProvider) Latest(ctx context.Context) (upgrade.Target, error) {
+	return provider.target, provider.err
+}
+
+func (provider fakeProvider) Resolve(ctx context.Context, target *upgrade.Target) error {
+	target.Metadata = nix.FlakeMetadata{LastModified: 2, Revision: "new", Locked: nix.FlakeLock{NarHash: "sha256-new"}}
+	return nil
+}
+
+func (provider fakeProvider) Ref(ctx context.Context, target upgrade.Target) (string, error) {
+	return "refs/heads/main", nil
+}
+
+// Reports the latest build unfinished until polled `unfinished` times.
+type finishingProvider struct {
+	fakeProvider
+	unfinished int
+	polls      *int
+}
+
+func (provider finishingProvider) Latest(ctx context.Context) (upgrade.Target, error) {
+	*provider.polls++
+	if *provider.polls <= provider.unfinished {
+		return provider.target, upgrade.ErrUnfinished
+	}
+	return provider.target, provider.err
+}
+
+type fakeRebuilder struct {
+	current  nix.FlakeMetadata
+	rebuilds []string
+	// returned by Rebuild
+	err error
+	// rebuilds failing with err, 0 fails every rebuild
+	failures int
+	// failed units listed before and after switching
+	failedUnits [][]string
+	// returned by Prefetch, a fake store path if empty
+	toplevel string
+	// returned by Running, unknown if empty
+	running string
+	// toplevels recovered to
+	recovered []string
+	// "<operation> <toplevel>" of each Activate
+	activated []string
+	// called by Rebuild, if set
+	onRebuild func()
+}
+
+func (rebuilder *fakeRebuilder) Current(ctx context.Context) (nix.FlakeMetadata, error) {
+	return rebuilder.current, nil
+}
+
+func (rebuilder *fakeRebuilder) DownloadSize(ctx context.Context, target upgrade.Target) (int64, error) {
+	return 0, nil
+}
+
+func (rebuilder *fakeRebuilder) Prefetch(ctx context.Context, target upgrade.Target) (string, error) {
+	if rebuilder.toplevel != "" {
+		return rebuilder.toplevel, nil
+	}
+	return "/nix/store/fake-nixos-system", nil
+}
+
+func (rebuilder *fakeRebuilder) CheckBuild(ctx context.Context, target upgrade.Target) error {
+	return nil
+}
+
+func (rebuilder *fakeRebuilder) DryActivate(ctx context.Context, toplevel string) (nix.Activation, error) {
+	return nix.Activation{}, nil
+}
+
+func (rebuilder *fakeRebuilder) FailedUnits(ctx context.Context) ([]string, error) {
+	if len(rebuilder.failedUnits) == 0 {
+		return []string{}, nil
+	}
+	units := rebuilder.failedUnits[0]
+	rebuilder.failedUnits = rebuilder.failedUnits[1:]
+	return units, nil
+}
+
+func (rebuilder *fakeRebuilder) Rebuild(ctx context.Context, operation string, target upgrade.Target) error {
+	rebuilder.rebuilds = append(rebuilder.rebuilds, operation)
+	if rebuilder.onRebuild != nil {
+		rebuilder.onRebuild()
+	}
+	if rebuilder.failures > 0 && len(rebuilder.rebuilds) > rebuilder.failures {
+		return nil
+	}
+	return rebuilder.err
+}
+
+func (rebuilder *fakeRebuilder) Activate(ctx context.Context, toplevel string, operation string) error {
+	rebuilder.activated = append(rebuilder.activated, operation+" "+toplevel)
+	return nil
+}
+
+func (rebuilder *fakeRebuilder) Running(ctx context.Context) (string, error) {
+	if rebuilder.running == "" {
+		return "", errors.New("unknown running system")
+	}
+	return rebuilder.running, nil
+}
+
+func (rebuilder *fakeRebuilder) Recover(ctx context.Context, toplevel string) error {
+	rebuilder.recovered = append(rebuilder.recovered, toplevel)
+	return nil
+}
+
+func (rebuilder *fakeRebuilder) Reboot(ctx context.Context) error {
+	return nil
+}
+
+type fakeArchiver struct {
+	archived []int
+	err      error
+}
+
+func (archiver *fakeArchiver) Archive(ctx context.Context, target upgrade.Target) error {
+	archiver.archived = append(archiver.archived, target.BuildID)
+	return archiver.err
+}
+
+func options(provider fakeProvider, rebuilder *fakeRebuilder) upgrade.Options {
+	return upgrade.Options{
+		Operation:          "boot",
+		Provider:           provider,
+		Rebuilder:          rebuilder,
+		AllowReleaseChange: true,
+	}
+}
+
+func TestRun(t *testing.T) {
+	provider := fakeProvider{target: upgrade.Target{BuildID: 1}}
+
+	t.Run("upgrades to newer builds", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		outcome, err := upgrade.Run(context.Background(), options(provider, rebuilder))
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.Equal(t, err, nil)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot"})
+	})
+
+	t.Run("reports phase timing", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		finished := record(&opts, events.RunFinished)
+		upgrade.Run(context.Background(), opts)
+		phases := []string{}
+		for _, timing := range (*finished)[0].Phases {
+			phases = append(phases, timing.Phase)
+		}
+		assert.ArrayEqual(t, phases, []string{"gate", "resolve", "preflight", "prefetch", "activate", "verify", "reboot"})
+	})
+
+	t.Run("reports the stderr of failed commands", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{
+			current: nix.FlakeMetadata{LastModified: 1},
+			err:     &runner.Error{Err: errors.New("exit status 1"), Stderr: "error: builder for foo failed\n"},
+		}
+		opts := options(provider, rebuilder)
+		finished := record(&opts, events.RunFinished)
+		upgrade.Run(context.Background(), opts)
+		assert.Equal(t, (*finished)[0].Stderr, "error: builder for foo failed\n")
+	})
+
+	t.Run("prefetches for a later run to activate", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.StateFile = filepath.Join(t.TempDir(), "state.json")
+		opts.Prefetch = true
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomePrefetched)
+		assert.Equal(t, outcome.Failed(), false)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+
+		opts.Prefetch = false
+		outcome, _ = upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot"})
+	})
+
+	t.Run("reports runs left in progress by crashed processes", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.StateFile = filepath.Join(t.TempDir(), "state.json")
+		// beyond the kernel's pid_max, never a running process
+		crashed := state.Run{BuildID: 1, Operation: "boot", Phase: state.PhaseGated, PID: 1 << 30}
+		err := state.State{Run: &crashed}.Save(opts.StateFile)
+		if err != nil {
+			panic(err)
+		}
+		temp := filepath.Join(filepath.Dir(opts.StateFile), ".state-123.json")
+		os.WriteFile(temp, []byte("{"), 0600)
+		os.Chtimes(temp, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+
+		crashes := record(&opts, events.RunCrashed)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.Equal(t, len(*crashes), 1)
+		assert.Equal(t, (*crashes)[0].BuildID, 1)
+		assert.Equal(t, (*crashes)[0].Phase, string(state.PhaseGated))
+		_, err = os.Stat(temp)
+		assert.Equal(t, errors.Is(err, os.ErrNotExist), true)
+
+		crashes = record(&opts, events.RunCrashed)
+		upgrade.Run(context.Background(), opts)
+		assert.Equal(t, len(*crashes), 0)
+	})
+
+	t.Run("reports runs of an earlier boot as crashed", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.StateFile = filepath.Join(t.TempDir(), "state.json")
+		// the pid is running again after power loss, here as this process
+		crashed := state.Run{BuildID: 1, Operation: "boot", Phase: state.PhasePrefetched}
+		crashed.Own()
+		crashed.Boot = "00000000-0000-0000-0000-000000000000"
+		err := state.State{Run: &crashed}.Save(opts.StateFile)
+		if err != nil {
+			panic(err)
+		}
+		crashes := record(&opts, events.RunCrashed)
+		upgrade.Run(context.Background(), opts)
+		assert.Equal(t, len(*crashes), 1)
+	})
+
+	t.Run("stops while another run holds the state file", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.StateFile = filepath.Join(t.TempDir(), "state.json")
+		lock, err := state.Acquire(opts.StateFile)
+		if err != nil {
+			panic(err)
+		}
+		outcome, err := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeBusy)
+		assert.Equal(t, outcome.Failed(), false)
+		assert.Equal(t, err, state.ErrLocked)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+
+		lock.Unlock()
+		outcome, _ = upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+	})
+
+	t.Run("archives artifacts without failing the upgrade", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		archiver := &fakeArchiver{err: errors.New("download failed")}
+		opts := options(provider, rebuilder)
+		opts.Artifacts = archiver
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, archiver.archived, []int{1})
+	})
+
+	t.Run("reports the sbom of the prefetched system", func(t *testing.T) {
+		original := nix.Runner
+		t.Cleanup(func() { nix.Runner = original })
+		nix.Runner = &runner.Fake{Outputs: map[string]string{
+			"nix path-info --json --recursive /nix/store/fake-nixos-system": `{"/nix/store/fake-nixos-system": {}}`,
+		}}
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.SBOM = &upgrade.SBOM{Format: "cyclonedx", Dir: t.TempDir()}
+		finished := record(&opts, events.RunFinished)
+		upgrade.Run(context.Background(), opts)
+		assert.Equal(t, (*finished)[0].SBOM, filepath.Join(opts.SBOM.Dir, "1.cdx.json"))
+		_, err := os.Stat((*finished)[0].SBOM)
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("only checks for newer builds", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Check = true
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeAvailable)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+
+	t.Run("skips builds already running", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 2}}
+		outcome, _ := upgrade.Run(context.Background(), options(provider, rebuilder))
+		assert.Equal(t, outcome, upgrade.OutcomeUpToDate)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+
+	t.Run("skips builds of the running source", func(t *testing.T) {
+		// e.g. a mirror with rewritten timestamps
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1, Locked: nix.FlakeLock{NarHash: "sha256-new"}}}
+		outcome, _ := upgrade.Run(context.Background(), options(provider, rebuilder))
+		assert.Equal(t, outcome, upgrade.OutcomeUpToDate)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+
+	t.Run("reports unfinished builds without waiting", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{}
+		unfinished := fakeProvider{err: upgrade.ErrUnfinished}
+		outcome, _ := upgrade.Run(context.Background(), options(unfinished, rebuilder))
+		assert.Equal(t, outcome, upgrade.OutcomeUnfinished)
+		assert.Equal(t, outcome.Failed(), false)
+	})
+
+	t.Run("defers blocked upgrades", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Gates.Upgrade = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return &gates.BlockedError{Gate: "test", Reason: "blocked"}
+		})}
+		outcome, err := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeDeferred)
+		assert.Equal(t, outcome.Failed(), false)
+		var blocked *gates.BlockedError
+		assert.Equal(t, errors.As(err, &blocked), true)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+
+	t.Run("applies policy from the target before upgrade gates", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Policy = func(ctx context.Context, target upgrade.Target, opts *upgrade.Options) error {
+			assert.Equal(t, target.BuildID, 1)
+			opts.Gates.Upgrade = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+				return &gates.BlockedError{Gate: "policy", Reason: "blocked"}
+			})}
+			return nil
+		}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeDeferred)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+
+	t.Run("inhibits sleep while fetching and activating", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		taken, held := 0, false
+		opts.Inhibit = func(ctx context.Context) (func(), error) {
+			taken++
+			held = true
+			return func() { held = false }, nil
+		}
+		opts.Gates.Switch = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			assert.Equal(t, held, true)
+			return nil
+		})}
+		opts.PostChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			assert.Equal(t, held, false)
+			return nil
+		})}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.Equal(t, taken, 1)
+		assert.Equal(t, held, false)
+	})
+
+	t.Run("fails on unhealthy canaries", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.HealthChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return errors.New("unreachable")
+		})}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeHealthCheckFailed)
+		assert.Equal(t, outcome.Failed(), true)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+
+	t.Run("reports advisory check failures without stopping", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.HealthChecks = []upgrade.Checker{upgrade.Advisory{Name: "ping:canary", Checker: upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return errors.New("unreachable")
+		})}}
+		opts.Gates.Upgrade = []upgrade.Checker{upgrade.Advisory{Name: "flake-check", Checker: upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return &gates.BlockedError{Gate: "flake-check", Reason: "checks failed"}
+		})}}
+		finished := record(&opts, events.RunFinished)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot"})
+		assert.ArrayEqual(t, (*finished)[0].Warnings, []string{"flake-check: flake-check: checks failed", "ping:canary: unreachable"})
+	})
+
+	t.Run("skips runs while offline", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Connectivity = upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return errors.New("offline: no default route")
+		})
+		outcome, err := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeOffline)
+		assert.Equal(t, outcome.Failed(), false)
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("rejects refs not allowed", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.AllowedRefs = []string{"refs/heads/release"}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeRefRejected)
+	})
+
+	t.Run("warns when builds drift from the expected origin", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 2}}
+		drifted := fakeProvider{target: upgrade.Target{BuildID: 1, Flake: "github:other/nixos/abc"}}
+		opts := options(drifted, rebuilder)
+		opts.ExpectedOrigin = "github:example/nixos"
+		drifts := record(&opts, events.OriginDrift)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeUpToDate)
+		assert.Equal(t, len(*drifts), 1)
+		assert.Equal(t, (*drifts)[0].Flake, "github:other/nixos/abc")
+
+		opts = options(drifted, rebuilder)
+		opts.ExpectedOrigin = "github:other/nixos"
+		drifts = record(&opts, events.OriginDrift)
+		upgrade.Run(context.Background(), opts)
+		assert.Equal(t, len(*drifts), 0)
+	})
+
+	t.Run("skips settled builds until a newer build or system", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}, running: "/nix/store/system-a"}
+		opts := options(provider, rebuilder)
+		opts.StateFile = fmt.Sprintf("%v/state.json", t.TempDir())
+		opts.SkipSettled = true
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		saved, _ := state.Load(opts.StateFile)
+		assert.Equal(t, saved.Settled.BuildID, 1)
+		assert.Equal(t, saved.Settled.System, "/nix/store/system-a")
+
+		// the boot upgrade isn't running yet, but the build was applied
+		outcome, _ = upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeUpToDate)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot"})
+
+		rebuilder.running = "/nix/store/system-b"
+		outcome, _ = upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot", "boot"})
+
+		opts.Provider = fakeProvider{target: upgrade.Target{BuildID: 2}}
+		outcome, _ = upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot", "boot", "boot"})
+	})
+
+	t.Run("classifies stalled rebuilds", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{
+			current: nix.FlakeMetadata{LastModified: 1},
+			err:     fmt.Errorf("nixos-rebuild: no output for 30m0s: %w", runner.ErrStalled),
+		}
+		outcome, err := upgrade.Run(context.Background(), options(provider, rebuilder))
+		assert.Equal(t, outcome, upgrade.OutcomeStalled)
+		assert.Equal(t, errors.Is(err, runner.ErrStalled), true)
+	})
+}
+
+// Records events of `kind`.
+func record(opts *upgrade.Options, kind events.Type) *[]events.Event {
+	recorded := &[]events.Event{}
+	opts.Sinks = append(opts.Sinks, events.SinkFunc(func(ctx context.Context, event events.Event) {
+		if event.Type == kind {
+			*recorded = append(*recorded, event)
+		}
+	}))
+	return recorded
+}
+
+func TestPhases(t *testing.T) {
+	provider := fakeProvider{target: upgrade.Target{BuildID: 1}}
+
+	t.Run("runs phases in order", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		finished := record(&opts, events.PhaseFinished)
+		runs := record(&opts, events.RunFinished)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		phases := []upgrade.Phase{}
+		for _, event := range *finished {
+			phases = append(phases, upgrade.Phase(event.Phase))
+		}
+		assert.ArrayEqual(t, phases, upgrade.Phases)
+		assert.Equal(t, len(*runs), 1)
+		assert.Equal(t, (*runs)[0].Outcome, "success")
+		assert.Equal(t, (*runs)[0].BuildID, 1)
+	})
+
+	t.Run("stops at the phase ending the run", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 2}}
+		opts := options(provider, rebuilder)
+		finished := record(&opts, events.PhaseFinished)
+		upgrade.Run(context.Background(), opts)
+		last := (*finished)[len(*finished)-1]
+		assert.Equal(t, last.Phase, string(upgrade.PhaseResolve))
+		assert.Equal(t, last.Outcome, string(upgrade.OutcomeUpToDate))
+	})
+
+	t.Run("retries failed phases", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		checks := 0
+		opts.HealthChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			checks++
+			if checks == 1 {
+				return errors.New("unreachable")
+			}
+			return nil
+		})}
+		opts.Retries = map[upgrade.Phase]int{upgrade.PhasePreflight: 1}
+		finished := record(&opts, events.PhaseFinished)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.Equal(t, (*finished)[2].Phase, string(upgrade.PhasePreflight))
+		assert.Equal(t, (*finished)[2].Attempts, 2)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot"})
+	})
+	t.Run("waits for unfinished builds", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		polls := 0
+		opts := options(provider, rebuilder)
+		opts.Provider = finishingProvider{fakeProvider: provider, unfinished: 2, polls: &polls}
+		opts.Wait = time.Second
+		opts.WaitInterval = time.Millisecond
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.Equal(t, polls, 3)
+	})
+	t.Run("stops waiting for unfinished builds", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		polls := 0
+		opts := options(provider, rebuilder)
+		opts.Provider = finishingProvider{fakeProvider: provider, unfinished: 100, polls: &polls}
+		opts.Wait = 10 * time.Millisecond
+		opts.WaitInterval = 4 * time.Millisecond
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeUnfinished)
+		assert.Equal(t, polls < 5, true)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+	t.Run("polls at the timeout when it is shorter than the interval", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		polls := 0
+		opts := options(provider, rebuilder)
+		opts.Provider = finishingProvider{fakeProvider: provider, unfinished: 1, polls: &polls}
+		opts.Wait = 10 * time.Millisecond
+		opts.WaitInterval = time.Hour
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.Equal(t, polls, 2)
+	})
+	t.Run("reports unfinished builds when cancelled while waiting", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		polls := 0
+		opts := options(provider, rebuilder)
+		opts.Provider = finishingProvider{fakeProvider: provider, unfinished: 100, polls: &polls}
+		opts.Wait = time.Hour
+		opts.WaitInterval = time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		outcome, _ := upgrade.Run(ctx, opts)
+		assert.Equal(t, outcome, upgrade.OutcomeUnfinished)
+		assert.Equal(t, outcome.Failed(), false)
+		assert.Equal(t, polls, 1)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+	t.Run("annotates events and the persisted run", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Annotation = "CHG-1234"
+		opts.StateFile = filepath.Join(t.TempDir(), "state.json")
+		opts.Operation = "switch"
+		persisted := ""
+		opts.PostChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			saved, err := state.Load(opts.StateFile)
+			if err == nil && saved.Run != nil {
+				persisted = saved.Run.Annotation
+			}
+			return err
+		})}
+		runs := record(&opts, events.RunFinished)
+		upgrade.Run(context.Background(), opts)
+		assert.Equal(t, (*runs)[0].Annotation, "CHG-1234")
+		assert.Equal(t, persisted, "CHG-1234")
+	})
+	t.Run("limits the commands of limited phases", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		fake := &runner.Fake{}
+		run := upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return fake.Run(ctx, runner.Command("true"))
+		})
+		opts.HealthChecks = []upgrade.Checker{run}
+		opts.PostChecks = []upgrade.Checker{run}
+		opts.Operation = "switch"
+		opts.Limits = map[upgrade.Phase]runner.Limits{upgrade.PhasePreflight: {Nice: 19}}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, fake.Ran, []string{"systemd-run --scope --quiet --collect --nice=19 -- true", "true"})
+	})
+	t.Run("never retries activation failures", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{
+			current: nix.FlakeMetadata{LastModified: 1},
+			err:     errors.New("warning: error(s) occurred while switching to the new configuration"),
+		}
+		opts := options(provider, rebuilder)
+		opts.Retries = map[upgrade.Phase]int{upgrade.PhaseActivate: 2}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeActivationFailed)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot"})
+	})
+	t.Run("retries switches failing to fetch", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{
+			current:  nix.FlakeMetadata{LastModified: 1},
+			err:      errors.New("error: unable to download 'https://cache.example.org/abc.narinfo': HTTP error 502"),
+			failures: 1,
+		}
+		opts := options(provider, rebuilder)
+		opts.SwitchRetries = 1
+		attempts := record(&opts, events.SwitchAttempted)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot", "boot"})
+		assert.Equal(t, len(*attempts), 2)
+		assert.Equal(t, (*attempts)[0].Outcome, string(upgrade.OutcomeFetchFailed))
+	})
+	t.Run("reports units failing after switching", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{
+			current:     nix.FlakeMetadata{LastModified: 1},
+			failedUnits: [][]string{{"old.service"}, {"old.service", "new.service"}},
+		}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		finished := record(&opts, events.RunFinished)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, (*finished)[0].FailedUnits, []string{"new.service"})
+	})
+	t.Run("fails post-switch checks", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		opts.PostChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return errors.New("secret missing")
+		})}
+		outcome, err := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeVerifyFailed)
+		assert.Equal(t, err.Error(), "secret missing")
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"switch"})
+	})
+	t.Run("installs tested systems for boot once checks pass", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Operation = upgrade.OperationTestThenBoot
+		checked := false
+		opts.PostChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			assert.ArrayEqual(t, rebuilder.rebuilds, []string{"test"})
+			checked = true
+			return nil
+		})}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.Equal(t, checked, true)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"test", "boot"})
+	})
+	t.Run("re-activates the previous system when tested systems fail checks", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}, running: "/nix/store/previous-nixos-system"}
+		opts := options(provider, rebuilder)
+		opts.Operation = upgrade.OperationTestThenBoot
+		opts.PostChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return errors.New("secret missing")
+		})}
+		rollbacks := record(&opts, events.RollbackTriggered)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeVerifyFailed)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"test"})
+		assert.ArrayEqual(t, rebuilder.activated, []string{"test /nix/store/previous-nixos-system"})
+		assert.Equal(t, len(*rollbacks), 1)
+	})
+	t.Run("rolls back switches failing post-switch checks", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}, running: "/nix/store/previous-nixos-system"}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		opts.Rollback.VerifyFailure = true
+		opts.PostChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return errors.New("canary unreachable")
+		})}
+		rollbacks := record(&opts, events.RollbackTriggered)
+		outcome, err := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeVerifyFailed)
+		assert.Equal(t, err.Error(), "canary unreachable")
+		assert.ArrayEqual(t, rebuilder.recovered, []string{"/nix/store/previous-nixos-system"})
+		assert.Equal(t, len(*rollbacks), 1)
+		assert.Equal(t, (*rollbacks)[0].RollbackTo, "/nix/store/previous-nixos-system")
+	})
+	t.Run("notifies of rollbacks when post-switch checks fail", func(t *testing.T) {
+		original := rollback.Runner
+		t.Cleanup(func() { rollback.Runner = original })
+		rollback.Runner = &runner.Fake{Outputs: map[string]string{
+			"readlink -f /nix/var/nix/profiles/system": "/nix/store/previous-nixos-system\n",
+		}}
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		opts.Rollback.ConfirmTimeout = time.Minute
+		opts.PostChecks = []upgrade.Checker{upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+			return errors.New("system degraded")
+		})}
+		rollbacks := record(&opts, events.RollbackTriggered)
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeVerifyFailed)
+		assert.Equal(t, len(*rollbacks), 1)
+		assert.Equal(t, (*rollbacks)[0].Error, "system degraded")
+		assert.Equal(t, (*rollbacks)[0].RollbackFrom, "/nix/store/fake-nixos-system")
+		assert.Equal(t, (*rollbacks)[0].RollbackTo, "/nix/store/previous-nixos-system")
+	})
+	t.Run("arms remote rollbacks right before switching", func(t *testing.T) {
+		original := rollback.Runner
+		t.Cleanup(func() { rollback.Runner = original })
+		ssh := "ssh -o BatchMode=yes -o ConnectTimeout=10 root@target -- "
+		fake := &runner.Fake{Outputs: map[string]string{
+			ssh + "'readlink' '-f' '/nix/var/nix/profiles/system'": "/nix/store/previous-nixos-system\n",
+		}}
+		rollback.Runner = fake
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		armed := ""
+		rebuilder.onRebuild = func() {
+			armed = fake.Ran[len(fake.Ran)-1]
+		}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		opts.TargetHost = "root@target"
+		opts.Rollback.MagicTimeout = time.Minute
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.Equal(t, strings.HasPrefix(armed, ssh+"'systemd-run'"), true)
+		// the timeout counts from the switched system
+		assert.ArrayEqual(t, fake.Ran[len(fake.Ran)-2:], []string{
+			ssh + "'systemctl' 'restart' 'nixos-hydra-upgrade-rollback.timer'",
+			ssh + "'systemctl' 'stop' 'nixos-hydra-upgrade-rollback.timer'",
+		})
+	})
+	t.Run("disarms rollbacks while retrying switches", func(t *testing.T) {
+		original := rollback.Runner
+		t.Cleanup(func() { rollback.Runner = original })
+		fake := &runner.Fake{Outputs: map[string]string{
+			"readlink -f /nix/var/nix/profiles/system": "/nix/store/previous-nixos-system\n",
+		}}
+		rollback.Runner = fake
+		rebuilder := &fakeRebuilder{
+			current:  nix.FlakeMetadata{LastModified: 1},
+			err:      errors.New("error: unable to download 'https://cache.example.org/abc.narinfo': HTTP error 502"),
+			failures: 1,
+		}
+		armed := []bool{}
+		rebuilder.onRebuild = func() {
+			armed = append(armed, strings.HasPrefix(fake.Ran[len(fake.Ran)-1], "systemd-run"))
+		}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		opts.SwitchRetries = 1
+		opts.Rollback.ConfirmTimeout = time.Minute
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, armed, []bool{true, true})
+		// arming is readlink, stop, reset-failed, and systemd-run
+		assert.Equal(t, fake.Ran[4], "systemctl stop nixos-hydra-upgrade-rollback.timer")
+		assert.Equal(t, fake.Ran[5], "readlink -f /nix/var/nix/profiles/system")
+	})
+	t.Run("disarms rollbacks of switches failing to evaluate", func(t *testing.T) {
+		original := rollback.Runner
+		t.Cleanup(func() { rollback.Runner = original })
+		fake := &runner.Fake{Outputs: map[string]string{
+			"readlink -f /nix/var/nix/profiles/system": "/nix/store/previous-nixos-system\n",
+		}}
+		rollback.Runner = fake
+		rebuilder := &fakeRebuilder{
+			current: nix.FlakeMetadata{LastModified: 1},
+			err:     errors.New("error: undefined variable 'pkgs'"),
+		}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		opts.Rollback.ConfirmTimeout = time.Minute
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeEvalFailed)
+		assert.Equal(t, fake.Ran[len(fake.Ran)-1], "systemctl stop nixos-hydra-upgrade-rollback.timer")
+	})
+	t.Run("recovers the previous system when activation fails", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{
+			current:     nix.FlakeMetadata{LastModified: 1},
+			err:         errors.New("warning: error(s) occurred while switching to the new configuration"),
+			running:     "/nix/store/previous-nixos-system",
+			failedUnits: [][]string{{}, {"sshd.service"}},
+		}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		opts.Rollback.RecoverActivation = true
+		opts.Restarts.CriticalUnits = []string{"sshd.*"}
+		rollbacks := record(&opts, events.RollbackTriggered)
+		outcome, err := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeActivationFailed)
+		assert.ArrayEqual(t, rebuilder.recovered, []string{"/nix/store/previous-nixos-system"})
+		assert.Equal(t, (*rollbacks)[0].RollbackTo, "/nix/store/previous-nixos-system")
+		assert.Equal(t, strings.Contains(err.Error(), "critical units failed after recovering: sshd.service"), true)
+	})
+	t.Run("waits for approval before activating", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(provider, rebuilder)
+		opts.StateFile = filepath.Join(t.TempDir(), "state.json")
+		opts.Approval = &approval.File{Path: filepath.Join(t.TempDir(), "approval")}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeAwaitingApproval)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+
+		err := opts.Approval.Save(approval.Approval{BuildID: 1, Toplevel: "/nix/store/fake-nixos-system"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		outcome, _ = upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot"})
+	})
+	t.Run("rejects systems differing from hydra's build", func(t *testing.T) {
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+		opts := options(fakeProvider{target: upgrade.Target{BuildID: 1, OutPath: "/nix/store/hydra-nixos-system"}}, rebuilder)
+		opts.Reproducibility = "eval"
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeBuildMismatch)
+		assert.ArrayEqual(t, rebuilder.rebuilds, []string{})
+	})
+	t.Run("re-execs the switched system's executable", func(t *testing.T) {
+		toplevel := t.TempDir()
+		err := os.MkdirAll(filepath.Join(toplevel, "sw", "bin"), 0o755)
+		if err != nil {
+			panic(err)
+		}
+		binary := filepath.Join(toplevel, "sw", "bin", "nixos-hydra-upgrade")
+		err = os.WriteFile(binary, []byte{}, 0o755)
+		if err != nil {
+			panic(err)
+		}
+		rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}, toplevel: toplevel}
+		opts := options(provider, rebuilder)
+		opts.Operation = "switch"
+		opts.StateFile = filepath.Join(t.TempDir(), "state.json")
+		execs := []string{}
+		opts.Reexec = &upgrade.Reexec{
+			Binary: "sw/bin/nixos-hydra-upgrade",
+			Exec: func(binary string) error {
+				execs = append(execs, binary)
+				return errors.New("exec format error")
+			},
+		}
+		outcome, _ := upgrade.Run(context.Background(), opts)
+		assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+		assert.ArrayEqual(t, execs, []string{binary})
+	})
+}
+
+func TestExplain(t *testing.T) {
+	blocked := upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+		return &gates.BlockedError{Gate: "hold", Reason: "maintenance"}
+	})
+	broken := upgrade.CheckerFunc(func(ctx context.Context, target upgrade.Target) error {
+		return errors.New("canary unreachable")
+	})
+
+	t.Run("explains every blocker", func(t *testing.T) {
+		opts := options(fakeProvider{target: upgrade.Target{BuildID: 1}}, &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}})
+		opts.Gates.Start = []upgrade.Checker{blocked}
+		opts.HealthChecks = []upgrade.Checker{broken}
+		opts.Gates.Upgrade = []upgrade.Checker{blocked}
+		blockers := upgrade.Explain(context.Background(), opts)
+		assert.ArrayEqual(t, blockers, []upgrade.Blocker{
+			{Check: "start gate", Reason: "hold: maintenance"},
+			{Check: "health check", Reason: "canary unreachable", Failed: true},
+			{Check: "upgrade gate", Reason: "hold: maintenance"},
+		})
+	})
+
+	t.Run("explains unfinished builds", func(t *testing.T) {
+		provider := fakeProvider{target: upgrade.Target{BuildID: 2}, err: upgrade.ErrUnfinished}
+		opts := options(provider, &fakeRebuilder{})
+		opts.Gates.Upgrade = []upgrade.Checker{blocked}
+		blockers := upgrade.Explain(context.Background(), opts)
+		assert.ArrayEqual(t, blockers, []upgrade.Blocker{{Check: "build", Reason: "latest build 2 hasn't finished"}})
+	})
+
+	t.Run("explains systems already up to date", func(t *testing.T) {
+		opts := options(fakeProvider{target: upgrade.Target{BuildID: 1}}, &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 2}})
+		blockers := upgrade.Explain(context.Background(), opts)
+		assert.ArrayEqual(t, blockers, []upgrade.Blocker{{Check: "build", Reason: "the system is up to date with build 1"}})
+	})
+}
+
+func TestSystemStateChecker(t *testing.T) {
+	original := systemd.Runner
+	t.Cleanup(func() { systemd.Runner = original })
+	degraded := &runner.Fake{
+		Outputs: map[string]string{
+			"systemctl is-system-running": "degraded\n",
+			"systemctl list-units --failed --all --full --plain --no-legend --no-pager": "broken.service loaded failed failed Broken\n",
+		},
+		Errors: map[string]error{"systemctl is-system-running": errors.New("exit status 1")},
+	}
+
+	systemd.Runner = degraded
+	err := upgrade.SystemStateChecker{Policy: "refuse"}.Check(context.Background(), upgrade.Target{})
+	assert.Equal(t, err.Error(), "system is degraded, failed units: broken.service")
+	err = upgrade.SystemStateChecker{Policy: "warn"}.Check(context.Background(), upgrade.Target{})
+	assert.Equal(t, err, nil)
+
+	systemd.Runner = &runner.Fake{Outputs: map[string]string{"systemctl is-system-running": "running\n"}}
+	err = upgrade.SystemStateChecker{Policy: "refuse"}.Check(context.Background(), upgrade.Target{})
+	assert.Equal(t, err, nil)
+}
+
+func TestFailoverProvider(t *testing.T) {
+	recent := fakeProvider{target: upgrade.Target{BuildID: 2, Finished: time.Now()}}
+	stale := fakeProvider{target: upgrade.Target{BuildID: 1, Finished: time.Now().Add(-48 * time.Hour)}}
+	failed := fakeProvider{err: errors.New("503 Service Unavailable")}
+
+	tests := []struct {
+		name      string
+		providers []upgrade.Provider
+		buildID   int
+	}{
+		{"prefers the primary", []upgrade.Provider{recent, stale}, 2},
+		{"falls back from stale builds", []upgrade.Provider{stale, recent}, 2},
+		{"falls back from failures", []upgrade.Provider{failed, stale, recent}, 2},
+		{"uses the primary when nothing is recent", []upgrade.Provider{stale, failed}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &upgrade.FailoverProvider{Providers: test.providers, MaxAge: 24 * time.Hour}
+			target, _ := provider.Latest(context.Background())
+			assert.Equal(t, target.BuildID, test.buildID)
+		})
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Now()
+	days := func(n int) int64 { return now.Add(-time.Duration(n) * 24 * time.Hour).Unix() }
+	// the job failed in the two newest evals, on the first and second page
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobset/project/jobset/evals", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "1":
+			fmt.Fprintf(w, `{"evals": [{"id": 3, "timestamp": %d}], "next": "?page=2"}`, days(1))
+		case "2":
+			fmt.Fprintf(w, `{"evals": [{"id": 2, "timestamp": %d}, {"id": 1, "timestamp": %d}]}`, days(3), days(5))
+		}
+	})
+	for id, builds := range map[string]string{
+		"3": fmt.Sprintf(`[{"id": 30, "job": "host", "finished": 1, "buildstatus": 1, "stoptime": %d}]`, days(1)),
+		"2": fmt.Sprintf(`[{"id": 21, "job": "other", "finished": 1, "buildstatus": 0, "stoptime": %d}, {"id": 20, "job": "host", "finished": 1, "buildstatus": 1, "stoptime": %d}]`, days(3), days(3)),
+		"1": fmt.Sprintf(`[{"id": 10, "job": "host", "finished": 1, "buildstatus": 0, "stoptime": %d}]`, days(5)),
+	} {
+		mux.HandleFunc("/eval/"+id+"/builds", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(builds))
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := hydra.HydraClient{Instance: server.URL, Project: "project", JobSet: "jobset", Job: "host"}
+
+	tests := []struct {
+		name        string
+		window      time.Duration
+		stale       bool
+		lastSuccess time.Time
+	}{
+		{"fresh within the window", 7 * 24 * time.Hour, false, time.Time{}},
+		{"stale beyond the window", 4 * 24 * time.Hour, true, time.Unix(days(5), 0)},
+		{"stale without a success in the window", 2 * 24 * time.Hour, true, time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := fakeProvider{target: upgrade.Target{BuildID: 30}}
+			opts := options(provider, &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 2}})
+			opts.Freshness = &upgrade.Freshness{Client: client, Window: test.window}
+			stale := record(&opts, events.JobsetStale)
+			upgrade.Run(context.Background(), opts)
+			assert.Equal(t, len(*stale) == 1, test.stale)
+			if test.stale {
+				assert.Equal(t, (*stale)[0].LastSuccess.Equal(test.lastSuccess), true)
+			}
+		})
+	}
+}
+
+func TestStagedProvider(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	latest := fakeProvider{target: upgrade.Target{BuildID: 2}}
+	rebuilder := &fakeRebuilder{current: nix.FlakeMetadata{LastModified: 1}}
+	opts := options(fakeProvider{target: upgrade.Target{BuildID: 1}}, rebuilder)
+	opts.StateFile = stateFile
+	opts.Prefetch = true
+	outcome, _ := upgrade.Run(context.Background(), opts)
+	assert.Equal(t, outcome, upgrade.OutcomePrefetched)
+
+	opts = options(latest, rebuilder)
+	opts.StateFile = stateFile
+	opts.Provider = upgrade.StagedProvider{Provider: latest, StateFile: stateFile}
+	finished := record(&opts, events.RunFinished)
+	outcome, _ = upgrade.Run(context.Background(), opts)
+	assert.Equal(t, outcome, upgrade.OutcomeSuccess)
+	assert.Equal(t, (*finished)[0].BuildID, 1)
+	assert.ArrayEqual(t, rebuilder.rebuilds, []string{"boot"})
+
+	outcome, _ = upgrade.Run(context.Background(), opts)
+	assert.Equal(t, outcome, upgrade.OutcomeNothingStaged)
+}
+
+func TestExpandArgs(t *testing.T) {
+	hostname, _ := os.Hostname()
+	target := upgrade.Target{BuildID: 42, Metadata: nix.FlakeMetadata{Revision: "abc123"}}
+	args := upgrade.ExpandArgs([]string{"--profile-name", "hydra-{buildid}-{rev}", "--target-host", "root@{hostname}"}, target, "")
+	assert.ArrayEqual(t, args, []string{"--profile-name", "hydra-42-abc123", "--target-host", "root@" + hostname})
+
+	args = upgrade.ExpandArgs([]string{"hydra-{buildid}{rev}"}, upgrade.Target{}, "")
+	assert.ArrayEqual(t, args, []string{"hydra-"})
+
+	args = upgrade.ExpandArgs([]string{"root@{hostname}"}, target, "golden")
+	assert.ArrayEqual(t, args, []string{"root@golden"})
+}
@@ -0,0 +1,52 @@
+package virtualization
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/runner"
+)
+
+// Runs external commands, replaced by tests.
+var Runner runner.Runner = runner.Exec{}
+
+func lines(output []byte) []string {
+	names := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			names = append(names, line)
+		}
+	}
+	return names
+}
+
+// Lists running libvirt domains on the system hypervisor.
+func RunningDomains() ([]string, error) {
+	output, err := Runner.Output(context.Background(), runner.Command("virsh", "--connect", "qemu:///system", "list", "--name", "--state-running"))
+	if err != nil {
+		return nil, err
+	}
+	return lines(output), nil
+}
+
+/*
+Lists running container names for each container runtime (podman, docker)
+installed on this system.
+*/
+func RunningContainers() ([]string, error) {
+	containers := []string{}
+	for _, runtime := range []string{"podman", "docker"} {
+		_, err := exec.LookPath(runtime)
+		if err != nil {
+			continue
+		}
+		output, err := Runner.Output(context.Background(), runner.Command(runtime, "ps", "--format", "{{.Names}}"))
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, lines(output)...)
+	}
+	return containers, nil
+}